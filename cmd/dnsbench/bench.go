@@ -0,0 +1,361 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/internal/dnsexchange"
+	"github.com/iangudger/dns/internal/dnsnames"
+)
+
+// benchConfig configures a benchmark.
+type benchConfig struct {
+	// server is the address of the server.
+	server string
+
+	// transport is "udp", "tcp" or "dot".
+	transport string
+
+	// tlsConfig is used for DoT.
+	tlsConfig *tls.Config
+
+	// qps is the target rate of queries per second. If zero, queries
+	// are sent as fast as the server answers them.
+	qps float64
+
+	// concurrency is the number of queries in flight at once.
+	concurrency int
+
+	// count is the number of queries to send. If zero, queries are sent
+	// until duration has passed.
+	count int
+
+	// duration is the maximum duration of the benchmark. If zero,
+	// queries are sent until count queries have been sent.
+	duration time.Duration
+
+	// timeout is the maximum time to wait for each response.
+	timeout time.Duration
+}
+
+// A report holds the results of a benchmark.
+type report struct {
+	// qps is the target rate of queries per second, or zero if queries
+	// were sent as fast as the server answered them.
+	qps float64
+
+	sent      int
+	timeouts  int
+	errors    int
+	rcodes    map[dnsmessage.RCode]int
+	latencies []time.Duration
+	elapsed   time.Duration
+}
+
+// completed returns the number of queries which were answered.
+func (r *report) completed() int {
+	return len(r.latencies)
+}
+
+// readQueries reads a query list from r. Each line holds a name and a type,
+// such as "example.com AAAA". Blank lines and lines starting with '#' are
+// ignored.
+func readQueries(r io.Reader) ([]dnsmessage.Question, error) {
+	var qs []dnsmessage.Question
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want name and type, got %q", line, text)
+		}
+		name := fields[0]
+		if !strings.HasSuffix(name, ".") {
+			name += "."
+		}
+		n, err := dnsmessage.NewName(name)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		t, err := dnsnames.ParseType(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		qs = append(qs, dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(qs) == 0 {
+		return nil, errors.New("no queries")
+	}
+	return qs, nil
+}
+
+// A job is a query to be sent by a worker.
+type job struct {
+	// i is the index of the query.
+	i int
+
+	// scheduled is the time at which the query was due to be sent.
+	// Latencies are measured from it rather than from when the query is
+	// actually sent, so that queries delayed by a slow server still
+	// account for the wait (the "coordinated omission" problem).
+	scheduled time.Time
+}
+
+// result is the result of a single query.
+type result struct {
+	latency time.Duration
+	rcode   dnsmessage.RCode
+	err     error
+}
+
+// run runs a benchmark, sending the queries in qs in turn, and returns its
+// report.
+func run(ctx context.Context, config benchConfig, qs []dnsmessage.Question) *report {
+	if config.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.duration)
+		defer cancel()
+	}
+	if config.concurrency <= 0 {
+		config.concurrency = 1
+	}
+
+	// Queries are dispatched to the workers by index. If a rate is
+	// set, the dispatcher schedules them evenly.
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		start := time.Now()
+		for i := 0; config.count == 0 || i < config.count; i++ {
+			j := job{i: i}
+			if config.qps > 0 {
+				j.scheduled = start.Add(time.Duration(float64(i) / config.qps * float64(time.Second)))
+				if d := time.Until(j.scheduled); d > 0 {
+					t := time.NewTimer(d)
+					select {
+					case <-ctx.Done():
+						t.Stop()
+						return
+					case <-t.C:
+					}
+				}
+			}
+			if j.scheduled.IsZero() {
+				j.scheduled = time.Now()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- j:
+			}
+		}
+	}()
+
+	r := &report{qps: config.qps, rcodes: make(map[dnsmessage.RCode]int)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < config.concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			c := &client{config: &config}
+			defer c.close()
+			for j := range jobs {
+				res := c.query(uint16(w<<8+j.i), qs[j.i%len(qs)], j.scheduled)
+				mu.Lock()
+				r.sent++
+				switch {
+				case res.err == nil:
+					r.rcodes[res.rcode]++
+					r.latencies = append(r.latencies, res.latency)
+				case isTimeout(res.err):
+					r.timeouts++
+				default:
+					r.errors++
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	return r
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// A client sends queries over a single connection, which is reopened after
+// errors.
+type client struct {
+	config *benchConfig
+	conn   net.Conn
+
+	// msg and buf are reused for queries and responses.
+	msg []byte
+	buf []byte
+}
+
+func (c *client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *client) dial() error {
+	var err error
+	d := net.Dialer{Timeout: c.config.timeout}
+	switch c.config.transport {
+	case "udp":
+		c.conn, err = d.Dial("udp", c.config.server)
+	case "tcp":
+		c.conn, err = d.Dial("tcp", c.config.server)
+	case "dot":
+		c.conn, err = tls.DialWithDialer(&d, "tcp", c.config.server, c.config.tlsConfig)
+	default:
+		err = fmt.Errorf("unknown transport %q", c.config.transport)
+	}
+	return err
+}
+
+// query sends a query for q with ID id, which was scheduled to be sent at
+// scheduled, and waits for its response.
+func (c *client) query(id uint16, q dnsmessage.Question, scheduled time.Time) result {
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return result{err: err}
+		}
+	}
+	res := c.exchange(id, q, scheduled)
+	if res.err != nil {
+		// The connection may be out of sync, so reopen it.
+		c.close()
+	}
+	return res
+}
+
+func (c *client) exchange(id uint16, q dnsmessage.Question, scheduled time.Time) result {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	b, err := msg.AppendPack(c.msg[:0])
+	if err != nil {
+		return result{err: err}
+	}
+	c.msg = b
+
+	c.conn.SetDeadline(time.Now().Add(c.config.timeout))
+	resp, err := dnsexchange.Exchange(c.conn, b, c.config.transport != "udp", c.buf)
+	if err != nil {
+		return result{err: err}
+	}
+	c.buf = resp[:0]
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return result{err: err}
+	}
+	return result{latency: time.Since(scheduled), rcode: h.RCode}
+}
+
+// percentile returns the p-th percentile of the sorted durations ds.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(ds)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ds[i]
+}
+
+// print writes a human readable summary of r to w.
+func (r *report) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	pct := func(n int) float64 {
+		if r.sent == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(r.sent)
+	}
+	fmt.Fprintf(tw, "Queries sent:\t%d\n", r.sent)
+	fmt.Fprintf(tw, "Queries completed:\t%d\t(%.2f%%)\n", r.completed(), pct(r.completed()))
+	fmt.Fprintf(tw, "Queries timed out:\t%d\t(%.2f%%)\n", r.timeouts, pct(r.timeouts))
+	fmt.Fprintf(tw, "Queries failed:\t%d\t(%.2f%%)\n", r.errors, pct(r.errors))
+	fmt.Fprintf(tw, "Run time:\t%v\n", r.elapsed.Round(time.Millisecond))
+	if r.qps > 0 {
+		fmt.Fprintf(tw, "Target rate:\t%.1f\tqueries/s\n", r.qps)
+	}
+	if s := r.elapsed.Seconds(); s > 0 {
+		fmt.Fprintf(tw, "Achieved rate:\t%.1f\tqueries/s\n", float64(r.sent)/s)
+		fmt.Fprintf(tw, "Throughput:\t%.1f\tqueries/s\n", float64(r.completed())/s)
+	}
+
+	if len(r.latencies) > 0 {
+		ds := append([]time.Duration(nil), r.latencies...)
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		var sum time.Duration
+		for _, d := range ds {
+			sum += d
+		}
+		fmt.Fprintf(tw, "\nLatency:\n")
+		fmt.Fprintf(tw, "  min\t%v\n", ds[0])
+		fmt.Fprintf(tw, "  mean\t%v\n", sum/time.Duration(len(ds)))
+		for _, p := range []float64{50, 90, 99, 99.9} {
+			fmt.Fprintf(tw, "  p%v\t%v\n", p, percentile(ds, p))
+		}
+		fmt.Fprintf(tw, "  max\t%v\n", ds[len(ds)-1])
+	}
+
+	if len(r.rcodes) > 0 {
+		rcodes := make([]dnsmessage.RCode, 0, len(r.rcodes))
+		for rc := range r.rcodes {
+			rcodes = append(rcodes, rc)
+		}
+		sort.Slice(rcodes, func(i, j int) bool { return rcodes[i] < rcodes[j] })
+		fmt.Fprintf(tw, "\nResponse codes:\n")
+		for _, rc := range rcodes {
+			n := r.rcodes[rc]
+			fmt.Fprintf(tw, "  %s\t%d\t(%.2f%%)\n", dnsnames.RCode(rc), n, 100*float64(n)/float64(r.completed()))
+		}
+	}
+	tw.Flush()
+}
+
+// openQueries opens the query list at path, or standard input if path is
+// "-".
+func openQueries(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
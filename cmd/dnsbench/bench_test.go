@@ -0,0 +1,297 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+func TestReadQueries(t *testing.T) {
+	qs, err := readQueries(strings.NewReader("# comment\nexample.com A\n\nfoo.example. aaaa\n"))
+	if err != nil {
+		t.Fatal("readQueries(...) =", err)
+	}
+	want := []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{Name: dnsmessage.MustNewName("foo.example."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+	}
+	if len(qs) != len(want) || qs[0] != want[0] || qs[1] != want[1] {
+		t.Errorf("got readQueries(...) = %v, want = %v", qs, want)
+	}
+
+	for _, in := range []string{"", "example.com\n", "example.com BOGUS\n"} {
+		if _, err := readQueries(strings.NewReader(in)); err == nil {
+			t.Errorf("readQueries(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	ds := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, want := range map[float64]time.Duration{0: 1, 50: 5, 90: 9, 99: 10, 100: 10} {
+		if got := percentile(ds, p); got != want {
+			t.Errorf("percentile(..., %v) = %v, want = %v", p, got, want)
+		}
+	}
+}
+
+// testResolver answers names under nx. with NXDOMAIN, and other names with
+// an empty NOERROR response.
+var testResolver = dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	if strings.HasSuffix(q.Name.String(), ".nx.") {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	return msg, true
+})
+
+// testCertificate returns a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generating key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("creating certificate:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("parsing certificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startServer starts a server for testResolver on loopback and returns the
+// addresses it serves UDP, TCP and DoT on.
+func startServer(t *testing.T, cert tls.Certificate) (udp, tcp, dot string) {
+	t.Helper()
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, testResolver)
+	if err != nil {
+		t.Fatal("creating packet resolver:", err)
+	}
+	srv, err := dnsserver.New(dnsserver.Config{Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening on UDP:", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening on TCP:", err)
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening on TCP:", err)
+	}
+	done := make(chan struct{}, 3)
+	go func() {
+		srv.ServeUDP(pc)
+		done <- struct{}{}
+	}()
+	go func() {
+		srv.ServeTCP(l)
+		done <- struct{}{}
+	}()
+	go func() {
+		srv.ServeTCP(tls.NewListener(tl, &tls.Config{Certificates: []tls.Certificate{cert}}))
+		done <- struct{}{}
+	}()
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+		tl.Close()
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+		srv.Wait()
+	})
+	return pc.LocalAddr().String(), l.Addr().String(), tl.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	cert, pool := testCertificate(t)
+	udp, tcp, dot := startServer(t, cert)
+	qs, err := readQueries(strings.NewReader("a.example. A\nb.nx. AAAA\n"))
+	if err != nil {
+		t.Fatal("readQueries(...) =", err)
+	}
+
+	for _, test := range []struct {
+		transport, server string
+	}{
+		{"udp", udp},
+		{"tcp", tcp},
+		{"dot", dot},
+	} {
+		t.Run(test.transport, func(t *testing.T) {
+			config := benchConfig{
+				server:      test.server,
+				transport:   test.transport,
+				tlsConfig:   &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+				concurrency: 4,
+				count:       40,
+				timeout:     5 * time.Second,
+			}
+			r := run(context.Background(), config, qs)
+			if r.sent != 40 || r.completed() != 40 || r.timeouts != 0 || r.errors != 0 {
+				t.Errorf("got sent, completed, timeouts, errors = %d, %d, %d, %d, want = 40, 40, 0, 0", r.sent, r.completed(), r.timeouts, r.errors)
+			}
+			if got, want := r.rcodes, map[dnsmessage.RCode]int{dnsmessage.RCodeSuccess: 20, dnsmessage.RCodeNameError: 20}; len(got) != 2 || got[0] != want[0] || got[3] != want[3] {
+				t.Errorf("got rcodes = %v, want = %v", got, want)
+			}
+
+			var out bytes.Buffer
+			r.print(&out)
+			for _, s := range []string{"Queries completed:  40", "p99", "NXDOMAIN"} {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("report doesn't contain %q:\n%s", s, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunRate(t *testing.T) {
+	udp, _, _ := startServer(t, tls.Certificate{})
+	qs, err := readQueries(strings.NewReader("a.example. A\n"))
+	if err != nil {
+		t.Fatal("readQueries(...) =", err)
+	}
+	config := benchConfig{
+		server:      udp,
+		transport:   "udp",
+		qps:         200,
+		concurrency: 2,
+		count:       21,
+		timeout:     5 * time.Second,
+	}
+	r := run(context.Background(), config, qs)
+	if r.completed() != 21 {
+		t.Errorf("got %d completed queries, want 21", r.completed())
+	}
+	// The last of 21 queries at 200 queries/s is sent after 100ms.
+	if r.elapsed < 100*time.Millisecond {
+		t.Errorf("got elapsed = %v, want >= 100ms", r.elapsed)
+	}
+}
+
+func TestRunRateSlowServer(t *testing.T) {
+	// The server answers one query every 20ms, by echoing it as a
+	// response.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			buf[2] |= 0x80
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	qs, err := readQueries(strings.NewReader("a.example. A\n"))
+	if err != nil {
+		t.Fatal("readQueries(...) =", err)
+	}
+	config := benchConfig{
+		server:      pc.LocalAddr().String(),
+		transport:   "udp",
+		qps:         200,
+		concurrency: 1,
+		count:       5,
+		timeout:     5 * time.Second,
+	}
+	r := run(context.Background(), config, qs)
+	if r.completed() != 5 {
+		t.Fatalf("got %d completed queries, want 5", r.completed())
+	}
+	// The last query is scheduled after 20ms but only sent after the
+	// first four have been answered, after 80ms, so its latency includes
+	// the 60ms it waited.
+	var max time.Duration
+	for _, d := range r.latencies {
+		if d > max {
+			max = d
+		}
+	}
+	if max < 80*time.Millisecond {
+		t.Errorf("got max latency = %v, want >= 80ms", max)
+	}
+
+	var out bytes.Buffer
+	r.print(&out)
+	for _, s := range []string{"Target rate:", "200.0", "Achieved rate:"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("report doesn't contain %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	qs, err := readQueries(strings.NewReader("a.example. A\n"))
+	if err != nil {
+		t.Fatal("readQueries(...) =", err)
+	}
+	// Nothing is listening, so queries time out or fail, but the run
+	// ends after its duration.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	defer pc.Close()
+	config := benchConfig{
+		server:      pc.LocalAddr().String(),
+		transport:   "udp",
+		qps:         100,
+		concurrency: 1,
+		duration:    50 * time.Millisecond,
+		timeout:     20 * time.Millisecond,
+	}
+	r := run(context.Background(), config, qs)
+	if r.sent == 0 || r.timeouts != r.sent {
+		t.Errorf("got sent, timeouts = %d, %d, want all queries to time out", r.sent, r.timeouts)
+	}
+}
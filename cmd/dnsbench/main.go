@@ -0,0 +1,108 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command dnsbench measures the performance of a DNS server by sending it
+// queries from a list and reporting the throughput, latency and response
+// codes.
+//
+// Usage:
+//
+//	dnsbench [flags] queries.txt
+//
+// Each line of the query list holds a name and a type, such as
+// "example.com AAAA". The queries are sent in turn, starting again from the
+// beginning of the list once it is exhausted. If the list is "-", it is read
+// from standard input.
+//
+// For example:
+//
+//	dnsbench -server 127.0.0.1:53 -qps 10000 -c 50 -l 30s queries.txt
+//
+// sends 10,000 queries per second for 30 seconds, with up to 50 queries in
+// flight at once. With -qps, latencies are measured from the time each query
+// was scheduled to be sent, so they include any time spent waiting for a
+// query in flight to finish, and the report compares the achieved rate with
+// the target.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var (
+	server      = flag.String("server", "127.0.0.1:53", "address of the DNS `server`")
+	transport   = flag.String("t", "udp", "`transport` to use: udp, tcp or dot")
+	qps         = flag.Float64("qps", 0, "target `rate` of queries per second, or 0 to send as fast as possible")
+	concurrency = flag.Int("c", 1, "maximum `number` of queries in flight")
+	count       = flag.Int("n", 0, "`number` of queries to send, or 0 to send until the run time has passed")
+	duration    = flag.Duration("l", 10*time.Second, "maximum run time, or 0 to send until -n queries have been sent")
+	timeout     = flag.Duration("timeout", 5*time.Second, "maximum time to wait for each response")
+	serverName  = flag.String("servername", "", "TLS server `name` for dot, if not the host of -server")
+	insecure    = flag.Bool("insecure", false, "skip verification of the TLS certificate for dot")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] queries.txt\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dnsbench: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	if *count == 0 && *duration == 0 {
+		log.Fatal("one of -n and -l must be set")
+	}
+	switch *transport {
+	case "udp", "tcp", "dot":
+	default:
+		log.Fatalf("unknown transport %q", *transport)
+	}
+
+	f, err := openQueries(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	qs, err := readQueries(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("reading %s: %v", flag.Arg(0), err)
+	}
+
+	config := benchConfig{
+		server:      *server,
+		transport:   *transport,
+		qps:         *qps,
+		concurrency: *concurrency,
+		count:       *count,
+		duration:    *duration,
+		timeout:     *timeout,
+	}
+	if *transport == "dot" {
+		name := *serverName
+		if name == "" {
+			if name, _, err = net.SplitHostPort(*server); err != nil {
+				log.Fatal(err)
+			}
+		}
+		config.tlsConfig = &tls.Config{ServerName: name, InsecureSkipVerify: *insecure}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	run(ctx, config, qs).print(os.Stdout)
+}
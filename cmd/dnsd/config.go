@@ -0,0 +1,273 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Transports of listeners.
+const (
+	transportUDP   = "udp"
+	transportTCP   = "tcp"
+	transportTLS   = "tls"
+	transportHTTPS = "https"
+)
+
+// Types of resolvers.
+const (
+	resolverStatic  = "static"
+	resolverZone    = "zone"
+	resolverCache   = "cache"
+	resolverForward = "forward"
+)
+
+// defaultDoHPath is the default path of DoH listeners, RFC 8484, section 3.
+const defaultDoHPath = "/dns-query"
+
+// config is the configuration file of dnsd.
+type config struct {
+	// Listen holds the addresses to serve DNS on.
+	Listen []listenConfig `yaml:"listen"`
+
+	// Resolvers is the chain of resolvers which answer queries. Each
+	// resolver passes the questions it can't answer to the next.
+	Resolvers []resolverConfig `yaml:"resolvers"`
+
+	Log     logConfig     `yaml:"log"`
+	Metrics metricsConfig `yaml:"metrics"`
+}
+
+// listenConfig configures a listener.
+type listenConfig struct {
+	// Transport is one of udp, tcp, tls (DoT) or https (DoH).
+	Transport string `yaml:"transport"`
+
+	// Address is the local address, such as ":53".
+	Address string `yaml:"address"`
+
+	// CertFile and KeyFile are the PEM encoded certificate chain and
+	// private key of tls and https listeners. They are reloaded on
+	// SIGHUP.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// Path is the path of the DoH endpoint of https listeners. If empty,
+	// /dns-query is used.
+	Path string `yaml:"path"`
+}
+
+// resolverConfig configures a resolver in the chain. Which fields apply
+// depends on the type.
+type resolverConfig struct {
+	// Type is one of static, zone, cache or forward.
+	Type string `yaml:"type"`
+
+	// Records are the records of a static resolver, in zone file
+	// format, such as "www.example.com. 300 IN A 192.0.2.1".
+	Records []string `yaml:"records"`
+
+	// NXDomain lists names which a static resolver answers with
+	// NXDOMAIN, along with the names below them.
+	NXDomain []string `yaml:"nxdomain"`
+
+	// File is the zone file of a zone resolver.
+	File string `yaml:"file"`
+
+	// Origin is the name of the zone of a zone resolver. If empty, the
+	// $ORIGIN of the zone file is used.
+	Origin string `yaml:"origin"`
+
+	// Name labels the metrics of a cache. If empty, "cache" is used.
+	Name string `yaml:"name"`
+
+	// MaxSize, MinTTL, MaxTTL and Negative correspond to the MaxSize,
+	// MinTTL, MaxTTL and EnableNegativeCaching fields of dnscache.Config.
+	MaxSize  int    `yaml:"max_size"`
+	MinTTL   uint32 `yaml:"min_ttl"`
+	MaxTTL   uint32 `yaml:"max_ttl"`
+	Negative bool   `yaml:"negative"`
+
+	// Servers are the upstream servers of a forward resolver, tried in
+	// order. The port defaults to 53.
+	Servers []string `yaml:"servers"`
+
+	// Timeout is the time a forward resolver waits for each server. If
+	// zero, the default value will be used.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// logConfig configures logging.
+type logConfig struct {
+	// Queries is the file to log queries to, or "-" for standard output.
+	// If empty, queries aren't logged. The file is reopened on SIGHUP.
+	Queries string `yaml:"queries"`
+}
+
+// metricsConfig configures metrics.
+type metricsConfig struct {
+	// Address is the address to serve Prometheus metrics on. If empty,
+	// metrics aren't served.
+	Address string `yaml:"address"`
+
+	// Path is the path of the metrics endpoint. If empty, /metrics is
+	// used.
+	Path string `yaml:"path"`
+}
+
+// readConfig reads and validates the configuration file at path.
+func readConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// parseConfig parses and validates a configuration file. Unknown fields are
+// rejected to catch typos.
+func parseConfig(r io.Reader) (*config, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var c config
+	if err := dec.Decode(&c); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("empty configuration")
+		}
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// validate checks c for errors which don't depend on other files, and fills
+// in defaults.
+func (c *config) validate() error {
+	if len(c.Listen) == 0 {
+		return errors.New("no listeners")
+	}
+	for i := range c.Listen {
+		l := &c.Listen[i]
+		if l.Address == "" {
+			return fmt.Errorf("listener %d: no address", i+1)
+		}
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("listener %d: %v", i+1, err)
+		}
+		switch l.Transport {
+		case transportUDP, transportTCP:
+		case transportTLS, transportHTTPS:
+			if l.CertFile == "" || l.KeyFile == "" {
+				return fmt.Errorf("listener %d: %s requires cert_file and key_file", i+1, l.Transport)
+			}
+		default:
+			return fmt.Errorf("listener %d: unknown transport %q", i+1, l.Transport)
+		}
+		if l.Transport == transportHTTPS {
+			if l.Path == "" {
+				l.Path = defaultDoHPath
+			}
+			if !strings.HasPrefix(l.Path, "/") {
+				return fmt.Errorf("listener %d: path %q doesn't start with /", i+1, l.Path)
+			}
+		}
+	}
+
+	if len(c.Resolvers) == 0 {
+		return errors.New("no resolvers")
+	}
+	names := make(map[string]bool)
+	for i := range c.Resolvers {
+		r := &c.Resolvers[i]
+		last := i == len(c.Resolvers)-1
+		switch r.Type {
+		case resolverStatic:
+			if len(r.Records) == 0 && len(r.NXDomain) == 0 {
+				return fmt.Errorf("resolver %d: static resolver has no records or nxdomain names", i+1)
+			}
+		case resolverZone:
+			if r.File == "" {
+				return fmt.Errorf("resolver %d: zone resolver has no file", i+1)
+			}
+		case resolverCache:
+			if last {
+				return fmt.Errorf("resolver %d: cache must be followed by another resolver", i+1)
+			}
+			if r.Name == "" {
+				r.Name = resolverCache
+			}
+			if names[r.Name] {
+				return fmt.Errorf("resolver %d: duplicate cache name %q", i+1, r.Name)
+			}
+			names[r.Name] = true
+		case resolverForward:
+			if !last {
+				return fmt.Errorf("resolver %d: forward resolver must be last", i+1)
+			}
+			if len(r.Servers) == 0 {
+				return fmt.Errorf("resolver %d: forward resolver has no servers", i+1)
+			}
+			if r.Timeout < 0 {
+				return fmt.Errorf("resolver %d: negative timeout", i+1)
+			}
+		default:
+			return fmt.Errorf("resolver %d: unknown type %q", i+1, r.Type)
+		}
+		if err := checkFields(r); err != nil {
+			return fmt.Errorf("resolver %d: %v", i+1, err)
+		}
+	}
+
+	if c.Metrics.Path == "" {
+		c.Metrics.Path = "/metrics"
+	}
+	return nil
+}
+
+// resolverFields lists the fields which apply to each type of resolver, by
+// YAML key.
+var resolverFields = map[string][]string{
+	resolverStatic:  {"records", "nxdomain"},
+	resolverZone:    {"file", "origin"},
+	resolverCache:   {"name", "max_size", "min_ttl", "max_ttl", "negative"},
+	resolverForward: {"servers", "timeout"},
+}
+
+// checkFields returns an error if a field which doesn't apply to the type of
+// r is set.
+func checkFields(r *resolverConfig) error {
+	v := reflect.ValueOf(r).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("yaml")
+		if key == "type" || v.Field(i).IsZero() {
+			continue
+		}
+		ok := false
+		for _, f := range resolverFields[r.Type] {
+			ok = ok || f == key
+		}
+		if !ok {
+			return fmt.Errorf("%s doesn't apply to %s resolvers", key, r.Type)
+		}
+	}
+	return nil
+}
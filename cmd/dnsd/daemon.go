@@ -0,0 +1,449 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iangudger/dns/dnscache"
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsmetrics"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+	"github.com/iangudger/dns/dnsstatic"
+	"github.com/iangudger/dns/internal/resolvers"
+)
+
+// A listener is an open listener of the daemon.
+type listener struct {
+	config listenConfig
+
+	pc   net.PacketConn // For udp.
+	l    net.Listener   // For tcp, tls and https.
+	http *http.Server   // For https.
+
+	// cert holds the *tls.Certificate of tls and https listeners.
+	cert atomic.Value
+}
+
+// addr returns the local address of l.
+func (l *listener) addr() net.Addr {
+	if l.pc != nil {
+		return l.pc.LocalAddr()
+	}
+	return l.l.Addr()
+}
+
+// loadCertificate loads the certificate of a tls or https listener.
+func (l *listener) loadCertificate(dir string) error {
+	cert, err := tls.LoadX509KeyPair(resolvePath(dir, l.config.CertFile), resolvePath(dir, l.config.KeyFile))
+	if err != nil {
+		return err
+	}
+	l.cert.Store(&cert)
+	return nil
+}
+
+func (l *listener) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return l.cert.Load().(*tls.Certificate), nil
+		},
+	}
+}
+
+// A daemon serves DNS as configured by a configuration file.
+type daemon struct {
+	// path is the path of the configuration file.
+	path string
+
+	// errorf logs errors.
+	errorf func(format string, v ...interface{})
+
+	// serverConfig is the configuration srv is created with.
+	serverConfig dnsserver.Config
+
+	srv       *dnsserver.Server
+	queryLog  swapQueryLogger
+	listeners []*listener
+
+	metrics       *dnsmetrics.Metrics
+	metricsServer *http.Server
+
+	// wg tracks the goroutines serving listeners.
+	wg sync.WaitGroup
+
+	// mu serializes reloads, and protects the fields below.
+	mu sync.Mutex
+
+	// config is the configuration in use.
+	config *config
+
+	// textLog writes the query log. It is kept across reloads, which
+	// only replace its file.
+	textLog textQueryLogger
+
+	// cacheStats holds the statistics of caches by name. They are kept
+	// across reloads, so that the metrics of a cache continue.
+	cacheStats map[string]*dnsresolver.Stats
+}
+
+// newDaemon creates a daemon for the configuration file at path, and opens
+// its listeners.
+func newDaemon(path string, errorf func(format string, v ...interface{})) (*daemon, error) {
+	c, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &daemon{
+		path:       path,
+		errorf:     errorf,
+		config:     c,
+		cacheStats: make(map[string]*dnsresolver.Stats),
+	}
+	d.serverConfig = dnsserver.Config{Errorf: errorf, QueryLogger: &d.queryLog}
+	if c.Metrics.Address != "" {
+		d.metrics = dnsmetrics.New()
+		d.serverConfig.Stats = new(dnsserver.Stats)
+		d.metrics.AddServer("dnsd", d.serverConfig.Stats)
+		d.serverConfig.QueryLogger = dnsserver.MultiQueryLogger(d.metrics, &d.queryLog)
+	}
+	if err := d.apply(c); err != nil {
+		return nil, err
+	}
+	if err := d.listen(c); err != nil {
+		d.textLog.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// resolvePath resolves path relative to the directory of the configuration
+// file.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// apply builds the resolver chain and query log of c and puts them in use,
+// creating the server on the first call.
+func (d *daemon) apply(c *config) error {
+	caches := make(map[string]*dnsresolver.Stats)
+	pr, err := buildResolver(c, filepath.Dir(d.path), func(name string) *dnsresolver.Stats {
+		s := d.cacheStats[name]
+		if s == nil {
+			s = new(dnsresolver.Stats)
+		}
+		caches[name] = s
+		return s
+	})
+	if err != nil {
+		return err
+	}
+	var (
+		logW io.Writer
+		logC io.Closer
+	)
+	if c.Log.Queries != "" {
+		if logW, logC, err = openQueryLog(resolvePath(filepath.Dir(d.path), c.Log.Queries)); err != nil {
+			return err
+		}
+	}
+	if d.srv == nil {
+		d.srv, err = dnsserver.New(d.serverConfig, pr)
+	} else {
+		err = d.srv.SetResolver(pr)
+	}
+	if err != nil {
+		if logC != nil {
+			logC.Close()
+		}
+		return err
+	}
+
+	for name, s := range caches {
+		if d.cacheStats[name] == nil {
+			d.cacheStats[name] = s
+			if d.metrics != nil {
+				d.metrics.AddResolver(name, s)
+			}
+		} else {
+			// The new cache starts empty. Requests in progress may
+			// still add entries to the old cache, so the count is
+			// approximate until it is replaced.
+			s.AddEntries(-int(s.Entries()))
+		}
+	}
+	// Queries in progress write to the new file, rather than to the
+	// closed old one.
+	d.textLog.reset(logW, logC)
+	if logW == nil {
+		d.queryLog.set(nil)
+	} else {
+		d.queryLog.set(&d.textLog)
+	}
+	return nil
+}
+
+// buildResolver builds the chain of resolvers configured by c. Files are
+// relative to dir. cacheStats returns the Stats of the named cache.
+func buildResolver(c *config, dir string, cacheStats func(name string) *dnsresolver.Stats) (dnsresolver.PacketResolver, error) {
+	// Questions which reach the end of the chain are refused.
+	var res dnsresolver.Resolver = dnsresolver.ResolverFunc(func(_ context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+		msg := resolvers.ResolveError(question, dnsmessage.RCodeRefused, recursionDesired)
+		msg.Header.RecursionAvailable = false
+		return msg, true
+	})
+	for i := len(c.Resolvers) - 1; i >= 0; i-- {
+		rc := c.Resolvers[i]
+		var err error
+		switch rc.Type {
+		case resolverStatic:
+			res, err = newStatic(rc.Records, rc.NXDomain, res)
+		case resolverZone:
+			var b []byte
+			if b, err = os.ReadFile(resolvePath(dir, rc.File)); err != nil {
+				break
+			}
+			var rs []dnsmessage.Resource
+			if rs, err = parseZone(string(b), rc.Origin); err != nil {
+				err = fmt.Errorf("%s: %v", rc.File, err)
+				break
+			}
+			if res, err = newZone(rs, res); err != nil {
+				err = fmt.Errorf("%s: %v", rc.File, err)
+			}
+		case resolverCache:
+			res, err = dnscache.NewResolver(dnscache.Config{
+				MaxSize:               rc.MaxSize,
+				MinTTL:                rc.MinTTL,
+				MaxTTL:                rc.MaxTTL,
+				EnableNegativeCaching: rc.Negative,
+				Stats:                 cacheStats(rc.Name),
+			}, res)
+		case resolverForward:
+			res = newForwarder(rc.Servers, rc.Timeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolver %d: %v", i+1, err)
+		}
+	}
+
+	// Answer questions which get no response, such as when no upstream
+	// server responds, with SERVFAIL rather than nothing.
+	chain := res
+	res = dnsresolver.ResolverFunc(func(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+		if msg, ok := chain.Resolve(ctx, question, recursionDesired); ok {
+			return msg, true
+		}
+		return resolvers.ResolveError(question, dnsmessage.RCodeServerFailure, recursionDesired), true
+	})
+	return dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, res)
+}
+
+// newStatic creates a resolver which answers with the records, given in zone
+// file format, and with NXDOMAIN for the names in nxdomain.
+func newStatic(records, nxdomain []string, nested dnsresolver.Resolver) (dnsresolver.Resolver, error) {
+	rs, err := parseZone(strings.Join(records, "\n"), ".")
+	if err != nil {
+		return nil, err
+	}
+	config := dnsstatic.Config{Records: rs, Authoritative: true}
+	for _, s := range nxdomain {
+		n, err := dnsmessage.NewName(s)
+		if err != nil || !strings.HasSuffix(s, ".") {
+			return nil, fmt.Errorf("invalid nxdomain name %q", s)
+		}
+		config.NXDomain = append(config.NXDomain, n)
+	}
+	return dnsstatic.NewResolver(config, nested)
+}
+
+// listen opens the listeners of c. If any fails, those already opened are
+// closed.
+func (d *daemon) listen(c *config) error {
+	dir := filepath.Dir(d.path)
+	for _, lc := range c.Listen {
+		l := &listener{config: lc}
+		var err error
+		switch lc.Transport {
+		case transportUDP:
+			l.pc, err = net.ListenPacket("udp", lc.Address)
+		case transportTCP:
+			l.l, err = net.Listen("tcp", lc.Address)
+		case transportTLS, transportHTTPS:
+			if err = l.loadCertificate(dir); err != nil {
+				break
+			}
+			if l.l, err = net.Listen("tcp", lc.Address); err != nil {
+				break
+			}
+			config := l.tlsConfig()
+			if lc.Transport == transportHTTPS {
+				config.NextProtos = []string{"h2", "http/1.1"}
+				l.http = &http.Server{
+					Handler:   &dohHandler{path: lc.Path, srv: d.srv},
+					TLSConfig: config,
+				}
+			}
+			l.l = tls.NewListener(l.l, config)
+		}
+		if err != nil {
+			d.closeListeners()
+			return fmt.Errorf("listening on %s %s: %v", lc.Transport, lc.Address, err)
+		}
+		d.listeners = append(d.listeners, l)
+	}
+	if c.Metrics.Address != "" {
+		ml, err := net.Listen("tcp", c.Metrics.Address)
+		if err != nil {
+			d.closeListeners()
+			return fmt.Errorf("listening for metrics on %s: %v", c.Metrics.Address, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(c.Metrics.Path, d.metrics)
+		d.metricsServer = &http.Server{Handler: mux}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if err := d.metricsServer.Serve(ml); err != http.ErrServerClosed {
+				d.errorf("serving metrics: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (d *daemon) closeListeners() {
+	for _, l := range d.listeners {
+		if l.pc != nil {
+			l.pc.Close()
+		} else {
+			l.l.Close()
+		}
+	}
+	d.listeners = nil
+	if d.metricsServer != nil {
+		d.metricsServer.Close()
+	}
+}
+
+// serve starts serving the listeners.
+func (d *daemon) serve() {
+	for _, l := range d.listeners {
+		d.wg.Add(1)
+		go func(l *listener) {
+			defer d.wg.Done()
+			var err error
+			switch {
+			case l.pc != nil:
+				err = d.srv.ServeUDP(l.pc)
+			case l.http != nil:
+				if err = l.http.Serve(l.l); err == http.ErrServerClosed {
+					err = nil
+				}
+			default:
+				err = d.srv.ServeTCP(l.l)
+			}
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				d.errorf("serving %s %s: %v", l.config.Transport, l.config.Address, err)
+			}
+		}(l)
+	}
+}
+
+// reload rereads the configuration file and puts the new resolver chain and
+// query log in use. Requests in progress complete with the old resolver
+// chain. Changes to listeners and metrics only take effect on restart, but
+// certificates are reloaded. If the configuration is invalid, the old one
+// stays in use.
+func (d *daemon) reload() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := readConfig(d.path)
+	if err != nil {
+		return err
+	}
+	if err := d.apply(c); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(c.Listen, d.config.Listen) || c.Metrics != d.config.Metrics {
+		d.errorf("changes to listeners and metrics take effect on restart")
+	}
+	d.config = c
+
+	dir := filepath.Dir(d.path)
+	for _, l := range d.listeners {
+		if l.config.CertFile == "" {
+			continue
+		}
+		if err := l.loadCertificate(dir); err != nil {
+			d.errorf("reloading certificate of %s %s: %v", l.config.Transport, l.config.Address, err)
+		}
+	}
+	return nil
+}
+
+// shutdown stops the listeners and waits for requests in progress to
+// complete, or ctx to be done.
+func (d *daemon) shutdown(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, l := range d.listeners {
+		if l.http != nil {
+			wg.Add(1)
+			go func(s *http.Server) {
+				defer wg.Done()
+				s.Shutdown(ctx)
+			}(l.http)
+		} else if l.pc != nil {
+			l.pc.Close()
+		} else {
+			l.l.Close()
+		}
+	}
+	if d.metricsServer != nil {
+		d.metricsServer.Close()
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		d.srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.errorf("shutting down: %v", ctx.Err())
+	}
+	d.textLog.Close()
+}
+
+// addrs returns the local addresses of the listeners, in the order they are
+// configured.
+func (d *daemon) addrs() []net.Addr {
+	addrs := make([]net.Addr, len(d.listeners))
+	for i, l := range d.listeners {
+		addrs[i] = l.addr()
+	}
+	return addrs
+}
@@ -0,0 +1,457 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig(strings.NewReader(`
+listen:
+  - transport: udp
+    address: ":53"
+  - transport: https
+    address: ":443"
+    cert_file: cert.pem
+    key_file: key.pem
+resolvers:
+  - type: cache
+    max_size: 100
+  - type: forward
+    servers: [192.0.2.53]
+    timeout: 1500ms
+`))
+	if err != nil {
+		t.Fatal("parseConfig(...) =", err)
+	}
+	if got := c.Listen[1].Path; got != defaultDoHPath {
+		t.Errorf("got DoH path = %q, want = %q", got, defaultDoHPath)
+	}
+	if got := c.Resolvers[0].Name; got != "cache" {
+		t.Errorf("got cache name = %q, want = cache", got)
+	}
+	if got := c.Resolvers[1].Timeout; got != 1500*time.Millisecond {
+		t.Errorf("got timeout = %v, want = 1.5s", got)
+	}
+	if got := c.Metrics.Path; got != "/metrics" {
+		t.Errorf("got metrics path = %q, want = /metrics", got)
+	}
+
+	const listen = "listen: [{transport: udp, address: ':53'}]\n"
+	for _, test := range []struct {
+		config, err string
+	}{
+		{"", "empty configuration"},
+		{"bogus: 1\n", "field bogus not found"},
+		{"resolvers: [{type: forward, servers: [192.0.2.53]}]\n", "no listeners"},
+		{"listen: [{transport: quic, address: ':53'}]\n", "unknown transport"},
+		{"listen: [{transport: udp, address: '53'}]\n", "missing port"},
+		{"listen: [{transport: tls, address: ':853'}]\n", "requires cert_file"},
+		{listen, "no resolvers"},
+		{listen + "resolvers: [{type: magic}]\n", "unknown type"},
+		{listen + "resolvers: [{type: cache}]\n", "cache must be followed"},
+		{listen + "resolvers: [{type: forward, servers: [192.0.2.53]}, {type: static, records: ['a. A 192.0.2.1']}]\n", "must be last"},
+		{listen + "resolvers: [{type: forward}]\n", "no servers"},
+		{listen + "resolvers: [{type: static, records: ['a. A 192.0.2.1'], file: x}]\n", "file doesn't apply"},
+		{listen + "resolvers: [{type: static}]\n", "no records or nxdomain"},
+		{listen + "resolvers: [{type: cache}, {type: cache}, {type: zone, file: x}]\n", "duplicate cache"},
+	} {
+		_, err := parseConfig(strings.NewReader(test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseConfig(%q) = %v, want error containing %q", test.config, err, test.err)
+		}
+	}
+}
+
+// upstreamResolver answers A questions for up.example. and TXT questions for
+// big.example., with enough records not to fit in a UDP response.
+var upstreamResolver = dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, rd bool) (dnsmessage.Message, bool) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: rd, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch {
+	case q.Name.String() == "up.example." && q.Type == dnsmessage.TypeA:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 7}}})
+	case q.Name.String() == "big.example." && q.Type == dnsmessage.TypeTXT:
+		for i := 0; i < 10; i++ {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.TXTResource{TXT: []string{strings.Repeat("x", 100)}}})
+		}
+	default:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	return msg, true
+})
+
+// startUpstream starts a server for upstreamResolver on loopback, and returns
+// the address it serves UDP and TCP on.
+func startUpstream(t *testing.T) string {
+	t.Helper()
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, upstreamResolver)
+	if err != nil {
+		t.Fatal("creating packet resolver:", err)
+	}
+	srv, err := dnsserver.New(dnsserver.Config{Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening on TCP:", err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal("listening on UDP:", err)
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		srv.ServeUDP(pc)
+		done <- struct{}{}
+	}()
+	go func() {
+		srv.ServeTCP(l)
+		done <- struct{}{}
+	}()
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+		<-done
+		<-done
+		srv.Wait()
+	})
+	return l.Addr().String()
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its key
+// to cert.pem and key.pem in dir.
+func writeCertificate(t *testing.T, dir string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generating key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("creating certificate:", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal("marshaling key:", err)
+	}
+	writeFile(t, filepath.Join(dir, "cert.pem"), string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, filepath.Join(dir, "key.pem"), string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})))
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("parsing certificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testConfig returns a configuration with a listener of each transport on
+// loopback, and a resolver chain ending with upstream, in which router.lan.
+// has address routerAddr.
+func testConfig(upstream, routerAddr string) string {
+	return fmt.Sprintf(`
+listen:
+  - {transport: udp, address: "127.0.0.1:0"}
+  - {transport: tcp, address: "127.0.0.1:0"}
+  - {transport: tls, address: "127.0.0.1:0", cert_file: cert.pem, key_file: key.pem}
+  - {transport: https, address: "127.0.0.1:0", cert_file: cert.pem, key_file: key.pem}
+resolvers:
+  - type: static
+    records:
+      - "router.lan. 300 IN A %s"
+    nxdomain: [ads.example.]
+  - type: zone
+    file: example.com.zone
+  - type: cache
+    name: main
+  - type: forward
+    servers: [%q]
+    timeout: 1s
+log:
+  queries: queries.log
+metrics:
+  address: "127.0.0.1:0"
+`, routerAddr, upstream)
+}
+
+const testZoneFile = `$ORIGIN example.com.
+@	SOA	ns1 hostmaster 1 2h 30m 1w 300
+www	A	192.0.2.1
+`
+
+// exchange sends a query for name and type typ to the listener with transport
+// at addr and returns the response.
+func exchange(t *testing.T, transport string, addr net.Addr, pool *x509.CertPool, name string, typ dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal("packing query:", err)
+	}
+	tlsConfig := &tls.Config{RootCAs: pool}
+
+	var resp []byte
+	switch transport {
+	case transportUDP:
+		c, err := net.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		resp = make([]byte, 512)
+		n, err := c.Read(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = resp[:n]
+	case transportTCP, transportTLS:
+		var c net.Conn
+		if transport == transportTCP {
+			c, err = net.Dial("tcp", addr.String())
+		} else {
+			c, err = tls.Dial("tcp", addr.String(), tlsConfig)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)); err != nil {
+			t.Fatal(err)
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			t.Fatal(err)
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c, resp); err != nil {
+			t.Fatal(err)
+		}
+	case transportHTTPS:
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+		defer client.CloseIdleConnections()
+		r, err := client.Post("https://"+addr.String()+defaultDoHPath, dohContentType, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("got HTTP status %s", r.Status)
+		}
+		if resp, err = io.ReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal("unpacking response:", err)
+	}
+	if m.Header.ID != 42 {
+		t.Fatalf("got response ID %d, want 42", m.Header.ID)
+	}
+	return m
+}
+
+// firstA returns the address in the first answer of m, which must be an A
+// record.
+func firstA(m dnsmessage.Message) string {
+	if len(m.Answers) == 0 {
+		return fmt.Sprintf("no answers, %v", m.Header.RCode)
+	}
+	a, ok := m.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok {
+		return fmt.Sprintf("%v", m.Answers[0].Body)
+	}
+	return net.IP(a.A[:]).String()
+}
+
+func TestDaemon(t *testing.T) {
+	dir := t.TempDir()
+	pool := writeCertificate(t, dir)
+	upstream := startUpstream(t)
+	path := filepath.Join(dir, "dnsd.yaml")
+	writeFile(t, path, testConfig(upstream, "192.168.1.1"))
+	writeFile(t, filepath.Join(dir, "example.com.zone"), testZoneFile)
+
+	d, err := newDaemon(path, t.Logf)
+	if err != nil {
+		t.Fatal("newDaemon(...) =", err)
+	}
+	d.serve()
+	defer d.shutdown(context.Background())
+	addrs := d.addrs()
+
+	transports := []string{transportUDP, transportTCP, transportTLS, transportHTTPS}
+	for i, transport := range transports {
+		for name, want := range map[string]string{
+			"router.lan.":      "192.168.1.1",
+			"www.example.com.": "192.0.2.1",
+			"up.example.":      "192.0.2.7",
+		} {
+			if got := firstA(exchange(t, transport, addrs[i], pool, name, dnsmessage.TypeA)); got != want {
+				t.Errorf("%s: got %s A = %s, want = %s", transport, name, got, want)
+			}
+		}
+		m := exchange(t, transport, addrs[i], pool, "x.ads.example.", dnsmessage.TypeA)
+		if m.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("%s: got x.ads.example. A rcode = %v, want NXDOMAIN", transport, m.Header.RCode)
+		}
+		m = exchange(t, transport, addrs[i], pool, "nope.example.com.", dnsmessage.TypeA)
+		if m.Header.RCode != dnsmessage.RCodeNameError || !m.Header.Authoritative {
+			t.Errorf("%s: got nope.example.com. A rcode, aa = %v, %t, want NXDOMAIN from the zone", transport, m.Header.RCode, m.Header.Authoritative)
+		}
+	}
+
+	// The upstream response is truncated over UDP, so the forwarder
+	// retries over TCP.
+	if m := exchange(t, transportTCP, addrs[1], pool, "big.example.", dnsmessage.TypeTXT); len(m.Answers) != 10 {
+		t.Errorf("got %d big.example. TXT answers, want 10", len(m.Answers))
+	}
+
+	// Reloading puts the new configuration in use.
+	writeFile(t, path, testConfig(upstream, "192.168.1.2"))
+	if err := d.reload(); err != nil {
+		t.Fatal("reload() =", err)
+	}
+	if got := firstA(exchange(t, transportUDP, addrs[0], pool, "router.lan.", dnsmessage.TypeA)); got != "192.168.1.2" {
+		t.Errorf("got router.lan. A = %s after reload, want = 192.168.1.2", got)
+	}
+
+	// An invalid configuration leaves the old one in use.
+	writeFile(t, path, strings.Replace(testConfig(upstream, "192.168.1.3"), "example.com.zone", "missing.zone", 1))
+	if err := d.reload(); err == nil {
+		t.Error("reload() with missing zone file succeeded, want error")
+	}
+	if got := firstA(exchange(t, transportUDP, addrs[0], pool, "router.lan.", dnsmessage.TypeA)); got != "192.168.1.2" {
+		t.Errorf("got router.lan. A = %s after failed reload, want = 192.168.1.2", got)
+	}
+
+	rec := httptest.NewRecorder()
+	d.metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, s := range []string{`dns_requests_total{transport="udp",qtype="A",rcode="NOERROR"}`, `dns_resolver_deferrals_total{resolver="main"}`} {
+		if !strings.Contains(rec.Body.String(), s) {
+			t.Errorf("metrics don't contain %s:\n%s", s, rec.Body.String())
+		}
+	}
+
+	d.shutdown(context.Background())
+	b, err := os.ReadFile(filepath.Join(dir, "queries.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{" udp router.lan. A NOERROR ", " tcp big.example. TXT NOERROR "} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("query log doesn't contain %q:\n%s", s, b)
+		}
+	}
+}
+
+func TestQueryLogReload(t *testing.T) {
+	dir := t.TempDir()
+	var l textQueryLogger
+	reset := func(name string) {
+		w, c, err := openQueryLog(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal("openQueryLog(...) =", err)
+		}
+		if err := l.reset(w, c); err != nil {
+			t.Fatal("reset(...) =", err)
+		}
+	}
+	reset("old.log")
+
+	// A query in progress during a reload holds the logger from before
+	// it.
+	var inProgress dnsserver.QueryLogger = &l
+	reset("new.log")
+	now := time.Now()
+	inProgress.LogQuery(&dnsserver.QueryLog{QueryTime: now, ResponseTime: now})
+	if err := l.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+
+	for name, want := range map[string]int{"old.log": 0, "new.log": 1} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(string(b), "\n"); got != want {
+			t.Errorf("got %d lines in %s, want = %d", got, name, want)
+		}
+	}
+}
+
+func TestDaemonErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dnsd.yaml")
+	for _, config := range []string{
+		// A missing certificate.
+		"listen: [{transport: tls, address: '127.0.0.1:0', cert_file: cert.pem, key_file: key.pem}]\nresolvers: [{type: static, records: ['a. A 192.0.2.1']}]\n",
+		// An invalid record.
+		"listen: [{transport: udp, address: '127.0.0.1:0'}]\nresolvers: [{type: static, records: ['a. A 192.0.2']}]\n",
+		// An invalid address.
+		"listen: [{transport: udp, address: '192.0.2.256:0'}]\nresolvers: [{type: static, records: ['a. A 192.0.2.1']}]\n",
+	} {
+		writeFile(t, path, config)
+		if d, err := newDaemon(path, t.Logf); err == nil {
+			d.shutdown(context.Background())
+			t.Errorf("newDaemon(...) with %q succeeded, want error", config)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+// dohContentType is the media type of DNS messages in DoH, RFC 8484,
+// section 6.
+const dohContentType = "application/dns-message"
+
+// A dohHandler serves DNS over HTTPS, as described in RFC 8484, resolving
+// requests with srv, so that they are logged, counted and traced like those
+// received over UDP and TCP.
+type dohHandler struct {
+	path string
+	srv  *dnsserver.Server
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP.
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	var req []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if req, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(req) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if req, err = io.ReadAll(io.LimitReader(r.Body, math.MaxUint16+1)); err != nil {
+			http.Error(w, "reading request", http.StatusBadRequest)
+			return
+		}
+		if len(req) > math.MaxUint16 {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, addr)
+	}
+	if addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		ctx = context.WithValue(ctx, dnsresolver.LocalContextKey, addr)
+	}
+	resp, err := h.srv.ResolvePacket(ctx, req, math.MaxUint16, nil)
+	if err != nil {
+		http.Error(w, "invalid DNS request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(resp)
+}
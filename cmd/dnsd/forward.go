@@ -0,0 +1,119 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/internal/dnsexchange"
+)
+
+// defaultForwardTimeout is the default time a forwarder waits for each
+// server.
+const defaultForwardTimeout = 2 * time.Second
+
+// forwardUDPSize is the UDP payload size advertised to upstream servers, as
+// recommended by DNS Flag Day 2020.
+const forwardUDPSize = 1232
+
+// A forwarder resolves questions by forwarding them to upstream servers, in
+// order, until one responds. Truncated UDP responses are retried over TCP.
+type forwarder struct {
+	servers []string
+	timeout time.Duration
+}
+
+// newForwarder creates a forwarder for servers, which default to port 53.
+func newForwarder(servers []string, timeout time.Duration) *forwarder {
+	f := &forwarder{timeout: timeout}
+	if f.timeout == 0 {
+		f.timeout = defaultForwardTimeout
+	}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		f.servers = append(f.servers, s)
+	}
+	return f
+}
+
+// Resolve implements dnsresolver.Resolver.Resolve.
+func (f *forwarder) Resolve(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	for _, server := range f.servers {
+		msg, err := f.exchange(ctx, server, question, recursionDesired)
+		if err == nil {
+			return msg, true
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return dnsmessage.Message{}, false
+}
+
+// exchange forwards question to server.
+func (f *forwarder) exchange(ctx context.Context, server string, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	msg, err := f.exchangeTransport(ctx, "udp", server, question, recursionDesired)
+	if err == nil && msg.Header.Truncated {
+		msg, err = f.exchangeTransport(ctx, "tcp", server, question, recursionDesired)
+	}
+	return msg, err
+}
+
+func (f *forwarder) exchangeTransport(ctx context.Context, network, server string, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	id := uint16(rand.Uint32())
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(forwardUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	query := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, RecursionDesired: recursionDesired},
+		Questions:   []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	resp, err := dnsexchange.Exchange(c, b, network == "tcp", nil)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	return stripOPT(msg), nil
+}
+
+// stripOPT removes the OPT record from msg, since EDNS(0) is hop-by-hop.
+func stripOPT(msg dnsmessage.Message) dnsmessage.Message {
+	rs := msg.Additionals[:0]
+	for _, r := range msg.Additionals {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			rs = append(rs, r)
+		}
+	}
+	msg.Additionals = rs
+	return msg
+}
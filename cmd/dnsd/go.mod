@@ -0,0 +1,15 @@
+module github.com/iangudger/dns/cmd/dnsd
+
+go 1.17
+
+require (
+	github.com/iangudger/dns v0.0.0-00010101000000-000000000000
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+)
+
+replace github.com/iangudger/dns => ../..
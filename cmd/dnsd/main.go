@@ -0,0 +1,151 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command dnsd is a DNS server configured by a YAML file.
+//
+// Usage:
+//
+//	dnsd [-config dnsd.yaml] [-check]
+//
+// The configuration file describes the listeners, the chain of resolvers
+// which answer queries, query logging and metrics. For example:
+//
+//	listen:
+//	  - transport: udp
+//	    address: ":53"
+//	  - transport: tcp
+//	    address: ":53"
+//	  - transport: tls
+//	    address: ":853"
+//	    cert_file: cert.pem
+//	    key_file: key.pem
+//	  - transport: https
+//	    address: ":443"
+//	    cert_file: cert.pem
+//	    key_file: key.pem
+//	resolvers:
+//	  - type: static
+//	    records:
+//	      - "router.lan. 300 IN A 192.168.1.1"
+//	    nxdomain: ["ads.example."]
+//	  - type: zone
+//	    file: example.com.zone
+//	    origin: example.com.
+//	  - type: cache
+//	    max_size: 10000
+//	    negative: true
+//	  - type: forward
+//	    servers: ["192.0.2.53", "198.51.100.53"]
+//	    timeout: 2s
+//	log:
+//	  queries: queries.log
+//	metrics:
+//	  address: "localhost:9153"
+//
+// Each resolver passes the questions it can't answer to the next one. A
+// static resolver answers with the records listed in zone file format, which
+// may include wildcards, and with NXDOMAIN for the nxdomain names and the
+// names below them. The names below the parent of a wildcard are all answered
+// by the static resolver, with NODATA or NXDOMAIN if they have no records. A
+// zone resolver answers authoritatively for the zone in a
+// zone file. A cache caches the responses of the resolvers after it. A forward
+// resolver, which must be last, forwards questions to upstream servers.
+// Questions which reach the end of a chain without a forward resolver are
+// refused. Relative file names are relative to the directory of the
+// configuration file.
+//
+// The https transport serves DNS over HTTPS at path /dns-query, or the path
+// configured with path. Query logs are appended to a file, or written to
+// standard output if the file is "-". Prometheus metrics are served at
+// /metrics, or the path configured with path.
+//
+// On SIGHUP, dnsd rereads the configuration file and replaces the resolver
+// chain without interrupting queries in progress, reopens the query log and
+// reloads certificates. Changes to listeners and metrics take effect on
+// restart. If the new configuration is invalid, the old one stays in use. On
+// SIGINT or SIGTERM, dnsd stops accepting queries and exits once the queries
+// in progress have been answered.
+//
+// The -check flag checks the configuration, including the files it refers to,
+// and exits.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/iangudger/dns/dnsresolver"
+)
+
+var (
+	configPath = flag.String("config", "dnsd.yaml", "configuration `file`")
+	check      = flag.Bool("check", false, "check the configuration and exit")
+)
+
+// shutdownTimeout is the maximum time to wait for queries in progress on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dnsd: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *check {
+		c, err := readConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		newStats := func(string) *dnsresolver.Stats { return nil }
+		if _, err := buildResolver(c, filepath.Dir(*configPath), newStats); err != nil {
+			log.Fatalf("%s: %v", *configPath, err)
+		}
+		fmt.Printf("%s: OK\n", *configPath)
+		return
+	}
+
+	d, err := newDaemon(*configPath, log.Printf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.serve()
+	for _, addr := range d.addrs() {
+		log.Printf("listening on %s %s", addr.Network(), addr)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			if err := d.reload(); err != nil {
+				log.Printf("reloading configuration: %v", err)
+			} else {
+				log.Printf("reloaded configuration")
+			}
+			continue
+		}
+		log.Printf("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		d.shutdown(ctx)
+		cancel()
+		return
+	}
+}
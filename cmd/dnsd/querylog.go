@@ -0,0 +1,122 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsserver"
+	"github.com/iangudger/dns/internal/dnsnames"
+)
+
+// A textQueryLogger writes a line describing each query to a file.
+//
+// Queries in progress during a reload may still hold the logger, so a reload
+// replaces the file with reset, rather than the logger, and lines are never
+// written to a closed file.
+type textQueryLogger struct {
+	mu sync.Mutex
+	w  io.Writer // nil if lines are discarded
+	c  io.Closer // nil for standard output
+}
+
+// openQueryLog opens path, which is appended to, for a textQueryLogger, or
+// returns standard output, with a nil Closer, if path is "-".
+func openQueryLog(path string) (io.Writer, io.Closer, error) {
+	if path == "-" {
+		return os.Stdout, nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
+// reset replaces the file lines are written to with w, which is closed with c
+// unless c is nil, and closes the old file. If w is nil, lines are discarded.
+func (l *textQueryLogger) reset(w io.Writer, c io.Closer) error {
+	l.mu.Lock()
+	old := l.c
+	l.w, l.c = w, c
+	l.mu.Unlock()
+	if old == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+// LogQuery implements dnsserver.QueryLogger.LogQuery.
+//
+// The line holds the time, client address, transport, question, response
+// code, response size and latency, such as:
+//
+//	2019-06-01T12:00:00.000Z 192.0.2.1:53535 udp example.com. A NOERROR 45 250µs
+func (l *textQueryLogger) LogQuery(ql *dnsserver.QueryLog) {
+	transport := "udp"
+	if ql.TCP {
+		transport = "tcp"
+	}
+	client := "-"
+	if ql.Source != nil {
+		client = ql.Source.String()
+	}
+	name, typ := "-", "-"
+	var p dnsmessage.Parser
+	if _, err := p.Start(ql.Query); err == nil {
+		if q, err := p.Question(); err == nil {
+			name, typ = q.Name.String(), dnsnames.Type(q.Type)
+		}
+	}
+	rcode := "-"
+	if h, err := p.Start(ql.Response); err == nil {
+		rcode = dnsnames.RCode(h.RCode)
+	}
+	line := fmt.Sprintf("%s %s %s %s %s %s %d %v\n",
+		ql.QueryTime.UTC().Format("2006-01-02T15:04:05.000Z07:00"), client, transport, name, typ, rcode,
+		len(ql.Response), ql.ResponseTime.Sub(ql.QueryTime).Round(time.Microsecond))
+
+	l.mu.Lock()
+	if l.w != nil {
+		io.WriteString(l.w, line)
+	}
+	l.mu.Unlock()
+}
+
+// Close closes the file, unless it is standard output. Later lines are
+// discarded.
+func (l *textQueryLogger) Close() error {
+	return l.reset(nil, nil)
+}
+
+// A swapQueryLogger is a dnsserver.QueryLogger which logs queries with a
+// QueryLogger that can be replaced while queries are being logged.
+type swapQueryLogger struct {
+	v atomic.Value // queryLoggerBox
+}
+
+// queryLoggerBox boxes a QueryLogger, since an atomic.Value must always hold
+// the same concrete type.
+type queryLoggerBox struct {
+	l dnsserver.QueryLogger
+}
+
+// set replaces the QueryLogger, which may be nil to disable logging.
+func (s *swapQueryLogger) set(l dnsserver.QueryLogger) {
+	s.v.Store(queryLoggerBox{l})
+}
+
+// LogQuery implements dnsserver.QueryLogger.LogQuery.
+func (s *swapQueryLogger) LogQuery(l *dnsserver.QueryLog) {
+	if b, ok := s.v.Load().(queryLoggerBox); ok && b.l != nil {
+		b.l.LogQuery(l)
+	}
+}
@@ -0,0 +1,591 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/internal/dnsnames"
+	"github.com/iangudger/dns/internal/dnstree"
+)
+
+// defaultTTL is the TTL of records which have none and aren't preceded by a
+// $TTL directive.
+const defaultTTL = 3600
+
+// maxCNAMEChain is the maximum number of CNAME records followed within a zone
+// to answer a question.
+const maxCNAMEChain = 8
+
+// A zoneToken is a token of a zone file.
+type zoneToken struct {
+	text string
+
+	// quoted indicates that the token was a quoted string, so it can't
+	// be a directive or the generic record data marker.
+	quoted bool
+}
+
+// A zoneEntry is a logical line of a zone file, which may span several lines
+// within parentheses.
+type zoneEntry struct {
+	tokens []zoneToken
+
+	// blankOwner indicates that the entry started with white space, so
+	// its owner is that of the previous record.
+	blankOwner bool
+
+	// line is the line number the entry started on.
+	line int
+}
+
+// splitZone splits the zone file s into entries, as described in RFC 1035,
+// section 5.1.
+func splitZone(s string) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var cur zoneEntry
+	var tok strings.Builder
+	inToken := false
+	depth := 0
+	line := 1
+	endToken := func() {
+		if inToken {
+			cur.tokens = append(cur.tokens, zoneToken{text: tok.String()})
+			tok.Reset()
+			inToken = false
+		}
+	}
+	startOfLine := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if startOfLine && depth == 0 {
+			cur = zoneEntry{blankOwner: c == ' ' || c == '\t', line: line}
+			startOfLine = false
+		}
+		switch {
+		case c == '\n':
+			endToken()
+			line++
+			if depth == 0 {
+				if len(cur.tokens) > 0 {
+					entries = append(entries, cur)
+				}
+				startOfLine = true
+			}
+		case c == ';':
+			endToken()
+			for i+1 < len(s) && s[i+1] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			endToken()
+		case c == '(':
+			endToken()
+			depth++
+		case c == ')':
+			endToken()
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parenthesis", line)
+			}
+		case c == '"':
+			endToken()
+			var b strings.Builder
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\n' {
+					line++
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					n, skip, err := unescape(s[i+1:])
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %v", line, err)
+					}
+					b.WriteByte(n)
+					i += skip
+					continue
+				}
+				b.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			cur.tokens = append(cur.tokens, zoneToken{text: b.String(), quoted: true})
+		default:
+			if c == '\\' && i+1 < len(s) {
+				// Keep escapes in unquoted tokens, so that
+				// the generic record data marker, \#, can be
+				// recognized.
+				tok.WriteByte(c)
+				i++
+				c = s[i]
+			}
+			tok.WriteByte(c)
+			inToken = true
+		}
+	}
+	endToken()
+	if depth > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parenthesis", line)
+	}
+	if len(cur.tokens) > 0 {
+		entries = append(entries, cur)
+	}
+	return entries, nil
+}
+
+// unescape decodes the escape sequence following a backslash at the start of
+// s, which is either \X or \DDD. It returns the byte and the length of the
+// sequence after the backslash.
+func unescape(s string) (byte, int, error) {
+	if len(s) >= 3 && isDigit(s[0]) && isDigit(s[1]) && isDigit(s[2]) {
+		n, _ := strconv.Atoi(s[:3])
+		if n > 255 {
+			return 0, 0, fmt.Errorf("invalid escape \\%s", s[:3])
+		}
+		return byte(n), 3, nil
+	}
+	return s[0], 1, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// A zoneParser parses the entries of a zone file into records.
+type zoneParser struct {
+	// origin is the absolute name which relative names are relative
+	// to.
+	origin string
+
+	// ttl is the TTL of records which have none.
+	ttl uint32
+
+	// owner is the owner of the previous record.
+	owner *dnsmessage.Name
+}
+
+// parseZone parses the zone file s. Relative names are relative to origin
+// until a $ORIGIN directive.
+func parseZone(s, origin string) ([]dnsmessage.Resource, error) {
+	entries, err := splitZone(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(origin, ".") {
+		origin += "."
+	}
+	p := zoneParser{origin: origin, ttl: defaultTTL}
+	var rs []dnsmessage.Resource
+	for _, e := range entries {
+		r, ok, err := p.parseEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", e.line, err)
+		}
+		if ok {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+// parseEntry parses a directive or a record. It returns false for
+// directives.
+func (p *zoneParser) parseEntry(e zoneEntry) (dnsmessage.Resource, bool, error) {
+	t := e.tokens
+	if first := t[0]; !first.quoted && strings.HasPrefix(first.text, "$") {
+		if len(t) != 2 {
+			return dnsmessage.Resource{}, false, fmt.Errorf("%s takes one argument", first.text)
+		}
+		switch strings.ToUpper(first.text) {
+		case "$ORIGIN":
+			n, err := p.name(t[1].text)
+			if err != nil {
+				return dnsmessage.Resource{}, false, err
+			}
+			p.origin = n.String()
+		case "$TTL":
+			ttl, err := parseTTL(t[1].text)
+			if err != nil {
+				return dnsmessage.Resource{}, false, err
+			}
+			p.ttl = ttl
+		default:
+			return dnsmessage.Resource{}, false, fmt.Errorf("unsupported directive %s", first.text)
+		}
+		return dnsmessage.Resource{}, false, nil
+	}
+
+	var h dnsmessage.ResourceHeader
+	if e.blankOwner {
+		if p.owner == nil {
+			return dnsmessage.Resource{}, false, errors.New("no owner name")
+		}
+		h.Name = *p.owner
+	} else {
+		n, err := p.name(t[0].text)
+		if err != nil {
+			return dnsmessage.Resource{}, false, err
+		}
+		h.Name = n
+		t = t[1:]
+	}
+	p.owner = &h.Name
+
+	// The TTL and class may appear in either order, and both are
+	// optional.
+	h.TTL = p.ttl
+	h.Class = dnsmessage.ClassINET
+	for i := 0; i < 2 && len(t) > 0; i++ {
+		if tok := t[0]; tok.quoted || tok.text == "" {
+			break
+		} else if isDigit(tok.text[0]) {
+			ttl, err := parseTTL(tok.text)
+			if err != nil {
+				return dnsmessage.Resource{}, false, err
+			}
+			h.TTL = ttl
+		} else if strings.EqualFold(tok.text, "IN") {
+			// The only supported class.
+		} else {
+			break
+		}
+		t = t[1:]
+	}
+	if len(t) == 0 {
+		return dnsmessage.Resource{}, false, errors.New("missing type")
+	}
+	typ, err := dnsnames.ParseType(t[0].text)
+	if err != nil {
+		return dnsmessage.Resource{}, false, err
+	}
+	h.Type = typ
+	body, err := p.parseRData(typ, t[1:])
+	if err != nil {
+		return dnsmessage.Resource{}, false, fmt.Errorf("%s %s: %v", h.Name, dnsnames.Type(typ), err)
+	}
+	return dnsmessage.Resource{Header: h, Body: body}, true, nil
+}
+
+// name returns the absolute name of s.
+func (p *zoneParser) name(s string) (dnsmessage.Name, error) {
+	switch {
+	case s == "@":
+		s = p.origin
+	case strings.HasSuffix(s, "."):
+	case p.origin == ".":
+		s += "."
+	default:
+		s += "." + p.origin
+	}
+	return dnsmessage.NewName(s)
+}
+
+// parseRData parses the record data of a record of type typ.
+func (p *zoneParser) parseRData(typ dnsmessage.Type, t []zoneToken) (dnsmessage.ResourceBody, error) {
+	if len(t) > 0 && !t[0].quoted && t[0].text == `\#` {
+		return parseGeneric(typ, t[1:])
+	}
+	want := map[dnsmessage.Type]int{
+		dnsmessage.TypeA:     1,
+		dnsmessage.TypeAAAA:  1,
+		dnsmessage.TypeNS:    1,
+		dnsmessage.TypeCNAME: 1,
+		dnsmessage.TypePTR:   1,
+		dnsmessage.TypeMX:    2,
+		dnsmessage.TypeSOA:   7,
+		dnsmessage.TypeSRV:   4,
+	}
+	if n, ok := want[typ]; ok && len(t) != n {
+		return nil, fmt.Errorf("got %d fields, want %d", len(t), n)
+	}
+	var err error
+	switch typ {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(t[0].text).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", t[0].text)
+		}
+		var r dnsmessage.AResource
+		copy(r.A[:], ip)
+		return &r, nil
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(t[0].text)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", t[0].text)
+		}
+		var r dnsmessage.AAAAResource
+		copy(r.AAAA[:], ip)
+		return &r, nil
+	case dnsmessage.TypeNS:
+		var r dnsmessage.NSResource
+		r.NS, err = p.name(t[0].text)
+		return &r, err
+	case dnsmessage.TypeCNAME:
+		var r dnsmessage.CNAMEResource
+		r.CNAME, err = p.name(t[0].text)
+		return &r, err
+	case dnsmessage.TypePTR:
+		var r dnsmessage.PTRResource
+		r.PTR, err = p.name(t[0].text)
+		return &r, err
+	case dnsmessage.TypeMX:
+		var r dnsmessage.MXResource
+		if r.Pref, err = parseUint16(t[0].text); err != nil {
+			return nil, err
+		}
+		r.MX, err = p.name(t[1].text)
+		return &r, err
+	case dnsmessage.TypeSOA:
+		var r dnsmessage.SOAResource
+		if r.NS, err = p.name(t[0].text); err != nil {
+			return nil, err
+		}
+		if r.MBox, err = p.name(t[1].text); err != nil {
+			return nil, err
+		}
+		if r.Serial, err = parseUint32(t[2].text); err != nil {
+			return nil, err
+		}
+		for i, f := range []*uint32{&r.Refresh, &r.Retry, &r.Expire, &r.MinTTL} {
+			if *f, err = parseTTL(t[3+i].text); err != nil {
+				return nil, err
+			}
+		}
+		return &r, nil
+	case dnsmessage.TypeTXT:
+		if len(t) == 0 {
+			return nil, errors.New("no strings")
+		}
+		var r dnsmessage.TXTResource
+		for _, s := range t {
+			if len(s.text) > 255 {
+				return nil, fmt.Errorf("string of %d bytes is longer than 255 bytes", len(s.text))
+			}
+			r.TXT = append(r.TXT, s.text)
+		}
+		return &r, nil
+	case dnsmessage.TypeSRV:
+		var r dnsmessage.SRVResource
+		for i, f := range []*uint16{&r.Priority, &r.Weight, &r.Port} {
+			if *f, err = parseUint16(t[i].text); err != nil {
+				return nil, err
+			}
+		}
+		r.Target, err = p.name(t[3].text)
+		return &r, err
+	}
+	return nil, errors.New(`unsupported type, use the generic \# format`)
+}
+
+// parseGeneric parses record data in the generic format of RFC 3597,
+// section 5.
+func parseGeneric(typ dnsmessage.Type, t []zoneToken) (dnsmessage.ResourceBody, error) {
+	if len(t) == 0 {
+		return nil, errors.New("missing length")
+	}
+	n, err := parseUint16(t[0].text)
+	if err != nil {
+		return nil, err
+	}
+	var hexData strings.Builder
+	for _, s := range t[1:] {
+		hexData.WriteString(s.text)
+	}
+	data, err := hex.DecodeString(hexData.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid data: %v", err)
+	}
+	if len(data) != int(n) {
+		return nil, fmt.Errorf("got %d bytes of data, want %d", len(data), n)
+	}
+	return &dnsmessage.UnknownResource{Type: typ, Data: data}, nil
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint16(n), nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// parseTTL parses a TTL given as a number of seconds or, as supported by BIND,
+// as a sequence of numbers with units, such as 1h30m.
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	if s == "" {
+		return 0, errors.New("empty TTL")
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total uint64
+	for rest := strings.ToLower(s); rest != ""; {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		if i == 0 || i == len(rest) || units[rest[i]] == 0 {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		n, err := strconv.ParseUint(rest[:i], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		if total += n * units[rest[i]]; total > 1<<32-1 {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		rest = rest[i+1:]
+	}
+	return uint32(total), nil
+}
+
+// A zone answers questions for the names in a zone authoritatively, as
+// described in RFC 1034, section 4.3.2, and passes other questions to a
+// nested resolver.
+type zone struct {
+	apex   dnsmessage.Name
+	soa    dnsmessage.Resource
+	nodes  dnstree.Tree
+	nested dnsresolver.Resolver
+}
+
+// newZone creates a zone from its records, which must include exactly one SOA
+// record, at the apex of the zone.
+func newZone(rs []dnsmessage.Resource, nested dnsresolver.Resolver) (*zone, error) {
+	z := &zone{nested: nested}
+	found := false
+	for _, r := range rs {
+		if r.Header.Type != dnsmessage.TypeSOA {
+			continue
+		}
+		if found {
+			return nil, errors.New("zone has more than one SOA record")
+		}
+		z.apex, z.soa, found = r.Header.Name, r, true
+	}
+	if !found {
+		return nil, errors.New("zone has no SOA record")
+	}
+	for _, r := range rs {
+		if !z.contains(r.Header.Name) {
+			return nil, fmt.Errorf("%s is outside zone %s", r.Header.Name, z.apex)
+		}
+		if z.nodes.Add(r).CNAMEConflict() {
+			return nil, fmt.Errorf("%s has a CNAME record and other records", r.Header.Name)
+		}
+	}
+	return z, nil
+}
+
+// contains reports whether name is in the zone.
+func (z *zone) contains(name dnsmessage.Name) bool {
+	return name.IsSubdomain(&z.apex)
+}
+
+// delegation returns the highest zone cut at or above name, or false if name
+// isn't delegated.
+func (z *zone) delegation(name dnsmessage.Name) (dnsmessage.Name, bool) {
+	var cut dnsmessage.Name
+	ok := false
+	for ; !name.Equals(&z.apex); name = name.Parent() {
+		if n := z.nodes.Get(name); n != nil && n.RRset(dnsmessage.TypeNS) != nil {
+			cut, ok = name, true
+		}
+	}
+	return cut, ok
+}
+
+// Resolve implements dnsresolver.Resolver.Resolve.
+func (z *zone) Resolve(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	if question.Class != dnsmessage.ClassINET || !z.contains(question.Name) {
+		return z.nested.Resolve(ctx, question, recursionDesired)
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:         true,
+			Authoritative:    true,
+			RecursionDesired: recursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	name := question.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		if cut, ok := z.delegation(name); ok {
+			if len(msg.Answers) == 0 {
+				// Refer the client to the child zone.
+				msg.Header.Authoritative = false
+				ns := z.nodes.Get(cut).RRset(dnsmessage.TypeNS)
+				msg.Authorities = append(msg.Authorities, ns...)
+				msg.Additionals = z.glue(ns)
+			}
+			return msg, true
+		}
+
+		n := z.nodes.Lookup(name)
+		if n == nil {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+			msg.Authorities = []dnsmessage.Resource{dnstree.NegativeSOA(z.soa)}
+			return msg, true
+		}
+		if cname := n.RRset(dnsmessage.TypeCNAME); cname != nil && question.Type != dnsmessage.TypeCNAME && question.Type != dnsmessage.TypeALL {
+			msg.Answers = n.Append(msg.Answers, dnsmessage.TypeCNAME, name)
+			name = cname[0].Body.(*dnsmessage.CNAMEResource).CNAME
+			if !z.contains(name) {
+				return msg, true
+			}
+			continue
+		}
+
+		chain := len(msg.Answers)
+		if question.Type == dnsmessage.TypeALL {
+			msg.Answers = n.AppendAll(msg.Answers, name)
+		} else {
+			msg.Answers = n.Append(msg.Answers, question.Type, name)
+		}
+		if len(msg.Answers) == chain {
+			// NODATA, RFC 2308, section 2.2.
+			msg.Authorities = []dnsmessage.Resource{dnstree.NegativeSOA(z.soa)}
+		}
+		return msg, true
+	}
+	// The CNAME chain is too long, and may loop.
+	msg.Header.RCode = dnsmessage.RCodeServerFailure
+	return msg, true
+}
+
+// glue returns the address records in the zone of the name servers in ns.
+func (z *zone) glue(ns []dnsmessage.Resource) []dnsmessage.Resource {
+	var rs []dnsmessage.Resource
+	for _, r := range ns {
+		n := z.nodes.Get(r.Body.(*dnsmessage.NSResource).NS)
+		if n == nil {
+			continue
+		}
+		rs = append(rs, n.RRset(dnsmessage.TypeA)...)
+		rs = append(rs, n.RRset(dnsmessage.TypeAAAA)...)
+	}
+	return rs
+}
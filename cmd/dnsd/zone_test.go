@@ -0,0 +1,201 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+)
+
+const testZone = `
+$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2019060100 ; serial
+		2h 30m 1w 300 )
+	IN	NS	ns1
+	IN	MX	10 mail
+ns1	300	A	192.0.2.53
+www	A	192.0.2.1
+	AAAA	2001:db8::1
+www.EXAMPLE.com. TXT "v=1; \"quoted\"" unquoted
+alias	CNAME	www
+chain	CNAME	alias
+out	CNAME	www.example.org.
+_dns._udp	SRV	0 5 53 ns1
+*.wild	A	192.0.2.9
+a.b.deep	A	192.0.2.10
+child	NS	ns.child
+ns.child	A	192.0.2.54
+private	TYPE65280	\# 3 abcdef
+`
+
+func TestParseZone(t *testing.T) {
+	rs, err := parseZone(testZone, ".")
+	if err != nil {
+		t.Fatal("parseZone(...) =", err)
+	}
+	var got []string
+	for _, r := range rs {
+		got = append(got, fmt.Sprintf("%s %d %v %v", r.Header.Name, r.Header.TTL, r.Header.Type, r.Body))
+	}
+	for _, want := range []string{
+		"example.com. 3600 TypeSOA &{ns1.example.com. hostmaster.example.com. 2019060100 7200 1800 604800 300}",
+		"example.com. 3600 TypeNS &{ns1.example.com.}",
+		"example.com. 3600 TypeMX &{10 mail.example.com.}",
+		"ns1.example.com. 300 TypeA &{[192 0 2 53]}",
+		"www.example.com. 3600 TypeAAAA &{[32 1 13 184 0 0 0 0 0 0 0 0 0 0 0 1]}",
+		`www.EXAMPLE.com. 3600 TypeTXT &{[v=1; "quoted" unquoted]}`,
+		"_dns._udp.example.com. 3600 TypeSRV &{0 5 53 ns1.example.com.}",
+		"private.example.com. 3600 65280 &{65280 [171 205 239]}",
+	} {
+		found := false
+		for _, g := range got {
+			found = found || g == want
+		}
+		if !found {
+			t.Errorf("records don't include %q:\n%s", want, strings.Join(got, "\n"))
+		}
+	}
+
+	for _, bad := range []string{
+		"www.example. A 192.0.2",
+		"www.example. AAAA 192.0.2.1",
+		"www.example. MX mail.example.",
+		"www.example. BOGUS x",
+		"www.example. HINFO a b",
+		"www.example. TYPE65280 \\# 2 ab",
+		"www.example. TXT \"unterminated",
+		"www.example. SOA ( a. b. 1 2 3 4 5",
+		"$INCLUDE other.zone",
+		"\tA 192.0.2.1",
+		"www.example. 1x A 192.0.2.1",
+	} {
+		if _, err := parseZone(bad, "."); err == nil {
+			t.Errorf("parseZone(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	for s, want := range map[string]uint32{"0": 0, "300": 300, "5m": 300, "1h30m": 5400, "1W": 604800, "1d1s": 86401} {
+		if got, err := parseTTL(s); err != nil || got != want {
+			t.Errorf("parseTTL(%q) = %d, %v, want = %d, <nil>", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "h", "1x", "1h5", "99999999999"} {
+		if _, err := parseTTL(s); err == nil {
+			t.Errorf("parseTTL(%q) succeeded, want error", s)
+		}
+	}
+}
+
+// nestedResolver refuses every question, so that questions passed to it can
+// be recognized.
+var nestedResolver = dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused},
+		Questions: []dnsmessage.Question{q},
+	}, true
+})
+
+// summarize returns the rcode, the authoritative bit and the records in the
+// sections of msg in a compact form.
+func summarize(msg dnsmessage.Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v aa=%t", msg.Header.RCode, msg.Header.Authoritative)
+	for _, s := range []struct {
+		name string
+		rs   []dnsmessage.Resource
+	}{
+		{"an", msg.Answers},
+		{"ns", msg.Authorities},
+		{"ar", msg.Additionals},
+	} {
+		for _, r := range s.rs {
+			fmt.Fprintf(&b, " %s:%s/%v", s.name, r.Header.Name, r.Header.Type)
+		}
+	}
+	return b.String()
+}
+
+func TestZone(t *testing.T) {
+	rs, err := parseZone(testZone, ".")
+	if err != nil {
+		t.Fatal("parseZone(...) =", err)
+	}
+	z, err := newZone(rs, nestedResolver)
+	if err != nil {
+		t.Fatal("newZone(...) =", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		typ  dnsmessage.Type
+		want string
+	}{
+		{"www.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true an:www.example.com./TypeA"},
+		{"WWW.Example.COM.", dnsmessage.TypeAAAA, "RCodeSuccess aa=true an:WWW.Example.COM./TypeAAAA"},
+		{"www.example.com.", dnsmessage.TypeALL, "RCodeSuccess aa=true an:www.example.com./TypeA an:www.example.com./TypeAAAA an:www.example.com./TypeTXT"},
+		{"www.example.com.", dnsmessage.TypeMX, "RCodeSuccess aa=true ns:example.com./TypeSOA"},
+		{"nope.example.com.", dnsmessage.TypeA, "RCodeNameError aa=true ns:example.com./TypeSOA"},
+		{"chain.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true an:chain.example.com./TypeCNAME an:alias.example.com./TypeCNAME an:www.example.com./TypeA"},
+		{"chain.example.com.", dnsmessage.TypeMX, "RCodeSuccess aa=true an:chain.example.com./TypeCNAME an:alias.example.com./TypeCNAME ns:example.com./TypeSOA"},
+		{"alias.example.com.", dnsmessage.TypeCNAME, "RCodeSuccess aa=true an:alias.example.com./TypeCNAME"},
+		{"out.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true an:out.example.com./TypeCNAME"},
+		{"x.wild.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true an:x.wild.example.com./TypeA"},
+		{"y.x.wild.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true an:y.x.wild.example.com./TypeA"},
+		{"x.wild.example.com.", dnsmessage.TypeAAAA, "RCodeSuccess aa=true ns:example.com./TypeSOA"},
+		// Empty non-terminals exist, so they aren't NXDOMAIN.
+		{"b.deep.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true ns:example.com./TypeSOA"},
+		{"deep.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=true ns:example.com./TypeSOA"},
+		{"c.deep.example.com.", dnsmessage.TypeA, "RCodeNameError aa=true ns:example.com./TypeSOA"},
+		{"host.child.example.com.", dnsmessage.TypeA, "RCodeSuccess aa=false ns:child.example.com./TypeNS ar:ns.child.example.com./TypeA"},
+		{"child.example.com.", dnsmessage.TypeNS, "RCodeSuccess aa=false ns:child.example.com./TypeNS ar:ns.child.example.com./TypeA"},
+		{"example.org.", dnsmessage.TypeA, "RCodeRefused aa=false"},
+	} {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: test.typ, Class: dnsmessage.ClassINET}
+		msg, ok := z.Resolve(context.Background(), q, true)
+		if !ok {
+			t.Errorf("Resolve(%v) didn't respond", q)
+			continue
+		}
+		if got := summarize(msg); got != test.want {
+			t.Errorf("Resolve(%s %v) = %s, want = %s", test.name, test.typ, got, test.want)
+		}
+		if !reflect.DeepEqual(msg.Questions, []dnsmessage.Question{q}) {
+			t.Errorf("Resolve(%s %v) has questions %v", test.name, test.typ, msg.Questions)
+		}
+	}
+
+	// Negative responses use the SOA minimum as TTL.
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("nope.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if msg, _ := z.Resolve(context.Background(), q, false); msg.Authorities[0].Header.TTL != 300 {
+		t.Errorf("got negative SOA TTL = %d, want = 300", msg.Authorities[0].Header.TTL)
+	}
+}
+
+func TestNewZoneErrors(t *testing.T) {
+	for _, zone := range []string{
+		"example.com. A 192.0.2.1",
+		"example.com. SOA a. b. 1 2 3 4 5\nexample.com. SOA a. b. 1 2 3 4 5",
+		"example.com. SOA a. b. 1 2 3 4 5\nexample.org. A 192.0.2.1",
+		"example.com. SOA a. b. 1 2 3 4 5\nx.example.com. CNAME y.\nx.example.com. A 192.0.2.1",
+	} {
+		rs, err := parseZone(zone, ".")
+		if err != nil {
+			t.Fatalf("parseZone(%q) = %v", zone, err)
+		}
+		if _, err := newZone(rs, nestedResolver); err == nil {
+			t.Errorf("newZone(%q) succeeded, want error", zone)
+		}
+	}
+}
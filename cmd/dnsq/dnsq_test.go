@@ -0,0 +1,406 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+func TestParseArgs(t *testing.T) {
+	q, err := parseArgs([]string{"@192.0.2.1", "example.com", "mx", "+tcp", "+dnssec", "+bufsize=1232", "+subnet=198.51.100.7/24", "+norec", "+cd"})
+	if err != nil {
+		t.Fatal("parseArgs(...) =", err)
+	}
+	want := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET}
+	if q.question != want {
+		t.Errorf("got question = %v, want = %v", q.question, want)
+	}
+	if q.server != "192.0.2.1" || q.transport != transportTCP || !q.dnssec || q.bufsize != 1232 || q.recursion || !q.checking {
+		t.Errorf("got query = %+v", q)
+	}
+	if got, want := q.subnet.String(), "198.51.100.0/24"; got != want {
+		t.Errorf("got subnet = %s, want = %s", got, want)
+	}
+	if got, want := q.address(), "192.0.2.1:53"; got != want {
+		t.Errorf("got address() = %s, want = %s", got, want)
+	}
+
+	q, err = parseArgs([]string{"+https", "@[2001:db8::1]"})
+	if err != nil {
+		t.Fatal("parseArgs(...) =", err)
+	}
+	if q.question.Name.String() != "." || q.question.Type != dnsmessage.TypeA || !q.recursion {
+		t.Errorf("got defaults = %+v", q)
+	}
+	if got, want := q.address(), "[2001:db8::1]:443"; got != want {
+		t.Errorf("got address() = %s, want = %s", got, want)
+	}
+
+	// A name spelled like a type follows the type.
+	q, err = parseArgs([]string{"aaaa", "ns", "+tls", "+notls"})
+	if err != nil {
+		t.Fatal("parseArgs(...) =", err)
+	}
+	if q.question.Name.String() != "ns." || q.question.Type != dnsmessage.TypeAAAA || q.transport != transportUDP {
+		t.Errorf("got query = %+v", q)
+	}
+
+	for _, args := range [][]string{
+		{"+bogus"},
+		{"+bufsize=12"},
+		{"+subnet=nonsense"},
+		{"+timeout=-1s"},
+		{"+tcp=1"},
+		{"a.example", "b.example"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	subnet, err := parseSubnet("2001:db8:1234::/44")
+	if err != nil {
+		t.Fatal("parseSubnet(...) =", err)
+	}
+	q := &query{
+		question:  dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		recursion: true,
+		dnssec:    true,
+		subnet:    subnet,
+	}
+	b, err := q.pack(nil, 42)
+	if err != nil {
+		t.Fatal("pack(...) =", err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(b); err != nil {
+		t.Fatal("unpacking query:", err)
+	}
+	if m.Header.ID != 42 || !m.Header.RecursionDesired || len(m.Questions) != 1 || len(m.Additionals) != 1 {
+		t.Fatalf("got query = %+v", m)
+	}
+	opt := m.Additionals[0]
+	if opt.Header.Type != dnsmessage.TypeOPT || opt.Header.Class != 1232 || !opt.Header.DNSSECAllowed() {
+		t.Errorf("got OPT header = %+v", opt.Header)
+	}
+	options := opt.Body.(*dnsmessage.OPTResource).Options
+	// Family 2, source prefix 44, scope 0 and the first 6 bytes of the
+	// address, with the last 4 bits cleared.
+	want := []byte{0, 2, 44, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x30}
+	if len(options) != 1 || options[0].Code != optionCodeClientSubnet || !bytes.Equal(options[0].Data, want) {
+		t.Errorf("got options = %v, want client subnet %v", options, want)
+	}
+
+	q.dnssec, q.subnet = false, nil
+	if b, err = q.pack(nil, 42); err != nil {
+		t.Fatal("pack(...) =", err)
+	}
+	if err := m.Unpack(b); err != nil {
+		t.Fatal("unpacking query:", err)
+	}
+	if len(m.Additionals) != 0 {
+		t.Errorf("got %d additionals without EDNS options, want 0", len(m.Additionals))
+	}
+}
+
+func TestPrintMessage(t *testing.T) {
+	name := dnsmessage.MustNewName("example.com.")
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 7, Response: true, RecursionDesired: true, RecursionAvailable: true, RCode: dnsmessage.RCodeSuccess},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.TXTResource{TXT: []string{`say "hi"`, "\x01"}},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: 65280, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.UnknownResource{Type: 65280, Data: []byte{0xab, 0xcd}},
+			},
+		},
+		Authorities: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+				Body: &dnsmessage.SOAResource{
+					NS:      dnsmessage.MustNewName("ns.example.com."),
+					MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+					Serial:  1,
+					Refresh: 2,
+					Retry:   3,
+					Expire:  4,
+					MinTTL:  5,
+				},
+			},
+		},
+		Additionals: []dnsmessage.Resource{
+			{
+				Header: opt,
+				Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: optionCodeClientSubnet, Data: []byte{0, 1, 24, 0, 198, 51, 100}}}},
+			},
+		},
+	}
+	var out bytes.Buffer
+	printMessage(&out, &m)
+	for _, s := range []string{
+		";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 7",
+		";; flags: qr rd ra; QUERY: 1, ANSWER: 3, AUTHORITY: 1, ADDITIONAL: 1",
+		"; EDNS: version: 0, flags: do; udp: 1232",
+		"; CLIENT-SUBNET: 198.51.100.0/24/0",
+		";example.com.\t\tIN\tA",
+		"example.com.\t300\tIN\tA\t192.0.2.1",
+		"example.com.\t60\tIN\tTXT\t\"say \\\"hi\\\"\" \"\\001\"",
+		"example.com.\t60\tIN\tTYPE65280\t\\# 2 ABCD",
+		"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 1 2 3 4 5",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("output doesn't contain %q:\n%s", s, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "ADDITIONAL SECTION") {
+		t.Errorf("output has an additional section with only an OPT record:\n%s", out.String())
+	}
+}
+
+func TestFormatDNSSEC(t *testing.T) {
+	for _, test := range []struct {
+		typ  dnsmessage.Type
+		data string
+		want string
+	}{
+		{typeDS, "\x30\x39\x08\x02\xab\xcd", "12345 8 2 ABCD"},
+		{typeDNSKEY, "\x01\x01\x03\x0d\x01\x02\x03", "257 3 13 AQID"},
+		{
+			dnsmessage.TypeRRSIG,
+			"\x00\x01\x08\x02\x00\x00\x01\x2c\x67\x74\x85\x80\x67\x4b\xa7\x00\x30\x39\x07example\x03com\x00\x01\x02\x03",
+			"A 8 2 300 20250101000000 20241201000000 12345 example.com. AQID",
+		},
+		{dnsmessage.TypeRRSIG, "\x00\x01\x08\x02\x00\x00\x01\x2c\x67\x74\x85\x80\x67\x4b\xa7\x00\x30\x39\x00", "A 8 2 300 20250101000000 20241201000000 12345 ."},
+		// Malformed records use the generic format.
+		{typeDS, "\x30\x39", `\# 2 3039`},
+		{dnsmessage.TypeRRSIG, "\x00\x01\x08\x02\x00\x00\x01\x2c\x67\x74\x85\x80\x67\x4b\xa7\x00\x30\x39\x07ex", `\# 21 000108020000012C67748580674BA7003039076578`},
+	} {
+		got := formatRData(&dnsmessage.UnknownResource{Type: test.typ, Data: []byte(test.data)})
+		if got != test.want {
+			t.Errorf("got formatRData(%v) = %q, want = %q", test.typ, got, test.want)
+		}
+	}
+}
+
+func TestFirstNameserver(t *testing.T) {
+	got, err := firstNameserver(strings.NewReader("# comment\nsearch example.com\nnameserver 192.0.2.53\nnameserver 192.0.2.54\n"))
+	if err != nil || got != "192.0.2.53" {
+		t.Errorf("got firstNameserver(...) = %q, %v, want = 192.0.2.53, <nil>", got, err)
+	}
+	if _, err := firstNameserver(strings.NewReader("search example.com\n")); err != errNoNameserver {
+		t.Errorf("got firstNameserver(...) = %v, want = %v", err, errNoNameserver)
+	}
+}
+
+// testResolver answers A queries with 192.0.2.1, and TXT queries with enough
+// records not to fit in a UDP response.
+var testResolver = dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, rd bool) (dnsmessage.Message, bool) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionAvailable: rd},
+		Questions: []dnsmessage.Question{q},
+	}
+	h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+	case dnsmessage.TypeTXT:
+		for i := 0; i < 10; i++ {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.TXTResource{TXT: []string{strings.Repeat("x", 100)}}})
+		}
+	}
+	return msg, true
+})
+
+// testCertificate returns a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generating key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("creating certificate:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("parsing certificate:", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startServers starts servers for testResolver on loopback and returns the
+// addresses they serve UDP and TCP, DoT and DoH on. UDP and TCP share a port.
+func startServers(t *testing.T, cert tls.Certificate) (udpAndTCP, dot, doh string) {
+	t.Helper()
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, testResolver)
+	if err != nil {
+		t.Fatal("creating packet resolver:", err)
+	}
+	srv, err := dnsserver.New(dnsserver.Config{Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening on TCP:", err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal("listening on UDP:", err)
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening on TCP:", err)
+	}
+	done := make(chan struct{}, 3)
+	go func() {
+		srv.ServeUDP(pc)
+		done <- struct{}{}
+	}()
+	go func() {
+		srv.ServeTCP(l)
+		done <- struct{}{}
+	}()
+	go func() {
+		srv.ServeTCP(tls.NewListener(tl, &tls.Config{Certificates: []tls.Certificate{cert}}))
+		done <- struct{}{}
+	}()
+
+	hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		req, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := pr.ResolvePacket(r.Context(), req, 65535, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(resp)
+	}))
+	hs.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	hs.StartTLS()
+
+	t.Cleanup(func() {
+		hs.Close()
+		pc.Close()
+		l.Close()
+		tl.Close()
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+		srv.Wait()
+	})
+	return l.Addr().String(), tl.Addr().String(), hs.Listener.Addr().String()
+}
+
+func TestExchange(t *testing.T) {
+	cert, pool := testCertificate(t)
+	udpAndTCP, dot, doh := startServers(t, cert)
+
+	for _, test := range []struct {
+		name   string
+		server string
+		args   []string
+	}{
+		{"udp", udpAndTCP, nil},
+		{"tcp", udpAndTCP, []string{"+tcp"}},
+		{"tls", dot, []string{"+tls"}},
+		{"https", doh, []string{"+https"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := parseArgs(append([]string{"@" + test.server, "a.example."}, test.args...))
+			if err != nil {
+				t.Fatal("parseArgs(...) =", err)
+			}
+			q.tlsConfig.RootCAs = pool
+			resp, err := exchange(context.Background(), q)
+			if err != nil {
+				t.Fatal("exchange(...) =", err)
+			}
+			var out bytes.Buffer
+			var m dnsmessage.Message
+			if err := m.Unpack(resp); err != nil {
+				t.Fatal("unpacking response:", err)
+			}
+			printShort(&out, &m)
+			if got, want := out.String(), "192.0.2.1\n"; got != want {
+				t.Errorf("got answers = %q, want = %q", got, want)
+			}
+		})
+	}
+
+	// Truncated UDP responses are retried over TCP, unless +ignore is set.
+	for _, ignore := range []bool{false, true} {
+		q, err := parseArgs([]string{"@" + udpAndTCP, "big.example.", "TXT"})
+		if err != nil {
+			t.Fatal("parseArgs(...) =", err)
+		}
+		q.ignoreTruncation = ignore
+		resp, err := exchange(context.Background(), q)
+		if err != nil {
+			t.Fatal("exchange(...) =", err)
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(resp); err != nil {
+			t.Fatal("unpacking response:", err)
+		}
+		if ignore != m.Header.Truncated || ignore == (len(m.Answers) == 10) {
+			t.Errorf("got truncated, answers = %t, %d with ignore = %t", m.Header.Truncated, len(m.Answers), ignore)
+		}
+	}
+}
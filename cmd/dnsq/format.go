@@ -0,0 +1,321 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/internal/dnsnames"
+)
+
+// EDNS(0) option codes.
+const (
+	optionCodeNSID         = 3
+	optionCodeClientSubnet = 8
+	optionCodeCookie       = 10
+)
+
+var opCodeNames = map[dnsmessage.OpCode]string{
+	0: "QUERY",
+	1: "IQUERY",
+	2: "STATUS",
+	4: "NOTIFY",
+	5: "UPDATE",
+}
+
+// DNSSEC record types which dnsmessage doesn't define.
+const (
+	typeDS     dnsmessage.Type = 43
+	typeDNSKEY dnsmessage.Type = 48
+)
+
+// base32Hex is the encoding of hashed owner names in NSEC3 records.
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// classString returns the mnemonic of c.
+func classString(c dnsmessage.Class) string {
+	switch c {
+	case dnsmessage.ClassINET:
+		return "IN"
+	case dnsmessage.ClassCHAOS:
+		return "CH"
+	case dnsmessage.ClassHESIOD:
+		return "HS"
+	case dnsmessage.ClassANY:
+		return "ANY"
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// formatRR returns r in presentation format.
+func formatRR(r *dnsmessage.Resource) string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s",
+		r.Header.Name, r.Header.TTL, classString(r.Header.Class), dnsnames.Type(r.Header.Type), formatRData(r.Body))
+}
+
+// formatRData returns the record data of b in presentation format.
+func formatRData(b dnsmessage.ResourceBody) string {
+	switch b := b.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", b.NS, b.MBox, b.Serial, b.Refresh, b.Retry, b.Expire, b.MinTTL)
+	case *dnsmessage.TXTResource:
+		s := make([]string, len(b.TXT))
+		for i, t := range b.TXT {
+			s[i] = quote(t)
+		}
+		return strings.Join(s, " ")
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.NSECResource:
+		return strings.TrimSpace(b.NextDomain.String() + " " + typeList(b.Types))
+	case *dnsmessage.NSEC3Resource:
+		salt := "-"
+		if len(b.Salt) > 0 {
+			salt = strings.ToUpper(hex.EncodeToString(b.Salt))
+		}
+		return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s",
+			b.HashAlgorithm, b.Flags, b.Iterations, salt, base32Hex.EncodeToString(b.NextHashedOwner), typeList(b.Types)))
+	case *dnsmessage.UnknownResource:
+		if s, ok := formatDNSSEC(b); ok {
+			return s
+		}
+		// The generic format of RFC 3597, section 5.
+		if len(b.Data) == 0 {
+			return `\# 0`
+		}
+		return fmt.Sprintf(`\# %d %s`, len(b.Data), strings.ToUpper(hex.EncodeToString(b.Data)))
+	}
+	return fmt.Sprintf("%#v", b)
+}
+
+// formatDNSSEC returns the record data of a DS, DNSKEY or RRSIG record in the
+// presentation format of RFC 4034. It returns false for other types and for
+// malformed records.
+func formatDNSSEC(b *dnsmessage.UnknownResource) (string, bool) {
+	d := b.Data
+	switch b.Type {
+	case typeDS:
+		// RFC 4034, section 5.3.
+		if len(d) < 4 {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %d %s",
+			binary.BigEndian.Uint16(d), d[2], d[3], strings.ToUpper(hex.EncodeToString(d[4:]))), true
+	case typeDNSKEY:
+		// RFC 4034, section 2.2.
+		if len(d) < 4 {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %d %s",
+			binary.BigEndian.Uint16(d), d[2], d[3], base64.StdEncoding.EncodeToString(d[4:])), true
+	case dnsmessage.TypeRRSIG:
+		// RFC 4034, section 3.2.
+		if len(d) < 18 {
+			return "", false
+		}
+		signer, n, ok := wireName(d[18:])
+		if !ok {
+			return "", false
+		}
+		return strings.TrimSpace(fmt.Sprintf("%s %d %d %d %s %s %d %s %s",
+			dnsnames.Type(dnsmessage.Type(binary.BigEndian.Uint16(d))), d[2], d[3],
+			binary.BigEndian.Uint32(d[4:]),
+			signatureTime(binary.BigEndian.Uint32(d[8:])),
+			signatureTime(binary.BigEndian.Uint32(d[12:])),
+			binary.BigEndian.Uint16(d[16:]), signer,
+			base64.StdEncoding.EncodeToString(d[18+n:]))), true
+	}
+	return "", false
+}
+
+// signatureTime returns the RRSIG expiration or inception time t in the
+// YYYYMMDDHHmmSS format of RFC 4034, section 3.2.
+func signatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// wireName returns the uncompressed name at the start of b in presentation
+// format, and its length in wire format.
+func wireName(b []byte) (string, int, bool) {
+	var s strings.Builder
+	for off := 0; off < len(b); {
+		l := int(b[off])
+		off++
+		if l == 0 {
+			if s.Len() == 0 {
+				s.WriteByte('.')
+			}
+			return s.String(), off, true
+		}
+		if l > 63 || off+l > len(b) {
+			break
+		}
+		for _, c := range b[off : off+l] {
+			switch {
+			case c == '.' || c == '\\':
+				s.WriteByte('\\')
+				s.WriteByte(c)
+			case c <= ' ' || c > '~':
+				fmt.Fprintf(&s, "\\%03d", c)
+			default:
+				s.WriteByte(c)
+			}
+		}
+		s.WriteByte('.')
+		off += l
+	}
+	return "", 0, false
+}
+
+func typeList(ts []dnsmessage.Type) string {
+	s := make([]string, len(ts))
+	for i, t := range ts {
+		s[i] = dnsnames.Type(t)
+	}
+	return strings.Join(s, " ")
+}
+
+// quote returns s as a quoted character string, escaping quotes, backslashes
+// and non-printable bytes as described in RFC 1035, section 5.1.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// printMessage writes m in the style of dig to w.
+func printMessage(w io.Writer, m *dnsmessage.Message) {
+	h := m.Header
+	rcode := h.RCode
+	var opt *dnsmessage.Resource
+	for i := range m.Additionals {
+		if m.Additionals[i].Header.Type == dnsmessage.TypeOPT {
+			opt = &m.Additionals[i]
+			rcode = opt.Header.ExtendedRCode(rcode)
+		}
+	}
+	opcode, ok := opCodeNames[h.OpCode]
+	if !ok {
+		opcode = "OPCODE" + strconv.Itoa(int(h.OpCode))
+	}
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcode, dnsnames.RCode(rcode), h.ID)
+
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{h.Response, "qr"},
+		{h.Authoritative, "aa"},
+		{h.Truncated, "tc"},
+		{h.RecursionDesired, "rd"},
+		{h.RecursionAvailable, "ra"},
+		{h.AuthenticData, "ad"},
+		{h.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(m.Questions), len(m.Answers), len(m.Authorities), len(m.Additionals))
+
+	if opt != nil {
+		fmt.Fprintf(w, "\n;; OPT PSEUDOSECTION:\n")
+		optFlags := ""
+		if opt.Header.DNSSECAllowed() {
+			optFlags = " do"
+		}
+		version := (opt.Header.TTL >> 16) & 0xff
+		fmt.Fprintf(w, "; EDNS: version: %d, flags:%s; udp: %d\n", version, optFlags, opt.Header.Class)
+		if body, ok := opt.Body.(*dnsmessage.OPTResource); ok {
+			for _, o := range body.Options {
+				fmt.Fprintf(w, "; %s\n", formatOption(o))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n;; QUESTION SECTION:\n")
+	for _, q := range m.Questions {
+		fmt.Fprintf(w, ";%s\t\t%s\t%s\n", q.Name, classString(q.Class), dnsnames.Type(q.Type))
+	}
+	for _, s := range []struct {
+		name string
+		rs   []dnsmessage.Resource
+	}{
+		{"ANSWER", m.Answers},
+		{"AUTHORITY", m.Authorities},
+		{"ADDITIONAL", m.Additionals},
+	} {
+		var lines []string
+		for i := range s.rs {
+			if s.rs[i].Header.Type != dnsmessage.TypeOPT {
+				lines = append(lines, formatRR(&s.rs[i]))
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", s.name)
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+		}
+	}
+}
+
+// formatOption returns a description of the EDNS(0) option o.
+func formatOption(o dnsmessage.Option) string {
+	switch o.Code {
+	case optionCodeNSID:
+		return fmt.Sprintf("NSID: %s (%s)", hex.EncodeToString(o.Data), quote(string(o.Data)))
+	case optionCodeClientSubnet:
+		if len(o.Data) >= 4 {
+			family := binary.BigEndian.Uint16(o.Data)
+			ip := make(net.IP, net.IPv6len)
+			if family == 1 {
+				ip = make(net.IP, net.IPv4len)
+			}
+			copy(ip, o.Data[4:])
+			return fmt.Sprintf("CLIENT-SUBNET: %v/%d/%d", ip, o.Data[2], o.Data[3])
+		}
+	case optionCodeCookie:
+		return "COOKIE: " + hex.EncodeToString(o.Data)
+	}
+	return fmt.Sprintf("OPT=%d: %s", o.Code, hex.EncodeToString(o.Data))
+}
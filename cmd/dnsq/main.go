@@ -0,0 +1,312 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command dnsq sends a DNS query and prints the response, in the style of dig.
+//
+// Usage:
+//
+//	dnsq [@server] [name] [type] [+option...]
+//
+// The name defaults to the root and the type to A. The server defaults to the
+// first name server in /etc/resolv.conf, and may include a port. The options
+// are:
+//
+//	+tcp            send the query over TCP
+//	+tls            send the query over TLS (DoT)
+//	+https[=path]   send the query over HTTPS (DoH), to path /dns-query by default
+//	+[no]rec        set the recursion desired bit (default on)
+//	+cd             set the checking disabled bit
+//	+dnssec         set the DNSSEC OK bit
+//	+bufsize=N      advertise an EDNS(0) UDP payload size of N
+//	+subnet=A/N     send an EDNS(0) client subnet option
+//	+ignore         don't retry truncated UDP responses over TCP
+//	+timeout=T      wait up to T for the response, such as 5s (default 5s)
+//	+tls-hostname=H verify the server's certificate for host H
+//	+insecure       don't verify the server's certificate
+//	+short          print only the answer record data
+//
+// For example:
+//
+//	dnsq @1.1.1.1 example.com AAAA +tls +dnssec
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/internal/dnsnames"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dnsq: ")
+	q, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dnsq: %v\nusage: %s [@server] [name] [type] [+option...]\n", err, os.Args[0])
+		os.Exit(2)
+	}
+	if q.server == "" {
+		q.server = systemServer()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	start := time.Now()
+	resp, err := exchange(ctx, q)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Fatalf("querying %s: %v", q.address(), err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		log.Fatalf("parsing response from %s: %v", q.address(), err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if q.short {
+		printShort(w, &m)
+	} else {
+		printMessage(w, &m)
+		printFooter(w, q, elapsed, start, len(resp))
+	}
+	w.Flush()
+}
+
+// parseArgs parses dig-style command line arguments.
+func parseArgs(args []string) (*query, error) {
+	q := &query{
+		transport: transportUDP,
+		path:      "/dns-query",
+		recursion: true,
+		timeout:   5 * time.Second,
+		tlsConfig: &tls.Config{},
+	}
+	var name string
+	var haveName, haveType bool
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			q.server = arg[1:]
+		case strings.HasPrefix(arg, "+"):
+			if err := q.setOption(arg[1:]); err != nil {
+				return nil, err
+			}
+		case !haveType && isType(arg):
+			q.question.Type, _ = dnsnames.ParseType(arg)
+			haveType = true
+		case strings.EqualFold(arg, "IN"):
+			// The only supported class.
+		case !haveName:
+			name, haveName = arg, true
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+
+	if !haveType {
+		q.question.Type = dnsmessage.TypeA
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name %q: %v", name, err)
+	}
+	q.question.Name = n
+	q.question.Class = dnsmessage.ClassINET
+	return q, nil
+}
+
+// isType reports whether s is the name of a type. As with dig, the first
+// argument spelled like a type is taken to be the type, not the name.
+func isType(s string) bool {
+	_, err := dnsnames.ParseType(s)
+	return err == nil
+}
+
+// setOption sets the option opt, given without its leading '+'.
+func (q *query) setOption(opt string) error {
+	key, value := opt, ""
+	hasValue := false
+	if i := strings.IndexByte(opt, '='); i >= 0 {
+		key, value, hasValue = opt[:i], opt[i+1:], true
+	}
+	on := true
+	if strings.HasPrefix(key, "no") {
+		key, on = key[2:], false
+	}
+	noValue := func() error {
+		if hasValue {
+			return fmt.Errorf("option +%s doesn't take a value", key)
+		}
+		return nil
+	}
+
+	var err error
+	switch key {
+	case "tcp", "vc":
+		err = noValue()
+		q.setTransport(transportTCP, on)
+	case "tls":
+		err = noValue()
+		q.setTransport(transportTLS, on)
+	case "https":
+		q.setTransport(transportHTTPS, on)
+		if hasValue && value != "" {
+			q.path = value
+			if !strings.HasPrefix(q.path, "/") {
+				q.path = "/" + q.path
+			}
+		}
+	case "rec", "recurse":
+		err = noValue()
+		q.recursion = on
+	case "cd", "cdflag":
+		err = noValue()
+		q.checking = on
+	case "dnssec":
+		err = noValue()
+		q.dnssec = on
+	case "ignore":
+		err = noValue()
+		q.ignoreTruncation = on
+	case "short":
+		err = noValue()
+		q.short = on
+	case "insecure":
+		err = noValue()
+		q.tlsConfig.InsecureSkipVerify = on
+	case "bufsize":
+		if !on {
+			q.bufsize = 0
+			break
+		}
+		var n int
+		if n, err = strconv.Atoi(value); err != nil || n < 512 || n > 65535 {
+			err = fmt.Errorf("invalid +bufsize %q, want a size from 512 to 65535", value)
+		}
+		q.bufsize = n
+	case "subnet":
+		if !on {
+			q.subnet = nil
+			break
+		}
+		q.subnet, err = parseSubnet(value)
+	case "timeout":
+		var d time.Duration
+		if d, err = parseTimeout(value); err == nil {
+			q.timeout = d
+		}
+	case "tls-hostname":
+		q.tlsConfig.ServerName = value
+	default:
+		err = fmt.Errorf("unknown option +%s", opt)
+	}
+	return err
+}
+
+// setTransport selects transport t, or reverts to UDP if t is turned off.
+func (q *query) setTransport(t string, on bool) {
+	if on {
+		q.transport = t
+	} else if q.transport == t {
+		q.transport = transportUDP
+	}
+}
+
+// parseSubnet parses a client subnet given as an address, with an optional
+// prefix length.
+func parseSubnet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid +subnet %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid +subnet %q", s)
+	}
+	if ip4 := n.IP.To4(); ip4 != nil {
+		n.IP = ip4
+	}
+	return n, nil
+}
+
+// parseTimeout parses a timeout given either as a duration or, like dig, as
+// a number of seconds.
+func parseTimeout(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid +timeout %q", s)
+	}
+	return d, nil
+}
+
+// systemServer returns the first name server in /etc/resolv.conf, or the
+// loopback address if there is none.
+func systemServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer f.Close()
+	if s, err := firstNameserver(f); err == nil {
+		return s
+	}
+	return "127.0.0.1"
+}
+
+// firstNameserver returns the first name server in the resolv.conf file r.
+func firstNameserver(r io.Reader) (string, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			return fields[1], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errNoNameserver
+}
+
+var errNoNameserver = errors.New("no nameserver")
+
+// printShort writes the record data of the answers in m to w.
+func printShort(w io.Writer, m *dnsmessage.Message) {
+	for _, a := range m.Answers {
+		fmt.Fprintln(w, formatRData(a.Body))
+	}
+}
+
+// printFooter writes the statistics of a query to w.
+func printFooter(w io.Writer, q *query, elapsed time.Duration, start time.Time, size int) {
+	transport := strings.ToUpper(q.transport)
+	fmt.Fprintf(w, "\n;; Query time: %v\n", elapsed.Round(time.Microsecond))
+	fmt.Fprintf(w, ";; SERVER: %s (%s)\n", q.address(), transport)
+	fmt.Fprintf(w, ";; WHEN: %s\n", start.Format(time.RFC1123))
+	fmt.Fprintf(w, ";; MSG SIZE  rcvd: %d\n", size)
+}
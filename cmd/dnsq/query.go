@@ -0,0 +1,276 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/internal/dnsexchange"
+)
+
+// Transports.
+const (
+	transportUDP   = "udp"
+	transportTCP   = "tcp"
+	transportTLS   = "tls"
+	transportHTTPS = "https"
+)
+
+// defaultPorts are the default server ports of each transport.
+var defaultPorts = map[string]string{
+	transportUDP:   "53",
+	transportTCP:   "53",
+	transportTLS:   "853",
+	transportHTTPS: "443",
+}
+
+// dohContentType is the media type of DNS messages in DoH, RFC 8484.
+const dohContentType = "application/dns-message"
+
+// A query describes a query and how to send it.
+type query struct {
+	// server is the host, and optionally port, of the server.
+	server string
+
+	// transport is one of the transport constants.
+	transport string
+
+	// path is the path of the DoH URI template.
+	path string
+
+	question dnsmessage.Question
+
+	recursion bool
+	checking  bool
+	dnssec    bool
+
+	// bufsize is the advertised EDNS(0) UDP payload size. If zero, and
+	// neither dnssec nor subnet is set, EDNS(0) isn't used.
+	bufsize int
+
+	// subnet is the EDNS(0) client subnet, RFC 7871.
+	subnet *net.IPNet
+
+	// ignoreTruncation disables retrying truncated UDP responses over TCP.
+	ignoreTruncation bool
+
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	// short prints only the answer record data.
+	short bool
+}
+
+// address returns the address of the server, including the default port of
+// the transport if none was given.
+func (q *query) address() string {
+	if _, _, err := net.SplitHostPort(q.server); err == nil {
+		return q.server
+	}
+	return net.JoinHostPort(strings.Trim(q.server, "[]"), defaultPorts[q.transport])
+}
+
+// edns reports whether the query includes an OPT record.
+func (q *query) edns() bool {
+	return q.dnssec || q.bufsize > 0 || q.subnet != nil
+}
+
+// pack appends the query message with ID id to buf.
+func (q *query) pack(buf []byte, id uint16) ([]byte, error) {
+	b := dnsmessage.NewBuilder(buf, dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: q.recursion,
+		CheckingDisabled: q.checking,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q.question); err != nil {
+		return nil, err
+	}
+	if q.edns() {
+		if err := b.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		bufsize := q.bufsize
+		if bufsize == 0 {
+			bufsize = 1232
+		}
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(bufsize, dnsmessage.RCodeSuccess, q.dnssec); err != nil {
+			return nil, err
+		}
+		var opt dnsmessage.OPTResource
+		if q.subnet != nil {
+			opt.Options = append(opt.Options, clientSubnetOption(q.subnet))
+		}
+		if err := b.OPTResource(h, opt); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// clientSubnetOption returns the EDNS(0) client subnet option for n, RFC 7871,
+// section 6.
+func clientSubnetOption(n *net.IPNet) dnsmessage.Option {
+	family, ip := uint16(2), n.IP.To16()
+	if ip4 := n.IP.To4(); ip4 != nil {
+		family, ip = 1, ip4
+	}
+	prefix, _ := n.Mask.Size()
+	data := make([]byte, 4, 4+len(ip))
+	binary.BigEndian.PutUint16(data, family)
+	data[2] = byte(prefix) // Source prefix length; the scope is zero.
+	data = append(data, ip.Mask(net.CIDRMask(prefix, 8*len(ip)))[:(prefix+7)/8]...)
+	return dnsmessage.Option{Code: optionCodeClientSubnet, Data: data}
+}
+
+// exchange sends q and returns the raw response.
+func exchange(ctx context.Context, q *query) ([]byte, error) {
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
+	switch q.transport {
+	case transportUDP:
+		resp, err := exchangeUDP(ctx, q)
+		if err != nil || q.ignoreTruncation {
+			return resp, err
+		}
+		var p dnsmessage.Parser
+		if h, err := p.Start(resp); err == nil && h.Truncated {
+			return exchangeStream(ctx, q, transportTCP)
+		}
+		return resp, nil
+	case transportTCP, transportTLS:
+		return exchangeStream(ctx, q, q.transport)
+	case transportHTTPS:
+		return exchangeHTTPS(ctx, q)
+	}
+	return nil, fmt.Errorf("unknown transport %q", q.transport)
+}
+
+// checkResponse returns an error if resp isn't a response to a query with
+// ID id.
+func checkResponse(resp []byte, id uint16) error {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return err
+	}
+	if !h.Response || h.ID != id {
+		return dnsexchange.ErrMismatch
+	}
+	return nil
+}
+
+func exchangeUDP(ctx context.Context, q *query) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", q.address())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	b, err := q.pack(nil, uint16(rand.Uint32()))
+	if err != nil {
+		return nil, err
+	}
+	return dnsexchange.Exchange(c, b, false, nil)
+}
+
+// exchangeStream sends q over TCP or TLS.
+func exchangeStream(ctx context.Context, q *query, transport string) ([]byte, error) {
+	var d net.Dialer
+	addr := q.address()
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if transport == transportTLS {
+		config := q.tlsConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(c, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	b, err := q.pack(nil, uint16(rand.Uint32()))
+	if err != nil {
+		return nil, err
+	}
+	return dnsexchange.Exchange(c, b, true, nil)
+}
+
+// exchangeHTTPS sends q as a DoH POST request, RFC 8484, section 4.1.
+func exchangeHTTPS(ctx context.Context, q *query) ([]byte, error) {
+	// The ID should be zero to make responses cacheable, RFC 8484,
+	// section 4.1.
+	b, err := q.pack(nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	url := "https://" + q.address() + q.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   q.tlsConfig,
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		return nil, fmt.Errorf("%s: unexpected content type %q", url, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, math.MaxUint16+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > math.MaxUint16 {
+		return nil, fmt.Errorf("%s: response too large", url)
+	}
+	return body, checkResponse(body, 0)
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command dnsreplay replays the DNS queries captured in a pcap file against a
+// DNS server and reports the responses which don't match those captured.
+//
+// Usage:
+//
+//	dnsreplay [flags] capture.pcap
+//
+// The capture can be taken with tcpdump, or written by a dnspcap.Writer used
+// as the QueryLogger of a dnsserver.Server. For example:
+//
+//	dnsreplay -server 127.0.0.1:53 -speed 2 -w replay.pcap capture.pcap
+//
+// replays the queries in capture.pcap twice as fast as they were captured and
+// records the replayed queries and their responses in replay.pcap.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnspcap"
+)
+
+var (
+	server      = flag.String("server", "127.0.0.1:53", "address of the DNS `server` to replay the queries to")
+	speed       = flag.Float64("speed", 1, "`factor` by which to speed up the captured timing, or a negative value to replay as fast as possible")
+	timeout     = flag.Duration("timeout", 5*time.Second, "maximum time to wait for each response")
+	maxInFlight = flag.Int("c", 256, "maximum `number` of queries awaiting a response")
+	output      = flag.String("w", "", "optionally record the replayed queries and responses to pcap `file`")
+	quiet       = flag.Bool("q", false, "only print the summary")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] capture.pcap\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dnsreplay: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	res, err := run(ctx, os.Stdout, flag.Arg(0))
+	printSummary(os.Stdout, res)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if res.Mismatched > 0 {
+		os.Exit(1)
+	}
+}
+
+// replayConfig returns the replay configuration given by the flags, which
+// prints mismatches to w unless -q is set.
+func replayConfig(w io.Writer) dnspcap.ReplayConfig {
+	config := dnspcap.ReplayConfig{
+		Address:     *server,
+		Speed:       *speed,
+		Timeout:     *timeout,
+		MaxInFlight: *maxInFlight,
+	}
+	if !*quiet {
+		config.Mismatch = func(m *dnspcap.Mismatch) {
+			printMismatch(w, m)
+		}
+	}
+	return config
+}
+
+// run replays the queries captured in the file at path as configured by the
+// flags.
+func run(ctx context.Context, w io.Writer, path string) (dnspcap.ReplayResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return dnspcap.ReplayResult{}, err
+	}
+	defer f.Close()
+	r, err := dnspcap.NewReader(f)
+	if err != nil {
+		return dnspcap.ReplayResult{}, fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	config := replayConfig(w)
+	var pw *dnspcap.Writer
+	if *output != "" {
+		out, err := os.Create(*output)
+		if err != nil {
+			return dnspcap.ReplayResult{}, err
+		}
+		if pw, err = dnspcap.NewWriter(out); err != nil {
+			out.Close()
+			return dnspcap.ReplayResult{}, fmt.Errorf("writing %s: %v", *output, err)
+		}
+		config.QueryLogger = pw
+	}
+
+	res, err := dnspcap.Replay(ctx, r, config)
+	if pw != nil {
+		if err := pw.Close(); err != nil {
+			log.Printf("writing %s: %v", *output, err)
+		}
+	}
+	return res, err
+}
+
+// printSummary prints the counts of res.
+func printSummary(w io.Writer, res dnspcap.ReplayResult) {
+	fmt.Fprintf(w, "%d queries: %d matched, %d mismatched (%d errors), %d without captured response\n",
+		res.Queries, res.Matched, res.Mismatched, res.Errors, res.Uncaptured)
+}
+
+// printMismatch prints a description of m to w.
+func printMismatch(w io.Writer, m *dnspcap.Mismatch) {
+	question := "?"
+	var p dnsmessage.Parser
+	if _, err := p.Start(m.Query.Payload); err == nil {
+		if q, err := p.Question(); err == nil {
+			question = fmt.Sprintf("%v %v", q.Name, q.Type)
+		}
+	}
+	fmt.Fprintf(w, "%s %s from %v: %s\n", m.Query.Time.Format(time.RFC3339Nano), question, m.Query.Source, m.Reason)
+}
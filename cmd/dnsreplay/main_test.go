@@ -0,0 +1,180 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnspcap"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+// setFlags sets the flags given as name, value pairs until the test ends.
+func setFlags(t *testing.T, nameValues ...string) {
+	t.Helper()
+	for i := 0; i < len(nameValues); i += 2 {
+		f := flag.Lookup(nameValues[i])
+		old := f.Value.String()
+		if err := flag.Set(f.Name, nameValues[i+1]); err != nil {
+			t.Fatalf("flag.Set(%q, %q) = %v", f.Name, nameValues[i+1], err)
+		}
+		t.Cleanup(func() { flag.Set(f.Name, old) })
+	}
+}
+
+func TestReplayConfig(t *testing.T) {
+	setFlags(t, "server", "192.0.2.1:5353", "speed", "-1", "timeout", "2s", "c", "8")
+	config := replayConfig(nil)
+	if config.Address != "192.0.2.1:5353" || config.Speed != -1 || config.Timeout != 2*time.Second || config.MaxInFlight != 8 {
+		t.Errorf("got replayConfig(...) = %+v", config)
+	}
+	if config.Mismatch == nil {
+		t.Error("got nil Mismatch, want mismatches printed")
+	}
+
+	setFlags(t, "q", "true")
+	if config := replayConfig(nil); config.Mismatch != nil {
+		t.Error("got Mismatch with -q, want only the summary")
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	var buf bytes.Buffer
+	printSummary(&buf, dnspcap.ReplayResult{Queries: 5, Matched: 2, Mismatched: 2, Errors: 1, Uncaptured: 1})
+	if got, want := buf.String(), "5 queries: 2 matched, 2 mismatched (1 errors), 1 without captured response\n"; got != want {
+		t.Errorf("got summary = %q, want = %q", got, want)
+	}
+}
+
+// testMessage returns a packed query for name or, if answer is non-nil, a
+// response to it answering answer.
+func testMessage(t *testing.T, id uint16, name string, answer []byte) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	if answer != nil {
+		m.Header.Response = true
+		var a [4]byte
+		copy(a[:], answer)
+		m.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 5},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal("Pack() =", err)
+	}
+	return b
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	capture := filepath.Join(dir, "capture.pcap")
+	f, err := os.Create(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := dnspcap.NewWriter(f)
+	if err != nil {
+		t.Fatal("NewWriter(...) =", err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 53}
+	now := time.Now()
+	for i, name := range []string{"match.example.", "mismatch.example."} {
+		q := testMessage(t, uint16(i), name, nil)
+		w.LogQuery(&dnsserver.QueryLog{
+			Source:       client,
+			Local:        server,
+			Query:        q,
+			QueryTime:    now,
+			Response:     testMessage(t, uint16(i), name, []byte{127, 0, 0, byte(i)}),
+			ResponseTime: now,
+		})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+
+	resolver := dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+		return dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: []dnsmessage.Question{q},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 5},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 0}},
+			}},
+		}, true
+	})
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, resolver)
+	if err != nil {
+		t.Fatal("NewPacketResolver(...) =", err)
+	}
+	srv, err := dnsserver.New(dnsserver.Config{Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("dnsserver.New(...) =", err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.ServeUDP(pc)
+		close(done)
+	}()
+	defer func() {
+		pc.Close()
+		<-done
+		srv.Wait()
+	}()
+
+	replayed := filepath.Join(dir, "replay.pcap")
+	setFlags(t, "server", pc.LocalAddr().String(), "speed", "-1", "timeout", "1s", "w", replayed)
+	var out bytes.Buffer
+	res, err := run(context.Background(), &out, capture)
+	if err != nil {
+		t.Fatal("run(...) =", err)
+	}
+	if want := (dnspcap.ReplayResult{Queries: 2, Matched: 1, Mismatched: 1}); res != want {
+		t.Errorf("got run(...) = %+v, want = %+v", res, want)
+	}
+	if got := out.String(); !strings.Contains(got, "mismatch.example. TypeA from 192.0.2.1:1234") || strings.Count(got, "\n") != 1 {
+		t.Errorf("got output = %q, want one line for mismatch.example.", got)
+	}
+
+	f, err = os.Open(replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := dnspcap.NewReader(f)
+	if err != nil {
+		t.Fatal("NewReader(...) =", err)
+	}
+	var packets int
+	for {
+		if _, err := r.Next(); err != nil {
+			break
+		}
+		packets++
+	}
+	if packets != 4 {
+		t.Errorf("got %d replayed packets, want 4 queries and responses", packets)
+	}
+}
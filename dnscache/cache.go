@@ -4,6 +4,10 @@
 
 // Package dnscache provides a basic DNS cache.
 //
+// Positive responses are cached as individual RRsets, so that data learned
+// from one response, such as a CNAME chain, can be used to answer other
+// questions. Negative responses are cached as whole messages.
+//
 // The cache is currently case-sensitive. This may change in the future.
 //
 // The caching behavior of DNS resolvers is spread across multiple RFCs on how
@@ -13,6 +17,9 @@
 //  - https://www.ietf.org/rfc/rfc1034.txt
 //  - https://www.ietf.org/rfc/rfc1035.txt
 //  - https://www.ietf.org/rfc/rfc2308.txt (negative caching)
+//  - https://tools.ietf.org/html/rfc8020 (NXDOMAIN cut)
+//  - https://tools.ietf.org/html/rfc8198 (aggressive use of NSEC/NSEC3)
+//  - https://tools.ietf.org/html/rfc2181#section-5.4.1 (ranking data)
 //  - https://tools.ietf.org/html/rfc2181#section-7 (SOA TTLs)
 //  - https://tools.ietf.org/html/rfc2181#section-8
 //  - https://tools.ietf.org/html/rfc1123#section-6.1.2.1
@@ -22,6 +29,7 @@ package dnscache
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"math"
 	"math/rand"
@@ -30,34 +38,146 @@ import (
 
 	"github.com/iangudger/dns/dnsmessage"
 	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnstrace"
 )
 
 const (
 	defaultMaxTTL = 3600 // in seconds.
+
+	// maxCNAMEChain is the maximum number of CNAME records that will be
+	// followed when assembling an answer from cached RRsets.
+	maxCNAMEChain = 8
+
+	// defaultFailureTTL is the default amount of time (in seconds) that
+	// failures are cached for.
+	defaultFailureTTL = 5
+
+	// maxFailureTTL is the maximum amount of time (in seconds) that
+	// failures may be cached for.
+	//
+	// From RFC 2308, section 7.1:
+	// In either case a resolver MAY cache a server failure response.  If
+	// it does so it MUST NOT cache it for longer than five (5) minutes,
+	// and it MUST be cached against the specific query tuple <query name,
+	// type, class, server IP address>.
+	maxFailureTTL = 300
 )
 
-// A cacheKey contains the arguments for the resolver.
+// An entryKind is a kind of cache entry.
+type entryKind uint8
+
+const (
+	// rrsetEntry is an entry holding an RRset.
+	rrsetEntry entryKind = iota
+
+	// negativeEntry is an entry holding a negative response.
+	negativeEntry
+
+	// nsecEntry is an entry holding a validated NSEC or NSEC3 record
+	// used to synthesize negative responses (RFC 8198).
+	nsecEntry
+
+	// nxdomainEntry is an entry holding an NXDOMAIN response which
+	// denies the existence of a name and every name below it
+	// (RFC 8020). The key's question has a zero Type.
+	nxdomainEntry
+
+	// failureEntry is an entry recording a server failure or that the
+	// nested resolver did not respond (RFC 2308, section 7).
+	failureEntry
+)
+
+// A cacheKey identifies an entry in the cache.
+//
+// Unlike whole responses, RRsets don't depend on whether recursion was desired
+// for the question that returned them, so the RecursionDesired bit is not part
+// of the key. Responses built from the cache copy the bit from the question,
+// and the RecursionAvailable bit from the cached entry.
 type cacheKey struct {
-	question         dnsmessage.Question
-	recursionDesired bool
+	// question holds the owner name, type and class of a cached RRset or
+	// NSEC/NSEC3 record, the ANY Question which a cached set of all the
+	// RRsets of a name answers, the Question which a cached negative response
+	// answers, or the name and class denied by a cached NXDOMAIN response.
+	question dnsmessage.Question
+
+	// kind is the kind of entry.
+	kind entryKind
 }
 
-// A cacheEntry is an entry in the DNS cache, it stores the actual DNS
-// response, an expiration time and the creation time of the entry.
+// A trustRank ranks the trustworthiness of cached data in accordance with
+// RFC 2181, section 5.4.1. Higher values are more trustworthy.
+type trustRank uint8
+
+const (
+	// rankAdditional is used for data from the additional section and
+	// from the authority section of a non-authoritative answer.
+	//
+	// From RFC 2181, section 5.4.1:
+	// Unauthenticated RRs received and cached from the least trustworthy
+	// of those groupings ... should not be cached in such a way that they
+	// would ever be returned as answers to a received query.
+	rankAdditional trustRank = iota
+
+	// rankAnswer is used for data from the answer section of a
+	// non-authoritative answer, and non-authoritative data from the answer
+	// section of an authoritative answer.
+	rankAnswer
+
+	// rankAuthAuthority is used for data from the authority section of an
+	// authoritative answer.
+	rankAuthAuthority
+
+	// rankAuthAnswer is used for authoritative data included in the answer
+	// section of an authoritative answer.
+	rankAuthAnswer
+)
+
+// A cacheEntry is an entry in the DNS cache. It stores either an RRset or a
+// negative DNS response, an expiration time and the creation time of the
+// entry.
 type cacheEntry struct {
 	cacheListEntry
 
 	// key is the key associated with this entry.
 	key cacheKey
 
-	// msg is the cached DNS response.
+	// rrs is the cached RRset. For NSEC entries, it holds the NSEC or
+	// NSEC3 record followed by any covering RRSIG records. It is not used
+	// for negative entries.
+	rrs []dnsmessage.Resource
+
+	// rank is the trustworthiness of rrs.
+	rank trustRank
+
+	// recursionAvailable is the RecursionAvailable bit of the response
+	// that rrs was taken from.
+	recursionAvailable bool
+
+	// authenticData is the AuthenticData bit of the response that rrs was
+	// taken from.
+	authenticData bool
+
+	// sigs holds the RRSIG records covering rrs from the answer section
+	// of the response that rrs was taken from. It is only used for RRset
+	// entries.
+	sigs []dnsmessage.Resource
+
+	// msg is the cached DNS response. It is only used for negative and
+	// failure entries.
 	msg dnsmessage.Message
 
-	// negative indicates that this is a negative cache entry.
-	negative bool
+	// noResponse indicates that a failure entry records that the nested
+	// resolver did not respond, rather than a response.
+	noResponse bool
+
+	// zone is the zone an NSEC entry belongs to.
+	zone *nsecZone
+
+	// hash is the hashed owner name of an NSEC3 entry.
+	hash []byte
 
-	// expires indicates the time after which this response must not be
-	// returned.
+	// expires indicates the time after which this entry must not be
+	// used.
 	expires time.Time
 
 	// created is the time when this entry was cached. This is used to
@@ -65,7 +185,8 @@ type cacheEntry struct {
 	created time.Time
 }
 
-// A cachingResolver caches successful DNS responses.
+// A cachingResolver caches RRsets from successful DNS responses and,
+// optionally, negative DNS responses and failures.
 type cachingResolver struct {
 	// config contains configuration options.
 	config Config
@@ -73,15 +194,22 @@ type cachingResolver struct {
 	// mu protects m and l below.
 	mu sync.Mutex
 
-	// m is the cache used to store DNS responses.
+	// m is the cache used to store RRsets and negative responses.
 	m map[cacheKey]*cacheEntry
 
 	// l is an LRU queue.
 	l cacheListList
 
+	// zones indexes NSEC entries by zone.
+	zones map[nsecZoneKey]*nsecZone
+
 	// nested is the nested resolver to which we defer all queries which
 	// cannot be served by the cache.
 	nested dnsresolver.Resolver
+
+	// randMu protects config.rand, which is not safe for concurrent use.
+	// It may be acquired while holding mu.
+	randMu sync.Mutex
 }
 
 // adjustTTL deducts elapsed from the TTL of each Resource. In case where for a
@@ -174,37 +302,158 @@ func reorderMsg(msg *dnsmessage.Message, f func([]dnsmessage.Resource, []int, *r
 	f(msg.Answers, pos[3*off:3*off+typeNS], rnd)
 }
 
-// lookup checks the cache for a matching cached entry. It adjusts the TTLs of
-// the cached records.
-func (c *cachingResolver) lookup(question dnsmessage.Question, recursionDesired bool) (msg dnsmessage.Message, ok bool) {
-	c.mu.Lock()
-	key := cacheKey{question, recursionDesired}
+// isReordered reports whether RRsets of type t are reordered.
+func isReordered(t dnsmessage.Type) bool {
+	switch t {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeMX, dnsmessage.TypeNS:
+		return true
+	default:
+		return false
+	}
+}
+
+// get returns the unexpired entry for key and moves it to the front of the
+// LRU queue. Expired entries are removed.
+//
+// c.mu must be held.
+func (c *cachingResolver) get(key cacheKey, now time.Time) *cacheEntry {
 	e, ok := c.m[key]
 	if !ok {
-		c.mu.Unlock()
-		return dnsmessage.Message{}, false
+		return nil
 	}
-
-	now := c.config.now()
 	if now.After(e.expires) {
-		delete(c.m, key)
-		c.l.Remove(e)
-		c.mu.Unlock()
-		return dnsmessage.Message{}, false
+		c.remove(e)
+		return nil
 	}
 
 	// Move the entry to the front of LRU queue.
 	c.l.Remove(e)
 	c.l.PushFront(e)
+	return e
+}
 
-	// Compute elapsed while holding entry lock.
-	elapsed := now.Sub(e.created)
-
-	if c.config.Reordering == RotationReordering {
+// getRRset returns the RRset for question if it can be used as an answer.
+//
+// c.mu must be held.
+func (c *cachingResolver) getRRset(question dnsmessage.Question, now time.Time) *cacheEntry {
+	e := c.get(cacheKey{question: question}, now)
+	if e == nil || e.rank < rankAnswer {
+		return nil
+	}
+	if c.config.Reordering == RotationReordering && isReordered(question.Type) {
 		// Rotate the A, AAAA, MX and NS records so every IP address
 		// has an equal chance of appearing first within the lists of
 		// records of those types.
-		reorderMsg(&e.msg, rotateRecords, c.config.rand)
+		pos := make([]int, len(e.rrs))
+		for i := range pos {
+			pos[i] = i
+		}
+		rotateRecords(e.rrs, pos, c.config.rand)
+	}
+	return e
+}
+
+// appendRRset appends a copy of the RRset in e, followed by its covering RRSIG
+// records if dnssecOK is set, to rs with TTLs adjusted for the time elapsed
+// since e was cached.
+func appendRRset(rs []dnsmessage.Resource, e *cacheEntry, dnssecOK bool, now time.Time) []dnsmessage.Resource {
+	n := len(rs)
+	rs = append(rs, e.rrs...)
+	if dnssecOK {
+		rs = append(rs, e.sigs...)
+	}
+	adjustTTL(rs[n:], now.Sub(e.created), false)
+	return rs
+}
+
+// coveredType returns the type covered by r if it is an RRSIG record.
+func coveredType(r dnsmessage.Resource) (dnsmessage.Type, bool) {
+	u, ok := r.Body.(*dnsmessage.UnknownResource)
+	if !ok || u.Type != dnsmessage.TypeRRSIG || len(u.Data) < 2 {
+		return 0, false
+	}
+	return dnsmessage.Type(binary.BigEndian.Uint16(u.Data)), true
+}
+
+// wantsDNSSEC reports whether RRSIG records should be included in responses
+// built from the cache. If ctx doesn't say whether the DNSSEC OK bit was set,
+// they are included, as the nested resolver's response would have been
+// returned as is.
+func wantsDNSSEC(ctx context.Context) bool {
+	dnssecOK, ok := ctx.Value(dnsresolver.DNSSECOKContextKey).(bool)
+	return dnssecOK || !ok
+}
+
+// lookup checks the cache for an answer to question. Answers are assembled
+// from cached RRsets, following cached CNAME chains. If no answer can be
+// assembled, lookup checks for a cached negative response. It adjusts the
+// TTLs of the returned records.
+//
+// The AuthenticData bit of an assembled answer is only set if every RRset in
+// it was validated. If dnssecOK is set, the RRSIG records covering each RRset
+// follow it.
+func (c *cachingResolver) lookup(question dnsmessage.Question, recursionDesired, dnssecOK bool) (msg dnsmessage.Message, ok bool) {
+	c.mu.Lock()
+	now := c.config.now()
+
+	var (
+		answers            []dnsmessage.Resource
+		recursionAvailable bool
+		authenticData      = true
+		found              bool
+	)
+	q := question
+	for i := 0; ; i++ {
+		if e := c.getRRset(q, now); e != nil {
+			if i == 0 {
+				recursionAvailable = e.recursionAvailable
+			}
+			authenticData = authenticData && e.authenticData
+			answers = appendRRset(answers, e, dnssecOK, now)
+			found = true
+			break
+		}
+		if question.Type == dnsmessage.TypeCNAME || i == maxCNAMEChain {
+			break
+		}
+		e := c.getRRset(dnsmessage.Question{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: q.Class}, now)
+		if e == nil || len(e.rrs) == 0 {
+			break
+		}
+		cname, ok := e.rrs[0].Body.(*dnsmessage.CNAMEResource)
+		if !ok {
+			break
+		}
+		if i == 0 {
+			recursionAvailable = e.recursionAvailable
+		}
+		authenticData = authenticData && e.authenticData
+		answers = appendRRset(answers, e, dnssecOK, now)
+		q.Name = cname.CNAME
+	}
+
+	if found {
+		c.mu.Unlock()
+		m := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				Response:           true,
+				RecursionDesired:   recursionDesired,
+				RecursionAvailable: recursionAvailable,
+				AuthenticData:      authenticData,
+			},
+			Questions: []dnsmessage.Question{question},
+			Answers:   answers,
+		}
+		if c.config.Reordering == RandomReordering {
+			c.shuffle(&m)
+		}
+		return m, true
+	}
+
+	e := c.getNegative(question, now)
+	if e == nil {
+		c.mu.Unlock()
+		return dnsmessage.Message{}, false
 	}
 
 	// Make copies of the Resources as we are modifying them.
@@ -215,19 +464,73 @@ func (c *cachingResolver) lookup(question dnsmessage.Question, recursionDesired
 		Authorities: append([]dnsmessage.Resource(nil), e.msg.Authorities...),
 		Additionals: append([]dnsmessage.Resource(nil), e.msg.Additionals...),
 	}
+	elapsed := now.Sub(e.created)
 	c.mu.Unlock()
 
-	if c.config.Reordering == RandomReordering {
-		reorderMsg(&m, shuffleRecords, c.config.rand)
-	}
+	m.Header.RecursionDesired = recursionDesired
 
 	// Adjust the Resource TTLs.
 	adjustTTL(m.Answers, elapsed, false)
-	adjustTTL(m.Authorities, elapsed, e.negative)
+	adjustTTL(m.Authorities, elapsed, true)
 	adjustTTL(m.Additionals, elapsed, false)
 	return m, true
 }
 
+// getNegative returns the cached negative response for question, if any.
+//
+// c.mu must be held.
+func (c *cachingResolver) getNegative(question dnsmessage.Question, now time.Time) *cacheEntry {
+	if e := c.get(cacheKey{question: question, kind: negativeEntry}, now); e != nil {
+		return e
+	}
+
+	// From RFC 8020, section 2:
+	// When an iterative caching DNS resolver receives an NXDOMAIN response,
+	// it SHOULD store it in its cache and then all names and resource
+	// record sets (RRsets) at or below that node SHOULD be considered
+	// unreachable.
+	name := question.Name
+	for {
+		key := cacheKey{question: dnsmessage.Question{Name: name, Class: question.Class}, kind: nxdomainEntry}
+		if e := c.get(key, now); e != nil {
+			return e
+		}
+		if name.Labels() == 0 {
+			return nil
+		}
+		name = name.Parent()
+	}
+}
+
+// raiseTTL raises the TTL of each Resource to at least min.
+func raiseTTL(rs []dnsmessage.Resource, min uint32) {
+	for i := range rs {
+		if rs[i].Header.TTL < min {
+			rs[i].Header.TTL = min
+		}
+	}
+}
+
+// shuffle shuffles the records of each RRset in msg.
+func (c *cachingResolver) shuffle(msg *dnsmessage.Message) {
+	c.randMu.Lock()
+	reorderMsg(msg, shuffleRecords, c.config.rand)
+	c.randMu.Unlock()
+}
+
+// expiry returns the time at which an entry cached at now for ttl seconds
+// expires. If TTLJitter is set, the time is randomly brought forward so that
+// entries cached together don't all expire together.
+func (c *cachingResolver) expiry(now time.Time, ttl uint32) time.Time {
+	d := time.Duration(ttl) * time.Second
+	if c.config.TTLJitter > 0 {
+		c.randMu.Lock()
+		d -= time.Duration(c.config.rand.Int63n(int64(d)/100*int64(c.config.TTLJitter) + 1))
+		c.randMu.Unlock()
+	}
+	return now.Add(d)
+}
+
 // minTTL returns the minimum of prevMinTTL and the TTLs in each Resource.
 func minTTL(rs []dnsmessage.Resource, prevMinTTL uint32) uint32 {
 	minTTL := prevMinTTL
@@ -239,30 +542,208 @@ func minTTL(rs []dnsmessage.Resource, prevMinTTL uint32) uint32 {
 	return minTTL
 }
 
-// putResponse stores an entry in the cache.
-func (c *cachingResolver) putResponse(question dnsmessage.Question, recursionDesired bool, msg dnsmessage.Message) {
-	if len(msg.Answers) == 0 && len(msg.Authorities) == 0 && len(msg.Additionals) == 0 {
-		// Do not cache the response if there are no Resources.
+// An rrset is an RRset extracted from a DNS response.
+type rrset struct {
+	question dnsmessage.Question
+	rrs      []dnsmessage.Resource
+	sigs     []dnsmessage.Resource
+	rank     trustRank
+}
+
+// rrsetBuilder groups the Resources in a DNS response into RRsets.
+type rrsetBuilder struct {
+	sets []rrset
+	idx  map[dnsmessage.Question]int
+}
+
+// add adds r to the RRset with the same owner name, type and class.
+//
+// The first Resource of an RRset determines its rank. Later Resources with a
+// different rank are ignored, so that an RRset is never assembled from data of
+// different trustworthiness.
+func (b *rrsetBuilder) add(r dnsmessage.Resource, rank trustRank) {
+	if r.Header.Type == dnsmessage.TypeOPT {
+		// OPT pseudo-records are specific to a single message.
+		return
+	}
+	q := dnsmessage.Question{Name: r.Header.Name, Type: r.Header.Type, Class: r.Header.Class}
+	i, ok := b.idx[q]
+	if !ok {
+		if b.idx == nil {
+			b.idx = make(map[dnsmessage.Question]int)
+		}
+		b.idx[q] = len(b.sets)
+		b.sets = append(b.sets, rrset{question: q, rrs: []dnsmessage.Resource{r}, rank: rank})
 		return
 	}
+	if s := &b.sets[i]; s.rank == rank {
+		s.rrs = append(s.rrs, r)
+	}
+}
 
-	// Compute the minimum TTL from the returned RRs.
-	ttl := minTTL(msg.Answers, math.MaxUint32)
-	ttl = minTTL(msg.Authorities, ttl)
-	ttl = minTTL(msg.Additionals, ttl)
-	if ttl == 0 {
-		// Do not cache the response.
+// addSig adds the RRSIG record r to the signatures of the RRset it covers, if
+// there is one.
+func (b *rrsetBuilder) addSig(r dnsmessage.Resource) {
+	t, ok := coveredType(r)
+	if !ok {
 		return
 	}
+	if i, ok := b.idx[dnsmessage.Question{Name: r.Header.Name, Type: t, Class: r.Header.Class}]; ok {
+		b.sets[i].sigs = append(b.sets[i].sigs, r)
+	}
+}
+
+// responseRRsets splits a DNS response to question into ranked RRsets.
+//
+// Only Resources in the answer section which are part of the answer to
+// question, including any CNAME chain, are used from the answer section. The
+// RRSIG records covering them are kept with each RRset.
+func responseRRsets(question dnsmessage.Question, msg dnsmessage.Message) []rrset {
+	var b rrsetBuilder
+
+	// Follow the CNAME chain to find the relevant answers.
+	names := []dnsmessage.Name{question.Name}
+	for i := 0; i < maxCNAMEChain && question.Type != dnsmessage.TypeCNAME; i++ {
+		var next *dnsmessage.Name
+		for _, r := range msg.Answers {
+			if r.Header.Name != names[len(names)-1] || r.Header.Class != question.Class {
+				continue
+			}
+			if cname, ok := r.Body.(*dnsmessage.CNAMEResource); ok {
+				next = &cname.CNAME
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		names = append(names, *next)
+	}
 
-	if ttl > c.config.MaxTTL {
-		ttl = c.config.MaxTTL
+	for _, r := range msg.Answers {
+		if r.Header.Class != question.Class {
+			continue
+		}
+		if t := r.Header.Type; t != question.Type && t != dnsmessage.TypeCNAME && question.Type != dnsmessage.TypeALL {
+			continue
+		}
+		for i, n := range names {
+			if r.Header.Name != n {
+				continue
+			}
+			rank := rankAnswer
+			if msg.Header.Authoritative && i == 0 {
+				rank = rankAuthAnswer
+			}
+			b.add(r, rank)
+			break
+		}
+	}
+	if question.Type != dnsmessage.TypeRRSIG && question.Type != dnsmessage.TypeALL {
+		// Signatures may precede the RRsets they cover, so they are
+		// only attached once the RRsets have been assembled.
+		for _, r := range msg.Answers {
+			b.addSig(r)
+		}
 	}
-	c.put(question, recursionDesired, msg, ttl, false /* negative */)
+
+	if question.Type == dnsmessage.TypeALL {
+		// The cache can't tell from individual RRsets whether it holds
+		// every RRset of a name, so the answer to an ANY question is
+		// also cached as a whole, keyed by the question.
+		all := rrset{question: question, rank: rankAnswer}
+		if msg.Header.Authoritative {
+			all.rank = rankAuthAnswer
+		}
+		for _, r := range msg.Answers {
+			if r.Header.Name == question.Name && r.Header.Class == question.Class && r.Header.Type != dnsmessage.TypeOPT {
+				all.rrs = append(all.rrs, r)
+			}
+		}
+		if len(all.rrs) > 0 {
+			b.sets = append(b.sets, all)
+		}
+	}
+
+	authRank := rankAdditional
+	if msg.Header.Authoritative {
+		authRank = rankAuthAuthority
+	}
+	for _, r := range msg.Authorities {
+		b.add(r, authRank)
+	}
+	for _, r := range msg.Additionals {
+		b.add(r, rankAdditional)
+	}
+	return b.sets
+}
+
+// putResponse stores the RRsets from a DNS response in the cache.
+func (c *cachingResolver) putResponse(question dnsmessage.Question, msg dnsmessage.Message) {
+	sets := responseRRsets(question, msg)
+	if len(sets) == 0 {
+		// Do not cache the response if there are no Resources.
+		return
+	}
+
+	c.mu.Lock()
+	now := c.config.now()
+	for _, s := range sets {
+		// Compute the minimum TTL from the RRs. RFC 2181, section 5.2
+		// requires all RRs in an RRset to have the same TTL, but we
+		// can't rely on that.
+		ttl := minTTL(s.rrs, math.MaxUint32)
+		if ttl < c.config.MinTTL {
+			ttl = c.config.MinTTL
+		}
+		if ttl == 0 {
+			// Do not cache the RRset.
+			continue
+		}
+		if ttl > c.config.MaxTTL {
+			ttl = c.config.MaxTTL
+		}
+
+		// From RFC 2181, section 5.4.1:
+		// When considering whether to accept an RRSet in a reply, or
+		// retain an RRSet already in its cache instead, a server
+		// should consider the relative likely trustworthiness of the
+		// various data.
+		k := cacheKey{question: s.question}
+		if old := c.get(k, now); old != nil && old.rank > s.rank {
+			continue
+		}
+
+		// Make a copy of the Resources to store in cache as we don't
+		// want a concurrent request reading them while they are being
+		// packed by the goroutine that put them in the cache.
+		rrs := append([]dnsmessage.Resource(nil), s.rrs...)
+		sigs := append([]dnsmessage.Resource(nil), s.sigs...)
+		if c.config.ReturnMinTTL {
+			raiseTTL(rrs, c.config.MinTTL)
+			raiseTTL(sigs, c.config.MinTTL)
+		}
+		c.insert(&cacheEntry{
+			key:                k,
+			rrs:                rrs,
+			sigs:               sigs,
+			rank:               s.rank,
+			recursionAvailable: msg.Header.RecursionAvailable,
+			authenticData:      msg.Header.AuthenticData,
+			expires:            c.expiry(now, ttl),
+			created:            now,
+		})
+	}
+
+	// A positive response supersedes any negative response.
+	if e, ok := c.m[cacheKey{question: question, kind: negativeEntry}]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
 }
 
 // putNegativeResponse stores a negative DNS response in the cache.
-func (c *cachingResolver) putNegativeResponse(question dnsmessage.Question, recursionDesired bool, msg dnsmessage.Message) {
+func (c *cachingResolver) putNegativeResponse(question dnsmessage.Question, msg dnsmessage.Message) {
 	ttl := uint32(0)
 	// From RFC 2308, section 3:
 	// The TTL of this record is set from the minimum
@@ -284,8 +765,8 @@ func (c *cachingResolver) putNegativeResponse(question dnsmessage.Question, recu
 		return
 	}
 
-	if ttl > c.config.MaxTTL {
-		ttl = c.config.MaxTTL
+	if ttl > c.config.MaxNegativeTTL {
+		ttl = c.config.MaxNegativeTTL
 	}
 
 	// From RFC 2308, section 5:
@@ -296,13 +777,7 @@ func (c *cachingResolver) putNegativeResponse(question dnsmessage.Question, recu
 	// tunable.  Values of one to three hours have been found to work well
 	// and would make sensible a default.  Values exceeding one day have
 	// been found to be problematic.
-	c.put(question, recursionDesired, msg, ttl, true /* negative */)
-}
 
-// put stores an entry in the cache.
-//
-// negative means that the entry is a negative cache entry.
-func (c *cachingResolver) put(question dnsmessage.Question, recursionDesired bool, msg dnsmessage.Message, ttl uint32, negative bool) {
 	// Make copies of the Resources to store in cache as we don't want a
 	// concurrent request for the same Question reading them while they
 	// are being packed by the goroutine that put them in the cache.
@@ -310,53 +785,186 @@ func (c *cachingResolver) put(question dnsmessage.Question, recursionDesired boo
 	msg.Authorities = append([]dnsmessage.Resource(nil), msg.Authorities...)
 	msg.Additionals = append([]dnsmessage.Resource(nil), msg.Additionals...)
 
-	// Cache the copy of the response.
 	c.mu.Lock()
 	now := c.config.now()
-	k := cacheKey{question, recursionDesired}
-	e := cacheEntry{
-		key:      k,
-		msg:      msg,
-		expires:  now.Add(time.Duration(ttl) * time.Second),
-		created:  now,
-		negative: negative,
+	expires := c.expiry(now, ttl)
+	c.insert(&cacheEntry{
+		key:     cacheKey{question: question, kind: negativeEntry},
+		msg:     msg,
+		expires: expires,
+		created: now,
+	})
+
+	// An NXDOMAIN which follows a CNAME chain applies to the target of the
+	// chain rather than the name in question.
+	if msg.Header.RCode == dnsmessage.RCodeNameError && len(msg.Answers) == 0 {
+		c.insert(&cacheEntry{
+			key:     cacheKey{question: dnsmessage.Question{Name: question.Name, Class: question.Class}, kind: nxdomainEntry},
+			msg:     msg,
+			expires: expires,
+			created: now,
+		})
 	}
-	c.m[k] = &e
-	c.l.PushFront(&e)
+	c.mu.Unlock()
+}
 
-	// Evict an old entry if needed.
-	if c.config.MaxSize > 0 && len(c.m) > c.config.MaxSize {
-		evict := c.l.Back()
-		c.l.Remove(evict)
-		delete(c.m, evict.key)
+// putFailure records a failure to answer question in the cache. If msg is
+// nil, the nested resolver did not respond.
+func (c *cachingResolver) putFailure(question dnsmessage.Question, msg *dnsmessage.Message) {
+	e := &cacheEntry{key: cacheKey{question: question, kind: failureEntry}}
+	ttl := c.config.NoResponseTTL
+	if msg != nil {
+		// Only the header is kept. Any records in a server failure
+		// response are not to be trusted.
+		e.msg.Header = msg.Header
+		ttl = c.config.FailureTTL
+	} else {
+		e.noResponse = true
 	}
 
+	c.mu.Lock()
+	now := c.config.now()
+	e.expires = now.Add(time.Duration(ttl) * time.Second)
+	e.created = now
+	c.insert(e)
 	c.mu.Unlock()
 }
 
+// lookupFailure returns a cached failure to answer question. It returns
+// false for the second result if no failure is cached, and for the third
+// result if the cached failure is that the nested resolver did not respond.
+func (c *cachingResolver) lookupFailure(question dnsmessage.Question, recursionDesired bool) (msg dnsmessage.Message, found, ok bool) {
+	c.mu.Lock()
+	e := c.get(cacheKey{question: question, kind: failureEntry}, c.config.now())
+	if e == nil {
+		c.mu.Unlock()
+		return dnsmessage.Message{}, false, false
+	}
+	header := e.msg.Header
+	noResponse := e.noResponse
+	c.mu.Unlock()
+
+	if noResponse {
+		return dnsmessage.Message{}, true, false
+	}
+	header.RecursionDesired = recursionDesired
+	return dnsmessage.Message{
+		Header:    header,
+		Questions: []dnsmessage.Question{question},
+	}, true, true
+}
+
+// insert stores an entry in the cache, replacing any existing entry with the
+// same key.
+//
+// c.mu must be held.
+func (c *cachingResolver) insert(e *cacheEntry) {
+	if old, ok := c.m[e.key]; ok {
+		c.remove(old)
+	}
+	c.m[e.key] = e
+	c.l.PushFront(e)
+	c.config.Stats.AddEntries(1)
+
+	// Evict old entries if needed.
+	for c.config.MaxSize > 0 && len(c.m) > c.config.MaxSize {
+		c.remove(c.l.Back())
+		c.config.Stats.AddEviction()
+	}
+}
+
+// remove removes an entry from the cache.
+//
+// c.mu must be held.
+func (c *cachingResolver) remove(e *cacheEntry) {
+	c.l.Remove(e)
+	delete(c.m, e.key)
+	c.config.Stats.AddEntries(-1)
+	if e.zone != nil {
+		c.removeNSEC(e)
+	}
+}
+
 // Resolve implements dnsresolver.Resolver.Resolve.
 func (c *cachingResolver) Resolve(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
 	c.config.Stats.AddQuestion()
+	c.config.Stats.AddQuestionType(question.Type)
+	ctx, span := dnstrace.StartResolve(ctx, "dnscache.Resolve", question)
+	msg, ok := c.resolve(ctx, span, question, recursionDesired)
+	if ok {
+		c.config.Stats.AddResponseRCode(msg.Header.RCode)
+	}
+	dnstrace.EndResolve(span, msg, ok)
+	return msg, ok
+}
 
-	if msg, ok := c.lookup(question, recursionDesired); ok {
+// resolve answers question from the cache or the nested resolver, and records
+// how it was answered in span.
+func (c *cachingResolver) resolve(ctx context.Context, span dnstrace.Span, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	if msg, ok := c.lookup(question, recursionDesired, wantsDNSSEC(ctx)); ok {
 		c.config.Stats.AddAnswer()
+		span.SetAttributes(dnstrace.String(dnstrace.KeyCacheResult, "hit"))
 		return msg, true
 	}
 
+	if c.aggressiveNSEC() {
+		if msg, ok := c.synthesize(question, recursionDesired); ok {
+			c.config.Stats.AddSynthesized()
+			c.config.Stats.AddAnswer()
+			span.SetAttributes(dnstrace.String(dnstrace.KeyCacheResult, "synthesized"))
+			return msg, true
+		}
+	}
+
+	if c.config.EnableFailureCaching {
+		if msg, found, ok := c.lookupFailure(question, recursionDesired); found {
+			c.config.Stats.AddCachedFailure()
+			if ok {
+				c.config.Stats.AddAnswer()
+			}
+			span.SetAttributes(dnstrace.String(dnstrace.KeyCacheResult, "cached_failure"))
+			return msg, ok
+		}
+	}
+
+	span.SetAttributes(dnstrace.String(dnstrace.KeyCacheResult, "miss"))
+	start := c.config.now()
 	msg, ok := c.nested.Resolve(ctx, question, recursionDesired)
 	c.config.Stats.AddDeferral()
+	c.config.Stats.AddLatency(c.config.now().Sub(start))
+	if !ok || msg.Header.RCode == dnsmessage.RCodeServerFailure {
+		c.config.Stats.AddError()
+	}
 	if !ok {
+		// If the request was canceled or timed out, the nested resolver
+		// may not have had a chance to respond. Caching that would make
+		// one impatient client fail the question for everyone.
+		if c.config.EnableFailureCaching && ctx.Err() == nil {
+			c.putFailure(question, nil)
+		}
 		return dnsmessage.Message{}, false
 	}
 
 	if c.config.Reordering != NoReordering {
-		reorderMsg(&msg, shuffleRecords, c.config.rand)
+		c.shuffle(&msg)
+	}
+
+	if c.config.ReturnMinTTL && msg.Header.RCode == dnsmessage.RCodeSuccess {
+		// Copy the answers as they may be shared with the nested
+		// resolver.
+		msg.Answers = append([]dnsmessage.Resource(nil), msg.Answers...)
+		raiseTTL(msg.Answers, c.config.MinTTL)
 	}
 
 	if c.config.EnableNegativeCaching && isCacheableNegativeResponse(question, msg) {
-		c.putNegativeResponse(question, recursionDesired, msg)
+		c.putNegativeResponse(question, msg)
+		if c.aggressiveNSEC() {
+			c.putNSEC(msg)
+		}
 	} else if msg.Header.RCode == dnsmessage.RCodeSuccess {
-		c.putResponse(question, recursionDesired, msg)
+		c.putResponse(question, msg)
+	} else if msg.Header.RCode == dnsmessage.RCodeServerFailure && c.config.EnableFailureCaching {
+		c.putFailure(question, &msg)
 	}
 
 	return msg, true
@@ -387,9 +995,44 @@ type Config struct {
 	Reordering ReorderingMode
 
 	// EnableNegativeCaching when true causes resolver to cache negative
-	// DNS responses in accordance to RFC 2308.
+	// DNS responses in accordance to RFC 2308. A cached NXDOMAIN response
+	// is also used to answer questions for names below the denied name
+	// (RFC 8020).
 	EnableNegativeCaching bool
 
+	// EnableAggressiveNSEC when true causes resolver to retain NSEC and
+	// NSEC3 records from negative responses validated by the nested
+	// resolver, and to use them to synthesize negative responses for
+	// other names covered by the same records in accordance to RFC 8198.
+	//
+	// A response is considered validated if it has the AuthenticData bit
+	// set, so the nested resolver must perform DNSSEC validation.
+	//
+	// EnableAggressiveNSEC has no effect unless EnableNegativeCaching is
+	// also set.
+	EnableAggressiveNSEC bool
+
+	// EnableFailureCaching when true causes resolver to briefly cache
+	// server failure responses and the nested resolver not responding, in
+	// accordance to RFC 2308, section 7.
+	EnableFailureCaching bool
+
+	// FailureTTL is the amount of time (in seconds) that server failure
+	// responses are cached when EnableFailureCaching is set.
+	//
+	// If zero, a sensible default will be used. Values greater than five
+	// minutes are reduced to five minutes as required by RFC 2308,
+	// section 7.1.
+	FailureTTL uint32
+
+	// NoResponseTTL is the amount of time (in seconds) that the nested
+	// resolver not responding is cached when EnableFailureCaching is set.
+	//
+	// If zero, a sensible default will be used. Values greater than five
+	// minutes are reduced to five minutes as required by RFC 2308,
+	// section 7.2.
+	NoResponseTTL uint32
+
 	// MaxTTL is the maximum amount of time (in seconds) that records
 	// should be cached.
 	//
@@ -400,7 +1043,35 @@ type Config struct {
 	// values exceeding one day have been found to be problematic.""
 	MaxTTL uint32
 
-	// MaxSize is the maximum number of responses to cache.
+	// MinTTL is the minimum amount of time (in seconds) that records
+	// should be cached. Records with a lower TTL, including a TTL of
+	// zero, are cached for MinTTL seconds. It must not exceed MaxTTL.
+	//
+	// MinTTL does not apply to negative responses.
+	MinTTL uint32
+
+	// ReturnMinTTL when true causes resolver to raise the TTLs of records
+	// returned to clients to at least MinTTL. Otherwise, records held for
+	// longer than their TTL because of MinTTL are returned with a TTL of
+	// zero.
+	ReturnMinTTL bool
+
+	// MaxNegativeTTL is the maximum amount of time (in seconds) that
+	// negative responses should be cached.
+	//
+	// If zero, MaxTTL is used.
+	MaxNegativeTTL uint32
+
+	// TTLJitter is the maximum percentage by which the time that an entry
+	// is cached may be randomly reduced, so that entries cached at the
+	// same time don't all expire at the same time. It must not exceed
+	// 100.
+	//
+	// If zero, entries are cached for exactly their TTL.
+	TTLJitter uint8
+
+	// MaxSize is the maximum number of RRsets, negative responses,
+	// NXDOMAIN names, failures and NSEC/NSEC3 records to cache.
 	//
 	// Cache is infinite if not positive.
 	MaxSize int
@@ -418,7 +1089,11 @@ type Config struct {
 	empty struct{}
 }
 
-var ErrInvalidReorderingMode = errors.New("invalid reordering mode")
+var (
+	ErrInvalidReorderingMode = errors.New("invalid reordering mode")
+	ErrInvalidMinTTL         = errors.New("MinTTL exceeds MaxTTL")
+	ErrInvalidTTLJitter      = errors.New("TTLJitter exceeds 100 percent")
+)
 
 // NewResolver creates a new DNS resolver that caches responses from the
 // nested resolver.
@@ -426,6 +1101,18 @@ func NewResolver(config Config, nested dnsresolver.Resolver) (dnsresolver.Resolv
 	if config.MaxTTL == 0 {
 		config.MaxTTL = defaultMaxTTL
 	}
+	if config.FailureTTL == 0 {
+		config.FailureTTL = defaultFailureTTL
+	}
+	if config.FailureTTL > maxFailureTTL {
+		config.FailureTTL = maxFailureTTL
+	}
+	if config.NoResponseTTL == 0 {
+		config.NoResponseTTL = defaultFailureTTL
+	}
+	if config.NoResponseTTL > maxFailureTTL {
+		config.NoResponseTTL = maxFailureTTL
+	}
 	if config.now == nil {
 		config.now = time.Now
 	}
@@ -435,9 +1122,19 @@ func NewResolver(config Config, nested dnsresolver.Resolver) (dnsresolver.Resolv
 	if config.Reordering >= invalidReordering {
 		return nil, ErrInvalidReorderingMode
 	}
+	if config.MinTTL > config.MaxTTL {
+		return nil, ErrInvalidMinTTL
+	}
+	if config.MaxNegativeTTL == 0 {
+		config.MaxNegativeTTL = config.MaxTTL
+	}
+	if config.TTLJitter > 100 {
+		return nil, ErrInvalidTTLJitter
+	}
 	return &cachingResolver{
 		config: config,
 		m:      make(map[cacheKey]*cacheEntry),
+		zones:  make(map[nsecZoneKey]*nsecZone),
 		nested: nested,
 	}, nil
 }
@@ -5,13 +5,16 @@
 package dnscache
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math/rand"
 	"net"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -355,10 +358,11 @@ func TestResolver(t *testing.T) {
 	}
 }
 
-// This resolver responds to all queries with one CNAME and two A records.
+// This resolver responds to all queries with one CNAME and two A records for
+// the CNAME target.
 func testShuffleResolver() dnsresolver.Resolver {
 	return dnsresolver.ResolverFunc(func(_ context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
-		cname := "addr-" + question.Name.String()
+		cname := dnsmessage.MustNewName("addr-" + question.Name.String())
 		return dnsmessage.Message{
 			Header: dnsmessage.Header{
 				Response:         true,
@@ -374,12 +378,12 @@ func testShuffleResolver() dnsresolver.Resolver {
 						TTL:   10,
 					},
 					Body: &dnsmessage.CNAMEResource{
-						CNAME: dnsmessage.MustNewName(cname),
+						CNAME: cname,
 					},
 				},
 				{
 					Header: dnsmessage.ResourceHeader{
-						Name:  question.Name,
+						Name:  cname,
 						Type:  dnsmessage.TypeA,
 						Class: dnsmessage.ClassINET,
 						TTL:   10,
@@ -390,7 +394,7 @@ func testShuffleResolver() dnsresolver.Resolver {
 				},
 				{
 					Header: dnsmessage.ResourceHeader{
-						Name:  question.Name,
+						Name:  cname,
 						Type:  dnsmessage.TypeA,
 						Class: dnsmessage.ClassINET,
 						TTL:   10,
@@ -989,16 +993,23 @@ func getNXDomainResolver(nested dnsresolver.Resolver) dnsresolver.ResolverFunc {
 }
 
 func TestCacheSize(t *testing.T) {
-	var count uint16
+	var count uint8
+	var stats dnsresolver.Stats
 	r, err := NewResolver(
-		Config{MaxSize: 2},
-		dnsresolver.ResolverFunc(func(_ context.Context, _ dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+		Config{MaxSize: 2, Stats: &stats},
+		dnsresolver.ResolverFunc(func(_ context.Context, question dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
 			count++
 			return dnsmessage.Message{
-				Header: dnsmessage.Header{ID: count},
+				Header:    dnsmessage.Header{Response: true},
+				Questions: []dnsmessage.Question{question},
 				Answers: []dnsmessage.Resource{{
-					dnsmessage.ResourceHeader{TTL: 3600},
-					&dnsmessage.AResource{},
+					Header: dnsmessage.ResourceHeader{
+						Name:  question.Name,
+						Type:  question.Type,
+						Class: question.Class,
+						TTL:   3600,
+					},
+					Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, count}},
 				}},
 			}, true
 		}),
@@ -1028,7 +1039,7 @@ func TestCacheSize(t *testing.T) {
 	tests := []struct {
 		name string
 		q    dnsmessage.Question
-		want uint16
+		want uint8
 	}{
 		{
 			"first question",
@@ -1083,9 +1094,1011 @@ func TestCacheSize(t *testing.T) {
 			if !ok {
 				t.Fatal("Resolve returned no answer")
 			}
-			if got := m.Header.ID; got != test.want {
-				t.Errorf("got ID = %d, want = %d", got, test.want)
+			if len(m.Answers) != 1 {
+				t.Fatalf("got %d answers, want 1", len(m.Answers))
+			}
+			if got := m.Answers[0].Body.(*dnsmessage.AResource).A[3]; got != test.want {
+				t.Errorf("got response number = %d, want = %d", got, test.want)
 			}
 		})
 	}
+
+	if got, want := stats.Evictions(), uint64(2); got != want {
+		t.Errorf("got Stats.Evictions() = %d, want = %d", got, want)
+	}
+	if got, want := stats.Entries(), int64(2); got != want {
+		t.Errorf("got Stats.Entries() = %d, want = %d", got, want)
+	}
+}
+
+// countingResolver responds to questions with the messages in m and counts the
+// number of questions it has received.
+type countingResolver struct {
+	m     map[dnsmessage.Question]dnsmessage.Message
+	count int
+}
+
+func (r *countingResolver) Resolve(_ context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	r.count++
+	msg, ok := r.m[question]
+	if !ok {
+		return resolvers.ResolveError(question, dnsmessage.RCodeServerFailure, recursionDesired), true
+	}
+	msg.Header.Response = true
+	msg.Header.RecursionDesired = recursionDesired
+	msg.Questions = []dnsmessage.Question{question}
+	return msg, true
+}
+
+func testResource(name string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	var t dnsmessage.Type
+	switch body.(type) {
+	case *dnsmessage.AResource:
+		t = dnsmessage.TypeA
+	case *dnsmessage.CNAMEResource:
+		t = dnsmessage.TypeCNAME
+	case *dnsmessage.NSResource:
+		t = dnsmessage.TypeNS
+	case *dnsmessage.SOAResource:
+		t = dnsmessage.TypeSOA
+	case *dnsmessage.NSECResource:
+		t = dnsmessage.TypeNSEC
+	case *dnsmessage.NSEC3Resource:
+		t = dnsmessage.TypeNSEC3
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  t,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: body,
+	}
+}
+
+func testQuestion(name string, t dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	www := testQuestion("www.example.", dnsmessage.TypeA)
+	web := testQuestion("web.example.", dnsmessage.TypeA)
+	cname := testResource("www.example.", 10, &dnsmessage.CNAMEResource{CNAME: web.Name})
+	a := testResource("web.example.", 20, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		www: {Answers: []dnsmessage.Resource{cname, a}},
+	}}
+	st := newStubTime()
+	r, err := NewResolver(Config{now: st.now}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	if _, ok := r.Resolve(ctx, www, true); !ok {
+		t.Fatal("first resolve did not return packet")
+	}
+	st.sleep(5 * time.Second)
+
+	// The CNAME target should be served from the cache.
+	got, ok := r.Resolve(ctx, web, true)
+	if !ok {
+		t.Fatal("CNAME target resolve did not return packet")
+	}
+	wantA := a
+	wantA.Header.TTL = 15
+	want := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true},
+		Questions: []dnsmessage.Question{web},
+		Answers:   []dnsmessage.Resource{wantA},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+
+	// The original question should be assembled from the cached chain.
+	got, ok = r.Resolve(ctx, www, true)
+	if !ok {
+		t.Fatal("second resolve did not return packet")
+	}
+	wantCNAME := cname
+	wantCNAME.Header.TTL = 5
+	want = dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true},
+		Questions: []dnsmessage.Question{www},
+		Answers:   []dnsmessage.Resource{wantCNAME, wantA},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+
+	if nested.count != 1 {
+		t.Errorf("got %d nested resolves, want 1", nested.count)
+	}
+
+	// Once the CNAME expires, the chain can no longer be used.
+	st.sleep(6 * time.Second)
+	if _, ok := r.Resolve(ctx, www, true); !ok {
+		t.Fatal("third resolve did not return packet")
+	}
+	if nested.count != 2 {
+		t.Errorf("got %d nested resolves, want 2", nested.count)
+	}
+}
+
+func testRRSIG(owner string, covered dnsmessage.Type, ttl uint32) dnsmessage.Resource {
+	r := testResource(owner, ttl, &dnsmessage.UnknownResource{Type: dnsmessage.TypeRRSIG, Data: []byte{byte(covered >> 8), byte(covered), 8, 2}})
+	r.Header.Type = dnsmessage.TypeRRSIG
+	return r
+}
+
+func TestAuthenticData(t *testing.T) {
+	www := testQuestion("www.example.", dnsmessage.TypeA)
+	web := testQuestion("web.example.", dnsmessage.TypeA)
+	other := testQuestion("other.example.", dnsmessage.TypeA)
+	cname := testResource("www.example.", 10, &dnsmessage.CNAMEResource{CNAME: web.Name})
+	cnameSig := testRRSIG("www.example.", dnsmessage.TypeCNAME, 10)
+	a := testResource("web.example.", 10, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	aSig := testRRSIG("web.example.", dnsmessage.TypeA, 10)
+	otherCNAME := testResource("other.example.", 10, &dnsmessage.CNAMEResource{CNAME: web.Name})
+
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		// The signatures precede the RRsets they cover.
+		www:   {Header: dnsmessage.Header{AuthenticData: true}, Answers: []dnsmessage.Resource{aSig, cnameSig, cname, a}},
+		other: {Answers: []dnsmessage.Resource{otherCNAME, a}},
+	}}
+	st := newStubTime()
+	r, err := NewResolver(Config{now: st.now}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	dnssecOK := context.WithValue(context.Background(), dnsresolver.DNSSECOKContextKey, true)
+	noDNSSEC := context.WithValue(context.Background(), dnsresolver.DNSSECOKContextKey, false)
+
+	if _, ok := r.Resolve(dnssecOK, other, true); !ok {
+		t.Fatal("resolving other did not return packet")
+	}
+	if _, ok := r.Resolve(dnssecOK, www, true); !ok {
+		t.Fatal("first resolve did not return packet")
+	}
+	got, ok := r.Resolve(dnssecOK, www, true)
+	if !ok {
+		t.Fatal("second resolve did not return packet")
+	}
+	want := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true, AuthenticData: true},
+		Questions: []dnsmessage.Question{www},
+		Answers:   []dnsmessage.Resource{cname, cnameSig, a, aSig},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+
+	// Without the DNSSEC OK bit, the signatures are left out.
+	got, ok = r.Resolve(noDNSSEC, www, true)
+	if !ok {
+		t.Fatal("third resolve did not return packet")
+	}
+	want.Answers = []dnsmessage.Resource{cname, a}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+	if nested.count != 2 {
+		t.Errorf("got %d nested resolves, want 2", nested.count)
+	}
+
+	// A chain through an unvalidated RRset is not authenticated, even if
+	// its target is.
+	got, ok = r.Resolve(dnssecOK, other, true)
+	if !ok {
+		t.Fatal("resolving other from cache did not return packet")
+	}
+	want = dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true},
+		Questions: []dnsmessage.Question{other},
+		Answers:   []dnsmessage.Resource{otherCNAME, a, aSig},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+}
+
+func TestTrustRanking(t *testing.T) {
+	zone := testQuestion("example.", dnsmessage.TypeNS)
+	host := testQuestion("host.example.", dnsmessage.TypeA)
+	ns1 := testQuestion("ns1.example.", dnsmessage.TypeA)
+	ns2 := testQuestion("ns2.example.", dnsmessage.TypeA)
+	answerNS := testResource("example.", 100, &dnsmessage.NSResource{NS: ns1.Name})
+	authorityNS := testResource("example.", 100, &dnsmessage.NSResource{NS: ns2.Name})
+	glue := testResource("ns2.example.", 100, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}})
+
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		zone: {Answers: []dnsmessage.Resource{answerNS}},
+		host: {
+			Answers:     []dnsmessage.Resource{testResource("host.example.", 100, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 3}})},
+			Authorities: []dnsmessage.Resource{authorityNS},
+			Additionals: []dnsmessage.Resource{glue},
+		},
+		ns2: {Answers: []dnsmessage.Resource{glue}},
+	}}
+	r, err := NewResolver(Config{now: newStubTime().now}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	for _, q := range []dnsmessage.Question{zone, host} {
+		if _, ok := r.Resolve(ctx, q, true); !ok {
+			t.Fatalf("resolving %v did not return packet", q.Name)
+		}
+	}
+
+	// Authority data must not override answer data.
+	got, ok := r.Resolve(ctx, zone, true)
+	if !ok {
+		t.Fatal("second resolve did not return packet")
+	}
+	want := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true},
+		Questions: []dnsmessage.Question{zone},
+		Answers:   []dnsmessage.Resource{answerNS},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+	if nested.count != 2 {
+		t.Errorf("got %d nested resolves, want 2", nested.count)
+	}
+
+	// Additional data must not be returned as an answer.
+	if _, ok := r.Resolve(ctx, ns2, true); !ok {
+		t.Fatal("glue resolve did not return packet")
+	}
+	if nested.count != 3 {
+		t.Errorf("got %d nested resolves, want 3", nested.count)
+	}
+
+	// Once learned from an answer, the same data can be served from the
+	// cache.
+	if _, ok := r.Resolve(ctx, ns2, true); !ok {
+		t.Fatal("second glue resolve did not return packet")
+	}
+	if nested.count != 3 {
+		t.Errorf("got %d nested resolves, want 3", nested.count)
+	}
+
+	// Data which was never cached still goes to the nested resolver.
+	if _, ok := r.Resolve(ctx, ns1, true); !ok {
+		t.Fatal("uncached resolve did not return packet")
+	}
+	if nested.count != 4 {
+		t.Errorf("got %d nested resolves, want 4", nested.count)
+	}
+}
+
+func testSOA(zone string, ttl uint32) dnsmessage.Resource {
+	return testResource(zone, ttl, &dnsmessage.SOAResource{
+		NS:     dnsmessage.MustNewName("ns." + zone),
+		MBox:   dnsmessage.MustNewName("hostmaster." + zone),
+		Serial: 1,
+		MinTTL: ttl,
+	})
+}
+
+func testNSEC(owner, next string, ttl uint32, types ...dnsmessage.Type) dnsmessage.Resource {
+	return testResource(owner, ttl, &dnsmessage.NSECResource{NextDomain: dnsmessage.MustNewName(next), Types: types})
+}
+
+func TestAggressiveNSEC(t *testing.T) {
+	soa := testSOA("example.", 100)
+	apexNSEC := testNSEC("example.", "a.example.", 100, dnsmessage.TypeNS, dnsmessage.TypeSOA, dnsmessage.TypeNSEC)
+	aNSEC := testNSEC("a.example.", "c.example.", 100, dnsmessage.TypeA, dnsmessage.TypeNSEC)
+
+	nxdomain := testQuestion("b.example.", dnsmessage.TypeA)
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		nxdomain: {
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError, AuthenticData: true},
+			Authorities: []dnsmessage.Resource{soa, aNSEC, apexNSEC},
+		},
+	}}
+	st := newStubTime()
+	var stats dnsresolver.Stats
+	r, err := NewResolver(Config{
+		EnableNegativeCaching: true,
+		EnableAggressiveNSEC:  true,
+		Stats:                 &stats,
+		now:                   st.now,
+	}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	if _, ok := r.Resolve(ctx, nxdomain, true); !ok {
+		t.Fatal("first resolve did not return packet")
+	}
+	st.sleep(10 * time.Second)
+
+	wantSOA := soa
+	wantSOA.Header.TTL = 90
+	wantA := aNSEC
+	wantA.Header.TTL = 90
+	wantApex := apexNSEC
+	wantApex.Header.TTL = 90
+
+	tests := []struct {
+		name     string
+		question dnsmessage.Question
+		want     dnsmessage.Message
+	}{
+		{
+			name:     "NXDOMAIN",
+			question: testQuestion("bb.example.", dnsmessage.TypeA),
+			want: dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true, RecursionDesired: true, AuthenticData: true, RCode: dnsmessage.RCodeNameError},
+				Questions:   []dnsmessage.Question{testQuestion("bb.example.", dnsmessage.TypeA)},
+				Authorities: []dnsmessage.Resource{wantSOA, wantA, wantApex},
+			},
+		},
+		{
+			name:     "NODATA",
+			question: testQuestion("a.example.", dnsmessage.TypeAAAA),
+			want: dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true, RecursionDesired: true, AuthenticData: true},
+				Questions:   []dnsmessage.Question{testQuestion("a.example.", dnsmessage.TypeAAAA)},
+				Authorities: []dnsmessage.Resource{wantSOA, wantA},
+			},
+		},
+	}
+	for _, test := range tests {
+		got, ok := r.Resolve(ctx, test.question, true)
+		if !ok {
+			t.Fatalf("%s: resolve did not return packet", test.name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got = %#v, want = %#v", test.name, &got, &test.want)
+		}
+	}
+	if nested.count != 1 {
+		t.Errorf("got %d nested resolves, want 1", nested.count)
+	}
+	if got := stats.Synthesized(); got != 2 {
+		t.Errorf("got Stats.Synthesized() = %d, want 2", got)
+	}
+
+	// Names which aren't covered and types which exist must be resolved.
+	for _, q := range []dnsmessage.Question{
+		testQuestion("d.example.", dnsmessage.TypeA),
+		testQuestion("a.example.", dnsmessage.TypeA),
+	} {
+		if _, ok := r.Resolve(ctx, q, true); !ok {
+			t.Fatalf("resolving %v did not return packet", q.Name)
+		}
+	}
+	if nested.count != 3 {
+		t.Errorf("got %d nested resolves, want 3", nested.count)
+	}
+
+	// Once the records expire, they can no longer be used.
+	st.sleep(91 * time.Second)
+	if _, ok := r.Resolve(ctx, testQuestion("bb.example.", dnsmessage.TypeA), true); !ok {
+		t.Fatal("resolve after expiry did not return packet")
+	}
+	if nested.count != 4 {
+		t.Errorf("got %d nested resolves, want 4", nested.count)
+	}
+}
+
+func TestAggressiveNSECUnvalidated(t *testing.T) {
+	nxdomain := testQuestion("b.example.", dnsmessage.TypeA)
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		nxdomain: {
+			Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{
+				testSOA("example.", 100),
+				testNSEC("a.example.", "c.example.", 100, dnsmessage.TypeA),
+				testNSEC("example.", "a.example.", 100, dnsmessage.TypeSOA),
+			},
+		},
+	}}
+	r, err := NewResolver(Config{
+		EnableNegativeCaching: true,
+		EnableAggressiveNSEC:  true,
+		now:                   newStubTime().now,
+	}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"b.example.", "bb.example."} {
+		if _, ok := r.Resolve(ctx, testQuestion(name, dnsmessage.TypeA), true); !ok {
+			t.Fatalf("resolving %s did not return packet", name)
+		}
+	}
+	if nested.count != 2 {
+		t.Errorf("got %d nested resolves, want 2", nested.count)
+	}
+}
+
+func TestAggressiveNSEC3(t *testing.T) {
+	apex := dnsmessage.MustNewName("example.")
+	salt := []byte{0xab}
+	const iterations = 1
+
+	// Build a chain of hashed owner names for the names in the zone.
+	var hashes [][]byte
+	for _, n := range []string{"example.", "a.example."} {
+		name := dnsmessage.MustNewName(n)
+		hashes = append(hashes, nsec3Hash(&name, salt, iterations))
+	}
+	if bytes.Compare(hashes[0], hashes[1]) > 0 {
+		hashes[0], hashes[1] = hashes[1], hashes[0]
+	}
+	var records []dnsmessage.Resource
+	for i, h := range hashes {
+		owner := nsec3Encoding.EncodeToString(h) + "." + apex.String()
+		records = append(records, testResource(owner, 100, &dnsmessage.NSEC3Resource{
+			HashAlgorithm:   nsec3SHA1,
+			Iterations:      iterations,
+			Salt:            salt,
+			NextHashedOwner: hashes[(i+1)%len(hashes)],
+			Types:           []dnsmessage.Type{dnsmessage.TypeA},
+		}))
+	}
+
+	nodata := testQuestion("a.example.", dnsmessage.TypeAAAA)
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		nodata: {
+			Header:      dnsmessage.Header{AuthenticData: true},
+			Authorities: append([]dnsmessage.Resource{testSOA("example.", 100)}, records...),
+		},
+	}}
+	var stats dnsresolver.Stats
+	r, err := NewResolver(Config{
+		EnableNegativeCaching: true,
+		EnableAggressiveNSEC:  true,
+		Stats:                 &stats,
+		now:                   newStubTime().now,
+	}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	if _, ok := r.Resolve(ctx, nodata, true); !ok {
+		t.Fatal("first resolve did not return packet")
+	}
+
+	// With only two names in the zone, the chain covers every other name.
+	tests := []struct {
+		question dnsmessage.Question
+		rcode    dnsmessage.RCode
+	}{
+		{testQuestion("b.example.", dnsmessage.TypeA), dnsmessage.RCodeNameError},
+		{testQuestion("x.a.example.", dnsmessage.TypeA), dnsmessage.RCodeNameError},
+		{testQuestion("example.", dnsmessage.TypeMX), dnsmessage.RCodeSuccess},
+	}
+	for _, test := range tests {
+		got, ok := r.Resolve(ctx, test.question, true)
+		if !ok {
+			t.Fatalf("resolving %v did not return packet", test.question.Name)
+		}
+		if got.Header.RCode != test.rcode || !got.Header.AuthenticData {
+			t.Errorf("resolving %v: got header %#v, want RCode %v with AuthenticData", test.question.Name, &got.Header, test.rcode)
+		}
+	}
+	if nested.count != 1 {
+		t.Errorf("got %d nested resolves, want 1", nested.count)
+	}
+	if got := stats.Synthesized(); got != uint64(len(tests)) {
+		t.Errorf("got Stats.Synthesized() = %d, want %d", got, len(tests))
+	}
+}
+
+func TestNXDOMAINCut(t *testing.T) {
+	nxdomain := testQuestion("foo.example.", dnsmessage.TypeA)
+	soa := testSOA("example.", 100)
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		nxdomain: {
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{soa},
+		},
+	}}
+	st := newStubTime()
+	r, err := NewResolver(Config{EnableNegativeCaching: true, now: st.now}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	if _, ok := r.Resolve(ctx, nxdomain, true); !ok {
+		t.Fatal("first resolve did not return packet")
+	}
+	st.sleep(30 * time.Second)
+
+	wantSOA := soa
+	wantSOA.Header.TTL = 70
+	for _, q := range []dnsmessage.Question{
+		testQuestion("foo.example.", dnsmessage.TypeAAAA),
+		testQuestion("bar.foo.example.", dnsmessage.TypeA),
+		testQuestion("baz.bar.foo.example.", dnsmessage.TypeTXT),
+	} {
+		got, ok := r.Resolve(ctx, q, false)
+		if !ok {
+			t.Fatalf("resolving %v did not return packet", q.Name)
+		}
+		want := dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+			Questions:   []dnsmessage.Question{q},
+			Authorities: []dnsmessage.Resource{wantSOA},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("resolving %v: got = %#v, want = %#v", q.Name, &got, &want)
+		}
+	}
+	if nested.count != 1 {
+		t.Errorf("got %d nested resolves, want 1", nested.count)
+	}
+
+	// Names above and beside the cut are not affected.
+	for _, q := range []dnsmessage.Question{
+		testQuestion("example.", dnsmessage.TypeA),
+		testQuestion("foofoo.example.", dnsmessage.TypeA),
+	} {
+		if _, ok := r.Resolve(ctx, q, true); !ok {
+			t.Fatalf("resolving %v did not return packet", q.Name)
+		}
+	}
+	if nested.count != 3 {
+		t.Errorf("got %d nested resolves, want 3", nested.count)
+	}
+
+	// Once the NXDOMAIN expires, the cut no longer applies.
+	st.sleep(71 * time.Second)
+	if _, ok := r.Resolve(ctx, testQuestion("bar.foo.example.", dnsmessage.TypeA), true); !ok {
+		t.Fatal("resolve after expiry did not return packet")
+	}
+	if nested.count != 4 {
+		t.Errorf("got %d nested resolves, want 4", nested.count)
+	}
+}
+
+func TestFailureCache(t *testing.T) {
+	servfail := testQuestion("broken.example.", dnsmessage.TypeA)
+	nested := &countingResolver{}
+	st := newStubTime()
+	var stats dnsresolver.Stats
+	r, err := NewResolver(Config{
+		EnableFailureCaching: true,
+		FailureTTL:           10,
+		Stats:                &stats,
+		now:                  st.now,
+	}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		got, ok := r.Resolve(ctx, servfail, true)
+		if !ok {
+			t.Fatalf("resolve %d did not return packet", i)
+		}
+		want := dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RecursionDesired: true, RecursionAvailable: true, RCode: dnsmessage.RCodeServerFailure},
+			Questions: []dnsmessage.Question{servfail},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("resolve %d: got = %#v, want = %#v", i, &got, &want)
+		}
+	}
+	if nested.count != 1 {
+		t.Errorf("got %d nested resolves, want 1", nested.count)
+	}
+	if got := stats.CachedFailures(); got != 2 {
+		t.Errorf("got Stats.CachedFailures() = %d, want 2", got)
+	}
+
+	st.sleep(11 * time.Second)
+	if _, ok := r.Resolve(ctx, servfail, true); !ok {
+		t.Fatal("resolve after expiry did not return packet")
+	}
+	if nested.count != 2 {
+		t.Errorf("got %d nested resolves, want 2", nested.count)
+	}
+}
+
+func TestFailureCacheNoResponse(t *testing.T) {
+	count := 0
+	nested := dnsresolver.ResolverFunc(func(context.Context, dnsmessage.Question, bool) (dnsmessage.Message, bool) {
+		count++
+		return dnsmessage.Message{}, false
+	})
+	st := newStubTime()
+	var stats dnsresolver.Stats
+	r, err := NewResolver(Config{
+		EnableFailureCaching: true,
+		NoResponseTTL:        3600,
+		Stats:                &stats,
+		now:                  st.now,
+	}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+	q := testQuestion("dead.example.", dnsmessage.TypeA)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := r.Resolve(ctx, q, true); ok {
+			t.Fatalf("resolve %d returned packet", i)
+		}
+	}
+	if count != 1 {
+		t.Errorf("got %d nested resolves, want 1", count)
+	}
+	if got := stats.CachedFailures(); got != 1 {
+		t.Errorf("got Stats.CachedFailures() = %d, want 1", got)
+	}
+
+	// The TTL is capped at five minutes.
+	st.sleep(301 * time.Second)
+	if _, ok := r.Resolve(ctx, q, true); ok {
+		t.Fatal("resolve after expiry returned packet")
+	}
+	if count != 2 {
+		t.Errorf("got %d nested resolves, want 2", count)
+	}
+
+	// A request which is canceled doesn't cache a failure for others.
+	st.sleep(301 * time.Second)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, ok := r.Resolve(canceled, q, true); ok {
+		t.Fatal("canceled resolve returned packet")
+	}
+	if _, ok := r.Resolve(ctx, q, true); ok {
+		t.Fatal("resolve after canceled resolve returned packet")
+	}
+	if count != 4 {
+		t.Errorf("got %d nested resolves, want 4", count)
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	zero := testQuestion("zero.example.", dnsmessage.TypeA)
+	one := testQuestion("one.example.", dnsmessage.TypeA)
+	zeroA := testResource("zero.example.", 0, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	oneA := testResource("one.example.", 1, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}})
+
+	for _, returnMinTTL := range []bool{false, true} {
+		nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+			zero: {Answers: []dnsmessage.Resource{zeroA}},
+			one:  {Answers: []dnsmessage.Resource{oneA}},
+		}}
+		st := newStubTime()
+		r, err := NewResolver(Config{MinTTL: 30, ReturnMinTTL: returnMinTTL, now: st.now}, nested)
+		if err != nil {
+			t.Fatal("NewResolver(...) =", err)
+		}
+		ctx := context.Background()
+
+		wantTTLs := map[dnsmessage.Question][2]uint32{
+			// TTLs of the first and second responses.
+			zero: {0, 0},
+			one:  {1, 0},
+		}
+		if returnMinTTL {
+			wantTTLs = map[dnsmessage.Question][2]uint32{
+				zero: {30, 20},
+				one:  {30, 20},
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			for _, q := range []dnsmessage.Question{zero, one} {
+				got, ok := r.Resolve(ctx, q, true)
+				if !ok || len(got.Answers) != 1 {
+					t.Fatalf("ReturnMinTTL = %t: resolving %v: got = %#v, want one answer", returnMinTTL, q.Name, &got)
+				}
+				if ttl, want := got.Answers[0].Header.TTL, wantTTLs[q][i]; ttl != want {
+					t.Errorf("ReturnMinTTL = %t: resolve %d of %v: got TTL %d, want %d", returnMinTTL, i, q.Name, ttl, want)
+				}
+			}
+			st.sleep(10 * time.Second)
+		}
+		if nested.count != 2 {
+			t.Errorf("ReturnMinTTL = %t: got %d nested resolves, want 2", returnMinTTL, nested.count)
+		}
+
+		// The nested resolver's records must not have been modified.
+		if zeroA.Header.TTL != 0 || oneA.Header.TTL != 1 {
+			t.Errorf("ReturnMinTTL = %t: nested records modified", returnMinTTL)
+		}
+	}
+}
+
+func TestMaxNegativeTTL(t *testing.T) {
+	q := testQuestion("missing.example.", dnsmessage.TypeA)
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		q: {
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{testSOA("example.", 100)},
+		},
+	}}
+	st := newStubTime()
+	r, err := NewResolver(Config{EnableNegativeCaching: true, MaxNegativeTTL: 20, now: st.now}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	for _, d := range []time.Duration{0, 19 * time.Second, 2 * time.Second} {
+		st.sleep(d)
+		if _, ok := r.Resolve(ctx, q, true); !ok {
+			t.Fatal("resolve did not return packet")
+		}
+	}
+	if nested.count != 2 {
+		t.Errorf("got %d nested resolves, want 2", nested.count)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	const n = 100
+	m := make(map[dnsmessage.Question]dnsmessage.Message)
+	var questions []dnsmessage.Question
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("host%d.example.", i)
+		q := testQuestion(name, dnsmessage.TypeA)
+		questions = append(questions, q)
+		m[q] = dnsmessage.Message{Answers: []dnsmessage.Resource{testResource(name, 100, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})}}
+	}
+	nested := &countingResolver{m: m}
+	st := newStubTime()
+	r, err := NewResolver(Config{TTLJitter: 20, now: st.now, rand: rand.New(rand.NewSource(1))}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	resolveAll := func() {
+		for _, q := range questions {
+			if _, ok := r.Resolve(ctx, q, true); !ok {
+				t.Fatalf("resolving %v did not return packet", q.Name)
+			}
+		}
+	}
+	resolveAll()
+
+	// No entry may expire before 80% of its TTL.
+	st.sleep(80 * time.Second)
+	resolveAll()
+	if nested.count != n {
+		t.Errorf("got %d nested resolves after 80s, want %d", nested.count, n)
+	}
+
+	// Some, but not all, entries should have expired by 90% of their TTL.
+	st.sleep(10 * time.Second)
+	before := nested.count
+	for _, q := range questions {
+		r.Resolve(ctx, q, true)
+	}
+	expired := nested.count - before
+	if expired == 0 || expired == n {
+		t.Errorf("got %d of %d entries expired after 90s, want some", expired, n)
+	}
+
+	// All remaining entries from the first resolve expire by their TTL.
+	st.sleep(10 * time.Second)
+	before = nested.count
+	resolveAll()
+	if got, want := nested.count-before, n-expired; got != want {
+		t.Errorf("got %d entries expired after 100s, want %d", got, want)
+	}
+}
+
+func TestNewResolverTTLErrors(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		want   error
+	}{
+		{Config{MinTTL: 10, MaxTTL: 5}, ErrInvalidMinTTL},
+		{Config{MinTTL: defaultMaxTTL + 1}, ErrInvalidMinTTL},
+		{Config{TTLJitter: 101}, ErrInvalidTTLJitter},
+	} {
+		if _, err := NewResolver(test.config, nil); err != test.want {
+			t.Errorf("NewResolver(%+v, nil) = %v, want = %v", test.config, err, test.want)
+		}
+	}
+}
+
+func TestStatsBreakdown(t *testing.T) {
+	st := newStubTime()
+	a := testQuestion("a.example.", dnsmessage.TypeA)
+	r, err := NewResolver(
+		Config{
+			EnableNegativeCaching: true,
+			Stats:                 new(dnsresolver.Stats),
+			now:                   st.now,
+		},
+		dnsresolver.ResolverFunc(func(_ context.Context, question dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+			st.sleep(3 * time.Millisecond)
+			if question != a {
+				return dnsmessage.Message{
+					Header:      dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+					Questions:   []dnsmessage.Question{question},
+					Authorities: []dnsmessage.Resource{testSOA("example.", 100)},
+				}, true
+			}
+			return dnsmessage.Message{
+				Header:    dnsmessage.Header{Response: true},
+				Questions: []dnsmessage.Question{question},
+				Answers:   []dnsmessage.Resource{testResource("a.example.", 100, &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})},
+			}, true
+		}),
+	)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	stats := r.(*cachingResolver).config.Stats
+
+	ctx := context.Background()
+	for _, q := range []dnsmessage.Question{a, a, testQuestion("b.example.", dnsmessage.TypeAAAA)} {
+		if _, ok := r.Resolve(ctx, q, false); !ok {
+			t.Fatalf("resolving %v returned no answer", q)
+		}
+	}
+
+	s := stats.Snapshot()
+	if want := map[dnsmessage.Type]uint64{dnsmessage.TypeA: 2, dnsmessage.TypeAAAA: 1}; !reflect.DeepEqual(s.QuestionTypes, want) {
+		t.Errorf("got QuestionTypes = %v, want = %v", s.QuestionTypes, want)
+	}
+	if want := map[dnsmessage.RCode]uint64{dnsmessage.RCodeSuccess: 2, dnsmessage.RCodeNameError: 1}; !reflect.DeepEqual(s.RCodes, want) {
+		t.Errorf("got RCodes = %v, want = %v", s.RCodes, want)
+	}
+	// Both deferrals took 3ms, so they are counted in the first bucket
+	// which includes 3ms.
+	for _, b := range s.Latency {
+		if b.Max >= 3*time.Millisecond {
+			if b.Count != 2 {
+				t.Errorf("got %d latencies in bucket %v, want 2", b.Count, b.Max)
+			}
+			break
+		}
+	}
+	if s.LatencySum != 6*time.Millisecond {
+		t.Errorf("got LatencySum = %v, want 6ms", s.LatencySum)
+	}
+}
+
+func TestAnyQuestion(t *testing.T) {
+	anyQ := testQuestion("www.example.", dnsmessage.TypeALL)
+	a := testResource("www.example.", 20, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	ns := testResource("www.example.", 30, &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.example.")})
+
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		anyQ: {Answers: []dnsmessage.Resource{a, ns}},
+	}}
+	st := newStubTime()
+	r, err := NewResolver(Config{now: st.now}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	ctx := context.Background()
+
+	if _, ok := r.Resolve(ctx, anyQ, true); !ok {
+		t.Fatal("first resolve did not return packet")
+	}
+	st.sleep(5 * time.Second)
+
+	got, ok := r.Resolve(ctx, anyQ, true)
+	if !ok {
+		t.Fatal("second resolve did not return packet")
+	}
+	wantA, wantNS := a, ns
+	wantA.Header.TTL = 15
+	wantNS.Header.TTL = 25
+	want := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionDesired: true},
+		Questions: []dnsmessage.Question{anyQ},
+		Answers:   []dnsmessage.Resource{wantA, wantNS},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want = %#v", &got, &want)
+	}
+
+	// The individual RRsets are cached as well.
+	if got, ok := r.Resolve(ctx, testQuestion("www.example.", dnsmessage.TypeNS), true); !ok || len(got.Answers) != 1 {
+		t.Errorf("got NS answers = %v, %t, want one answer", got.Answers, ok)
+	}
+	if nested.count != 1 {
+		t.Errorf("got %d nested resolves, want 1", nested.count)
+	}
+}
+
+func TestTTLJitterNSEC(t *testing.T) {
+	soa := testSOA("example.", 100)
+	apexNSEC := testNSEC("example.", "a.example.", 100, dnsmessage.TypeNS, dnsmessage.TypeSOA, dnsmessage.TypeNSEC)
+	aNSEC := testNSEC("a.example.", "c.example.", 100, dnsmessage.TypeA, dnsmessage.TypeNSEC)
+	nxdomain := testQuestion("b.example.", dnsmessage.TypeA)
+	nested := &countingResolver{m: map[dnsmessage.Question]dnsmessage.Message{
+		nxdomain: {
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError, AuthenticData: true},
+			Authorities: []dnsmessage.Resource{soa, aNSEC, apexNSEC},
+		},
+	}}
+	st := newStubTime()
+	r, err := NewResolver(Config{
+		EnableNegativeCaching: true,
+		EnableAggressiveNSEC:  true,
+		TTLJitter:             50,
+		now:                   st.now,
+		rand:                  rand.New(rand.NewSource(1)),
+	}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	if _, ok := r.Resolve(context.Background(), nxdomain, true); !ok {
+		t.Fatal("resolve did not return packet")
+	}
+
+	c := r.(*cachingResolver)
+	ttl := 100 * time.Second
+	jittered := 0
+	for k, e := range c.m {
+		if k.kind != nsecEntry {
+			continue
+		}
+		d := e.expires.Sub(e.created)
+		if d < ttl/2 || d > ttl {
+			t.Errorf("got %v NSEC entry cached for %v, want between %v and %v", k.question.Name, d, ttl/2, ttl)
+		}
+		if d < ttl {
+			jittered++
+		}
+	}
+	if jittered == 0 {
+		t.Error("no NSEC entry had its expiry jittered")
+	}
+}
+
+func TestConcurrentRandom(t *testing.T) {
+	// Run with the race detector to check that the random source shared
+	// by reordering and TTL jitter is used safely.
+	nested := dnsresolver.ResolverFunc(func(_ context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+		// Let other requests run, so that they interleave even on a
+		// single CPU.
+		runtime.Gosched()
+		name := question.Name.String()
+		return dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RecursionDesired: recursionDesired},
+			Questions: []dnsmessage.Question{question},
+			Answers: []dnsmessage.Resource{
+				testResource(name, 100, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+				testResource(name, 100, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}),
+			},
+		}, true
+	})
+	r, err := NewResolver(Config{Reordering: RandomReordering, TTLJitter: 20, MaxSize: 10}, nested)
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				q := testQuestion(fmt.Sprintf("host%d.example.", (i*100+j)%20), dnsmessage.TypeA)
+				if _, ok := r.Resolve(context.Background(), q, true); !ok {
+					t.Errorf("resolving %v did not return packet", q.Name)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,610 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnscache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+const (
+	// nsec3SHA1 is the only NSEC3 hash algorithm defined by RFC 5155,
+	// section 11.
+	nsec3SHA1 = 1
+
+	// maxNSEC3Iterations is the maximum number of additional NSEC3 hash
+	// iterations we are willing to perform.
+	//
+	// From RFC 9276, section 3.2:
+	// Validating resolvers MAY return an insecure response to their
+	// clients when processing NSEC3 records with iterations larger than
+	// 0.
+	//
+	// We don't go that far, but we do refuse to use records with
+	// excessive iterations to synthesize responses.
+	maxNSEC3Iterations = 150
+
+	// typeDNAME is the type of DNAME records (RFC 6672).
+	typeDNAME dnsmessage.Type = 39
+
+	// typeDS is the type of DS records (RFC 4034).
+	typeDS dnsmessage.Type = 43
+)
+
+// nsec3Encoding is the encoding of hashed owner names (RFC 5155, section 3.3).
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// An nsecZoneKey identifies a zone for which NSEC or NSEC3 records are
+// cached.
+type nsecZoneKey struct {
+	// apex is the canonical wire format of the zone's name.
+	apex  string
+	class dnsmessage.Class
+}
+
+// An nsecZone holds the validated NSEC and NSEC3 records cached for a zone.
+type nsecZone struct {
+	key  nsecZoneKey
+	apex dnsmessage.Name
+
+	// soa is the SOA record of the zone. It is included in synthesized
+	// responses.
+	soa dnsmessage.Resource
+
+	// soaCreated is the time at which soa was cached.
+	soaCreated time.Time
+
+	// soaExpires is the time after which soa must not be used.
+	soaExpires time.Time
+
+	// recursionAvailable is the RecursionAvailable bit of the response
+	// that soa was taken from.
+	recursionAvailable bool
+
+	// nsec holds NSEC entries sorted by owner name in canonical order.
+	nsec []*cacheEntry
+
+	// nsec3 holds NSEC3 entries sorted by hashed owner name.
+	nsec3 []*cacheEntry
+
+	// nsec3Salt and nsec3Iterations are the NSEC3 parameters shared by
+	// all entries in nsec3.
+	nsec3Salt       []byte
+	nsec3Iterations uint16
+}
+
+// zoneKey returns the key for the zone with the given apex and class.
+func zoneKey(apex *dnsmessage.Name, class dnsmessage.Class) nsecZoneKey {
+	return nsecZoneKey{string(apex.AppendCanonical(nil)), class}
+}
+
+// hasType reports whether types contains t.
+func hasType(types []dnsmessage.Type, t dnsmessage.Type) bool {
+	for _, u := range types {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the NSEC or NSEC3 range from an owner to a next name
+// covers a name, given the results of comparing the owner to the name, the
+// name to the next name and the next name to the owner. The last range in a
+// zone wraps around to the start.
+func covers(ownerName, nameNext, nextOwner int) bool {
+	if ownerName >= 0 {
+		return false
+	}
+	return nameNext < 0 || nextOwner <= 0
+}
+
+// nsecCovers reports whether the NSEC range from owner to next covers name.
+func nsecCovers(owner, next, name *dnsmessage.Name) bool {
+	return covers(owner.Compare(name), name.Compare(next), next.Compare(owner))
+}
+
+// nsec3Covers reports whether the NSEC3 range from the hashed owner name owner
+// to next covers the hash h.
+func nsec3Covers(owner, next, h []byte) bool {
+	return covers(bytes.Compare(owner, h), bytes.Compare(h, next), bytes.Compare(next, owner))
+}
+
+// typesDenyData reports whether an NSEC or NSEC3 record with the given type
+// bit map matching the name in question proves that question has no data.
+func typesDenyData(types []dnsmessage.Type, question dnsmessage.Question) bool {
+	if hasType(types, question.Type) || hasType(types, dnsmessage.TypeCNAME) {
+		return false
+	}
+	if question.Type == typeDS {
+		// The DS RRset lives in the parent zone. A record from the apex
+		// of the child zone says nothing about it.
+		return !hasType(types, dnsmessage.TypeSOA)
+	}
+	// A record from the parent side of a delegation only proves what the
+	// parent zone holds (RFC 4035, section 5.4).
+	return !hasType(types, dnsmessage.TypeNS) || hasType(types, dnsmessage.TypeSOA)
+}
+
+// isDelegation reports whether an NSEC or NSEC3 record with the given type bit
+// map is at a delegation point or DNAME, in which case it can't be used to
+// deny names below it.
+func isDelegation(types []dnsmessage.Type) bool {
+	return hasType(types, typeDNAME) || hasType(types, dnsmessage.TypeNS) && !hasType(types, dnsmessage.TypeSOA)
+}
+
+// commonAncestor returns the closest common ancestor of a and b.
+func commonAncestor(a, b dnsmessage.Name) dnsmessage.Name {
+	for a.Labels() > b.Labels() {
+		a = a.Parent()
+	}
+	for b.Labels() > a.Labels() {
+		b = b.Parent()
+	}
+	for !a.Equals(&b) {
+		a = a.Parent()
+		b = b.Parent()
+	}
+	return a
+}
+
+// wildcardName returns the wildcard name (RFC 4592) immediately below n.
+func wildcardName(n dnsmessage.Name) (dnsmessage.Name, error) {
+	s := n.String()
+	if s == "." {
+		s = ""
+	}
+	return dnsmessage.NewName("*." + s)
+}
+
+// nsec3Hash computes the hashed owner name of n (RFC 5155, section 5).
+func nsec3Hash(n *dnsmessage.Name, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(n.AppendCanonical(nil))
+	h.Write(salt)
+	sum := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(salt)
+		sum = h.Sum(sum[:0])
+	}
+	return sum
+}
+
+// find returns the entry in entries, which is sorted by owner, with the
+// greatest owner which is not greater than a target, or nil if there is none.
+// compare compares the owner of an entry to the target. find also reports
+// whether the entry matches the target exactly.
+func find(entries []*cacheEntry, compare func(*cacheEntry) int) (*cacheEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return compare(entries[i]) > 0
+	})
+	if i == 0 {
+		return nil, false
+	}
+	e := entries[i-1]
+	return e, compare(e) == 0
+}
+
+// compareNSEC compares the owner names of NSEC entries in canonical order.
+func compareNSEC(a, b *cacheEntry) int {
+	return a.rrs[0].Header.Name.Compare(&b.rrs[0].Header.Name)
+}
+
+// compareNSEC3 compares the hashed owner names of NSEC3 entries.
+func compareNSEC3(a, b *cacheEntry) int {
+	return bytes.Compare(a.hash, b.hash)
+}
+
+// insertSorted inserts e into entries, which is sorted by owner as compared
+// by compare.
+func insertSorted(entries []*cacheEntry, e *cacheEntry, compare func(a, b *cacheEntry) int) []*cacheEntry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return compare(entries[i], e) >= 0
+	})
+	entries = append(entries, nil)
+	copy(entries[i+1:], entries[i:])
+	entries[i] = e
+	return entries
+}
+
+// removeEntry removes e from entries.
+func removeEntry(entries []*cacheEntry, e *cacheEntry) []*cacheEntry {
+	for i, f := range entries {
+		if f == e {
+			copy(entries[i:], entries[i+1:])
+			entries[len(entries)-1] = nil
+			return entries[:len(entries)-1]
+		}
+	}
+	return entries
+}
+
+// aggressiveNSEC reports whether NSEC and NSEC3 records should be used to
+// synthesize negative responses.
+func (c *cachingResolver) aggressiveNSEC() bool {
+	return c.config.EnableNegativeCaching && c.config.EnableAggressiveNSEC
+}
+
+// removeNSEC removes an NSEC entry from its zone.
+//
+// c.mu must be held.
+func (c *cachingResolver) removeNSEC(e *cacheEntry) {
+	z := e.zone
+	if e.key.question.Type == dnsmessage.TypeNSEC3 {
+		z.nsec3 = removeEntry(z.nsec3, e)
+	} else {
+		z.nsec = removeEntry(z.nsec, e)
+	}
+	if len(z.nsec) == 0 && len(z.nsec3) == 0 {
+		delete(c.zones, z.key)
+	}
+}
+
+// putNSEC stores the NSEC and NSEC3 records from a validated negative
+// response in the cache.
+func (c *cachingResolver) putNSEC(msg dnsmessage.Message) {
+	if !msg.Header.AuthenticData {
+		// The nested resolver did not validate the response.
+		return
+	}
+
+	// The SOA record identifies the zone.
+	var soa *dnsmessage.Resource
+	for i := range msg.Authorities {
+		if _, ok := msg.Authorities[i].Body.(*dnsmessage.SOAResource); ok {
+			soa = &msg.Authorities[i]
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+	apex := soa.Header.Name
+	class := soa.Header.Class
+
+	// From RFC 8198, section 5.4:
+	// the TTL of the NSEC/NSEC3 record ... MUST NOT exceed the negative
+	// TTL of the zone.
+	negTTL := soa.Header.TTL
+	if min := soa.Body.(*dnsmessage.SOAResource).MinTTL; negTTL > min {
+		negTTL = min
+	}
+	if negTTL > c.config.MaxNegativeTTL {
+		negTTL = c.config.MaxNegativeTTL
+	}
+	if negTTL == 0 {
+		return
+	}
+
+	var records []dnsmessage.Resource
+	for _, r := range msg.Authorities {
+		if r.Header.Class != class || !r.Header.Name.IsSubdomain(&apex) {
+			continue
+		}
+		switch b := r.Body.(type) {
+		case *dnsmessage.NSECResource:
+			if !b.NextDomain.IsSubdomain(&apex) {
+				continue
+			}
+		case *dnsmessage.NSEC3Resource:
+			if b.HashAlgorithm != nsec3SHA1 || b.Iterations > maxNSEC3Iterations {
+				continue
+			}
+			if p := r.Header.Name.Parent(); !p.Equals(&apex) {
+				continue
+			}
+		default:
+			continue
+		}
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.config.now()
+
+	zk := zoneKey(&apex, class)
+	z, ok := c.zones[zk]
+	if !ok {
+		z = &nsecZone{key: zk, apex: apex}
+		c.zones[zk] = z
+	}
+	z.soa = *soa
+	z.soaCreated = now
+	z.soaExpires = now.Add(time.Duration(negTTL) * time.Second)
+	z.recursionAvailable = msg.Header.RecursionAvailable
+
+	for _, r := range records {
+		ttl := r.Header.TTL
+		if ttl > negTTL {
+			ttl = negTTL
+		}
+		if ttl == 0 {
+			continue
+		}
+
+		e := &cacheEntry{
+			key: cacheKey{
+				question: dnsmessage.Question{Name: r.Header.Name, Type: r.Header.Type, Class: class},
+				kind:     nsecEntry,
+			},
+			rrs:     []dnsmessage.Resource{r},
+			zone:    z,
+			expires: c.expiry(now, ttl),
+			created: now,
+		}
+
+		// Include the signatures so that the synthesized response can
+		// be validated downstream.
+		for _, sig := range msg.Authorities {
+			if t, ok := coveredType(sig); ok && t == r.Header.Type && sig.Header.Name.Equals(&r.Header.Name) {
+				e.rrs = append(e.rrs, sig)
+			}
+		}
+
+		if b, ok := r.Body.(*dnsmessage.NSEC3Resource); ok {
+			label := strings.SplitN(r.Header.Name.String(), ".", 2)[0]
+			hash, err := nsec3Encoding.DecodeString(strings.ToUpper(label))
+			if err != nil || len(hash) != len(b.NextHashedOwner) {
+				continue
+			}
+			e.hash = hash
+			if len(z.nsec3) == 0 {
+				z.nsec3Salt = b.Salt
+				z.nsec3Iterations = b.Iterations
+			} else if !bytes.Equal(z.nsec3Salt, b.Salt) || z.nsec3Iterations != b.Iterations {
+				// The zone's NSEC3 parameters have changed.
+				for len(z.nsec3) > 0 {
+					c.remove(z.nsec3[0])
+				}
+				if _, ok := c.zones[zk]; !ok {
+					c.zones[zk] = z
+				}
+				z.nsec3Salt = b.Salt
+				z.nsec3Iterations = b.Iterations
+			}
+		}
+
+		// Remove any entry with the same owner before adding the new
+		// one to the zone index.
+		if old, ok := c.m[e.key]; ok {
+			c.remove(old)
+			if _, ok := c.zones[zk]; !ok {
+				c.zones[zk] = z
+			}
+		}
+		if e.hash != nil {
+			z.nsec3 = insertSorted(z.nsec3, e, compareNSEC3)
+		} else {
+			z.nsec = insertSorted(z.nsec, e, compareNSEC)
+		}
+		c.insert(e)
+	}
+}
+
+// findZone returns the closest enclosing zone of name with cached NSEC or
+// NSEC3 records.
+//
+// c.mu must be held.
+func (c *cachingResolver) findZone(name dnsmessage.Name, class dnsmessage.Class) *nsecZone {
+	for {
+		if z, ok := c.zones[zoneKey(&name, class)]; ok {
+			return z
+		}
+		if name.Labels() == 0 {
+			return nil
+		}
+		name = name.Parent()
+	}
+}
+
+// use checks that e has not expired and marks it as recently used.
+//
+// c.mu must be held.
+func (c *cachingResolver) use(e *cacheEntry, now time.Time) bool {
+	return e != nil && c.get(e.key, now) == e
+}
+
+// synthesize attempts to synthesize a negative response to question from
+// cached NSEC or NSEC3 records as described in RFC 8198.
+func (c *cachingResolver) synthesize(question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.config.now()
+
+	z := c.findZone(question.Name, question.Class)
+	if z == nil || now.After(z.soaExpires) {
+		return dnsmessage.Message{}, false
+	}
+
+	var (
+		rcode  dnsmessage.RCode
+		proofs []*cacheEntry
+		ok     bool
+	)
+	if len(z.nsec) > 0 {
+		rcode, proofs, ok = c.synthesizeNSEC(z, question, now)
+	}
+	if !ok && len(z.nsec3) > 0 {
+		rcode, proofs, ok = c.synthesizeNSEC3(z, question, now)
+	}
+	if !ok {
+		return dnsmessage.Message{}, false
+	}
+
+	soa := []dnsmessage.Resource{z.soa}
+	adjustTTL(soa, now.Sub(z.soaCreated), true)
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:           true,
+			RecursionDesired:   recursionDesired,
+			RecursionAvailable: z.recursionAvailable,
+			AuthenticData:      true,
+			RCode:              rcode,
+		},
+		Questions:   []dnsmessage.Question{question},
+		Authorities: soa,
+	}
+	for i, e := range proofs {
+		duplicate := false
+		for _, f := range proofs[:i] {
+			duplicate = duplicate || e == f
+		}
+		if !duplicate {
+			m.Authorities = appendRRset(m.Authorities, e, false, now)
+		}
+	}
+	return m, true
+}
+
+// synthesizeNSEC attempts to prove that question has no answer using cached
+// NSEC records (RFC 4035, section 5.4).
+//
+// c.mu must be held.
+func (c *cachingResolver) synthesizeNSEC(z *nsecZone, question dnsmessage.Question, now time.Time) (dnsmessage.RCode, []*cacheEntry, bool) {
+	e, match := find(z.nsec, func(e *cacheEntry) int {
+		return e.rrs[0].Header.Name.Compare(&question.Name)
+	})
+	if !c.use(e, now) {
+		return 0, nil, false
+	}
+	nsec := e.rrs[0].Body.(*dnsmessage.NSECResource)
+	if match {
+		if !typesDenyData(nsec.Types, question) {
+			return 0, nil, false
+		}
+		return dnsmessage.RCodeSuccess, []*cacheEntry{e}, true
+	}
+
+	owner := e.rrs[0].Header.Name
+	if !nsecCovers(&owner, &nsec.NextDomain, &question.Name) {
+		return 0, nil, false
+	}
+	if question.Name.IsSubdomain(&owner) && isDelegation(nsec.Types) {
+		return 0, nil, false
+	}
+
+	// The name doesn't exist. Check that it could not have been
+	// synthesized from a wildcard at the closest encloser.
+	ce := commonAncestor(question.Name, owner)
+	if ce2 := commonAncestor(question.Name, nsec.NextDomain); ce2.Labels() > ce.Labels() {
+		ce = ce2
+	}
+	wildcard, err := wildcardName(ce)
+	if err != nil {
+		return 0, nil, false
+	}
+	we, match := find(z.nsec, func(e *cacheEntry) int {
+		return e.rrs[0].Header.Name.Compare(&wildcard)
+	})
+	if match || !c.use(we, now) {
+		return 0, nil, false
+	}
+	wnsec := we.rrs[0].Body.(*dnsmessage.NSECResource)
+	if !nsecCovers(&we.rrs[0].Header.Name, &wnsec.NextDomain, &wildcard) {
+		return 0, nil, false
+	}
+	return dnsmessage.RCodeNameError, []*cacheEntry{e, we}, true
+}
+
+// findNSEC3 returns a cached NSEC3 entry which matches or covers name, and
+// whether it matches.
+//
+// c.mu must be held.
+func (c *cachingResolver) findNSEC3(z *nsecZone, name *dnsmessage.Name, now time.Time) (*cacheEntry, bool) {
+	h := nsec3Hash(name, z.nsec3Salt, z.nsec3Iterations)
+	e, match := find(z.nsec3, func(e *cacheEntry) int {
+		return bytes.Compare(e.hash, h)
+	})
+	if e == nil && len(z.nsec3) > 0 {
+		// The hash sorts before all cached hashes, so it can only be
+		// covered by the range which wraps around.
+		e = z.nsec3[len(z.nsec3)-1]
+	}
+	if !c.use(e, now) {
+		return nil, false
+	}
+	if match {
+		return e, true
+	}
+	next := e.rrs[0].Body.(*dnsmessage.NSEC3Resource).NextHashedOwner
+	if bytes.Compare(e.hash, h) >= 0 {
+		// Only the wrap around range can cover h.
+		if bytes.Compare(next, e.hash) > 0 || bytes.Compare(h, next) >= 0 {
+			return nil, false
+		}
+		return e, false
+	}
+	if !nsec3Covers(e.hash, next, h) {
+		return nil, false
+	}
+	return e, false
+}
+
+// synthesizeNSEC3 attempts to prove that question has no answer using cached
+// NSEC3 records (RFC 5155, section 8).
+//
+// c.mu must be held.
+func (c *cachingResolver) synthesizeNSEC3(z *nsecZone, question dnsmessage.Question, now time.Time) (dnsmessage.RCode, []*cacheEntry, bool) {
+	// Find the closest encloser.
+	var (
+		ce, nextCloser dnsmessage.Name
+		ceEntry        *cacheEntry
+	)
+	for n := question.Name; n.IsSubdomain(&z.apex); n = n.Parent() {
+		e, match := c.findNSEC3(z, &n, now)
+		if match {
+			ce, ceEntry = n, e
+			break
+		}
+		if n.Labels() == z.apex.Labels() {
+			break
+		}
+		nextCloser = n
+	}
+	if ceEntry == nil {
+		return 0, nil, false
+	}
+	types := ceEntry.rrs[0].Body.(*dnsmessage.NSEC3Resource).Types
+
+	if ce.Labels() == question.Name.Labels() {
+		if !typesDenyData(types, question) {
+			return 0, nil, false
+		}
+		return dnsmessage.RCodeSuccess, []*cacheEntry{ceEntry}, true
+	}
+	if isDelegation(types) {
+		return 0, nil, false
+	}
+
+	// From RFC 8198, section 5.2:
+	// ... if the NSEC3 record covering the next closer name has the
+	// Opt-Out flag set, the name may exist as an unsigned delegation.
+	nce, match := c.findNSEC3(z, &nextCloser, now)
+	if nce == nil || match || nce.rrs[0].Body.(*dnsmessage.NSEC3Resource).Flags&dnsmessage.NSEC3OptOut != 0 {
+		return 0, nil, false
+	}
+
+	wildcard, err := wildcardName(ce)
+	if err != nil {
+		return 0, nil, false
+	}
+	we, match := c.findNSEC3(z, &wildcard, now)
+	if we == nil || match {
+		return 0, nil, false
+	}
+	return dnsmessage.RCodeNameError, []*cacheEntry{ceEntry, nce, we}, true
+}
@@ -8,13 +8,16 @@
 // The package also supports messages with Extension Mechanisms for DNS
 // (EDNS(0)) as defined in RFC 6891.
 //
+// Resource records of types which the package has no specific ResourceBody
+// for, such as RRSIG or private use types, are unpacked as UnknownResource
+// with their data stored as-is (RFC 3597) instead of failing to parse.
+//
 // This implementation is designed to minimize heap allocations and avoid
 // unnecessary packing and unpacking as much as possible.
 package dnsmessage
 
 import (
 	"errors"
-	"fmt"
 )
 
 // Message formats
@@ -34,6 +37,9 @@ const (
 	TypeAAAA  Type = 28
 	TypeSRV   Type = 33
 	TypeOPT   Type = 41
+	TypeRRSIG Type = 46
+	TypeNSEC  Type = 47
+	TypeNSEC3 Type = 50
 
 	// Question.Type
 	TypeWKS   Type = 11
@@ -54,6 +60,9 @@ var typeNames = map[Type]string{
 	TypeAAAA:  "TypeAAAA",
 	TypeSRV:   "TypeSRV",
 	TypeOPT:   "TypeOPT",
+	TypeRRSIG: "TypeRRSIG",
+	TypeNSEC:  "TypeNSEC",
+	TypeNSEC3: "TypeNSEC3",
 	TypeWKS:   "TypeWKS",
 	TypeHINFO: "TypeHINFO",
 	TypeMINFO: "TypeMINFO",
@@ -279,6 +288,7 @@ var (
 	errStringTooLong      = errors.New("character string exceeds maximum length (255)")
 	errCompressedSRV      = errors.New("compressed name in SRV resource data")
 	errInvalidEscape      = errors.New("escaped text is invalid")
+	errInvalidTypeBitMap  = errors.New("invalid type bit map")
 )
 
 // Internal constants.
@@ -324,6 +334,8 @@ type Header struct {
 	Truncated          bool
 	RecursionDesired   bool
 	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
 	RCode              RCode
 }
 
@@ -333,6 +345,12 @@ func (m *Header) pack() (id uint16, bits uint16) {
 	if m.RecursionAvailable {
 		bits |= headerBitRA
 	}
+	if m.AuthenticData {
+		bits |= headerBitAD
+	}
+	if m.CheckingDisabled {
+		bits |= headerBitCD
+	}
 	if m.RecursionDesired {
 		bits |= headerBitRD
 	}
@@ -358,6 +376,8 @@ func (m *Header) GoString() string {
 		"Truncated: " + printBool(m.Truncated) + ", " +
 		"RecursionDesired: " + printBool(m.RecursionDesired) + ", " +
 		"RecursionAvailable: " + printBool(m.RecursionAvailable) + ", " +
+		"AuthenticData: " + printBool(m.AuthenticData) + ", " +
+		"CheckingDisabled: " + printBool(m.CheckingDisabled) + ", " +
 		"RCode: " + m.RCode.GoString() + "}"
 }
 
@@ -386,6 +406,8 @@ const (
 	headerBitTC = 1 << 9  // truncated
 	headerBitRD = 1 << 8  // recursion desired
 	headerBitRA = 1 << 7  // recursion available
+	headerBitAD = 1 << 5  // authentic data (RFC 4035, section 3.2.3)
+	headerBitCD = 1 << 4  // checking disabled (RFC 4035, section 3.2.2)
 )
 
 var sectionNames = map[section]string{
@@ -463,6 +485,8 @@ func (h *header) header() Header {
 		Truncated:          (h.bits & headerBitTC) != 0,
 		RecursionDesired:   (h.bits & headerBitRD) != 0,
 		RecursionAvailable: (h.bits & headerBitRA) != 0,
+		AuthenticData:      (h.bits & headerBitAD) != 0,
+		CheckingDisabled:   (h.bits & headerBitCD) != 0,
 		RCode:              RCode(h.bits & 0xF),
 	}
 }
@@ -1030,6 +1054,60 @@ func (p *Parser) OPTResource() (OPTResource, error) {
 	return r, nil
 }
 
+// NSECResource parses a single NSECResource.
+//
+// One of the XXXHeader methods must have been called before calling this
+// method.
+func (p *Parser) NSECResource() (NSECResource, error) {
+	if !p.resHeaderValid || p.resHeader.Type != TypeNSEC {
+		return NSECResource{}, ErrNotStarted
+	}
+	r, err := unpackNSECResource(p.msg, p.off, p.resHeader.Length)
+	if err != nil {
+		return NSECResource{}, err
+	}
+	p.off += int(p.resHeader.Length)
+	p.resHeaderValid = false
+	p.index++
+	return r, nil
+}
+
+// NSEC3Resource parses a single NSEC3Resource.
+//
+// One of the XXXHeader methods must have been called before calling this
+// method.
+func (p *Parser) NSEC3Resource() (NSEC3Resource, error) {
+	if !p.resHeaderValid || p.resHeader.Type != TypeNSEC3 {
+		return NSEC3Resource{}, ErrNotStarted
+	}
+	r, err := unpackNSEC3Resource(p.msg, p.off, p.resHeader.Length)
+	if err != nil {
+		return NSEC3Resource{}, err
+	}
+	p.off += int(p.resHeader.Length)
+	p.resHeaderValid = false
+	p.index++
+	return r, nil
+}
+
+// UnknownResource parses a single UnknownResource.
+//
+// One of the XXXHeader methods must have been called before calling this
+// method.
+func (p *Parser) UnknownResource() (UnknownResource, error) {
+	if !p.resHeaderValid {
+		return UnknownResource{}, ErrNotStarted
+	}
+	r, err := unpackUnknownResource(p.resHeader.Type, p.msg, p.off, p.resHeader.Length)
+	if err != nil {
+		return UnknownResource{}, err
+	}
+	p.off += int(p.resHeader.Length)
+	p.resHeaderValid = false
+	p.index++
+	return r, nil
+}
+
 // Unpack parses a full Message.
 func (m *Message) Unpack(msg []byte) error {
 	var p Parser
@@ -1564,6 +1642,78 @@ func (b *Builder) OPTResource(h ResourceHeader, r OPTResource) error {
 	return nil
 }
 
+// NSECResource adds a single NSECResource.
+func (b *Builder) NSECResource(h ResourceHeader, r NSECResource) error {
+	if err := b.checkResourceSection(); err != nil {
+		return err
+	}
+	h.Type = r.realType()
+	msg, lenOff, err := h.pack(b.msg, b.compression, b.start)
+	if err != nil {
+		return &nestedError{"ResourceHeader", err}
+	}
+	preLen := len(msg)
+	if msg, err = r.pack(msg, b.compression, b.start); err != nil {
+		return &nestedError{"NSECResource body", err}
+	}
+	if err := h.fixLen(msg, lenOff, preLen); err != nil {
+		return err
+	}
+	if err := b.incrementSectionCount(); err != nil {
+		return err
+	}
+	b.msg = msg
+	return nil
+}
+
+// NSEC3Resource adds a single NSEC3Resource.
+func (b *Builder) NSEC3Resource(h ResourceHeader, r NSEC3Resource) error {
+	if err := b.checkResourceSection(); err != nil {
+		return err
+	}
+	h.Type = r.realType()
+	msg, lenOff, err := h.pack(b.msg, b.compression, b.start)
+	if err != nil {
+		return &nestedError{"ResourceHeader", err}
+	}
+	preLen := len(msg)
+	if msg, err = r.pack(msg, b.compression, b.start); err != nil {
+		return &nestedError{"NSEC3Resource body", err}
+	}
+	if err := h.fixLen(msg, lenOff, preLen); err != nil {
+		return err
+	}
+	if err := b.incrementSectionCount(); err != nil {
+		return err
+	}
+	b.msg = msg
+	return nil
+}
+
+// UnknownResource adds a single UnknownResource.
+func (b *Builder) UnknownResource(h ResourceHeader, r UnknownResource) error {
+	if err := b.checkResourceSection(); err != nil {
+		return err
+	}
+	h.Type = r.realType()
+	msg, lenOff, err := h.pack(b.msg, b.compression, b.start)
+	if err != nil {
+		return &nestedError{"ResourceHeader", err}
+	}
+	preLen := len(msg)
+	if msg, err = r.pack(msg, b.compression, b.start); err != nil {
+		return &nestedError{"UnknownResource body", err}
+	}
+	if err := h.fixLen(msg, lenOff, preLen); err != nil {
+		return err
+	}
+	if err := b.incrementSectionCount(); err != nil {
+		return err
+	}
+	b.msg = msg
+	return nil
+}
+
 // Finish ends message building and generates a binary message.
 func (b *Builder) Finish() ([]byte, error) {
 	if b.section < sectionHeader {
@@ -1916,6 +2066,116 @@ func (n *Name) Equals(other *Name) bool {
 	return true
 }
 
+// labelOffsets stores the offsets of the labels of n, not including the root
+// label, in offs and returns the number of labels.
+func (n *Name) labelOffsets(offs *[nameLen / 2]uint8) int {
+	c := 0
+	for i := 0; i < int(n.length) && n.data[i] != 0; i += int(n.data[i]) + 1 {
+		offs[c] = uint8(i)
+		c++
+	}
+	return c
+}
+
+// label returns the label of n at offset off, without the length prefix.
+func (n *Name) label(off uint8) []byte {
+	return n.data[off+1 : off+1+n.data[off]]
+}
+
+// Labels returns the number of labels in n, not including the root label.
+func (n *Name) Labels() int {
+	var offs [nameLen / 2]uint8
+	return n.labelOffsets(&offs)
+}
+
+// Parent returns n with its leftmost label removed. The parent of the root
+// domain is the root domain.
+func (n *Name) Parent() Name {
+	if n.length <= 1 {
+		return *n
+	}
+	l := n.data[0] + 1
+	p := Name{length: n.length - l}
+	copy(p.data[:], n.data[l:n.length])
+	return p
+}
+
+// IsSubdomain reports whether n is equal to or below parent, ignoring case.
+func (n *Name) IsSubdomain(parent *Name) bool {
+	if parent.length == 0 || n.length < parent.length {
+		return false
+	}
+	off := 0
+	for int(n.length)-off > int(parent.length) {
+		off += int(n.data[off]) + 1
+	}
+	if int(n.length)-off != int(parent.length) {
+		return false
+	}
+	suffix := Name{length: parent.length}
+	copy(suffix.data[:], n.data[off:n.length])
+	return suffix.Equals(parent)
+}
+
+// Compare compares n and other in canonical DNS name order (RFC 4034, section
+// 6.1). The result is 0 if n and other are equal ignoring case, -1 if n sorts
+// before other and +1 if n sorts after other.
+func (n *Name) Compare(other *Name) int {
+	var a, b [nameLen / 2]uint8
+	i, j := n.labelOffsets(&a)-1, other.labelOffsets(&b)-1
+	for ; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := compareLabels(n.label(a[i]), other.label(b[j])); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case i < j:
+		return -1
+	case i > j:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareLabels compares two labels as case-insensitive byte strings.
+func compareLabels(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, y := toLower(a[i]), toLower(b[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func toLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 0x20
+	}
+	return c
+}
+
+// AppendCanonical appends the canonical wire format of n (RFC 4034, section
+// 6.2) to b. This is the uncompressed wire format with all letters in lower
+// case.
+func (n *Name) AppendCanonical(b []byte) []byte {
+	for _, c := range n.data[:n.length] {
+		b = append(b, toLower(c))
+	}
+	return b
+}
+
 func requiresNumberEscape(c byte) bool {
 	return c < ' ' && c != '\t' || '~' < c
 }
@@ -2327,13 +2587,25 @@ func unpackResourceBody(msg []byte, off int, hdr ResourceHeader) (ResourceBody,
 		rb, err = unpackOPTResource(msg, off, hdr.Length)
 		r = &rb
 		name = "OPT"
+	case TypeNSEC:
+		var rb NSECResource
+		rb, err = unpackNSECResource(msg, off, hdr.Length)
+		r = &rb
+		name = "NSEC"
+	case TypeNSEC3:
+		var rb NSEC3Resource
+		rb, err = unpackNSEC3Resource(msg, off, hdr.Length)
+		r = &rb
+		name = "NSEC3"
+	default:
+		var rb UnknownResource
+		rb, err = unpackUnknownResource(hdr.Type, msg, off, hdr.Length)
+		r = &rb
+		name = "Unknown"
 	}
 	if err != nil {
 		return nil, off, &nestedError{name + " record", err}
 	}
-	if r == nil {
-		return nil, off, fmt.Errorf("invalid resource type: %d", hdr.Type)
-	}
 	return r, off + int(hdr.Length), nil
 }
 
@@ -2777,3 +3049,264 @@ func unpackOPTResource(msg []byte, off int, length uint16) (OPTResource, error)
 	}
 	return OPTResource{opts}, nil
 }
+
+// An NSECResource is an NSEC Resource record as defined in RFC 4034, section
+// 4.
+type NSECResource struct {
+	NextDomain Name // Not compressed as per RFC 4034.
+	Types      []Type
+}
+
+func (r *NSECResource) realType() Type {
+	return TypeNSEC
+}
+
+// pack appends the wire format of the NSECResource to msg.
+func (r *NSECResource) pack(msg []byte, compression map[string]int, compressionOff int) ([]byte, error) {
+	oldMsg := msg
+	msg, err := r.NextDomain.pack(msg, nil, compressionOff)
+	if err != nil {
+		return oldMsg, &nestedError{"NSECResource.NextDomain", err}
+	}
+	return packTypeBitMap(msg, r.Types), nil
+}
+
+// GoString implements fmt.GoStringer.GoString.
+func (r *NSECResource) GoString() string {
+	return "dnsmessage.NSECResource{" +
+		"NextDomain: " + r.NextDomain.GoString() + ", " +
+		"Types: " + printTypes(r.Types) + "}"
+}
+
+func unpackNSECResource(msg []byte, off int, length uint16) (NSECResource, error) {
+	end := off + int(length)
+	if end > len(msg) {
+		return NSECResource{}, errResourceLen
+	}
+	var next Name
+	off, err := next.unpackCompressed(msg[:end], off, false /* allowCompression */)
+	if err != nil {
+		return NSECResource{}, &nestedError{"NextDomain", err}
+	}
+	types, err := unpackTypeBitMap(msg[off:end])
+	if err != nil {
+		return NSECResource{}, &nestedError{"Types", err}
+	}
+	return NSECResource{next, types}, nil
+}
+
+// An NSEC3Resource is an NSEC3 Resource record as defined in RFC 5155,
+// section 3.
+type NSEC3Resource struct {
+	HashAlgorithm   uint8
+	Flags           uint8
+	Iterations      uint16
+	Salt            []byte
+	NextHashedOwner []byte
+	Types           []Type
+}
+
+// NSEC3OptOut is the Opt-Out flag of an NSEC3Resource (RFC 5155, section
+// 3.1.2.1).
+const NSEC3OptOut = 1
+
+func (r *NSEC3Resource) realType() Type {
+	return TypeNSEC3
+}
+
+// pack appends the wire format of the NSEC3Resource to msg.
+func (r *NSEC3Resource) pack(msg []byte, compression map[string]int, compressionOff int) ([]byte, error) {
+	if len(r.Salt) > 255 {
+		return msg, &nestedError{"NSEC3Resource.Salt", errSegTooLong}
+	}
+	if len(r.NextHashedOwner) > 255 {
+		return msg, &nestedError{"NSEC3Resource.NextHashedOwner", errSegTooLong}
+	}
+	msg = append(msg, r.HashAlgorithm, r.Flags)
+	msg = packUint16(msg, r.Iterations)
+	msg = append(msg, byte(len(r.Salt)))
+	msg = packBytes(msg, r.Salt)
+	msg = append(msg, byte(len(r.NextHashedOwner)))
+	msg = packBytes(msg, r.NextHashedOwner)
+	return packTypeBitMap(msg, r.Types), nil
+}
+
+// GoString implements fmt.GoStringer.GoString.
+func (r *NSEC3Resource) GoString() string {
+	return "dnsmessage.NSEC3Resource{" +
+		"HashAlgorithm: " + string(printUint8Bytes(nil, r.HashAlgorithm)) + ", " +
+		"Flags: " + string(printUint8Bytes(nil, r.Flags)) + ", " +
+		"Iterations: " + printUint16(r.Iterations) + ", " +
+		"Salt: []byte{" + printByteSlice(r.Salt) + "}, " +
+		"NextHashedOwner: []byte{" + printByteSlice(r.NextHashedOwner) + "}, " +
+		"Types: " + printTypes(r.Types) + "}"
+}
+
+func unpackNSEC3Resource(msg []byte, off int, length uint16) (NSEC3Resource, error) {
+	end := off + int(length)
+	if end > len(msg) {
+		return NSEC3Resource{}, errResourceLen
+	}
+	msg = msg[:end]
+	var r NSEC3Resource
+	if off+4 > end {
+		return NSEC3Resource{}, errBaseLen
+	}
+	r.HashAlgorithm = msg[off]
+	r.Flags = msg[off+1]
+	r.Iterations, off, _ = unpackUint16(msg, off+2)
+	var err error
+	if r.Salt, off, err = unpackLengthPrefixedBytes(msg, off); err != nil {
+		return NSEC3Resource{}, &nestedError{"Salt", err}
+	}
+	if r.NextHashedOwner, off, err = unpackLengthPrefixedBytes(msg, off); err != nil {
+		return NSEC3Resource{}, &nestedError{"NextHashedOwner", err}
+	}
+	if r.Types, err = unpackTypeBitMap(msg[off:]); err != nil {
+		return NSEC3Resource{}, &nestedError{"Types", err}
+	}
+	return r, nil
+}
+
+// An UnknownResource is a Resource record of a type which is not otherwise
+// supported by this package, such as RRSIG. The data is stored as-is
+// (RFC 3597).
+//
+// Parsing a record of any type without a specific ResourceBody returns an
+// UnknownResource, so that messages with such records, which are common with
+// DNSSEC, can be parsed and packed again unchanged. Versions of this package
+// before UnknownResource was added returned an error for these records.
+type UnknownResource struct {
+	Type Type
+	Data []byte
+}
+
+func (r *UnknownResource) realType() Type {
+	return r.Type
+}
+
+// pack appends the wire format of the UnknownResource to msg.
+func (r *UnknownResource) pack(msg []byte, compression map[string]int, compressionOff int) ([]byte, error) {
+	return packBytes(msg, r.Data), nil
+}
+
+// GoString implements fmt.GoStringer.GoString.
+func (r *UnknownResource) GoString() string {
+	return "dnsmessage.UnknownResource{" +
+		"Type: " + r.Type.GoString() + ", " +
+		"Data: []byte{" + printByteSlice(r.Data) + "}}"
+}
+
+func unpackUnknownResource(recordType Type, msg []byte, off int, length uint16) (UnknownResource, error) {
+	// Make a copy because the caller might be reusing msg.
+	data := make([]byte, length)
+	if _, err := unpackBytes(msg, off, data); err != nil {
+		return UnknownResource{}, err
+	}
+	return UnknownResource{recordType, data}, nil
+}
+
+// unpackLengthPrefixedBytes unpacks a byte string preceded by a one byte
+// length.
+func unpackLengthPrefixedBytes(msg []byte, off int) ([]byte, int, error) {
+	if off >= len(msg) {
+		return nil, off, errBaseLen
+	}
+	l := int(msg[off])
+	off++
+	if off+l > len(msg) {
+		return nil, off, errCalcLen
+	}
+	b := make([]byte, l)
+	copy(b, msg[off:off+l])
+	return b, off + l, nil
+}
+
+// packTypeBitMap appends the type bit maps field of NSEC and NSEC3 records
+// (RFC 4034, section 4.1.2) to msg.
+func packTypeBitMap(msg []byte, types []Type) []byte {
+	var (
+		bitmap [32]byte
+		window = -1
+		used   int
+	)
+	flush := func() {
+		if window >= 0 {
+			msg = append(msg, byte(window), byte(used))
+			msg = append(msg, bitmap[:used]...)
+		}
+		bitmap = [32]byte{}
+		used = 0
+	}
+	for _, t := range sortedTypes(types) {
+		if w := int(t >> 8); w != window {
+			flush()
+			window = w
+		}
+		i := int(t&0xff) / 8
+		bitmap[i] |= 0x80 >> (t & 7)
+		if i >= used {
+			used = i + 1
+		}
+	}
+	flush()
+	return msg
+}
+
+// sortedTypes returns a sorted copy of types without duplicates.
+func sortedTypes(types []Type) []Type {
+	sorted := make([]Type, 0, len(types))
+	for _, t := range types {
+		i := 0
+		for i < len(sorted) && sorted[i] < t {
+			i++
+		}
+		if i < len(sorted) && sorted[i] == t {
+			continue
+		}
+		sorted = append(sorted, 0)
+		copy(sorted[i+1:], sorted[i:])
+		sorted[i] = t
+	}
+	return sorted
+}
+
+// unpackTypeBitMap unpacks the type bit maps field of NSEC and NSEC3 records
+// (RFC 4034, section 4.1.2). msg must contain exactly the field.
+func unpackTypeBitMap(msg []byte) ([]Type, error) {
+	var types []Type
+	lastWindow := -1
+	for len(msg) > 0 {
+		if len(msg) < 2 {
+			return nil, errBaseLen
+		}
+		window, l := int(msg[0]), int(msg[1])
+		if window <= lastWindow || l == 0 || l > 32 {
+			return nil, errInvalidTypeBitMap
+		}
+		if len(msg) < 2+l {
+			return nil, errCalcLen
+		}
+		for i, b := range msg[2 : 2+l] {
+			for j := 0; j < 8; j++ {
+				if b&(0x80>>j) != 0 {
+					types = append(types, Type(window<<8|i*8+j))
+				}
+			}
+		}
+		lastWindow = window
+		msg = msg[2+l:]
+	}
+	return types, nil
+}
+
+func printTypes(types []Type) string {
+	s := "[]dnsmessage.Type{"
+	for i, t := range types {
+		if i > 0 {
+			s += ", "
+		}
+		s += t.GoString()
+	}
+	return s + "}"
+}
@@ -0,0 +1,481 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsmetrics exports metrics about DNS servers and resolvers in the
+// Prometheus text exposition format.
+//
+// The format is described at
+// https://prometheus.io/docs/instrumenting/exposition_formats/. Metrics are
+// collected without depending on the Prometheus client library, so a Metrics
+// can be served with any HTTP server.
+package dnsmetrics
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+// contentType is the content type of the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Label values used when a request can't be classified.
+const (
+	labelOther = "other"
+	labelNone  = "none"
+)
+
+// typeLabels are the qtype label values of question types which are counted
+// separately. Other question types are counted as "other", which bounds the
+// number of time series regardless of the queries received.
+var typeLabels = map[dnsmessage.Type]string{
+	dnsmessage.TypeA:     "A",
+	dnsmessage.TypeNS:    "NS",
+	dnsmessage.TypeCNAME: "CNAME",
+	dnsmessage.TypeSOA:   "SOA",
+	dnsmessage.TypePTR:   "PTR",
+	dnsmessage.TypeMX:    "MX",
+	dnsmessage.TypeTXT:   "TXT",
+	dnsmessage.TypeAAAA:  "AAAA",
+	dnsmessage.TypeSRV:   "SRV",
+	35:                   "NAPTR",
+	43:                   "DS",
+	dnsmessage.TypeRRSIG: "RRSIG",
+	dnsmessage.TypeNSEC:  "NSEC",
+	48:                   "DNSKEY",
+	dnsmessage.TypeNSEC3: "NSEC3",
+	52:                   "TLSA",
+	64:                   "SVCB",
+	65:                   "HTTPS",
+	251:                  "IXFR",
+	dnsmessage.TypeAXFR:  "AXFR",
+	dnsmessage.TypeALL:   "ANY",
+	257:                  "CAA",
+}
+
+// rcodeLabels are the rcode label values of response codes which are counted
+// separately. Other response codes are counted as "other".
+var rcodeLabels = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// sizeBuckets are the upper bounds of the response size histogram buckets, in
+// bytes.
+var sizeBuckets = []uint64{64, 128, 256, 512, 1024, 1232, 2048, 4096, 8192, 16384, 65535}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets, in
+// nanoseconds.
+var latencyBuckets = []uint64{
+	100e3, 250e3, 500e3,
+	1e6, 2.5e6, 5e6, 10e6, 25e6, 50e6, 100e6, 250e6, 500e6,
+	1e9, 2.5e9, 5e9,
+}
+
+// A histogram counts observations in buckets. It must be created with
+// newHistogram.
+type histogram struct {
+	// bounds are the upper bounds of the buckets.
+	bounds []uint64
+
+	// div is the value observations and bounds are divided by when
+	// exported, to convert them to base units.
+	div float64
+
+	// counts holds the number of observations in each bucket, followed by
+	// the number of observations greater than the last bound. It must be
+	// accessed atomically.
+	counts []uint64
+
+	// sum is the sum of the observations. It must be accessed atomically.
+	sum uint64
+}
+
+func newHistogram(bounds []uint64, div float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		div:    div,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// observe records an observation of v.
+func (h *histogram) observe(v uint64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+// requestKey identifies a time series of the request counter.
+type requestKey struct {
+	transport string
+	qtype     string
+	rcode     string
+}
+
+type namedServerStats struct {
+	name  string
+	stats *dnsserver.Stats
+}
+
+type namedResolverStats struct {
+	name  string
+	stats *dnsresolver.Stats
+}
+
+// Metrics collects metrics about DNS servers and resolvers and serves them in
+// the Prometheus text exposition format.
+//
+// Metrics implements dnsserver.QueryLogger to collect metrics about the
+// requests handled by a server, and http.Handler to serve the metrics. The
+// counts kept by server and resolver Stats can be exported with AddServer and
+// AddResolver.
+//
+// A Metrics must be created with New. All methods are safe for concurrent
+// use.
+type Metrics struct {
+	// mu protects requests, servers and resolvers. The counters in
+	// requests must be accessed atomically.
+	mu        sync.RWMutex
+	requests  map[requestKey]*uint64
+	servers   []namedServerStats
+	resolvers []namedResolverStats
+
+	// sizes and latencies are indexed by transport.
+	sizes     [2]*histogram
+	latencies [2]*histogram
+}
+
+var (
+	_ dnsserver.QueryLogger = (*Metrics)(nil)
+	_ http.Handler          = (*Metrics)(nil)
+)
+
+// transports are the transport label values, indexed by whether the
+// transport is TCP.
+var transports = [2]string{"udp", "tcp"}
+
+func transportIndex(tcp bool) int {
+	if tcp {
+		return 1
+	}
+	return 0
+}
+
+// New creates a new Metrics.
+func New() *Metrics {
+	m := &Metrics{requests: make(map[requestKey]*uint64)}
+	for i := range transports {
+		m.sizes[i] = newHistogram(sizeBuckets, 1)
+		m.latencies[i] = newHistogram(latencyBuckets, 1e9)
+	}
+	return m
+}
+
+// AddServer exports the counts kept by stats, labeled with server name.
+//
+// stats is typically the Stats of a dnsserver.Config.
+func (m *Metrics) AddServer(name string, stats *dnsserver.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.servers = append(m.servers, namedServerStats{name, stats})
+}
+
+// AddResolver exports the counts kept by stats, labeled with resolver name.
+//
+// stats is typically the Stats of a resolver's configuration, such as a
+// dnscache.Config. The metrics are named after the counts of
+// dnsresolver.Stats, and those the resolver doesn't keep are exported as
+// zero. For a cache, dns_resolver_answers_total and
+// dns_resolver_deferrals_total count hits and misses.
+func (m *Metrics) AddResolver(name string, stats *dnsresolver.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resolvers = append(m.resolvers, namedResolverStats{name, stats})
+}
+
+// LogQuery implements dnsserver.QueryLogger.LogQuery.
+func (m *Metrics) LogQuery(l *dnsserver.QueryLog) {
+	t := transportIndex(l.TCP)
+	key := requestKey{
+		transport: transports[t],
+		qtype:     queryTypeLabel(l.Query),
+		rcode:     responseRCodeLabel(l.Response),
+	}
+	m.request(key)
+
+	if l.Response != nil {
+		m.sizes[t].observe(uint64(len(l.Response)))
+	}
+	if !l.QueryTime.IsZero() {
+		if d := l.ResponseTime.Sub(l.QueryTime); d >= 0 {
+			m.latencies[t].observe(uint64(d))
+		}
+	}
+}
+
+// request increments the request counter identified by key.
+func (m *Metrics) request(key requestKey) {
+	m.mu.RLock()
+	c, ok := m.requests[key]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if c, ok = m.requests[key]; !ok {
+			c = new(uint64)
+			m.requests[key] = c
+		}
+		m.mu.Unlock()
+	}
+	atomic.AddUint64(c, 1)
+}
+
+// queryTypeLabel returns the qtype label value of the query message query.
+func queryTypeLabel(query []byte) string {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return labelNone
+	}
+	q, err := p.Question()
+	if err != nil {
+		return labelNone
+	}
+	return typeLabel(q.Type)
+}
+
+// typeLabel returns the qtype label value of question type t.
+func typeLabel(t dnsmessage.Type) string {
+	if l, ok := typeLabels[t]; ok {
+		return l
+	}
+	return labelOther
+}
+
+// responseRCodeLabel returns the rcode label value of the response message
+// resp.
+func responseRCodeLabel(resp []byte) string {
+	if resp == nil {
+		return labelNone
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return labelOther
+	}
+	return rcodeLabel(h.RCode)
+}
+
+// rcodeLabel returns the rcode label value of response code rcode.
+func rcodeLabel(rcode dnsmessage.RCode) string {
+	if l, ok := rcodeLabels[rcode]; ok {
+		return l
+	}
+	return labelOther
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP by writing the metrics in the
+// Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	bw.Flush()
+}
+
+// write writes the metrics to w.
+func (m *Metrics) write(w *bufio.Writer) {
+	m.mu.RLock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	counts := make(map[requestKey]uint64, len(m.requests))
+	for k, c := range m.requests {
+		counts[k] = atomic.LoadUint64(c)
+	}
+	servers := append([]namedServerStats(nil), m.servers...)
+	resolvers := append([]namedResolverStats(nil), m.resolvers...)
+	m.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.transport != b.transport {
+			return a.transport < b.transport
+		}
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		return a.rcode < b.rcode
+	})
+	writeHeader(w, "dns_requests_total", "counter", "DNS requests handled, by transport, question type and response code.")
+	for _, k := range keys {
+		writeSample(w, "dns_requests_total", labels("transport", k.transport, "qtype", k.qtype, "rcode", k.rcode), uintValue(counts[k]))
+	}
+
+	writeHeader(w, "dns_response_size_bytes", "histogram", "Size of DNS responses, by transport.")
+	for i, t := range transports {
+		writeHistogram(w, "dns_response_size_bytes", "transport", t, m.sizes[i])
+	}
+	writeHeader(w, "dns_request_duration_seconds", "histogram", "Time taken to handle DNS requests, by transport.")
+	for i, t := range transports {
+		writeHistogram(w, "dns_request_duration_seconds", "transport", t, m.latencies[i])
+	}
+
+	serverCounters := []struct {
+		name, help string
+		value      func(*dnsserver.Stats) uint64
+	}{
+		{"dns_server_udp_dropped_total", "UDP requests dropped because the queue was full.", (*dnsserver.Stats).UDPDropped},
+		{"dns_server_udp_rejected_total", "UDP requests rejected because the queue was full.", (*dnsserver.Stats).UDPRejected},
+		{"dns_server_rrl_dropped_total", "UDP responses dropped by Response Rate Limiting.", (*dnsserver.Stats).RRLDropped},
+		{"dns_server_rrl_slipped_total", "Truncated UDP responses sent by Response Rate Limiting.", (*dnsserver.Stats).RRLSlipped},
+		{"dns_server_panics_total", "Panics recovered while resolving requests.", (*dnsserver.Stats).Panics},
+	}
+	if len(servers) > 0 {
+		for _, c := range serverCounters {
+			writeHeader(w, c.name, "counter", c.help)
+			for _, s := range servers {
+				writeSample(w, c.name, labels("server", s.name), uintValue(c.value(s.stats)))
+			}
+		}
+	}
+
+	snapshots := make([]dnsresolver.StatsSnapshot, len(resolvers))
+	for i, r := range resolvers {
+		snapshots[i] = r.stats.Snapshot()
+	}
+	resolverCounters := []struct {
+		name, help string
+		value      func(*dnsresolver.StatsSnapshot) uint64
+	}{
+		{"dns_resolver_questions_total", "Questions received by the resolver.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Questions }},
+		{"dns_resolver_rejected_total", "Questions rejected by the resolver.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Rejected }},
+		{"dns_resolver_errors_total", "Errors encountered by the resolver, including those of the resolvers it defers to.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Errors }},
+		{"dns_resolver_answers_total", "Questions answered by the resolver itself, such as from a cache.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Answers }},
+		{"dns_resolver_deferrals_total", "Questions deferred to a nested resolver.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Deferrals }},
+		{"dns_resolver_synthesized_total", "Questions answered with responses synthesized from cached records.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Synthesized }},
+		{"dns_resolver_cached_failures_total", "Questions answered from cached failures.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.CachedFailures }},
+		{"dns_resolver_evictions_total", "Entries evicted to make room for new entries.", func(s *dnsresolver.StatsSnapshot) uint64 { return s.Evictions }},
+	}
+	if len(resolvers) > 0 {
+		for _, c := range resolverCounters {
+			writeHeader(w, c.name, "counter", c.help)
+			for i, r := range resolvers {
+				writeSample(w, c.name, labels("resolver", r.name), uintValue(c.value(&snapshots[i])))
+			}
+		}
+		writeHeader(w, "dns_resolver_entries", "gauge", "Entries held by the resolver, such as cached responses.")
+		for i, r := range resolvers {
+			writeSample(w, "dns_resolver_entries", labels("resolver", r.name), strconv.FormatInt(snapshots[i].Entries, 10))
+		}
+
+		writeHeader(w, "dns_resolver_questions_by_type_total", "counter", "Questions received by the resolver, by question type.")
+		for i, r := range resolvers {
+			counts := make(map[string]uint64)
+			for t, n := range snapshots[i].QuestionTypes {
+				counts[typeLabel(t)] += n
+			}
+			writeLabeledCounts(w, "dns_resolver_questions_by_type_total", "resolver", r.name, "qtype", counts)
+		}
+		writeHeader(w, "dns_resolver_responses_total", "counter", "Responses returned by the resolver, by response code.")
+		for i, r := range resolvers {
+			counts := make(map[string]uint64)
+			for rcode, n := range snapshots[i].RCodes {
+				counts[rcodeLabel(rcode)] += n
+			}
+			writeLabeledCounts(w, "dns_resolver_responses_total", "resolver", r.name, "rcode", counts)
+		}
+		writeHeader(w, "dns_resolver_upstream_duration_seconds", "histogram", "Time taken by the upstream resolver to answer deferred questions.")
+		for i, r := range resolvers {
+			writeHistogram(w, "dns_resolver_upstream_duration_seconds", "resolver", r.name, snapshotHistogram(&snapshots[i]))
+		}
+	}
+}
+
+// writeLabeledCounts writes the samples in counts, labeled with label=value
+// and key=k for each key k of counts, to w.
+func writeLabeledCounts(w *bufio.Writer, name, label, value, key string, counts map[string]uint64) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeSample(w, name, labels(label, value, key, k), uintValue(counts[k]))
+	}
+}
+
+// snapshotHistogram returns a histogram holding the latencies of s.
+func snapshotHistogram(s *dnsresolver.StatsSnapshot) *histogram {
+	h := &histogram{div: 1e9, sum: uint64(s.LatencySum)}
+	for i, b := range s.Latency {
+		if i < len(s.Latency)-1 {
+			h.bounds = append(h.bounds, uint64(b.Max))
+		}
+		h.counts = append(h.counts, b.Count)
+	}
+	return h
+}
+
+// writeHistogram writes the samples of h, labeled with label=value, to w.
+func writeHistogram(w *bufio.Writer, name, label, value string, h *histogram) {
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, name+"_bucket", labels(label, value, "le", floatValue(float64(b)/h.div)), uintValue(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	writeSample(w, name+"_bucket", labels(label, value, "le", "+Inf"), uintValue(cumulative))
+	writeSample(w, name+"_sum", labels(label, value), floatValue(float64(atomic.LoadUint64(&h.sum))/h.div))
+	writeSample(w, name+"_count", labels(label, value), uintValue(cumulative))
+}
+
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name, labels, value string) {
+	w.WriteString(name + labels + " " + value + "\n")
+}
+
+// labels formats pairs of label names and values.
+func labels(nameValues ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(nameValues[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(nameValues[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func uintValue(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+func floatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
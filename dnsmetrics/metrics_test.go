@@ -0,0 +1,133 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsmetrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+func pack(t *testing.T, m dnsmessage.Message) []byte {
+	t.Helper()
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal("packing message:", err)
+	}
+	return b
+}
+
+func TestMetrics(t *testing.T) {
+	q := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeAAAA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query := pack(t, q)
+	q.Header.Response = true
+	q.Header.RCode = dnsmessage.RCodeNameError
+	resp := pack(t, q)
+	q.Questions[0].Type = 99
+	other := pack(t, q)
+
+	m := New()
+	start := time.Unix(1000, 0)
+	m.LogQuery(&dnsserver.QueryLog{
+		Query:        query,
+		QueryTime:    start,
+		Response:     resp,
+		ResponseTime: start.Add(3 * time.Millisecond),
+	})
+	m.LogQuery(&dnsserver.QueryLog{
+		Query:        query,
+		QueryTime:    start,
+		Response:     resp,
+		ResponseTime: start.Add(time.Second),
+	})
+	m.LogQuery(&dnsserver.QueryLog{TCP: true, Query: other})
+	m.LogQuery(&dnsserver.QueryLog{Query: []byte("bad")})
+
+	var ss dnsserver.Stats
+	ss.AddPanic()
+	m.AddServer("main", &ss)
+	var rs dnsresolver.Stats
+	rs.AddAnswer()
+	rs.AddDeferral()
+	rs.AddDeferral()
+	rs.AddEviction()
+	rs.AddEntries(5)
+	rs.AddQuestionType(dnsmessage.TypeA)
+	rs.AddQuestionType(99)
+	rs.AddQuestionType(1000)
+	rs.AddResponseRCode(dnsmessage.RCodeServerFailure)
+	rs.AddLatency(20 * time.Millisecond)
+	m.AddResolver(`ca"che`, &rs)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != contentType {
+		t.Errorf("got Content-Type = %q, want = %q", got, contentType)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal("reading body:", err)
+	}
+	out := string(body)
+
+	want := []string{
+		"# TYPE dns_requests_total counter\n",
+		`dns_requests_total{transport="udp",qtype="AAAA",rcode="NXDOMAIN"} 2` + "\n",
+		`dns_requests_total{transport="tcp",qtype="other",rcode="none"} 1` + "\n",
+		`dns_requests_total{transport="udp",qtype="none",rcode="none"} 1` + "\n",
+		"# TYPE dns_response_size_bytes histogram\n",
+		`dns_response_size_bytes_bucket{transport="udp",le="64"} 2` + "\n",
+		`dns_response_size_bytes_count{transport="udp"} 2` + "\n",
+		`dns_response_size_bytes_count{transport="tcp"} 0` + "\n",
+		`dns_request_duration_seconds_bucket{transport="udp",le="0.0025"} 0` + "\n",
+		`dns_request_duration_seconds_bucket{transport="udp",le="0.005"} 1` + "\n",
+		`dns_request_duration_seconds_bucket{transport="udp",le="1"} 2` + "\n",
+		`dns_request_duration_seconds_bucket{transport="udp",le="+Inf"} 2` + "\n",
+		`dns_request_duration_seconds_sum{transport="udp"} 1.003` + "\n",
+		`dns_server_panics_total{server="main"} 1` + "\n",
+		`dns_resolver_answers_total{resolver="ca\"che"} 1` + "\n",
+		`dns_resolver_deferrals_total{resolver="ca\"che"} 2` + "\n",
+		`dns_resolver_evictions_total{resolver="ca\"che"} 1` + "\n",
+		"# TYPE dns_resolver_entries gauge\n",
+		`dns_resolver_entries{resolver="ca\"che"} 5` + "\n",
+		`dns_resolver_questions_by_type_total{resolver="ca\"che",qtype="A"} 1` + "\n",
+		`dns_resolver_questions_by_type_total{resolver="ca\"che",qtype="other"} 2` + "\n",
+		`dns_resolver_responses_total{resolver="ca\"che",rcode="SERVFAIL"} 1` + "\n",
+		`dns_resolver_upstream_duration_seconds_bucket{resolver="ca\"che",le="0.01"} 0` + "\n",
+		`dns_resolver_upstream_duration_seconds_bucket{resolver="ca\"che",le="0.025"} 1` + "\n",
+		`dns_resolver_upstream_duration_seconds_sum{resolver="ca\"che"} 0.02` + "\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("output doesn't contain %q", w)
+		}
+	}
+	if t.Failed() {
+		t.Log("output:\n" + out)
+	}
+}
+
+func TestMetricsWithoutStats(t *testing.T) {
+	rec := httptest.NewRecorder()
+	New().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, name := range []string{"dns_server_", "dns_resolver_"} {
+		if strings.Contains(out, name) {
+			t.Errorf("output contains %s metrics without any Stats added", name)
+		}
+	}
+}
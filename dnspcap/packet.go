@@ -0,0 +1,252 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnspcap
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+)
+
+// IP protocol numbers.
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	tcpHeaderLen  = 20
+
+	// ttl is the TTL, or hop limit, of synthesized IP packets.
+	ttl = 64
+
+	// TCP flags.
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// splitAddr returns the IP address and port of addr. If addr isn't an IP
+// address, it returns the unspecified IPv4 address.
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		if a != nil && a.IP != nil {
+			return a.IP, a.Port
+		}
+	case *net.TCPAddr:
+		if a != nil && a.IP != nil {
+			return a.IP, a.Port
+		}
+	}
+	return net.IPv4zero, 0
+}
+
+// appendPacket appends an IP packet holding p to b and returns the length the
+// packet would have if p.Payload fit.
+//
+// If both addresses of p are IPv4 addresses, an IPv4 packet is appended.
+// Otherwise, an IPv6 packet is appended. TCP messages are appended as a
+// single segment, which is enough for tools such as Wireshark to decode
+// them. If the payload doesn't fit in the packet, which can only happen to
+// TCP messages close to the maximum length, it is truncated, leaving the
+// lengths in the IP and transport headers describing the truncated packet.
+func appendPacket(b []byte, p *Packet) (_ []byte, origLen int) {
+	srcIP, srcPort := splitAddr(p.Source)
+	dstIP, dstPort := splitAddr(p.Destination)
+	src4, dst4 := srcIP.To4(), dstIP.To4()
+	v4 := src4 != nil && dst4 != nil
+
+	protocol := byte(protocolUDP)
+	transportHeaderLen := udpHeaderLen
+	if p.TCP {
+		protocol = protocolTCP
+		transportHeaderLen = tcpHeaderLen + 2
+	}
+	ipLen := ipv6HeaderLen
+	maxTransportLen := math.MaxUint16 // The IPv6 payload length.
+	if v4 {
+		ipLen = ipv4HeaderLen
+		maxTransportLen = math.MaxUint16 - ipv4HeaderLen // The IPv4 total length.
+	}
+	payload := p.Payload
+	origLen = ipLen + transportHeaderLen + len(payload)
+	if transportHeaderLen+len(payload) > maxTransportLen {
+		payload = payload[:maxTransportLen-transportHeaderLen]
+	}
+	transportLen := transportHeaderLen + len(payload)
+
+	// The pseudo-header used by the transport checksum.
+	var sum uint32
+	var src, dst net.IP
+	if v4 {
+		src, dst = src4, dst4
+		b = append(b,
+			0x45, 0, // Version, IHL and DSCP.
+			0, 0, // Total length.
+			0, 0, // ID.
+			0x40, 0, // Don't fragment.
+			ttl, protocol,
+			0, 0, // Checksum.
+		)
+		b = append(b, src...)
+		b = append(b, dst...)
+		h := b[len(b)-ipv4HeaderLen:]
+		binary.BigEndian.PutUint16(h[2:], uint16(ipv4HeaderLen+transportLen))
+		binary.BigEndian.PutUint16(h[10:], checksum(h, 0))
+	} else {
+		src, dst = srcIP.To16(), dstIP.To16()
+		b = append(b,
+			0x60, 0, 0, 0, // Version, traffic class and flow label.
+			0, 0, // Payload length.
+			protocol, ttl,
+		)
+		binary.BigEndian.PutUint16(b[len(b)-4:], uint16(transportLen))
+		b = append(b, src...)
+		b = append(b, dst...)
+	}
+	sum = sumBytes(src, sum)
+	sum = sumBytes(dst, sum)
+	sum += uint32(protocol) + uint32(transportLen)
+
+	start := len(b)
+	b = appendUint16(b, uint16(srcPort))
+	b = appendUint16(b, uint16(dstPort))
+	if p.TCP {
+		b = append(b,
+			0, 0, 0, 1, // Sequence number.
+			0, 0, 0, 1, // Acknowledgment number.
+			tcpHeaderLen<<2, tcpFlagPSH|tcpFlagACK,
+			0xff, 0xff, // Window.
+			0, 0, // Checksum.
+			0, 0, // Urgent pointer.
+		)
+		// The length of the whole message, even if it is truncated.
+		b = appendUint16(b, uint16(len(p.Payload)))
+	} else {
+		b = appendUint16(b, uint16(transportLen))
+		b = append(b, 0, 0) // Checksum.
+	}
+	b = append(b, payload...)
+
+	c := checksum(b[start:], sum)
+	if !p.TCP && c == 0 {
+		// A zero UDP checksum means that there is no checksum.
+		c = 0xffff
+	}
+	off := 6
+	if p.TCP {
+		off = 16
+	}
+	binary.BigEndian.PutUint16(b[start+off:], c)
+	return b, origLen
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// sumBytes adds the 16 bit big endian words of b to sum, as used by the
+// Internet checksum.
+func sumBytes(b []byte, sum uint32) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksum returns the Internet checksum of b, starting with sum.
+func checksum(b []byte, sum uint32) uint16 {
+	sum = sumBytes(b, sum)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// parsePacket parses the IP packet b, if it is a UDP packet or a TCP segment
+// holding a whole DNS message.
+func parsePacket(b []byte) (*Packet, bool) {
+	if len(b) < 1 {
+		return nil, false
+	}
+	var protocol byte
+	var src, dst net.IP
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < ipv4HeaderLen {
+			return nil, false
+		}
+		ihl := int(b[0]&0xf) * 4
+		total := int(binary.BigEndian.Uint16(b[2:]))
+		if ihl < ipv4HeaderLen || total < ihl || total > len(b) {
+			return nil, false
+		}
+		if flagsOff := binary.BigEndian.Uint16(b[6:]); flagsOff&0x3fff != 0 {
+			// A fragment.
+			return nil, false
+		}
+		protocol = b[9]
+		src = net.IP(append([]byte(nil), b[12:16]...))
+		dst = net.IP(append([]byte(nil), b[16:20]...))
+		b = b[ihl:total]
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return nil, false
+		}
+		payload := int(binary.BigEndian.Uint16(b[4:]))
+		if ipv6HeaderLen+payload > len(b) {
+			return nil, false
+		}
+		// Extension headers are not supported.
+		protocol = b[6]
+		src = net.IP(append([]byte(nil), b[8:24]...))
+		dst = net.IP(append([]byte(nil), b[24:40]...))
+		b = b[ipv6HeaderLen : ipv6HeaderLen+payload]
+	default:
+		return nil, false
+	}
+
+	switch protocol {
+	case protocolUDP:
+		if len(b) < udpHeaderLen {
+			return nil, false
+		}
+		l := int(binary.BigEndian.Uint16(b[4:]))
+		if l < udpHeaderLen || l > len(b) {
+			return nil, false
+		}
+		return &Packet{
+			Source:      &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(b[0:]))},
+			Destination: &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(b[2:]))},
+			Payload:     b[udpHeaderLen:l],
+		}, true
+	case protocolTCP:
+		if len(b) < tcpHeaderLen {
+			return nil, false
+		}
+		off := int(b[12]>>4) * 4
+		if off < tcpHeaderLen || off > len(b) {
+			return nil, false
+		}
+		data := b[off:]
+		if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+			return nil, false
+		}
+		return &Packet{
+			TCP:         true,
+			Source:      &net.TCPAddr{IP: src, Port: int(binary.BigEndian.Uint16(b[0:]))},
+			Destination: &net.TCPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(b[2:]))},
+			Payload:     data[2:],
+		}, true
+	}
+	return nil, false
+}
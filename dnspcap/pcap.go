@@ -0,0 +1,358 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnspcap records DNS traffic to pcap files and replays it.
+//
+// A Writer records the queries and responses handled by a dnsserver.Server,
+// synthesizing the IP and UDP or TCP headers which a packet capture would
+// include. A Reader reads DNS packets from pcap files, such as those written
+// by a Writer or captured with tcpdump, and Replay sends the queries they
+// hold to a resolver or server and reports the answers which don't match
+// those captured.
+//
+// The classic pcap format is described at
+// https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcap/. The newer pcapng
+// format is not supported.
+package dnspcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iangudger/dns/dnsserver"
+)
+
+// pcap file header magic numbers, which also identify the byte order and
+// timestamp precision.
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	magicNanoseconds  = 0xa1b23c4d
+)
+
+// Link types, from https://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+const (
+	fileHeaderLen   = 24
+	recordHeaderLen = 16
+
+	// snapLen is the maximum length of packets written by a Writer.
+	// Longer packets are truncated, as by tools such as tcpdump.
+	snapLen = 65535
+
+	// maxRecordLen is the maximum length of packets accepted by a
+	// Reader.
+	maxRecordLen = 256 << 10
+)
+
+var (
+	// ErrNotPcap indicates that a file isn't in the pcap format.
+	ErrNotPcap = errors.New("not a pcap file")
+
+	// ErrClosed indicates that a Writer has been closed.
+	ErrClosed = errors.New("pcap writer closed")
+)
+
+// A Packet is a DNS message sent over UDP or TCP.
+type Packet struct {
+	// Time is the time at which the packet was captured.
+	Time time.Time
+
+	// TCP indicates that the message was sent over TCP rather than UDP.
+	TCP bool
+
+	// Source and Destination are the addresses the message was sent from
+	// and to. They are *net.TCPAddr if TCP is set, and *net.UDPAddr
+	// otherwise.
+	Source      net.Addr
+	Destination net.Addr
+
+	// Payload is the DNS message, without the length prefix used over
+	// TCP.
+	Payload []byte
+}
+
+// A Writer writes DNS packets to a pcap file. It implements
+// dnsserver.QueryLogger, so it can record the traffic handled by a server.
+//
+// Packets are buffered, so Flush or Close must be called once done.
+//
+// All methods are safe for concurrent use.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	bw     *bufio.Writer
+	closed bool
+	err    error
+	buf    []byte
+}
+
+var _ dnsserver.QueryLogger = (*Writer)(nil)
+
+// NewWriter creates a Writer which writes a pcap file to w.
+//
+// If w is an io.Closer, it is closed by Close.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w, bw: bufio.NewWriter(w)}
+	var h [fileHeaderLen]byte
+	binary.LittleEndian.PutUint32(h[0:], magicMicroseconds)
+	binary.LittleEndian.PutUint16(h[4:], 2) // Major version.
+	binary.LittleEndian.PutUint16(h[6:], 4) // Minor version.
+	binary.LittleEndian.PutUint32(h[16:], snapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	if _, err := pw.bw.Write(h[:]); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// LogQuery implements dnsserver.QueryLogger.LogQuery by writing a packet for
+// the query and, if there is one, a packet for the response.
+//
+// Errors are reported by Flush and Close.
+func (pw *Writer) LogQuery(l *dnsserver.QueryLog) {
+	src, dst := l.Source, l.Local
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.write(&Packet{Time: l.QueryTime, TCP: l.TCP, Source: src, Destination: dst, Payload: l.Query})
+	if l.Response != nil {
+		pw.write(&Packet{Time: l.ResponseTime, TCP: l.TCP, Source: dst, Destination: src, Payload: l.Response})
+	}
+}
+
+// WritePacket writes p.
+func (pw *Writer) WritePacket(p *Packet) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.write(p)
+	return pw.err
+}
+
+// write writes p. pw.mu must be held.
+func (pw *Writer) write(p *Packet) {
+	if pw.closed {
+		pw.fail(ErrClosed)
+		return
+	}
+	if pw.err != nil {
+		return
+	}
+	// Only TCP messages close to the maximum length don't fit in an IP
+	// packet or are longer than snapLen once the headers are added. The
+	// record holds the original length, so readers can tell that the
+	// packet was truncated.
+	var origLen int
+	pw.buf, origLen = appendPacket(pw.buf[:0], p)
+	if len(pw.buf) > snapLen {
+		pw.buf = pw.buf[:snapLen]
+	}
+
+	var h [recordHeaderLen]byte
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	binary.LittleEndian.PutUint32(h[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(pw.buf)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(origLen))
+	if _, err := pw.bw.Write(h[:]); err != nil {
+		pw.fail(err)
+		return
+	}
+	if _, err := pw.bw.Write(pw.buf); err != nil {
+		pw.fail(err)
+	}
+}
+
+func (pw *Writer) fail(err error) {
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+// Flush writes any buffered packets. It returns the first error encountered
+// while writing.
+func (pw *Writer) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err == nil {
+		pw.fail(pw.bw.Flush())
+	}
+	return pw.err
+}
+
+// Close flushes pw and closes the output. It returns the first error
+// encountered while writing.
+func (pw *Writer) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.closed {
+		return ErrClosed
+	}
+	pw.closed = true
+	if pw.err == nil {
+		pw.fail(pw.bw.Flush())
+	}
+	if c, ok := pw.w.(io.Closer); ok {
+		pw.fail(c.Close())
+	}
+	return pw.err
+}
+
+// A Reader reads DNS packets from a pcap file.
+type Reader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+	buf      []byte
+}
+
+// NewReader creates a Reader which reads a pcap file from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	var h [fileHeaderLen]byte
+	if _, err := io.ReadFull(pr.r, h[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotPcap
+		}
+		return nil, err
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(h[0:]) {
+		case magicMicroseconds:
+			pr.order = order
+		case magicNanoseconds:
+			pr.order = order
+			pr.nano = true
+		}
+	}
+	if pr.order == nil {
+		return nil, ErrNotPcap
+	}
+	// The link type is in the low 16 bits, and the upper bits may
+	// hold flags.
+	pr.linkType = pr.order.Uint32(h[20:]) & 0xffff
+	switch pr.linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL, linkTypeIPv4, linkTypeIPv6, linkTypeLinuxSLL2:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", pr.linkType)
+	}
+	return pr, nil
+}
+
+// Next returns the next UDP or TCP packet, skipping other packets. It
+// returns io.EOF at the end of the file.
+//
+// TCP segments are only returned if they hold a whole DNS message, as
+// streams are not reassembled. IP fragments and packets truncated by the
+// capture are skipped.
+//
+// The returned packet's Payload is only valid until the next call to Next.
+func (pr *Reader) Next() (*Packet, error) {
+	for {
+		var h [recordHeaderLen]byte
+		if _, err := io.ReadFull(pr.r, h[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("reading pcap record header: %v", err)
+			}
+			return nil, err
+		}
+		sec := pr.order.Uint32(h[0:])
+		frac := pr.order.Uint32(h[4:])
+		n := pr.order.Uint32(h[8:])
+		origLen := pr.order.Uint32(h[12:])
+		if n > maxRecordLen {
+			return nil, fmt.Errorf("pcap record length %d exceeds %d", n, maxRecordLen)
+		}
+		if cap(pr.buf) < int(n) {
+			pr.buf = make([]byte, n)
+		}
+		pr.buf = pr.buf[:n]
+		if _, err := io.ReadFull(pr.r, pr.buf); err != nil {
+			return nil, fmt.Errorf("reading pcap record: %v", err)
+		}
+		if n < origLen {
+			// Truncated by the capture.
+			continue
+		}
+		if !pr.nano {
+			frac *= 1000
+		}
+
+		ip, ok := pr.network(pr.buf)
+		if !ok {
+			continue
+		}
+		p, ok := parsePacket(ip)
+		if !ok {
+			continue
+		}
+		p.Time = time.Unix(int64(sec), int64(frac))
+		return p, nil
+	}
+}
+
+// network returns the network layer packet within the link layer packet b,
+// if it is an IP packet.
+func (pr *Reader) network(b []byte) ([]byte, bool) {
+	var etherType uint16
+	switch pr.linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return b, true
+	case linkTypeNull:
+		// The header holds the address family in the byte order of
+		// the capturing host, which can be determined from the IP
+		// version.
+		if len(b) < 4 {
+			return nil, false
+		}
+		return b[4:], true
+	case linkTypeEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			// VLAN tags.
+			if len(b) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(b[14:])
+		b = b[16:]
+	case linkTypeLinuxSLL2:
+		if len(b) < 20 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(b[0:])
+		b = b[20:]
+	}
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return nil, false
+	}
+	return b, true
+}
@@ -0,0 +1,422 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnspcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+)
+
+func testQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal("packing query:", err)
+	}
+	return b
+}
+
+func testResponse(t *testing.T, query []byte, a [4]byte) []byte {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		t.Fatal("unpacking query:", err)
+	}
+	m.Header.Response = true
+	m.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  m.Questions[0].Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		},
+		Body: &dnsmessage.AResource{A: a},
+	}}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal("packing response:", err)
+	}
+	return b
+}
+
+func readAll(t *testing.T, b []byte) []Packet {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("NewReader(...) =", err)
+	}
+	var ps []Packet
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return ps
+		}
+		if err != nil {
+			t.Fatal("Next() =", err)
+		}
+		c := *p
+		c.Payload = append([]byte(nil), p.Payload...)
+		ps = append(ps, c)
+	}
+}
+
+func TestWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal("NewWriter(...) =", err)
+	}
+	query := testQuery(t, 1, "example.com.")
+	resp := testResponse(t, query, [4]byte{192, 0, 2, 1})
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 5353}
+	server := &net.UDPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 53}
+	start := time.Unix(1000, 123000)
+	w.LogQuery(&dnsserver.QueryLog{
+		Source:       client,
+		Local:        server,
+		Query:        query,
+		QueryTime:    start,
+		Response:     resp,
+		ResponseTime: start.Add(time.Millisecond),
+	})
+	tcpClient := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 40000}
+	tcpServer := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+	w.LogQuery(&dnsserver.QueryLog{
+		TCP:       true,
+		Source:    tcpClient,
+		Local:     tcpServer,
+		Query:     query,
+		QueryTime: start.Add(time.Second),
+	})
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+
+	// Verify the checksums of the synthesized packets.
+	b := buf.Bytes()[fileHeaderLen:]
+	for len(b) > 0 {
+		n := binary.LittleEndian.Uint32(b[8:])
+		ip := b[recordHeaderLen : recordHeaderLen+n]
+		b = b[recordHeaderLen+n:]
+		if ip[0]>>4 == 4 {
+			if c := checksum(ip[:ipv4HeaderLen], 0); c != 0 {
+				t.Errorf("invalid IPv4 header checksum, got sum = %#x", c)
+			}
+			sum := sumBytes(ip[12:20], 0) + uint32(ip[9]) + uint32(len(ip)-ipv4HeaderLen)
+			if c := checksum(ip[ipv4HeaderLen:], sum); c != 0 {
+				t.Errorf("invalid IPv4 transport checksum, got sum = %#x", c)
+			}
+		} else {
+			sum := sumBytes(ip[8:40], 0) + uint32(ip[6]) + uint32(len(ip)-ipv6HeaderLen)
+			if c := checksum(ip[ipv6HeaderLen:], sum); c != 0 {
+				t.Errorf("invalid IPv6 transport checksum, got sum = %#x", c)
+			}
+		}
+	}
+
+	got := readAll(t, buf.Bytes())
+	want := []Packet{
+		{Time: start, Source: client, Destination: server, Payload: query},
+		{Time: start.Add(time.Millisecond), Source: server, Destination: client, Payload: resp},
+		{Time: start.Add(time.Second), TCP: true, Source: tcpClient, Destination: tcpServer, Payload: query},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got packets = %+v, want = %+v", got, want)
+	}
+}
+
+func TestWriterTruncate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		tcp     bool
+		client  net.IP
+		server  net.IP
+		payload int
+	}{
+		{"ipv4 tcp", true, net.IPv4(192, 0, 2, 10).To4(), net.IPv4(198, 51, 100, 1).To4(), 65535},
+		{"ipv6 tcp", true, net.ParseIP("2001:db8::10"), net.ParseIP("2001:db8::1"), 65535},
+		{"ipv4 udp", false, net.IPv4(192, 0, 2, 10).To4(), net.IPv4(198, 51, 100, 1).To4(), 65535},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf)
+			if err != nil {
+				t.Fatal("NewWriter(...) =", err)
+			}
+			var client, server net.Addr = &net.UDPAddr{IP: test.client, Port: 40000}, &net.UDPAddr{IP: test.server, Port: 53}
+			transportLen := udpHeaderLen + test.payload
+			if test.tcp {
+				client, server = &net.TCPAddr{IP: test.client, Port: 40000}, &net.TCPAddr{IP: test.server, Port: 53}
+				transportLen = tcpHeaderLen + 2 + test.payload
+			}
+			big := &Packet{TCP: test.tcp, Source: server, Destination: client, Payload: make([]byte, test.payload)}
+			if err := w.WritePacket(big); err != nil {
+				t.Fatal("WritePacket(...) with a long packet =", err)
+			}
+			query := testQuery(t, 1, "example.com.")
+			small := &Packet{Time: time.Unix(1000, 0), TCP: test.tcp, Source: client, Destination: server, Payload: query}
+			if err := w.WritePacket(small); err != nil {
+				t.Fatal("WritePacket(...) =", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal("Close() =", err)
+			}
+
+			h := buf.Bytes()[fileHeaderLen:]
+			ipHeaderLen := ipv4HeaderLen
+			ipLen := binary.BigEndian.Uint16(h[recordHeaderLen+2:])
+			if test.client.To4() == nil {
+				ipHeaderLen = ipv6HeaderLen
+				ipLen = binary.BigEndian.Uint16(h[recordHeaderLen+4:])
+			}
+			if inclLen, origLen := binary.LittleEndian.Uint32(h[8:]), binary.LittleEndian.Uint32(h[12:]); inclLen != snapLen || int(origLen) != ipHeaderLen+transportLen {
+				t.Errorf("got long record lengths = %d, %d, want = %d, %d", inclLen, origLen, snapLen, ipHeaderLen+transportLen)
+			}
+			// The lengths in the headers describe the truncated packet,
+			// rather than wrapping around.
+			if ipLen != math.MaxUint16 {
+				t.Errorf("got IP length = %d, want = %d", ipLen, math.MaxUint16)
+			}
+
+			// The truncated packet is skipped.
+			if got := readAll(t, buf.Bytes()); !reflect.DeepEqual(got, []Packet{*small}) {
+				t.Errorf("got packets = %+v, want = %+v", got, []Packet{*small})
+			}
+		})
+	}
+}
+
+func TestReaderEthernet(t *testing.T) {
+	query := testQuery(t, 1, "example.com.")
+	ip, _ := appendPacket(nil, &Packet{
+		Source:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234},
+		Destination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 53},
+		Payload:     query,
+	})
+	frame := make([]byte, 12)
+	frame = append(frame, 0x81, 0x00, 0, 7) // VLAN tag.
+	frame = append(frame, 0x08, 0x00)
+	frame = append(frame, ip...)
+	// ARP, which is skipped.
+	arp := append(make([]byte, 12), 0x08, 0x06, 0, 0)
+
+	// A big endian file with nanosecond timestamps.
+	var b []byte
+	b = appendBigEndian32(b, magicNanoseconds)
+	b = append(b, 0, 2, 0, 4)
+	b = append(b, make([]byte, 8)...)
+	b = appendBigEndian32(b, snapLen)
+	b = appendBigEndian32(b, linkTypeEthernet)
+	for i, f := range [][]byte{arp, frame} {
+		b = appendBigEndian32(b, 5)
+		b = appendBigEndian32(b, uint32(i))
+		b = appendBigEndian32(b, uint32(len(f)))
+		b = appendBigEndian32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+
+	got := readAll(t, b)
+	if len(got) != 1 {
+		t.Fatalf("got %d packets, want 1", len(got))
+	}
+	if !got[0].Time.Equal(time.Unix(5, 1)) || !bytes.Equal(got[0].Payload, query) {
+		t.Errorf("got packet = %+v, want query at %v", got[0], time.Unix(5, 1))
+	}
+}
+
+func appendBigEndian32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func TestNewReaderNotPcap(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader(make([]byte, 40))); err != ErrNotPcap {
+		t.Errorf("got NewReader(...) = %v, want = %v", err, ErrNotPcap)
+	}
+}
+
+// testCapture returns a capture of three UDP queries: one whose response
+// matches testResolver, one whose response doesn't and one without a
+// response.
+func testCapture(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal("NewWriter(...) =", err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 53}
+	start := time.Now()
+	for i, name := range []string{"match.example.", "mismatch.example.", "uncaptured.example."} {
+		q := testQuery(t, uint16(i), name)
+		l := dnsserver.QueryLog{
+			Source:    client,
+			Local:     server,
+			Query:     q,
+			QueryTime: start.Add(time.Duration(i) * time.Millisecond),
+		}
+		if i < 2 {
+			l.Response = testResponse(t, q, [4]byte{127, 0, 0, byte(i)})
+			l.ResponseTime = l.QueryTime
+		}
+		w.LogQuery(&l)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+	return buf.Bytes()
+}
+
+// testResolver answers every question with 127.0.0.0.
+var testResolver = dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 5},
+			Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 0}},
+		}},
+	}, true
+})
+
+func checkReplay(t *testing.T, config ReplayConfig) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(testCapture(t)))
+	if err != nil {
+		t.Fatal("NewReader(...) =", err)
+	}
+	var mismatches []*Mismatch
+	config.Mismatch = func(m *Mismatch) {
+		mismatches = append(mismatches, m)
+	}
+	res, err := Replay(context.Background(), r, config)
+	if err != nil {
+		t.Fatal("Replay(...) =", err)
+	}
+	if want := (ReplayResult{Queries: 3, Matched: 1, Mismatched: 1, Uncaptured: 1}); res != want {
+		t.Errorf("got Replay(...) = %+v, want = %+v", res, want)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("got %d mismatches, want 1", len(mismatches))
+	}
+	if m := mismatches[0]; m.Err != nil || m.Got == nil || m.Reason == "" {
+		t.Errorf("got mismatch = %+v, want differing answers", m)
+	}
+}
+
+func TestReplayResolver(t *testing.T) {
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, testResolver)
+	if err != nil {
+		t.Fatal("NewPacketResolver(...) =", err)
+	}
+	var logged countingLogger
+	checkReplay(t, ReplayConfig{Resolver: pr, Speed: 10, QueryLogger: &logged})
+	if logged.n != 3 {
+		t.Errorf("logged %d queries, want 3", logged.n)
+	}
+}
+
+type countingLogger struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (l *countingLogger) LogQuery(*dnsserver.QueryLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n++
+}
+
+func TestReplayAddress(t *testing.T) {
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, testResolver)
+	if err != nil {
+		t.Fatal("NewPacketResolver(...) =", err)
+	}
+	srv, err := dnsserver.New(dnsserver.Config{Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("dnsserver.New(...) =", err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.ServeUDP(pc)
+		close(done)
+	}()
+	defer func() {
+		pc.Close()
+		<-done
+		srv.Wait()
+	}()
+
+	checkReplay(t, ReplayConfig{Address: pc.LocalAddr().String(), Speed: -1, Timeout: time.Second})
+}
+
+func TestReplayMaxInFlight(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inFlight int
+		peak     int
+	)
+	pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, req []byte, maxLen int, buf []byte) ([]byte, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil, errors.New("no response")
+	})
+	r, err := NewReader(bytes.NewReader(testCapture(t)))
+	if err != nil {
+		t.Fatal("NewReader(...) =", err)
+	}
+	res, err := Replay(context.Background(), r, ReplayConfig{Resolver: pr, Speed: -1, MaxInFlight: 1})
+	if err != nil {
+		t.Fatal("Replay(...) =", err)
+	}
+	if res.Queries != 3 || res.Errors != 3 {
+		t.Errorf("got Replay(...) = %+v, want 3 queries and errors", res)
+	}
+	if peak != 1 {
+		t.Errorf("got %d queries in flight, want 1", peak)
+	}
+}
+
+func TestReplayNoTarget(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(testCapture(t)))
+	if err != nil {
+		t.Fatal("NewReader(...) =", err)
+	}
+	if _, err := Replay(context.Background(), r, ReplayConfig{}); err != errNoReplayTarget {
+		t.Errorf("got Replay(...) = %v, want = %v", err, errNoReplayTarget)
+	}
+}
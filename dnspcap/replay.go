@@ -0,0 +1,345 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnspcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnsserver"
+	"github.com/iangudger/dns/internal/dnsexchange"
+)
+
+const (
+	// defaultReplayTimeout is the default time to wait for a response.
+	defaultReplayTimeout = 5 * time.Second
+
+	// defaultReplayMaxInFlight is the default maximum number of queries
+	// awaiting a response.
+	defaultReplayMaxInFlight = 256
+
+	// maxUDPResponseLength is the maximum length of a response to a
+	// query replayed over UDP, as used by dnsserver.
+	maxUDPResponseLength = 512
+)
+
+var errNoReplayTarget = errors.New("neither a Resolver nor an Address to replay to")
+
+// ReplayConfig configures Replay.
+type ReplayConfig struct {
+	_ struct{} // Prevent positional initialization.
+
+	// Resolver answers the replayed queries. If nil, the queries are
+	// sent to the server at Address instead.
+	Resolver dnsresolver.PacketResolver
+
+	// Address is the address of the server the queries are sent to if
+	// Resolver is nil. Queries which were captured over TCP are sent
+	// over TCP, and others over UDP.
+	Address string
+
+	// Speed is the factor by which replayed queries are sped up compared
+	// to the captured timing, so 1 replays the queries with their
+	// original timing and 2 replays them twice as fast.
+	//
+	// If zero, the default value of 1 will be used. If negative, the
+	// queries are replayed as fast as possible.
+	Speed float64
+
+	// Timeout is the maximum time to wait for a response to a replayed
+	// query.
+	//
+	// If zero, the default value will be used.
+	Timeout time.Duration
+
+	// MaxInFlight is the maximum number of queries awaiting a response at
+	// once. Each uses a socket when replaying to Address. Once the limit
+	// is reached, further queries are delayed until a response is
+	// received or times out.
+	//
+	// If not positive, the default value of 256 will be used.
+	MaxInFlight int
+
+	// Mismatch is optionally called for each replayed query whose
+	// response doesn't match the captured response. Calls are not
+	// concurrent.
+	Mismatch func(m *Mismatch)
+
+	// QueryLogger is optionally used to log each replayed query and its
+	// response, such as with a Writer to record the replay.
+	QueryLogger dnsserver.QueryLogger
+}
+
+// A Mismatch describes a replayed query whose response doesn't match the
+// captured response.
+type Mismatch struct {
+	// Query is the captured query.
+	Query *Packet
+
+	// Want is the captured response to the query.
+	Want []byte
+
+	// Got is the response to the replayed query, or nil if there was an
+	// error.
+	Got []byte
+
+	// Err is the error encountered while replaying the query, if any.
+	Err error
+
+	// Reason describes the difference between the responses.
+	Reason string
+}
+
+// ReplayResult summarizes a replay.
+type ReplayResult struct {
+	// Queries is the number of queries replayed.
+	Queries int
+
+	// Matched is the number of responses which matched the captured
+	// responses.
+	Matched int
+
+	// Mismatched is the number of responses which didn't match the
+	// captured responses, including errors.
+	Mismatched int
+
+	// Errors is the number of replayed queries which failed, such as
+	// by timing out.
+	Errors int
+
+	// Uncaptured is the number of replayed queries whose response wasn't
+	// captured, so their response could not be compared.
+	Uncaptured int
+}
+
+// exchange is a captured query and its captured response, if any.
+type exchange struct {
+	query *Packet
+	want  []byte
+}
+
+// Replay reads the DNS queries captured in r and sends them to a resolver or
+// server as described by config, comparing each response with the captured
+// response.
+//
+// Responses are considered to match if they have the same response code and
+// the same answer records, ignoring order, TTLs and the case of names.
+//
+// Replay returns once all queries have been replayed and their responses
+// received, or ctx is done.
+func Replay(ctx context.Context, r *Reader, config ReplayConfig) (ReplayResult, error) {
+	if config.Resolver == nil && config.Address == "" {
+		return ReplayResult{}, errNoReplayTarget
+	}
+	if config.Speed == 0 {
+		config.Speed = 1
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultReplayTimeout
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = defaultReplayMaxInFlight
+	}
+
+	exchanges, err := readExchanges(r)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	var (
+		mu  sync.Mutex
+		res ReplayResult
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, config.MaxInFlight)
+	)
+	start := time.Now()
+	for _, e := range exchanges {
+		if config.Speed > 0 {
+			offset := e.query.Time.Sub(exchanges[0].query.Time)
+			t := time.NewTimer(time.Until(start.Add(time.Duration(float64(offset) / config.Speed))))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				wg.Wait()
+				return res, ctx.Err()
+			case <-t.C:
+			}
+		} else if err := ctx.Err(); err != nil {
+			wg.Wait()
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return res, ctx.Err()
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(e exchange) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			queryTime := time.Now()
+			got, err := replayQuery(ctx, &config, e.query)
+			if config.QueryLogger != nil {
+				config.QueryLogger.LogQuery(&dnsserver.QueryLog{
+					TCP:          e.query.TCP,
+					Source:       e.query.Source,
+					Local:        e.query.Destination,
+					Query:        e.query.Payload,
+					QueryTime:    queryTime,
+					Response:     got,
+					ResponseTime: time.Now(),
+				})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Queries++
+			var reason string
+			switch {
+			case err != nil:
+				res.Errors++
+				reason = err.Error()
+			case e.want == nil:
+				res.Uncaptured++
+				return
+			default:
+				if reason = compareResponses(e.want, got); reason == "" {
+					res.Matched++
+					return
+				}
+			}
+			res.Mismatched++
+			if config.Mismatch != nil {
+				config.Mismatch(&Mismatch{Query: e.query, Want: e.want, Got: got, Err: err, Reason: reason})
+			}
+		}(e)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// exchangeKey identifies a query and its response.
+type exchangeKey struct {
+	client, server string
+	tcp            bool
+	id             uint16
+}
+
+// readExchanges reads the queries captured in r, along with their captured
+// responses.
+func readExchanges(r *Reader) ([]exchange, error) {
+	var exchanges []exchange
+	pending := make(map[exchangeKey]int)
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var parser dnsmessage.Parser
+		h, err := parser.Start(p.Payload)
+		if err != nil {
+			continue
+		}
+		if !h.Response {
+			c := *p
+			c.Payload = append([]byte(nil), p.Payload...)
+			pending[exchangeKey{p.Source.String(), p.Destination.String(), p.TCP, h.ID}] = len(exchanges)
+			exchanges = append(exchanges, exchange{query: &c})
+			continue
+		}
+		k := exchangeKey{p.Destination.String(), p.Source.String(), p.TCP, h.ID}
+		if i, ok := pending[k]; ok {
+			exchanges[i].want = append([]byte(nil), p.Payload...)
+			delete(pending, k)
+		}
+	}
+	return exchanges, nil
+}
+
+// replayQuery sends the query q to the resolver or server described by config
+// and returns the response.
+func replayQuery(ctx context.Context, config *ReplayConfig, q *Packet) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	if config.Resolver != nil {
+		maxLen := maxUDPResponseLength
+		if q.TCP {
+			maxLen = math.MaxUint16
+		}
+		ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, q.Source)
+		ctx = context.WithValue(ctx, dnsresolver.LocalContextKey, q.Destination)
+		return config.Resolver.ResolvePacket(ctx, q.Payload, maxLen, nil)
+	}
+
+	network := "udp"
+	if q.TCP {
+		network = "tcp"
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	return dnsexchange.Exchange(c, q.Payload, q.TCP, nil)
+}
+
+// compareResponses compares the responses want and got and returns a
+// description of their difference, or "" if they match.
+func compareResponses(want, got []byte) string {
+	var w, g dnsmessage.Message
+	if err := w.Unpack(want); err != nil {
+		return fmt.Sprintf("unpacking captured response: %v", err)
+	}
+	if err := g.Unpack(got); err != nil {
+		return fmt.Sprintf("unpacking response: %v", err)
+	}
+	if w.Header.RCode != g.Header.RCode {
+		return fmt.Sprintf("got RCode %v, want %v", g.Header.RCode, w.Header.RCode)
+	}
+	wa, ga := answerStrings(w.Answers), answerStrings(g.Answers)
+	if len(wa) != len(ga) {
+		return fmt.Sprintf("got %d answers, want %d", len(ga), len(wa))
+	}
+	for i := range wa {
+		if wa[i] != ga[i] {
+			return fmt.Sprintf("got answer %s, want %s", ga[i], wa[i])
+		}
+	}
+	return ""
+}
+
+// answerStrings returns sorted descriptions of rs, ignoring their TTLs and
+// the case of their names.
+func answerStrings(rs []dnsmessage.Resource) []string {
+	s := make([]string, 0, len(rs))
+	for _, r := range rs {
+		s = append(s, fmt.Sprintf("%s %v %v %v", strings.ToLower(r.Header.Name.String()), r.Header.Class, r.Header.Type, r.Body.GoString()))
+	}
+	sort.Strings(s)
+	return s
+}
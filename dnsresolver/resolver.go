@@ -9,9 +9,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sync/atomic"
 
 	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnstrace"
 )
 
 var (
@@ -39,6 +39,12 @@ var (
 
 type sourceContextKey struct{}
 
+type localContextKey struct{}
+
+type cookieContextKey struct{}
+
+type dnssecOKContextKey struct{}
+
 var (
 	// SourceContextKey is a context key. It can be used in Resolver and
 	// PacketResolver implementations. The associated value is of type
@@ -46,8 +52,68 @@ var (
 	// If no source is available (e.g. a request originating in the same
 	// binary), SourceContextKey is omitted.
 	SourceContextKey = &sourceContextKey{}
+
+	// LocalContextKey is a context key. It can be used in Resolver and
+	// PacketResolver implementations. The associated value is the local
+	// address a request was sent to, of type *net.UDPAddr from a UDP
+	// server and *net.TCPAddr from a TCP server. If no local address is
+	// available, LocalContextKey is omitted.
+	LocalContextKey = &localContextKey{}
+
+	// CookieContextKey is a context key. It can be used in Resolver and
+	// PacketResolver implementations. The associated value is of type
+	// CookieStatus. If the server does not support DNS Cookies,
+	// CookieContextKey is omitted.
+	CookieContextKey = &cookieContextKey{}
+
+	// DNSSECOKContextKey is a context key. It can be used in Resolver
+	// implementations. The associated value is of type bool and reports
+	// whether the DNSSEC OK bit was set in the EDNS(0) OPT record of the
+	// request (RFC 3225), so that RRSIG records may be included in the
+	// response. The default PacketResolver always sets it. If the request
+	// did not come from a DNS packet, DNSSECOKContextKey is omitted.
+	DNSSECOKContextKey = &dnssecOKContextKey{}
+)
+
+// A CookieStatus describes the DNS Cookie, as described in RFC 7873, included
+// in a request.
+type CookieStatus int
+
+const (
+	// CookieNone indicates that the request did not include a cookie.
+	CookieNone CookieStatus = iota
+
+	// CookieClientOnly indicates that the request included a client
+	// cookie, but no server cookie. This is normal for the first request
+	// from a client.
+	CookieClientOnly
+
+	// CookieInvalid indicates that the request included a server cookie
+	// which is not valid, for example because it has expired or was
+	// generated for a different client.
+	CookieInvalid
+
+	// CookieValid indicates that the request included a valid server
+	// cookie, which means that the source address of the request is very
+	// unlikely to be spoofed.
+	CookieValid
 )
 
+var cookieStatusNames = map[CookieStatus]string{
+	CookieNone:       "CookieNone",
+	CookieClientOnly: "CookieClientOnly",
+	CookieInvalid:    "CookieInvalid",
+	CookieValid:      "CookieValid",
+}
+
+// String implements fmt.Stringer.String.
+func (s CookieStatus) String() string {
+	if n, ok := cookieStatusNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("CookieStatus(%d)", int(s))
+}
+
 // A PacketResolver responds to binary DNS packet requests with binary DNS
 // packet responses.
 type PacketResolver interface {
@@ -55,7 +121,8 @@ type PacketResolver interface {
 	// packet request and appends it to buf, using append semantics. If buf
 	// is nil, a new buffer will be allocated.
 	//
-	// ctx includes a SourceContextKey, if applicable.
+	// ctx includes a SourceContextKey, LocalContextKey and
+	// CookieContextKey, if applicable.
 	//
 	// maxPacketLength is the maximum final packet length to be appended to
 	// buf. Intermediate packets may be appended, but the final returned
@@ -77,7 +144,8 @@ type Resolver interface {
 	//
 	// If no message is to be returned, Resolve returns false.
 	//
-	// ctx includes a SourceContextKey, if applicable.
+	// ctx includes a SourceContextKey, LocalContextKey and
+	// CookieContextKey, if applicable.
 	//
 	// recursionDesired indicates that question should be resolved
 	// recursively.
@@ -92,6 +160,21 @@ func (f ResolverFunc) Resolve(ctx context.Context, question dnsmessage.Question,
 	return f(ctx, question, recursionDesired)
 }
 
+// NewTracingResolver creates a Resolver which records a span named name for
+// each question resolved by res, using the dnstrace.Tracer carried by the
+// context, if any.
+//
+// It allows resolvers which don't record spans themselves, such as one which
+// forwards questions to an upstream server, to appear in traces.
+func NewTracingResolver(name string, res Resolver) Resolver {
+	return ResolverFunc(func(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+		ctx, span := dnstrace.StartResolve(ctx, name, question)
+		msg, ok := res.Resolve(ctx, question, recursionDesired)
+		dnstrace.EndResolve(span, msg, ok)
+		return msg, ok
+	})
+}
+
 // PacketResolverConfig contains optional configuration options for the default PacketResolver.
 type PacketResolverConfig struct {
 	_ struct{} // Prevent positional initialization.
@@ -132,7 +215,11 @@ func NewPacketResolver(config PacketResolverConfig, res Resolver) (PacketResolve
 			return respondError(h, dnsmessage.RCodeFormatError)
 		}
 
-		resp, ok := res.Resolve(ctx, q, h.RecursionDesired)
+		ctx = context.WithValue(ctx, DNSSECOKContextKey, dnssecOK(&p))
+
+		rctx, span := dnstrace.StartResolve(ctx, "dnsresolver.PacketResolver", q)
+		resp, ok := res.Resolve(rctx, q, h.RecursionDesired)
+		dnstrace.EndResolve(span, resp, ok)
 		if !ok {
 			return nil, ErrNoResponse
 		}
@@ -174,6 +261,30 @@ func NewPacketResolver(config PacketResolverConfig, res Resolver) (PacketResolve
 	}), nil
 }
 
+// dnssecOK reports whether the request being parsed by p, which must be done
+// with the question section, has an OPT record with the DNSSEC OK bit set.
+// Malformed records are treated as if the bit were clear.
+func dnssecOK(p *dnsmessage.Parser) bool {
+	if err := p.SkipAllAnswers(); err != nil {
+		return false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return false
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return h.DNSSECAllowed()
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return false
+		}
+	}
+}
+
 func respondError(h dnsmessage.Header, rcode dnsmessage.RCode) ([]byte, error) {
 	resp := dnsmessage.Message{
 		Header: dnsmessage.Header{
@@ -189,91 +300,3 @@ func respondError(h dnsmessage.Header, rcode dnsmessage.RCode) ([]byte, error) {
 	}
 	return respBuf, nil
 }
-
-// Stats collects counts of various DNS-related events that have
-// occurred for a particular DNS Resolver.
-//
-// All methods are safe for concurrent use.
-type Stats struct {
-	questions uint64
-	rejected  uint64
-	errors    uint64
-	deferrals uint64
-	answers   uint64
-}
-
-// Questions returns the number of DNS questions a resolver has received.
-func (rs *Stats) Questions() uint64 {
-	return atomic.LoadUint64(&rs.questions)
-}
-
-// AddQuestion records that a resolver has received a DNS question.
-//
-// If rs is nil, AddQuestion is a no-op.
-func (rs *Stats) AddQuestion() {
-	if rs == nil {
-		return
-	}
-	atomic.AddUint64(&rs.questions, 1)
-}
-
-// Rejected returns the number of requests a resolver has rejected.
-func (rs *Stats) Rejected() uint64 {
-	return atomic.LoadUint64(&rs.rejected)
-}
-
-// AddRejected records that a resolver has rejected a request.
-//
-// If rs is nil, AddRejected is a no-op.
-func (rs *Stats) AddRejected() {
-	if rs == nil {
-		return
-	}
-	atomic.AddUint64(&rs.rejected, 1)
-}
-
-// Errors returns the number of errors a resolver has encountered.
-func (rs *Stats) Errors() uint64 {
-	return atomic.LoadUint64(&rs.errors)
-}
-
-// AddError records that a resolver has encountered an error.
-//
-// If rs is nil, AddError is a no-op.
-func (rs *Stats) AddError() {
-	if rs == nil {
-		return
-	}
-	atomic.AddUint64(&rs.errors, 1)
-}
-
-// Deferrals returns the number of times the resolver has deferred to a nested
-// resolver.
-func (rs *Stats) Deferrals() uint64 {
-	return atomic.LoadUint64(&rs.deferrals)
-}
-
-// AddDeferral records that a resolver has deferred to a nested resolver.
-//
-// If rs is nil, AddDeferral is a no-op.
-func (rs *Stats) AddDeferral() {
-	if rs == nil {
-		return
-	}
-	atomic.AddUint64(&rs.deferrals, 1)
-}
-
-// Answers returns the number of DNS questions a resolver has answered.
-func (rs *Stats) Answers() uint64 {
-	return atomic.LoadUint64(&rs.answers)
-}
-
-// AddAnswer records that a resolver has answered a DNS question.
-//
-// If rs is nil, AddAnswer is a no-op.
-func (rs *Stats) AddAnswer() {
-	if rs == nil {
-		return
-	}
-	atomic.AddUint64(&rs.answers, 1)
-}
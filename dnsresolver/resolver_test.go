@@ -103,6 +103,52 @@ func TestNewPacketResolver(t *testing.T) {
 	}
 }
 
+func TestPacketResolverDNSSECOK(t *testing.T) {
+	var got interface{}
+	pr, err := dnsresolver.NewPacketResolver(
+		dnsresolver.PacketResolverConfig{},
+		dnsresolver.ResolverFunc(func(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+			got = ctx.Value(dnsresolver.DNSSECOKContextKey)
+			return resolvers.ResolveError(question, 0, recursionDesired), true
+		}),
+	)
+	if err != nil {
+		t.Fatal("NewPacketResolver(...) = _,", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		opt  bool
+		do   bool
+	}{
+		{"no OPT", false, false},
+		{"DO clear", true, false},
+		{"DO set", true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := dnsmessage.Message{Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}}
+			if test.opt {
+				var h dnsmessage.ResourceHeader
+				if err := h.SetEDNS0(1232, dnsmessage.RCodeSuccess, test.do); err != nil {
+					t.Fatal("SetEDNS0(...) =", err)
+				}
+				req.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+			}
+			b, err := req.Pack()
+			if err != nil {
+				t.Fatal("req.Pack() =", err)
+			}
+			got = nil
+			if _, err := pr.ResolvePacket(context.Background(), b, 0, nil); err != nil {
+				t.Fatal("pr.ResolvePacket(...) = _,", err)
+			}
+			if got != test.do {
+				t.Errorf("got DNSSECOKContextKey = %v, want = %t", got, test.do)
+			}
+		})
+	}
+}
+
 func TestTruncation(t *testing.T) {
 	name := dnsmessage.MustNewName("example.com.")
 
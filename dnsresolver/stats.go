@@ -0,0 +1,419 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsresolver
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+// maxCountedType is the largest question type which is counted separately.
+// Larger question types are counted together.
+const maxCountedType = 255
+
+// numRCodes is the number of response codes which fit in a DNS message header.
+// Extended response codes are counted together.
+const numRCodes = 16
+
+// latencyBuckets are the inclusive upper bounds of the buckets of the latency
+// histogram kept by Stats. Latencies greater than the last bound are counted
+// in an additional bucket.
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Stats collects counts of various DNS-related events that have
+// occurred for a particular DNS Resolver.
+//
+// All methods are safe for concurrent use.
+type Stats struct {
+	questions   uint64
+	rejected    uint64
+	errors      uint64
+	deferrals   uint64
+	answers     uint64
+	synthesized uint64
+	failures    uint64
+	evictions   uint64
+	entries     int64
+
+	// types counts questions by type, with all types greater than
+	// maxCountedType counted in the last element.
+	types [maxCountedType + 2]uint64
+
+	// rcodes counts responses by response code, with all extended
+	// response codes counted in the last element.
+	rcodes [numRCodes + 1]uint64
+
+	// latencies counts latencies by bucket of latencyBuckets, with
+	// latencies greater than the last bound counted in the last element.
+	latencies  [len(latencyBuckets) + 1]uint64
+	latencySum uint64
+}
+
+// Questions returns the number of DNS questions a resolver has received.
+func (rs *Stats) Questions() uint64 {
+	return atomic.LoadUint64(&rs.questions)
+}
+
+// AddQuestion records that a resolver has received a DNS question.
+//
+// If rs is nil, AddQuestion is a no-op.
+func (rs *Stats) AddQuestion() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.questions, 1)
+}
+
+// Rejected returns the number of requests a resolver has rejected.
+func (rs *Stats) Rejected() uint64 {
+	return atomic.LoadUint64(&rs.rejected)
+}
+
+// AddRejected records that a resolver has rejected a request.
+//
+// If rs is nil, AddRejected is a no-op.
+func (rs *Stats) AddRejected() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.rejected, 1)
+}
+
+// Errors returns the number of errors a resolver has encountered.
+func (rs *Stats) Errors() uint64 {
+	return atomic.LoadUint64(&rs.errors)
+}
+
+// AddError records that a resolver has encountered an error.
+//
+// If rs is nil, AddError is a no-op.
+func (rs *Stats) AddError() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.errors, 1)
+}
+
+// Deferrals returns the number of times the resolver has deferred to a nested
+// resolver.
+func (rs *Stats) Deferrals() uint64 {
+	return atomic.LoadUint64(&rs.deferrals)
+}
+
+// AddDeferral records that a resolver has deferred to a nested resolver.
+//
+// If rs is nil, AddDeferral is a no-op.
+func (rs *Stats) AddDeferral() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.deferrals, 1)
+}
+
+// Answers returns the number of DNS questions a resolver has answered.
+func (rs *Stats) Answers() uint64 {
+	return atomic.LoadUint64(&rs.answers)
+}
+
+// AddAnswer records that a resolver has answered a DNS question.
+//
+// If rs is nil, AddAnswer is a no-op.
+func (rs *Stats) AddAnswer() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.answers, 1)
+}
+
+// Synthesized returns the number of DNS questions a resolver has answered with
+// responses synthesized from cached data, such as NSEC or NSEC3 records,
+// rather than with a cached or nested response.
+func (rs *Stats) Synthesized() uint64 {
+	return atomic.LoadUint64(&rs.synthesized)
+}
+
+// AddSynthesized records that a resolver has answered a DNS question with a
+// synthesized response.
+//
+// If rs is nil, AddSynthesized is a no-op.
+func (rs *Stats) AddSynthesized() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.synthesized, 1)
+}
+
+// CachedFailures returns the number of DNS questions a resolver has answered
+// from a cached failure rather than deferring to a nested resolver.
+func (rs *Stats) CachedFailures() uint64 {
+	return atomic.LoadUint64(&rs.failures)
+}
+
+// AddCachedFailure records that a resolver has answered a DNS question from
+// a cached failure.
+//
+// If rs is nil, AddCachedFailure is a no-op.
+func (rs *Stats) AddCachedFailure() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.failures, 1)
+}
+
+// Evictions returns the number of entries a caching resolver has evicted to
+// make room for new entries.
+func (rs *Stats) Evictions() uint64 {
+	return atomic.LoadUint64(&rs.evictions)
+}
+
+// AddEviction records that a caching resolver has evicted an entry to make
+// room for a new entry.
+//
+// If rs is nil, AddEviction is a no-op.
+func (rs *Stats) AddEviction() {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.evictions, 1)
+}
+
+// Entries returns the number of entries currently held by a caching resolver.
+func (rs *Stats) Entries() int64 {
+	return atomic.LoadInt64(&rs.entries)
+}
+
+// AddEntries records that a caching resolver has added delta entries, or
+// removed -delta entries if delta is negative.
+//
+// If rs is nil, AddEntries is a no-op.
+func (rs *Stats) AddEntries(delta int) {
+	if rs == nil {
+		return
+	}
+	atomic.AddInt64(&rs.entries, int64(delta))
+}
+
+// QuestionsByType returns the number of DNS questions of type t a resolver has
+// received.
+//
+// Question types greater than 255 are counted together, so for such types
+// QuestionsByType returns the number of questions of any type greater than
+// 255.
+func (rs *Stats) QuestionsByType(t dnsmessage.Type) uint64 {
+	return atomic.LoadUint64(&rs.types[typeIndex(t)])
+}
+
+// AddQuestionType records that a resolver has received a DNS question of type
+// t. It is typically called along with AddQuestion.
+//
+// If rs is nil, AddQuestionType is a no-op.
+func (rs *Stats) AddQuestionType(t dnsmessage.Type) {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.types[typeIndex(t)], 1)
+}
+
+func typeIndex(t dnsmessage.Type) int {
+	if t > maxCountedType {
+		return maxCountedType + 1
+	}
+	return int(t)
+}
+
+// ResponsesByRCode returns the number of responses with response code rcode a
+// resolver has returned.
+//
+// Extended response codes are counted together, so for such response codes
+// ResponsesByRCode returns the number of responses with any extended response
+// code.
+func (rs *Stats) ResponsesByRCode(rcode dnsmessage.RCode) uint64 {
+	return atomic.LoadUint64(&rs.rcodes[rcodeIndex(rcode)])
+}
+
+// AddResponseRCode records that a resolver has returned a response with
+// response code rcode.
+//
+// If rs is nil, AddResponseRCode is a no-op.
+func (rs *Stats) AddResponseRCode(rcode dnsmessage.RCode) {
+	if rs == nil {
+		return
+	}
+	atomic.AddUint64(&rs.rcodes[rcodeIndex(rcode)], 1)
+}
+
+func rcodeIndex(rcode dnsmessage.RCode) int {
+	if rcode >= numRCodes {
+		return numRCodes
+	}
+	return int(rcode)
+}
+
+// AddLatency records that a nested resolver took d to answer a question
+// deferred to it.
+//
+// If rs is nil, AddLatency is a no-op.
+func (rs *Stats) AddLatency(d time.Duration) {
+	if rs == nil {
+		return
+	}
+	if d < 0 {
+		d = 0
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	atomic.AddUint64(&rs.latencies[i], 1)
+	atomic.AddUint64(&rs.latencySum, uint64(d))
+}
+
+// A LatencyBucket is a bucket of a latency histogram.
+type LatencyBucket struct {
+	// Max is the inclusive upper bound of the latencies counted in the
+	// bucket. It is math.MaxInt64 for the last bucket, which has no
+	// upper bound.
+	Max time.Duration
+
+	// Count is the number of latencies counted in the bucket, excluding
+	// those counted in earlier buckets.
+	Count uint64
+}
+
+// A StatsSnapshot holds the counts of a Stats at a point in time.
+type StatsSnapshot struct {
+	Questions      uint64
+	Rejected       uint64
+	Errors         uint64
+	Deferrals      uint64
+	Answers        uint64
+	Synthesized    uint64
+	CachedFailures uint64
+	Evictions      uint64
+	Entries        int64
+
+	// QuestionTypes holds the non-zero counts of questions by type.
+	// Questions of types greater than 255 are counted under type 256.
+	QuestionTypes map[dnsmessage.Type]uint64
+
+	// RCodes holds the non-zero counts of responses by response code.
+	// Responses with extended response codes are counted under response
+	// code 16.
+	RCodes map[dnsmessage.RCode]uint64
+
+	// Latency is the histogram of nested resolver latencies. The buckets
+	// have fixed bounds, in increasing order, and the last bucket is
+	// unbounded.
+	Latency []LatencyBucket
+
+	// LatencySum is the sum of the nested resolver latencies.
+	LatencySum time.Duration
+}
+
+// Snapshot returns the current counts of rs.
+//
+// The counts are read individually without locking, so a snapshot taken
+// while events are being recorded may include some of an event's counts
+// but not others.
+//
+// If rs is nil, Snapshot returns an empty snapshot.
+func (rs *Stats) Snapshot() StatsSnapshot {
+	s := StatsSnapshot{
+		QuestionTypes: make(map[dnsmessage.Type]uint64),
+		RCodes:        make(map[dnsmessage.RCode]uint64),
+		Latency:       make([]LatencyBucket, len(latencyBuckets)+1),
+	}
+	for i := range s.Latency {
+		s.Latency[i].Max = math.MaxInt64
+		if i < len(latencyBuckets) {
+			s.Latency[i].Max = latencyBuckets[i]
+		}
+	}
+	if rs == nil {
+		return s
+	}
+
+	s.Questions = rs.Questions()
+	s.Rejected = rs.Rejected()
+	s.Errors = rs.Errors()
+	s.Deferrals = rs.Deferrals()
+	s.Answers = rs.Answers()
+	s.Synthesized = rs.Synthesized()
+	s.CachedFailures = rs.CachedFailures()
+	s.Evictions = rs.Evictions()
+	s.Entries = rs.Entries()
+	for i := range rs.types {
+		if n := atomic.LoadUint64(&rs.types[i]); n != 0 {
+			s.QuestionTypes[dnsmessage.Type(i)] = n
+		}
+	}
+	for i := range rs.rcodes {
+		if n := atomic.LoadUint64(&rs.rcodes[i]); n != 0 {
+			s.RCodes[dnsmessage.RCode(i)] = n
+		}
+	}
+	for i := range rs.latencies {
+		s.Latency[i].Count = atomic.LoadUint64(&rs.latencies[i])
+	}
+	s.LatencySum = time.Duration(atomic.LoadUint64(&rs.latencySum))
+	return s
+}
+
+// Sub returns the counts recorded between prev and s, where prev is an
+// earlier snapshot of the same Stats. This allows deltas to be computed
+// without resetting the Stats.
+//
+// Entries is not a count of events, so the Entries of the result is that of
+// s.
+func (s StatsSnapshot) Sub(prev StatsSnapshot) StatsSnapshot {
+	d := StatsSnapshot{
+		Questions:      s.Questions - prev.Questions,
+		Rejected:       s.Rejected - prev.Rejected,
+		Errors:         s.Errors - prev.Errors,
+		Deferrals:      s.Deferrals - prev.Deferrals,
+		Answers:        s.Answers - prev.Answers,
+		Synthesized:    s.Synthesized - prev.Synthesized,
+		CachedFailures: s.CachedFailures - prev.CachedFailures,
+		Evictions:      s.Evictions - prev.Evictions,
+		Entries:        s.Entries,
+		QuestionTypes:  make(map[dnsmessage.Type]uint64),
+		RCodes:         make(map[dnsmessage.RCode]uint64),
+		Latency:        append([]LatencyBucket(nil), s.Latency...),
+		LatencySum:     s.LatencySum - prev.LatencySum,
+	}
+	for t, n := range s.QuestionTypes {
+		if n -= prev.QuestionTypes[t]; n != 0 {
+			d.QuestionTypes[t] = n
+		}
+	}
+	for rcode, n := range s.RCodes {
+		if n -= prev.RCodes[rcode]; n != 0 {
+			d.RCodes[rcode] = n
+		}
+	}
+	for i := range d.Latency {
+		if i < len(prev.Latency) {
+			d.Latency[i].Count -= prev.Latency[i].Count
+		}
+	}
+	return d
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsresolver
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+func TestStatsNil(t *testing.T) {
+	var rs *Stats
+	rs.AddQuestionType(dnsmessage.TypeA)
+	rs.AddResponseRCode(dnsmessage.RCodeSuccess)
+	rs.AddLatency(time.Millisecond)
+	s := rs.Snapshot()
+	if s.Questions != 0 || len(s.QuestionTypes) != 0 || len(s.RCodes) != 0 {
+		t.Errorf("got Snapshot() = %+v, want empty", s)
+	}
+	if got, want := len(s.Latency), len(latencyBuckets)+1; got != want {
+		t.Errorf("got %d latency buckets, want = %d", got, want)
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	var rs Stats
+	rs.AddQuestion()
+	rs.AddQuestionType(dnsmessage.TypeAAAA)
+	rs.AddQuestionType(257)
+	rs.AddQuestionType(65535)
+	rs.AddResponseRCode(dnsmessage.RCodeNameError)
+	rs.AddResponseRCode(23)
+	rs.AddLatency(-time.Second)
+	rs.AddLatency(time.Minute)
+
+	s := rs.Snapshot()
+	if s.Questions != 1 {
+		t.Errorf("got Questions = %d, want 1", s.Questions)
+	}
+	if want := map[dnsmessage.Type]uint64{dnsmessage.TypeAAAA: 1, 256: 2}; !reflect.DeepEqual(s.QuestionTypes, want) {
+		t.Errorf("got QuestionTypes = %v, want = %v", s.QuestionTypes, want)
+	}
+	if got := rs.QuestionsByType(257); got != 2 {
+		t.Errorf("got QuestionsByType(257) = %d, want 2", got)
+	}
+	if want := map[dnsmessage.RCode]uint64{dnsmessage.RCodeNameError: 1, 16: 1}; !reflect.DeepEqual(s.RCodes, want) {
+		t.Errorf("got RCodes = %v, want = %v", s.RCodes, want)
+	}
+	if got := rs.ResponsesByRCode(dnsmessage.RCodeNameError); got != 1 {
+		t.Errorf("got ResponsesByRCode(RCodeNameError) = %d, want 1", got)
+	}
+	first, last := s.Latency[0], s.Latency[len(s.Latency)-1]
+	if first.Count != 1 || last.Count != 1 || last.Max != math.MaxInt64 {
+		t.Errorf("got first, last latency buckets = %+v, %+v, want one latency in each", first, last)
+	}
+	if s.LatencySum != time.Minute {
+		t.Errorf("got LatencySum = %v, want = %v", s.LatencySum, time.Minute)
+	}
+}
+
+func TestStatsSnapshotSub(t *testing.T) {
+	var rs Stats
+	rs.AddQuestion()
+	rs.AddQuestionType(dnsmessage.TypeA)
+	rs.AddLatency(time.Millisecond)
+	rs.AddEntries(3)
+	prev := rs.Snapshot()
+
+	rs.AddQuestion()
+	rs.AddQuestionType(dnsmessage.TypeMX)
+	rs.AddResponseRCode(dnsmessage.RCodeSuccess)
+	rs.AddLatency(time.Millisecond)
+	rs.AddEntries(-1)
+	d := rs.Snapshot().Sub(prev)
+
+	if d.Questions != 1 || d.Entries != 2 {
+		t.Errorf("got Questions, Entries = %d, %d, want = 1, 2", d.Questions, d.Entries)
+	}
+	if want := map[dnsmessage.Type]uint64{dnsmessage.TypeMX: 1}; !reflect.DeepEqual(d.QuestionTypes, want) {
+		t.Errorf("got QuestionTypes = %v, want = %v", d.QuestionTypes, want)
+	}
+	if want := map[dnsmessage.RCode]uint64{dnsmessage.RCodeSuccess: 1}; !reflect.DeepEqual(d.RCodes, want) {
+		t.Errorf("got RCodes = %v, want = %v", d.RCodes, want)
+	}
+	var n uint64
+	for _, b := range d.Latency {
+		n += b.Count
+	}
+	if n != 1 || d.LatencySum != time.Millisecond {
+		t.Errorf("got %d latencies summing to %v, want 1 summing to 1ms", n, d.LatencySum)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	var rs Stats
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rs.AddQuestionType(dnsmessage.TypeA)
+				rs.AddLatency(time.Duration(j) * time.Millisecond)
+				rs.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := rs.QuestionsByType(dnsmessage.TypeA); got != 400 {
+		t.Errorf("got QuestionsByType(TypeA) = %d, want 400", got)
+	}
+}
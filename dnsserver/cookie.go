@@ -0,0 +1,447 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+)
+
+const (
+	// optionCodeCookie is the EDNS(0) option code of DNS Cookies.
+	optionCodeCookie = 10
+
+	// rcodeBadCookie is the extended RCode indicating that a request had a
+	// bad or missing server cookie.
+	rcodeBadCookie dnsmessage.RCode = 23
+
+	clientCookieLength = 8
+
+	// serverCookieLength is the length of the server cookies described in
+	// RFC 9018.
+	serverCookieLength = 16
+
+	// From RFC 7873, section 4:
+	// The Server Cookie ... is of variable size with a minimum size of 8
+	// bytes and a maximum size of 32 bytes.
+	minServerCookieLength = 8
+	maxServerCookieLength = 32
+
+	// cookieOverhead is the maximum number of bytes added to a response
+	// by an OPT record with a COOKIE option.
+	cookieOverhead = 11 + 4 + clientCookieLength + serverCookieLength
+
+	// defaultCookieRotationInterval is the default interval at which the
+	// cookie secret is changed.
+	defaultCookieRotationInterval = 24 * time.Hour
+
+	// From RFC 9018, section 4.3:
+	// The Server Cookie can be considered expired if it was generated
+	// more than an hour ago (3600 seconds), and it is considered to be
+	// from the future if its Timestamp is more than 5 minutes in the
+	// future (300 seconds).
+	cookieMaxAge    = 3600
+	cookieMaxFuture = 300
+
+	// From RFC 9018, section 4.3:
+	// It is RECOMMENDED that a new Server Cookie be generated if the
+	// Timestamp is more than half an hour old.
+	cookieRefreshAge = 1800
+)
+
+var errInvalidCookieSecret = errors.New("cookie secret must be 16 bytes")
+
+// CookieConfig contains optional configuration options for DNS Cookies.
+type CookieConfig struct {
+	_ struct{} // Prevent positional initialization.
+
+	// Enable enables DNS Cookies, as described in RFC 7873. Server
+	// cookies are generated and validated as described in RFC 9018 and
+	// the status of the cookie in each request is available to the
+	// resolver using dnsresolver.CookieContextKey.
+	Enable bool
+
+	// Secret is the initial 16 byte secret used to generate server
+	// cookies. Servers which share a secret, such as the servers in an
+	// anycast group, accept each other's cookies.
+	//
+	// If nil, a random secret is generated.
+	Secret []byte
+
+	// RotationInterval is the interval at which a new random secret is
+	// generated. Cookies generated with the previous secret are still
+	// accepted.
+	//
+	// If zero, the default value will be used.
+	//
+	// If negative, the secret is only changed by SetCookieSecret.
+	RotationInterval time.Duration
+
+	// MaxUnverifiedUDPResponse is an optional limit on the size of
+	// responses to UDP requests without a valid server cookie, which
+	// limits the amplification available to an attacker spoofing the
+	// source address. Requests with a client cookie which would receive
+	// larger responses are answered with BADCOOKIE and a new server
+	// cookie, which the client uses to retry. Requests without a cookie
+	// are answered with a truncated response, which causes the client to
+	// retry over TCP.
+	//
+	// MaxUnverifiedUDPResponse is only enforced if greater than zero.
+	MaxUnverifiedUDPResponse int
+
+	// now is used to override time.Now for testing.
+	now func() time.Time
+}
+
+// cookieSecrets holds the secrets used to generate and validate server
+// cookies.
+type cookieSecrets struct {
+	mu sync.Mutex
+
+	// current is used to generate server cookies. Cookies generated with
+	// either current or previous are accepted.
+	current, previous [16]byte
+	hasPrevious       bool
+
+	// rotated is the time at which current was set.
+	rotated time.Time
+}
+
+// initCookies sets up the cookie secrets.
+func (s *Server) initCookies() error {
+	c := &s.config.Cookies
+	if !c.Enable {
+		return nil
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.RotationInterval == 0 {
+		c.RotationInterval = defaultCookieRotationInterval
+	}
+	if c.Secret != nil {
+		return s.SetCookieSecret(c.Secret)
+	}
+	if _, err := rand.Read(s.cookies.current[:]); err != nil {
+		return fmt.Errorf("generating cookie secret: %v", err)
+	}
+	s.cookies.rotated = c.now()
+	return nil
+}
+
+// SetCookieSecret changes the 16 byte secret used to generate server
+// cookies. Cookies generated with the previous secret are still accepted
+// until the secret is changed again.
+func (s *Server) SetCookieSecret(secret []byte) error {
+	if len(secret) != len(s.cookies.current) {
+		return errInvalidCookieSecret
+	}
+	now := time.Now()
+	if s.config.Cookies.now != nil {
+		now = s.config.Cookies.now()
+	}
+
+	s.cookies.mu.Lock()
+	defer s.cookies.mu.Unlock()
+	s.cookies.rotate(now)
+	copy(s.cookies.current[:], secret)
+	return nil
+}
+
+// rotate makes the current secret the previous secret.
+//
+// cs.mu must be held.
+func (cs *cookieSecrets) rotate(now time.Time) {
+	cs.previous = cs.current
+	cs.hasPrevious = true
+	cs.rotated = now
+}
+
+// currentCookieSecrets returns the current and previous secrets, generating
+// a new secret if the current one is too old.
+func (s *Server) currentCookieSecrets(now time.Time) (current, previous *[16]byte) {
+	cs := &s.cookies
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if d := s.config.Cookies.RotationInterval; d > 0 && now.Sub(cs.rotated) >= d {
+		var secret [16]byte
+		if _, err := rand.Read(secret[:]); err != nil {
+			s.errorf("DNS server: generating cookie secret: %v", err)
+		} else {
+			cs.rotate(now)
+			cs.current = secret
+		}
+	}
+	current = new([16]byte)
+	*current = cs.current
+	if cs.hasPrevious {
+		previous = new([16]byte)
+		*previous = cs.previous
+	}
+	return current, previous
+}
+
+// serverCookie generates a server cookie as described in RFC 9018, section
+// 4.
+//
+//	Version | Reserved | Timestamp | Hash
+//
+// where Hash is the SipHash-2-4 of:
+//
+//	Client Cookie | Version | Reserved | Timestamp | Client-IP
+func serverCookie(secret *[16]byte, clientCookie []byte, ip net.IP, timestamp uint32) [serverCookieLength]byte {
+	var c [serverCookieLength]byte
+	c[0] = 1 // Version.
+	binary.BigEndian.PutUint32(c[4:8], timestamp)
+
+	var buf [clientCookieLength + 8 + net.IPv6len]byte
+	in := append(buf[:0], clientCookie...)
+	in = append(in, c[:8]...)
+	if ip4 := ip.To4(); ip4 != nil {
+		in = append(in, ip4...)
+	} else {
+		in = append(in, ip.To16()...)
+	}
+	binary.LittleEndian.PutUint64(c[8:], sipHash24(secret, in))
+	return c
+}
+
+// A cookieCheck is the result of checking the COOKIE option of a request.
+type cookieCheck struct {
+	status dnsresolver.CookieStatus
+
+	// malformed indicates that the COOKIE option was malformed and a
+	// FORMERR response should be sent.
+	malformed bool
+
+	// cookie is the COOKIE option to include in the response, if any.
+	cookie []byte
+}
+
+// checkCookie checks the COOKIE option of req from a client with the given
+// IP address.
+func (s *Server) checkCookie(req []byte, ip net.IP) cookieCheck {
+	opt, ok := findCookie(req)
+	if !ok {
+		return cookieCheck{status: dnsresolver.CookieNone}
+	}
+
+	// From RFC 7873, section 5.2.2:
+	// If the COOKIE option is too short to contain a Client Cookie, then
+	// FORMERR is generated. If the COOKIE option is longer than that
+	// required to hold a COOKIE option with just a Client Cookie (8 bytes)
+	// but is shorter than the minimum COOKIE option with both a Client
+	// and a Server Cookie (16 bytes), then FORMERR is generated. If the
+	// COOKIE option is longer than the maximum valid COOKIE option (40
+	// bytes), then FORMERR is generated.
+	if l := len(opt); l < clientCookieLength ||
+		(l > clientCookieLength && l < clientCookieLength+minServerCookieLength) ||
+		l > clientCookieLength+maxServerCookieLength {
+		return cookieCheck{malformed: true}
+	}
+	clientCookie, received := opt[:clientCookieLength], opt[clientCookieLength:]
+
+	now := s.config.Cookies.now()
+	ts := uint32(now.Unix())
+	current, previous := s.currentCookieSecrets(now)
+
+	check := cookieCheck{status: dnsresolver.CookieClientOnly}
+	if len(received) > 0 {
+		check.status = dnsresolver.CookieInvalid
+	}
+	if len(received) == serverCookieLength && received[0] == 1 {
+		// Timestamps use serial number arithmetic.
+		age := int64(int32(ts - binary.BigEndian.Uint32(received[4:8])))
+		if age <= cookieMaxAge && age >= -cookieMaxFuture {
+			for _, secret := range []*[16]byte{current, previous} {
+				if secret == nil {
+					continue
+				}
+				want := serverCookie(secret, clientCookie, ip, binary.BigEndian.Uint32(received[4:8]))
+				if !bytes.Equal(received, want[:]) {
+					continue
+				}
+				check.status = dnsresolver.CookieValid
+				if secret == current && age < cookieRefreshAge {
+					// Echo the cookie, which allows servers
+					// with the same secret to agree on it.
+					check.cookie = append([]byte(nil), opt...)
+					return check
+				}
+				break
+			}
+		}
+	}
+
+	sc := serverCookie(current, clientCookie, ip, ts)
+	check.cookie = append(append(make([]byte, 0, clientCookieLength+serverCookieLength), clientCookie...), sc[:]...)
+	return check
+}
+
+// findCookie returns the data of the COOKIE option in the OPT record of req,
+// if any.
+func findCookie(req []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(req); err != nil {
+		return nil, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return nil, false
+		}
+		if h.Type != dnsmessage.TypeOPT {
+			if err := p.SkipAdditional(); err != nil {
+				return nil, false
+			}
+			continue
+		}
+		opt, err := p.OPTResource()
+		if err != nil {
+			return nil, false
+		}
+		for _, o := range opt.Options {
+			if o.Code == optionCodeCookie {
+				return o.Data, true
+			}
+		}
+		return nil, false
+	}
+}
+
+// sourceIP returns the IP address of the client from ctx.
+func sourceIP(ctx context.Context) net.IP {
+	switch a := ctx.Value(dnsresolver.SourceContextKey).(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// resolvePacket resolves a request, handling DNS Cookies if enabled. udp
+// indicates that the request was received over UDP.
+func (s *Server) resolvePacket(ctx context.Context, req []byte, maxPacketLength int, buf []byte, udp bool) ([]byte, error) {
+	pr := s.Resolver()
+	if !s.config.Cookies.Enable {
+		return pr.ResolvePacket(ctx, req, maxPacketLength, buf)
+	}
+	ip := sourceIP(ctx)
+	if ip == nil {
+		// Cookies depend on the client address.
+		return pr.ResolvePacket(ctx, req, maxPacketLength, buf)
+	}
+
+	check := s.checkCookie(req, ip)
+	if check.malformed {
+		resp, ok := errorResponse(req, dnsmessage.RCodeFormatError, buf)
+		if !ok {
+			return nil, errors.New("malformed cookie")
+		}
+		return resp, nil
+	}
+	ctx = context.WithValue(ctx, dnsresolver.CookieContextKey, check.status)
+
+	if check.cookie != nil && maxPacketLength > 0 {
+		// Leave room for the cookie.
+		maxPacketLength -= cookieOverhead
+	}
+	resp, err := pr.ResolvePacket(ctx, req, maxPacketLength, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := s.config.Cookies.MaxUnverifiedUDPResponse
+	if udp && limit > 0 && check.status != dnsresolver.CookieValid && len(resp)-len(buf) > limit {
+		if check.cookie == nil {
+			resp, ok := errorResponse(req, dnsmessage.RCodeSuccess, buf)
+			if !ok {
+				return nil, errors.New("creating truncated response")
+			}
+			// Set the TC bit.
+			resp[len(buf)+2] |= 0x02
+			return resp, nil
+		}
+
+		// From RFC 7873, section 5.2.3:
+		// If the server responds ... with a BADCOOKIE error, it
+		// SHOULD include a new Server Cookie in the response.
+		resp, ok := errorResponse(req, rcodeBadCookie&0xf, buf)
+		if !ok {
+			return nil, errors.New("creating BADCOOKIE response")
+		}
+		return addCookie(resp, len(buf), check.cookie, rcodeBadCookie)
+	}
+
+	if check.cookie == nil {
+		return resp, nil
+	}
+	return addCookie(resp, len(buf), check.cookie, 0)
+}
+
+// addCookie adds a COOKIE option to the packed response in resp[off:],
+// adding an OPT record if needed. extRCode is the extended RCode used if an
+// OPT record is added.
+func addCookie(resp []byte, off int, cookie []byte, extRCode dnsmessage.RCode) ([]byte, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp[off:]); err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+
+	option := dnsmessage.Option{Code: optionCodeCookie, Data: cookie}
+	added := false
+	for _, r := range m.Additionals {
+		opt, ok := r.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		opts := opt.Options[:0]
+		for _, o := range opt.Options {
+			if o.Code != optionCodeCookie {
+				opts = append(opts, o)
+			}
+		}
+		opt.Options = append(opts, option)
+		added = true
+		break
+	}
+	if !added {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(udpBufferSize, extRCode, false); err != nil {
+			return nil, fmt.Errorf("creating OPT record: %v", err)
+		}
+		m.Additionals = append(m.Additionals, dnsmessage.Resource{
+			Header: h,
+			Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{option}},
+		})
+	}
+
+	// m doesn't reference resp, so the packed message can overwrite it.
+	b, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing response: %v", err)
+	}
+	return append(resp[:off], b...), nil
+}
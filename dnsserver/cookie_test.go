@@ -0,0 +1,313 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex.DecodeString(%q) = %v", s, err)
+	}
+	return b
+}
+
+func TestSipHash24(t *testing.T) {
+	// From the appendix of the SipHash paper.
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if got, want := sipHash24(&key, msg), uint64(0xa129ca6149be45e5); got != want {
+		t.Errorf("sipHash24(...) = %#x, want = %#x", got, want)
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	// From RFC 9018, appendix A.
+	tests := []struct {
+		name         string
+		secret       string
+		clientCookie string
+		ip           string
+		timestamp    uint32
+		want         string
+	}{
+		{
+			name:         "A.1",
+			secret:       "e5e973e5a6b2a43f48e7dc849e37bfcf",
+			clientCookie: "2464c4abcf10c957",
+			ip:           "198.51.100.100",
+			timestamp:    1559731985,
+			want:         "010000005cf79f111f8130c3eee29480",
+		},
+		{
+			name:         "A.2",
+			secret:       "e5e973e5a6b2a43f48e7dc849e37bfcf",
+			clientCookie: "2464c4abcf10c957",
+			ip:           "198.51.100.100",
+			timestamp:    1559734385,
+			want:         "010000005cf7a871d4a564a1442aca77",
+		},
+		{
+			name:         "A.3",
+			secret:       "e5e973e5a6b2a43f48e7dc849e37bfcf",
+			clientCookie: "fc93fc62807ddb86",
+			ip:           "203.0.113.203",
+			timestamp:    1559734700,
+			want:         "010000005cf7a9acf73a7810aca2381e",
+		},
+		{
+			name:         "A.4",
+			secret:       "dd3bdf9344b678b185a6f5cb60fca715",
+			clientCookie: "22681ab97d52c298",
+			ip:           "2001:db8:220:1:59de:d0f4:8769:82b8",
+			timestamp:    1559741817,
+			want:         "010000005cf7c57926556bd0934c72f8",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var secret [16]byte
+			copy(secret[:], mustDecodeHex(t, test.secret))
+			got := serverCookie(&secret, mustDecodeHex(t, test.clientCookie), net.ParseIP(test.ip), test.timestamp)
+			if want := mustDecodeHex(t, test.want); !bytes.Equal(got[:], want) {
+				t.Errorf("serverCookie(...) = %x, want = %x", got, want)
+			}
+		})
+	}
+}
+
+// cookieRequest packs a request with the given COOKIE option, or without an
+// OPT record if cookie is nil.
+func cookieRequest(t *testing.T, cookie []byte) []byte {
+	t.Helper()
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 7},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	if cookie != nil {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal("SetEDNS0(...) =", err)
+		}
+		req.Additionals = []dnsmessage.Resource{{
+			Header: h,
+			Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: optionCodeCookie, Data: cookie}}},
+		}}
+	}
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	return b
+}
+
+// parseCookieResponse returns the extended RCode and COOKIE option of a
+// response.
+func parseCookieResponse(t *testing.T, resp []byte) (dnsmessage.RCode, []byte, bool) {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal("unpacking response:", err)
+	}
+	for _, r := range m.Additionals {
+		if opt, ok := r.Body.(*dnsmessage.OPTResource); ok {
+			for _, o := range opt.Options {
+				if o.Code == optionCodeCookie {
+					return r.Header.ExtendedRCode(m.Header.RCode), o.Data, m.Header.Truncated
+				}
+			}
+		}
+	}
+	return m.Header.RCode, nil, m.Header.Truncated
+}
+
+func TestCookies(t *testing.T) {
+	now := time.Unix(1559731985, 0)
+	var statuses []dnsresolver.CookieStatus
+	big := bytes.Repeat([]byte{0}, 300)
+	pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+		status, _ := ctx.Value(dnsresolver.CookieContextKey).(dnsresolver.CookieStatus)
+		statuses = append(statuses, status)
+		resp, _ := errorResponse(packet, dnsmessage.RCodeSuccess, buf)
+		// Pad the response with an unknown record to make it large.
+		m := dnsmessage.Message{}
+		if err := m.Unpack(resp[len(buf):]); err != nil {
+			return nil, err
+		}
+		m.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: 65280, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.UnknownResource{Type: 65280, Data: big},
+		}}
+		return m.AppendPack(buf)
+	})
+	config := Config{Cookies: CookieConfig{
+		Enable:                   true,
+		Secret:                   mustDecodeHex(t, "e5e973e5a6b2a43f48e7dc849e37bfcf"),
+		MaxUnverifiedUDPResponse: 100,
+		now:                      func() time.Time { return now },
+	}}
+	srv, err := New(config, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	ctx := context.WithValue(context.Background(), dnsresolver.SourceContextKey, &net.UDPAddr{IP: net.ParseIP("198.51.100.100"), Port: 5353})
+
+	clientCookie := mustDecodeHex(t, "2464c4abcf10c957")
+	wantCookie := mustDecodeHex(t, "2464c4abcf10c957010000005cf79f111f8130c3eee29480")
+
+	// A UDP request with only a client cookie which would get a large
+	// response gets BADCOOKIE and a server cookie.
+	resp, err := srv.resolvePacket(ctx, cookieRequest(t, clientCookie), udpBufferSize, nil, true)
+	if err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+	rcode, cookie, _ := parseCookieResponse(t, resp)
+	if rcode != rcodeBadCookie || !bytes.Equal(cookie, wantCookie) {
+		t.Errorf("got RCode = %v, cookie = %x, want = %v, %x", rcode, cookie, rcodeBadCookie, wantCookie)
+	}
+
+	// The same request over TCP gets the full response with the cookie.
+	resp, err = srv.resolvePacket(ctx, cookieRequest(t, clientCookie), 0, nil, false)
+	if err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+	rcode, cookie, _ = parseCookieResponse(t, resp)
+	if rcode != dnsmessage.RCodeSuccess || !bytes.Equal(cookie, wantCookie) || len(resp) < len(big) {
+		t.Errorf("got RCode = %v, cookie = %x, length = %d, want = %v, %x, > %d", rcode, cookie, len(resp), dnsmessage.RCodeSuccess, wantCookie, len(big))
+	}
+
+	// Retrying over UDP with the server cookie succeeds and the cookie
+	// is echoed.
+	now = now.Add(time.Minute)
+	resp, err = srv.resolvePacket(ctx, cookieRequest(t, wantCookie), udpBufferSize, nil, true)
+	if err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+	rcode, cookie, _ = parseCookieResponse(t, resp)
+	if rcode != dnsmessage.RCodeSuccess || !bytes.Equal(cookie, wantCookie) || len(resp) < len(big) {
+		t.Errorf("got RCode = %v, cookie = %x, length = %d, want = %v, %x, > %d", rcode, cookie, len(resp), dnsmessage.RCodeSuccess, wantCookie, len(big))
+	}
+
+	// A request without a cookie gets a truncated response.
+	resp, err = srv.resolvePacket(ctx, cookieRequest(t, nil), udpBufferSize, nil, true)
+	if err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+	if _, cookie, truncated := parseCookieResponse(t, resp); cookie != nil || !truncated {
+		t.Errorf("got cookie = %x, truncated = %t, want = nil, true", cookie, truncated)
+	}
+
+	// From RFC 9018, appendix A.2: an old cookie is replaced.
+	now = time.Unix(1559734385, 0)
+	resp, err = srv.resolvePacket(ctx, cookieRequest(t, wantCookie), 0, nil, false)
+	if err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+	want := mustDecodeHex(t, "2464c4abcf10c957010000005cf7a871d4a564a1442aca77")
+	if _, cookie, _ := parseCookieResponse(t, resp); !bytes.Equal(cookie, want) {
+		t.Errorf("got cookie = %x, want = %x", cookie, want)
+	}
+
+	// A cookie from a different client address is invalid.
+	otherCtx := context.WithValue(context.Background(), dnsresolver.SourceContextKey, &net.TCPAddr{IP: net.ParseIP("203.0.113.203"), Port: 5353})
+	if _, err := srv.resolvePacket(otherCtx, cookieRequest(t, wantCookie), 0, nil, false); err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+
+	// After the secret changes twice, the cookie is invalid.
+	for i := 0; i < 2; i++ {
+		if err := srv.SetCookieSecret(bytes.Repeat([]byte{byte(i)}, 16)); err != nil {
+			t.Fatal("SetCookieSecret(...) =", err)
+		}
+	}
+	if _, err := srv.resolvePacket(ctx, cookieRequest(t, wantCookie), 0, nil, false); err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+
+	// A malformed cookie gets FORMERR.
+	resp, err = srv.resolvePacket(ctx, cookieRequest(t, clientCookie[:4]), 0, nil, false)
+	if err != nil {
+		t.Fatal("resolvePacket(...) =", err)
+	}
+	if rcode, _, _ := parseCookieResponse(t, resp); rcode != dnsmessage.RCodeFormatError {
+		t.Errorf("got RCode = %v, want = %v", rcode, dnsmessage.RCodeFormatError)
+	}
+
+	wantStatuses := []dnsresolver.CookieStatus{
+		dnsresolver.CookieClientOnly,
+		dnsresolver.CookieClientOnly,
+		dnsresolver.CookieValid,
+		dnsresolver.CookieNone,
+		dnsresolver.CookieValid,
+		dnsresolver.CookieInvalid,
+		dnsresolver.CookieInvalid,
+	}
+	if len(statuses) != len(wantStatuses) {
+		t.Fatalf("got statuses = %v, want = %v", statuses, wantStatuses)
+	}
+	for i := range statuses {
+		if statuses[i] != wantStatuses[i] {
+			t.Errorf("got statuses = %v, want = %v", statuses, wantStatuses)
+			break
+		}
+	}
+}
+
+func TestCookieSecretRotation(t *testing.T) {
+	now := time.Unix(1559731985, 0)
+	srv, err := New(Config{Cookies: CookieConfig{
+		Enable:           true,
+		RotationInterval: 20 * time.Minute,
+		now:              func() time.Time { return now },
+	}}, echoPacketResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	cookie := srv.checkCookie(cookieRequest(t, mustDecodeHex(t, "0102030405060708")), ip).cookie
+
+	// Cookies generated with the previous secret are accepted, but
+	// replaced.
+	now = now.Add(25 * time.Minute)
+	check := srv.checkCookie(cookieRequest(t, cookie), ip)
+	if check.status != dnsresolver.CookieValid || bytes.Equal(check.cookie, cookie) {
+		t.Errorf("after one rotation got status = %v, cookie = %x, want = %v, new cookie", check.status, check.cookie, dnsresolver.CookieValid)
+	}
+
+	// Cookies generated with older secrets are not.
+	now = now.Add(25 * time.Minute)
+	if check := srv.checkCookie(cookieRequest(t, cookie), ip); check.status != dnsresolver.CookieInvalid {
+		t.Errorf("after two rotations got status = %v, want = %v", check.status, dnsresolver.CookieInvalid)
+	}
+}
+
+func TestNewInvalidCookieSecret(t *testing.T) {
+	_, err := New(Config{Cookies: CookieConfig{Enable: true, Secret: []byte{1, 2, 3}}}, echoPacketResolver)
+	if err != errInvalidCookieSecret {
+		t.Errorf("New(...) = %v, want = %v", err, errInvalidCookieSecret)
+	}
+}
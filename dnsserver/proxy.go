@@ -0,0 +1,254 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyConfig contains optional configuration options for the PROXY
+// protocol.
+//
+// The PROXY protocol allows a load balancer or other proxy to pass the
+// addresses of the original connection to the server. It is described at
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+type ProxyConfig struct {
+	_ struct{} // Prevent positional initialization.
+
+	// Trusted is the list of networks from which PROXY protocol headers
+	// are accepted. TCP connections and UDP requests from these networks
+	// must start with a PROXY protocol header, and are closed or dropped
+	// otherwise. The addresses in the header are used for the
+	// SourceContextKey and LocalContextKey values of the requests.
+	//
+	// Connections and requests from other networks are handled as usual.
+	//
+	// TCP connections accept both version 1 and version 2 headers. UDP
+	// requests only accept version 2 headers, which are prepended to each
+	// datagram.
+	//
+	// TCP connection limits apply to the address of the proxy, not the
+	// address in the header.
+	//
+	// If empty, the PROXY protocol is disabled.
+	Trusted []*net.IPNet
+}
+
+// trusted reports whether PROXY protocol headers are accepted from addr.
+func (c *ProxyConfig) trusted(addr net.Addr) bool {
+	if len(c.Trusted) == 0 {
+		return false
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, n := range c.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errProxyHeaderMissing = errors.New("missing PROXY protocol header")
+	errProxyHeaderInvalid = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	// proxyV1MaxLength is the maximum length of a version 1 header,
+	// including the CRLF.
+	proxyV1MaxLength = 107
+
+	// proxyV2HeaderLength is the length of the fixed part of a version 2
+	// header.
+	proxyV2HeaderLength = 16
+
+	// proxyV2MaxUDPLength is the length of the longest version 2 header
+	// accepted in front of a UDP request of the maximum size. It is
+	// enough for the largest address block, which holds two AF_UNIX
+	// addresses of 108 bytes, and a few hundred bytes of TLVs.
+	proxyV2MaxUDPLength = 512
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// A proxyHeader holds the addresses of the original connection from a PROXY
+// protocol header.
+//
+// If the proxy did not provide the addresses, such as for health checks, src
+// and dst are nil.
+type proxyHeader struct {
+	src, dst         net.IP
+	srcPort, dstPort int
+}
+
+// addrs returns the source and destination addresses in the form used by the
+// network of local, or false if h has no addresses.
+func (h proxyHeader) addrs(local net.Addr) (src, dst net.Addr, ok bool) {
+	if h.src == nil {
+		return nil, nil, false
+	}
+	if _, ok := local.(*net.UDPAddr); ok {
+		return &net.UDPAddr{IP: h.src, Port: h.srcPort}, &net.UDPAddr{IP: h.dst, Port: h.dstPort}, true
+	}
+	return &net.TCPAddr{IP: h.src, Port: h.srcPort}, &net.TCPAddr{IP: h.dst, Port: h.dstPort}, true
+}
+
+// readProxyHeader reads a version 1 or version 2 PROXY protocol header from
+// r without reading past the end of it.
+func readProxyHeader(r io.Reader) (proxyHeader, error) {
+	// The shortest version 1 header, "PROXY UNKNOWN\r\n", is longer than
+	// the version 2 signature.
+	buf := make([]byte, len(proxyV2Signature), proxyV1MaxLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return proxyHeader{}, err
+	}
+
+	if bytes.Equal(buf, proxyV2Signature) {
+		buf = buf[:proxyV2HeaderLength]
+		if _, err := io.ReadFull(r, buf[len(proxyV2Signature):]); err != nil {
+			return proxyHeader{}, err
+		}
+		l := int(binary.BigEndian.Uint16(buf[14:]))
+		buf = append(buf, make([]byte, l)...)
+		if _, err := io.ReadFull(r, buf[proxyV2HeaderLength:]); err != nil {
+			return proxyHeader{}, err
+		}
+		h, _, err := parseProxyV2(buf)
+		return h, err
+	}
+
+	if !bytes.HasPrefix(buf, proxyV1Prefix) {
+		return proxyHeader{}, errProxyHeaderMissing
+	}
+	// The line must be read one byte at a time to avoid reading the
+	// request which follows it.
+	var b [1]byte
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == proxyV1MaxLength {
+			return proxyHeader{}, errProxyHeaderInvalid
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return proxyHeader{}, err
+		}
+		buf = append(buf, b[0])
+	}
+	return parseProxyV1(buf)
+}
+
+// parseProxyV1 parses a version 1 header, including the CRLF.
+//
+// A version 1 header looks like:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n
+func parseProxyV1(b []byte) (proxyHeader, error) {
+	fields := strings.Split(string(b[:len(b)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return proxyHeader{}, errProxyHeaderInvalid
+	}
+	if fields[1] == "UNKNOWN" {
+		// The rest of the line must be ignored.
+		return proxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return proxyHeader{}, errProxyHeaderInvalid
+	}
+
+	var h proxyHeader
+	h.src = net.ParseIP(fields[2])
+	h.dst = net.ParseIP(fields[3])
+	if h.src == nil || h.dst == nil || (h.src.To4() != nil) != (fields[1] == "TCP4") || (h.dst.To4() != nil) != (fields[1] == "TCP4") {
+		return proxyHeader{}, errProxyHeaderInvalid
+	}
+	var err error
+	if h.srcPort, err = parseProxyPort(fields[4]); err != nil {
+		return proxyHeader{}, err
+	}
+	if h.dstPort, err = parseProxyPort(fields[5]); err != nil {
+		return proxyHeader{}, err
+	}
+	return h, nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	// Leading zeros are not allowed.
+	if len(s) > 1 && s[0] == '0' {
+		return 0, errProxyHeaderInvalid
+	}
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, errProxyHeaderInvalid
+	}
+	return int(p), nil
+}
+
+// parseProxyV2 parses a version 2 header at the start of b. It returns the
+// header and its length.
+func parseProxyV2(b []byte) (proxyHeader, int, error) {
+	if len(b) < proxyV2HeaderLength || !bytes.Equal(b[:len(proxyV2Signature)], proxyV2Signature) {
+		return proxyHeader{}, 0, errProxyHeaderMissing
+	}
+	n := proxyV2HeaderLength + int(binary.BigEndian.Uint16(b[14:]))
+	if len(b) < n {
+		return proxyHeader{}, 0, errProxyHeaderInvalid
+	}
+	if b[12]>>4 != 2 {
+		return proxyHeader{}, 0, fmt.Errorf("unsupported PROXY protocol version %d", b[12]>>4)
+	}
+
+	switch b[12] & 0xf {
+	case 0x0:
+		// LOCAL: the connection was established by the proxy itself,
+		// for example for a health check.
+		return proxyHeader{}, n, nil
+	case 0x1:
+		// PROXY
+	default:
+		return proxyHeader{}, 0, errProxyHeaderInvalid
+	}
+
+	// The high nibble is the address family and the low nibble is the
+	// transport protocol. Both stream and datagram transports are
+	// accepted.
+	addrs := b[proxyV2HeaderLength:n]
+	var ipLen int
+	switch b[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX: the addresses must be ignored.
+		return proxyHeader{}, n, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return proxyHeader{}, 0, errProxyHeaderInvalid
+	}
+	h := proxyHeader{
+		src:     append(net.IP(nil), addrs[:ipLen]...),
+		dst:     append(net.IP(nil), addrs[ipLen:2*ipLen]...),
+		srcPort: int(binary.BigEndian.Uint16(addrs[2*ipLen:])),
+		dstPort: int(binary.BigEndian.Uint16(addrs[2*ipLen+2:])),
+	}
+	// Any TLVs which follow are ignored.
+	return h, n, nil
+}
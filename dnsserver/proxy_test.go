@@ -0,0 +1,411 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+)
+
+// proxyV2 builds a version 2 header with the given command, family and
+// address block.
+func proxyV2(command, family byte, addrs []byte) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+// proxyV2Addrs builds a version 2 address block.
+func proxyV2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	b := append(append([]byte(nil), src...), dst...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+	return append(b, ports[:]...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src4, dst4 := net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4()
+	src6, dst6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	tests := []struct {
+		name    string
+		in      []byte
+		want    proxyHeader
+		wantErr bool
+	}{
+		{
+			name: "v1 tcp4",
+			in:   []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n"),
+			want: proxyHeader{src: net.ParseIP("192.0.2.1"), dst: net.ParseIP("198.51.100.1"), srcPort: 56324, dstPort: 53},
+		},
+		{
+			name: "v1 tcp6",
+			in:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 53\r\n"),
+			want: proxyHeader{src: src6, dst: dst6, srcPort: 56324, dstPort: 53},
+		},
+		{
+			name: "v1 unknown",
+			in:   []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+		},
+		{
+			name:    "v1 mismatched family",
+			in:      []byte("PROXY TCP6 192.0.2.1 198.51.100.1 56324 53\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "v1 bad port",
+			in:      []byte("PROXY TCP4 192.0.2.1 198.51.100.1 056324 53\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "v1 too long",
+			in:      append(append([]byte("PROXY UNKNOWN "), bytes.Repeat([]byte("a"), 100)...), "\r\n"...),
+			wantErr: true,
+		},
+		{
+			name: "v2 tcp4",
+			in:   proxyV2(1, 0x11, proxyV2Addrs(src4, dst4, 56324, 53)),
+			want: proxyHeader{src: src4, dst: dst4, srcPort: 56324, dstPort: 53},
+		},
+		{
+			name: "v2 udp6 with TLV",
+			in:   proxyV2(1, 0x22, append(proxyV2Addrs(src6, dst6, 56324, 53), 0x04, 0, 1, 0)),
+			want: proxyHeader{src: src6, dst: dst6, srcPort: 56324, dstPort: 53},
+		},
+		{
+			name: "v2 local",
+			in:   proxyV2(0, 0x00, nil),
+		},
+		{
+			name:    "v2 short addresses",
+			in:      proxyV2(1, 0x11, src4),
+			wantErr: true,
+		},
+		{
+			name:    "v2 bad command",
+			in:      proxyV2(2, 0x11, proxyV2Addrs(src4, dst4, 56324, 53)),
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			in:      []byte("\x00\x1dGET / HTTP/1.1\r\n"),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The header must be consumed exactly, leaving the
+			// request which follows.
+			r := bytes.NewReader(append(append([]byte(nil), test.in...), "rest"...))
+			got, err := readProxyHeader(r)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("readProxyHeader(%q) = %v, want error = %t", test.in, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readProxyHeader(%q) = %+v, want = %+v", test.in, got, test.want)
+			}
+			if r.Len() != len("rest") {
+				t.Errorf("readProxyHeader(%q) left %d bytes unread, want = %d", test.in, r.Len(), len("rest"))
+			}
+		})
+	}
+}
+
+// sourceRecorder is a PacketResolver which records the SourceContextKey and
+// LocalContextKey values of requests.
+type sourceRecorder struct {
+	sources, locals chan net.Addr
+}
+
+func newSourceRecorder() *sourceRecorder {
+	return &sourceRecorder{make(chan net.Addr, 1), make(chan net.Addr, 1)}
+}
+
+func (r *sourceRecorder) ResolvePacket(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+	source, _ := ctx.Value(dnsresolver.SourceContextKey).(net.Addr)
+	local, _ := ctx.Value(dnsresolver.LocalContextKey).(net.Addr)
+	r.sources <- source
+	r.locals <- local
+	return echoPacketResolver(ctx, packet, maxPacketLength, buf)
+}
+
+var proxyTestRequest = dnsmessage.Message{
+	Questions: []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName("example.com."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}},
+}
+
+func loopbackNet() []*net.IPNet {
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	return []*net.IPNet{n}
+}
+
+func TestTCPProxy(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []*net.IPNet
+		header     []byte
+		wantSource net.Addr
+		wantLocal  net.Addr
+	}{
+		{
+			name:       "v1",
+			trusted:    loopbackNet(),
+			header:     []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n"),
+			wantSource: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			wantLocal:  &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53},
+		},
+		{
+			name:       "v2",
+			trusted:    loopbackNet(),
+			header:     proxyV2(1, 0x11, proxyV2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 56324, 53)),
+			wantSource: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 56324},
+			wantLocal:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 53},
+		},
+		{
+			name:    "v2 local",
+			trusted: loopbackNet(),
+			header:  proxyV2(0, 0x00, nil),
+		},
+		{
+			name: "untrusted",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := newSourceRecorder()
+			srv, err := New(Config{Proxy: ProxyConfig{Trusted: test.trusted}, Errorf: t.Logf}, rec)
+			if err != nil {
+				t.Fatal("creating server:", err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("listening:", err)
+			}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				srv.ServeTCP(l)
+				wg.Done()
+			}()
+			defer func() {
+				l.Close()
+				wg.Wait()
+				srv.Wait()
+			}()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal("dialing server:", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write(test.header); err != nil {
+				t.Fatal("writing header:", err)
+			}
+			if err := writeTCPMessage(conn, proxyTestRequest); err != nil {
+				t.Fatal("writing request:", err)
+			}
+			if _, err := readTCPMessage(conn); err != nil {
+				t.Fatal("reading response:", err)
+			}
+
+			wantSource, wantLocal := test.wantSource, test.wantLocal
+			if wantSource == nil {
+				wantSource, wantLocal = conn.LocalAddr(), conn.RemoteAddr()
+			}
+			if got := <-rec.sources; got.String() != wantSource.String() {
+				t.Errorf("got SourceContextKey = %v, want = %v", got, wantSource)
+			}
+			if got := <-rec.locals; got.String() != wantLocal.String() {
+				t.Errorf("got LocalContextKey = %v, want = %v", got, wantLocal)
+			}
+		})
+	}
+}
+
+func TestTCPProxyMissingHeader(t *testing.T) {
+	srv, err := New(Config{Proxy: ProxyConfig{Trusted: loopbackNet()}}, echoPacketResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeTCP(l)
+		wg.Done()
+	}()
+	defer func() {
+		l.Close()
+		wg.Wait()
+		srv.Wait()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing server:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if err := writeTCPMessage(conn, proxyTestRequest); err != nil {
+		t.Fatal("writing request:", err)
+	}
+	expectTCPClosed(t, conn)
+}
+
+func TestUDPProxy(t *testing.T) {
+	rec := newSourceRecorder()
+	srv, err := New(Config{Proxy: ProxyConfig{Trusted: loopbackNet()}, Errorf: t.Logf}, rec)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	pc, addr, err := testUDP()
+	if err != nil {
+		t.Fatal("creating UDP socket:", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeUDP(pc)
+		wg.Done()
+	}()
+	defer func() {
+		pc.Close()
+		wg.Wait()
+		srv.Wait()
+	}()
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal("dialing server:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	reqBuf, err := proxyTestRequest.Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+
+	// A request without a header is dropped.
+	if _, err := conn.Write(reqBuf); err != nil {
+		t.Fatal("writing request:", err)
+	}
+
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	req := append(proxyV2(1, 0x22, proxyV2Addrs(src, dst, 56324, 53)), reqBuf...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal("writing request:", err)
+	}
+	resp := make([]byte, udpBufferSize)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal("reading response:", err)
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp[:n]); err != nil {
+		t.Fatal("parsing response:", err)
+	}
+
+	wantSource := &net.UDPAddr{IP: src, Port: 56324}
+	wantLocal := &net.UDPAddr{IP: dst, Port: 53}
+	if got := <-rec.sources; !reflect.DeepEqual(got, wantSource) {
+		t.Errorf("got SourceContextKey = %v, want = %v", got, wantSource)
+	}
+	if got := <-rec.locals; !reflect.DeepEqual(got, wantLocal) {
+		t.Errorf("got LocalContextKey = %v, want = %v", got, wantLocal)
+	}
+}
+
+func TestUDPProxyMaxSizeRequest(t *testing.T) {
+	lengths := make(chan int, 1)
+	pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+		lengths <- len(packet)
+		return echoPacketResolver(ctx, packet, maxPacketLength, buf)
+	})
+	srv, err := New(Config{Proxy: ProxyConfig{Trusted: loopbackNet()}, Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	pc, addr, err := testUDP()
+	if err != nil {
+		t.Fatal("creating UDP socket:", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeUDP(pc)
+		wg.Done()
+	}()
+	defer func() {
+		pc.Close()
+		wg.Wait()
+		srv.Wait()
+	}()
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal("dialing server:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Pad the request to the maximum size with a TXT record.
+	req := proxyTestRequest
+	req.Additionals = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		},
+		Body: &dnsmessage.TXTResource{TXT: []string{""}},
+	}}
+	reqBuf, err := req.Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	pad := udpBufferSize - len(reqBuf)
+	req.Additionals[0].Body = &dnsmessage.TXTResource{TXT: []string{string(make([]byte, 255)), string(make([]byte, pad-256))}}
+	if reqBuf, err = req.Pack(); err != nil {
+		t.Fatal("packing request:", err)
+	}
+	if len(reqBuf) != udpBufferSize {
+		t.Fatalf("got request length = %d, want = %d", len(reqBuf), udpBufferSize)
+	}
+
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	if _, err := conn.Write(append(proxyV2(1, 0x22, proxyV2Addrs(src, dst, 56324, 53)), reqBuf...)); err != nil {
+		t.Fatal("writing request:", err)
+	}
+	resp := make([]byte, udpBufferSize)
+	if _, err := conn.Read(resp); err != nil {
+		t.Fatal("reading response:", err)
+	}
+	if got := <-lengths; got != udpBufferSize {
+		t.Errorf("got resolved request length = %d, want = %d", got, udpBufferSize)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/iangudger/dns/dnsresolver"
+)
+
+// A QueryLogger logs the queries handled by a server.
+type QueryLogger interface {
+	// LogQuery is called once a server has handled a query, just before
+	// the response is sent.
+	//
+	// l and the slices it references are only valid for the duration of
+	// the call. LogQuery is called concurrently and must not block, as it
+	// delays the response.
+	LogQuery(l *QueryLog)
+}
+
+// A QueryLog describes a query handled by a server.
+type QueryLog struct {
+	// TCP indicates that the query was received over TCP rather than
+	// UDP.
+	TCP bool
+
+	// Source is the address of the client, as provided to the resolver
+	// with dnsresolver.SourceContextKey, or nil if not available.
+	Source net.Addr
+
+	// Local is the address the query was sent to, as provided to the
+	// resolver with dnsresolver.LocalContextKey, or nil if not
+	// available.
+	Local net.Addr
+
+	// Query is the query message.
+	Query []byte
+
+	// QueryTime is the time at which the query started to be resolved.
+	QueryTime time.Time
+
+	// Response is the response message, or nil if no response is sent,
+	// for example because of Response Rate Limiting.
+	Response []byte
+
+	// ResponseTime is the time at which the response was ready to be
+	// sent.
+	ResponseTime time.Time
+}
+
+// MultiQueryLogger returns a QueryLogger which logs each query with each of
+// loggers in turn.
+func MultiQueryLogger(loggers ...QueryLogger) QueryLogger {
+	return multiQueryLogger(append([]QueryLogger(nil), loggers...))
+}
+
+type multiQueryLogger []QueryLogger
+
+func (m multiQueryLogger) LogQuery(l *QueryLog) {
+	for _, ql := range m {
+		ql.LogQuery(l)
+	}
+}
+
+// queryStartTime returns the time to be used as the start of a query, or the
+// zero time if queries are not logged.
+func (s *Server) queryStartTime() time.Time {
+	if s.config.QueryLogger == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// logQuery logs a query with the QueryLogger, if any.
+func (s *Server) logQuery(ctx context.Context, tcp bool, query []byte, start time.Time, resp []byte) {
+	if s.config.QueryLogger == nil {
+		return
+	}
+	l := QueryLog{
+		TCP:          tcp,
+		Query:        query,
+		QueryTime:    start,
+		Response:     resp,
+		ResponseTime: time.Now(),
+	}
+	l.Source, _ = ctx.Value(dnsresolver.SourceContextKey).(net.Addr)
+	l.Local, _ = ctx.Value(dnsresolver.LocalContextKey).(net.Addr)
+	s.config.QueryLogger.LogQuery(&l)
+}
@@ -0,0 +1,21 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package dnsserver
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported reports whether reusePort can set SO_REUSEPORT.
+const reusePortSupported = false
+
+// reusePort is a net.ListenConfig Control function which sets SO_REUSEPORT.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,28 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
+
+package dnsserver
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported reports whether reusePort can set SO_REUSEPORT.
+const reusePortSupported = true
+
+// reusePort is a net.ListenConfig Control function which sets SO_REUSEPORT.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
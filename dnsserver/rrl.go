@@ -0,0 +1,350 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+const (
+	// defaultRRLWindow is the default period over which responses are
+	// accounted.
+	defaultRRLWindow = 15 * time.Second
+
+	// defaultRRLSlip is the default slip ratio.
+	defaultRRLSlip = 2
+
+	// defaultRRLMaxBuckets is the default maximum number of buckets.
+	defaultRRLMaxBuckets = 100000
+
+	defaultRRLIPv4PrefixLength = 24
+	defaultRRLIPv6PrefixLength = 56
+)
+
+// RRLConfig contains optional configuration options for Response Rate
+// Limiting (RRL) of UDP responses.
+//
+// RRL limits the rate of identical responses sent to a network, which stops
+// a server from being used to flood a victim with responses to requests
+// with a spoofed source address. Legitimate clients which lose a response
+// retry, and receive a truncated response, which causes them to retry over
+// TCP, often enough to still be answered.
+//
+// Responses are identical if they have the same name, type and RCode and are
+// sent to addresses in the same network, as given by IPv4PrefixLength and
+// IPv6PrefixLength.
+type RRLConfig struct {
+	_ struct{} // Prevent positional initialization.
+
+	// ResponsesPerSecond is the number of identical responses allowed
+	// per second. Further responses are dropped or, as specified by Slip,
+	// replaced with truncated responses.
+	//
+	// If not positive, RRL is disabled.
+	ResponsesPerSecond int
+
+	// Window is the period over which responses are accounted. A network
+	// which exceeds the limit is limited until its rate of requests has
+	// been below the limit for up to Window.
+	//
+	// If not positive, the default value will be used.
+	Window time.Duration
+
+	// Slip is the ratio of limited responses which are replaced with
+	// truncated responses rather than dropped. One in every Slip limited
+	// responses is replaced. A value of one replaces all limited
+	// responses.
+	//
+	// If zero, the default value will be used.
+	//
+	// If negative, all limited responses are dropped.
+	Slip int
+
+	// IPv4PrefixLength is the length of the prefix of IPv4 client
+	// addresses which identifies a network.
+	//
+	// If not positive, the default value of 24 will be used.
+	IPv4PrefixLength int
+
+	// IPv6PrefixLength is the length of the prefix of IPv6 client
+	// addresses which identifies a network.
+	//
+	// If not positive, the default value of 56 will be used.
+	IPv6PrefixLength int
+
+	// MaxBuckets is the maximum number of responses accounted for at
+	// once, each of which uses roughly 100 bytes. When the limit is
+	// reached, the least recently used response is forgotten, which
+	// allows it to be sent again as if it were new.
+	//
+	// If not positive, the default value of 100000 will be used.
+	MaxBuckets int
+
+	// now is used to override time.Now for testing.
+	now func() time.Time
+}
+
+// An rrlAction is the action to be taken for a response.
+type rrlAction uint8
+
+const (
+	// rrlSend indicates that the response should be sent.
+	rrlSend rrlAction = iota
+
+	// rrlDrop indicates that the response should be dropped.
+	rrlDrop
+
+	// rrlSlip indicates that a truncated response should be sent.
+	rrlSlip
+)
+
+// An rrlKey identifies identical responses.
+type rrlKey struct {
+	network [net.IPv6len]byte
+	name    string
+	qtype   dnsmessage.Type
+	rcode   dnsmessage.RCode
+}
+
+// An rrlBucket accounts for identical responses.
+type rrlBucket struct {
+	key rrlKey
+
+	// prev and next link the bucket into rateLimiter.lru.
+	prev, next *rrlBucket
+
+	// balance is the number of responses which can be sent. It is
+	// negative while responses are limited.
+	balance int
+
+	// updated is the second at which balance was last updated.
+	updated int64
+
+	// limited is the number of responses limited, used to determine
+	// which responses slip.
+	limited int
+}
+
+// A rateLimiter implements Response Rate Limiting.
+type rateLimiter struct {
+	rate       int
+	window     int64
+	slip       int
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	now        func() time.Time
+	minBalance int
+
+	maxBuckets int
+
+	mu      sync.Mutex
+	buckets map[rrlKey]*rrlBucket
+
+	// lru holds the buckets from most to least recently used, so that
+	// expired buckets are found at its back.
+	lru rrlList
+}
+
+// An rrlList is a doubly linked list of buckets.
+type rrlList struct {
+	front, back *rrlBucket
+}
+
+// pushFront inserts b at the front of l.
+func (l *rrlList) pushFront(b *rrlBucket) {
+	b.prev, b.next = nil, l.front
+	if l.front != nil {
+		l.front.prev = b
+	} else {
+		l.back = b
+	}
+	l.front = b
+}
+
+// remove removes b from l.
+func (l *rrlList) remove(b *rrlBucket) {
+	if b.prev != nil {
+		b.prev.next = b.next
+	} else {
+		l.front = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	} else {
+		l.back = b.prev
+	}
+	b.prev, b.next = nil, nil
+}
+
+// newRateLimiter returns a rateLimiter for config, or nil if RRL is
+// disabled.
+func newRateLimiter(config RRLConfig) *rateLimiter {
+	if config.ResponsesPerSecond <= 0 {
+		return nil
+	}
+	window := config.Window
+	if window <= 0 {
+		window = defaultRRLWindow
+	}
+	slip := config.Slip
+	if slip == 0 {
+		slip = defaultRRLSlip
+	}
+	ipv4PrefixLength := config.IPv4PrefixLength
+	if ipv4PrefixLength <= 0 || ipv4PrefixLength > 32 {
+		ipv4PrefixLength = defaultRRLIPv4PrefixLength
+	}
+	ipv6PrefixLength := config.IPv6PrefixLength
+	if ipv6PrefixLength <= 0 || ipv6PrefixLength > 128 {
+		ipv6PrefixLength = defaultRRLIPv6PrefixLength
+	}
+	maxBuckets := config.MaxBuckets
+	if maxBuckets <= 0 {
+		maxBuckets = defaultRRLMaxBuckets
+	}
+	now := config.now
+	if now == nil {
+		now = time.Now
+	}
+
+	// Windows are accounted in whole seconds.
+	windowSeconds := int64((window + time.Second - 1) / time.Second)
+	return &rateLimiter{
+		rate:       config.ResponsesPerSecond,
+		window:     windowSeconds,
+		slip:       slip,
+		ipv4Mask:   net.CIDRMask(ipv4PrefixLength, 32),
+		ipv6Mask:   net.CIDRMask(ipv6PrefixLength, 128),
+		now:        now,
+		minBalance: -int(windowSeconds) * config.ResponsesPerSecond,
+		maxBuckets: maxBuckets,
+		buckets:    make(map[rrlKey]*rrlBucket),
+	}
+}
+
+// check accounts for a response to ip and returns the action to be taken.
+func (rl *rateLimiter) check(ip net.IP, q dnsmessage.Question, rcode dnsmessage.RCode) rrlAction {
+	key := rrlKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		rcode: rcode,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key.network[:], ip4.Mask(rl.ipv4Mask))
+	} else {
+		copy(key.network[:], ip.Mask(rl.ipv6Mask))
+	}
+
+	now := rl.now().Unix()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if ok {
+		rl.lru.remove(b)
+	} else {
+		if len(rl.buckets) >= rl.maxBuckets {
+			rl.evict(rl.lru.back)
+		}
+		b = &rrlBucket{key: key, balance: rl.rate, updated: now}
+		rl.buckets[key] = b
+	}
+	rl.lru.pushFront(b)
+	if elapsed := now - b.updated; elapsed > 0 {
+		// Limit elapsed to avoid overflow.
+		if elapsed > rl.window+1 {
+			elapsed = rl.window + 1
+		}
+		b.balance += int(elapsed) * rl.rate
+		if b.balance > rl.rate {
+			b.balance = rl.rate
+		}
+		b.updated = now
+	}
+
+	b.balance--
+	if b.balance >= 0 {
+		return rrlSend
+	}
+	if b.balance < rl.minBalance {
+		b.balance = rl.minBalance
+	}
+
+	b.limited++
+	if rl.slip > 0 && b.limited%rl.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// sweep removes buckets which have not been used for long enough to have
+// been fully refilled, which makes them equivalent to new buckets.
+//
+// As buckets are used in order of time, only the least recently used ones
+// need to be checked.
+//
+// rl.mu must be held.
+func (rl *rateLimiter) sweep(now int64) {
+	for b := rl.lru.back; b != nil && now-b.updated > rl.window; b = rl.lru.back {
+		rl.evict(b)
+	}
+}
+
+// evict removes b.
+//
+// rl.mu must be held.
+func (rl *rateLimiter) evict(b *rrlBucket) {
+	rl.lru.remove(b)
+	delete(rl.buckets, b.key)
+}
+
+// rateLimitUDP applies RRL to a UDP response to ip. It returns the response
+// to send, which may be a truncated version of resp written to buf, or false
+// if no response should be sent.
+func (s *Server) rateLimitUDP(ip net.IP, resp, buf []byte) ([]byte, bool) {
+	if s.rrl == nil || ip == nil {
+		return resp, true
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return resp, true
+	}
+	q, err := p.Question()
+	if err != nil {
+		// Responses without a question don't identify a name to be
+		// used for amplification.
+		return resp, true
+	}
+
+	switch s.rrl.check(ip, q, h.RCode) {
+	case rrlDrop:
+		s.config.Stats.AddRRLDropped()
+		return nil, false
+	case rrlSlip:
+		s.config.Stats.AddRRLSlipped()
+		// From RFC 1035, section 4.1.1:
+		// TC - TrunCation - specifies that this message was truncated
+		// due to length greater than that permitted on the
+		// transmission channel.
+		h.Truncated = true
+		m := dnsmessage.Message{Header: h, Questions: []dnsmessage.Question{q}}
+		tc, err := m.AppendPack(buf)
+		if err != nil {
+			return nil, false
+		}
+		return tc, true
+	}
+	return resp, true
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+func rrlQuestion(name string, qtype dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(RRLConfig{
+		ResponsesPerSecond: 2,
+		Window:             2 * time.Second,
+		Slip:               3,
+		now:                func() time.Time { return now },
+	})
+
+	client := net.ParseIP("192.0.2.1")
+	q := rrlQuestion("example.com.", dnsmessage.TypeA)
+	check := func(n int) []rrlAction {
+		var got []rrlAction
+		for i := 0; i < n; i++ {
+			got = append(got, rl.check(client, q, dnsmessage.RCodeSuccess))
+		}
+		return got
+	}
+
+	// Two responses are allowed per second, then one in three limited
+	// responses slips.
+	if got, want := check(8), []rrlAction{rrlSend, rrlSend, rrlDrop, rrlDrop, rrlSlip, rrlDrop, rrlDrop, rrlSlip}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first second got = %v, want = %v", got, want)
+	}
+
+	// The balance is limited to a window of debt, -4, which the next
+	// second reduces to -2.
+	now = now.Add(time.Second)
+	if got, want := check(1), []rrlAction{rrlDrop}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second second got = %v, want = %v", got, want)
+	}
+
+	// After a quiet period, the remaining debt of -3 has been repaid.
+	now = now.Add(3 * time.Second)
+	if got, want := check(2), []rrlAction{rrlSend, rrlSend}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after quiet period got = %v, want = %v", got, want)
+	}
+
+	// Other clients in the same /24 share the limit, regardless of the
+	// case of the name.
+	other := net.ParseIP("192.0.2.200")
+	if got := rl.check(other, rrlQuestion("EXAMPLE.com.", dnsmessage.TypeA), dnsmessage.RCodeSuccess); got == rrlSend {
+		t.Errorf("same network got = %v, want limited", got)
+	}
+
+	// Other networks, names, types and RCodes don't.
+	tests := []struct {
+		name  string
+		ip    net.IP
+		q     dnsmessage.Question
+		rcode dnsmessage.RCode
+	}{
+		{"network", net.ParseIP("192.0.3.1"), q, dnsmessage.RCodeSuccess},
+		{"name", client, rrlQuestion("example.org.", dnsmessage.TypeA), dnsmessage.RCodeSuccess},
+		{"type", client, rrlQuestion("example.com.", dnsmessage.TypeAAAA), dnsmessage.RCodeSuccess},
+		{"rcode", client, q, dnsmessage.RCodeNameError},
+	}
+	for _, test := range tests {
+		if got := rl.check(test.ip, test.q, test.rcode); got != rrlSend {
+			t.Errorf("different %s got = %v, want = %v", test.name, got, rrlSend)
+		}
+	}
+}
+
+func TestRateLimiterIPv6(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(RRLConfig{
+		ResponsesPerSecond: 1,
+		Slip:               -1,
+		now:                func() time.Time { return now },
+	})
+	q := rrlQuestion("example.com.", dnsmessage.TypeA)
+
+	if got := rl.check(net.ParseIP("2001:db8:0:100::1"), q, dnsmessage.RCodeSuccess); got != rrlSend {
+		t.Errorf("first response got = %v, want = %v", got, rrlSend)
+	}
+	// The same /56.
+	for i := 0; i < 4; i++ {
+		if got := rl.check(net.ParseIP("2001:db8:0:1ff::2"), q, dnsmessage.RCodeSuccess); got != rrlDrop {
+			t.Errorf("same network got = %v, want = %v", got, rrlDrop)
+		}
+	}
+	// A different /56.
+	if got := rl.check(net.ParseIP("2001:db8:0:200::1"), q, dnsmessage.RCodeSuccess); got != rrlSend {
+		t.Errorf("different network got = %v, want = %v", got, rrlSend)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(RRLConfig{
+		ResponsesPerSecond: 1,
+		Window:             time.Second,
+		now:                func() time.Time { return now },
+	})
+	q := rrlQuestion("example.com.", dnsmessage.TypeA)
+	for i := 0; i < 10; i++ {
+		rl.check(net.IPv4(192, 0, byte(i), 1), q, dnsmessage.RCodeSuccess)
+	}
+	if got := len(rl.buckets); got != 10 {
+		t.Fatalf("got %d buckets, want = 10", got)
+	}
+
+	now = now.Add(5 * time.Second)
+	rl.check(net.IPv4(192, 0, 0, 1), q, dnsmessage.RCodeSuccess)
+	if got := len(rl.buckets); got != 1 {
+		t.Errorf("after sweep got %d buckets, want = 1", got)
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(RRLConfig{
+		ResponsesPerSecond: 1,
+		MaxBuckets:         2,
+		now:                func() time.Time { return now },
+	})
+	q := rrlQuestion("example.com.", dnsmessage.TypeA)
+	first, second, third := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 1), net.IPv4(203, 0, 113, 1)
+	rl.check(first, q, dnsmessage.RCodeSuccess)
+	rl.check(second, q, dnsmessage.RCodeSuccess)
+
+	// Using the first bucket makes the second the least recently used.
+	if got := rl.check(first, q, dnsmessage.RCodeSuccess); got == rrlSend {
+		t.Errorf("got second response to %v = %v, want limited", first, got)
+	}
+	rl.check(third, q, dnsmessage.RCodeSuccess)
+	if got := len(rl.buckets); got != 2 {
+		t.Errorf("got %d buckets, want = 2", got)
+	}
+	if got := rl.check(second, q, dnsmessage.RCodeSuccess); got != rrlSend {
+		t.Errorf("got response to evicted %v = %v, want = %v", second, got, rrlSend)
+	}
+	if got := rl.check(third, q, dnsmessage.RCodeSuccess); got == rrlSend {
+		t.Errorf("got second response to %v = %v, want limited", third, got)
+	}
+}
+
+func TestRateLimitUDP(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var stats Stats
+	config := Config{
+		UDP: UDPConfig{RRL: RRLConfig{
+			ResponsesPerSecond: 1,
+			Slip:               2,
+			now:                func() time.Time { return now },
+		}},
+		Stats: &stats,
+	}
+	srv, err := New(config, echoPacketResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 3, Response: true, Authoritative: true},
+		Questions: []dnsmessage.Question{
+			rrlQuestion("example.com.", dnsmessage.TypeA),
+		},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}
+	resp, err := m.Pack()
+	if err != nil {
+		t.Fatal("packing response:", err)
+	}
+	client := net.ParseIP("198.51.100.1")
+
+	if got, ok := srv.rateLimitUDP(client, resp, nil); !ok || !reflect.DeepEqual(got, resp) {
+		t.Errorf("first response got = %x, %t, want = %x, true", got, ok, resp)
+	}
+	if _, ok := srv.rateLimitUDP(client, resp, nil); ok {
+		t.Error("second response was sent, want dropped")
+	}
+
+	got, ok := srv.rateLimitUDP(client, resp, nil)
+	if !ok {
+		t.Fatal("third response was dropped, want truncated")
+	}
+	var tc dnsmessage.Message
+	if err := tc.Unpack(got); err != nil {
+		t.Fatal("unpacking truncated response:", err)
+	}
+	want := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 3, Response: true, Authoritative: true, Truncated: true},
+		Questions:   m.Questions,
+		Answers:     []dnsmessage.Resource{},
+		Authorities: []dnsmessage.Resource{},
+		Additionals: []dnsmessage.Resource{},
+	}
+	if !reflect.DeepEqual(tc, want) {
+		t.Errorf("truncated response got = %#v, want = %#v", &tc, &want)
+	}
+
+	if got, want := stats.RRLDropped(), uint64(1); got != want {
+		t.Errorf("got RRLDropped() = %d, want = %d", got, want)
+	}
+	if got, want := stats.RRLSlipped(), uint64(1); got != want {
+		t.Errorf("got RRLSlipped() = %d, want = %d", got, want)
+	}
+}
@@ -6,10 +6,15 @@
 package dnsserver
 
 import (
+	"context"
 	"errors"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 
+	"github.com/iangudger/dns/dnsmessage"
 	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnstrace"
 )
 
 // A Logger allows emitting debug information.
@@ -28,8 +33,34 @@ type Config struct {
 	// server.
 	UDP UDPConfig
 
+	// Proxy contains optional configuration options for the PROXY
+	// protocol.
+	Proxy ProxyConfig
+
+	// Cookies contains optional configuration options for DNS Cookies.
+	Cookies CookieConfig
+
 	// Errorf is optionally used to log errors.
 	Errorf Logger
+
+	// Stats optionally records statistics about server operation.
+	Stats *Stats
+
+	// QueryLogger is optionally used to log every query and response.
+	QueryLogger QueryLogger
+
+	// Tracer optionally records a span for each query, which is the parent
+	// of the spans recorded by the resolvers. It is provided to the
+	// resolvers in the context.
+	Tracer dnstrace.Tracer
+
+	// DisablePanicRecovery, when true, causes panics while resolving a
+	// request to crash the process, which can be useful for debugging.
+	//
+	// By default, such panics are recovered, logged with Errorf along with
+	// a stack trace and counted, and the request is answered with a
+	// SERVFAIL response.
+	DisablePanicRecovery bool
 }
 
 // A Server is a DNS server. It can be used with both TCP and UDP.
@@ -43,19 +74,105 @@ type Server struct {
 	// on 32-bit systems.
 	config Config
 
-	pr dnsresolver.PacketResolver
+	// pr holds a packetResolverBox with the PacketResolver used for new
+	// requests.
+	pr atomic.Value
 
 	wg sync.WaitGroup
+
+	// tcpMu protects tcpConns, tcpConnsPerIP and tcpOpen.
+	tcpMu sync.Mutex
+
+	// tcpConns holds the open TCP connections.
+	tcpConns map[*tcpConn]struct{}
+
+	// tcpConnsPerIP counts the open TCP connections by client IP address.
+	tcpConnsPerIP map[string]int
+
+	// tcpOpen is the number of connections in tcpConns which haven't been
+	// evicted.
+	tcpOpen int
+
+	// tcpIdleMu protects tcpIdle. It is acquired after tcpMu and
+	// tcpConn.mu.
+	tcpIdleMu sync.Mutex
+
+	// tcpIdle holds the idle TCP connections, from the one which has been
+	// idle the longest.
+	tcpIdle tcpConnList
+
+	// cookies holds the secrets used for DNS Cookies.
+	cookies cookieSecrets
+
+	// rrl limits the rate of UDP responses, or is nil if RRL is disabled.
+	rrl *rateLimiter
 }
 
-var errNilResolver = errors.New("PacketResolver can't be nil")
+var (
+	errNilResolver            = errors.New("PacketResolver can't be nil")
+	errInvalidFullQueuePolicy = errors.New("invalid full queue policy")
+	errResolverPanic          = errors.New("panic while resolving request")
+)
 
 // New creates a new DNS server, but does not start it.
 func New(config Config, r dnsresolver.PacketResolver) (*Server, error) {
 	if r == nil {
 		return nil, errNilResolver
 	}
-	return &Server{config: config, pr: r}, nil
+	if config.UDP.FullQueuePolicy >= invalidFullQueuePolicy {
+		return nil, errInvalidFullQueuePolicy
+	}
+	if config.Cookies.Secret != nil && len(config.Cookies.Secret) != len(cookieSecrets{}.current) {
+		return nil, errInvalidCookieSecret
+	}
+	s := &Server{config: config, rrl: newRateLimiter(config.UDP.RRL)}
+	s.pr.Store(packetResolverBox{r})
+	if err := s.initCookies(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// packetResolverBox boxes a PacketResolver so that PacketResolvers of
+// different concrete types can be stored in an atomic.Value.
+type packetResolverBox struct {
+	pr dnsresolver.PacketResolver
+}
+
+// SetResolver replaces the PacketResolver used to resolve requests. Requests
+// received afterwards use r, while requests in progress complete with the
+// PacketResolver they started with. It is safe to call SetResolver while the
+// server is running, so that the server can be reconfigured without closing
+// its listeners.
+func (s *Server) SetResolver(r dnsresolver.PacketResolver) error {
+	if r == nil {
+		return errNilResolver
+	}
+	s.pr.Store(packetResolverBox{r})
+	return nil
+}
+
+// Resolver returns the PacketResolver used for new requests.
+func (s *Server) Resolver() dnsresolver.PacketResolver {
+	return s.pr.Load().(packetResolverBox).pr
+}
+
+// ResolvePacket resolves a request received over another stream transport,
+// such as DNS over HTTPS, and appends the response to buf. The request is
+// handled like those received by ServeTCP, including DNS Cookies, panic
+// recovery, tracing and query logging. The addresses of the client and the
+// server can be provided in ctx with dnsresolver.SourceContextKey and
+// dnsresolver.LocalContextKey.
+//
+// ResolvePacket implements dnsresolver.PacketResolver.
+func (s *Server) ResolvePacket(ctx context.Context, req []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+	start := s.queryStartTime()
+	resp, err := s.resolve(ctx, req, maxPacketLength, buf, false)
+	if err != nil {
+		return nil, err
+	}
+	s.logQuery(ctx, true, req, start, resp[len(buf):])
+	return resp, nil
 }
 
 // Wait waits for all spawned goroutines to exit.
@@ -63,8 +180,81 @@ func (s *Server) Wait() {
 	s.wg.Wait()
 }
 
+// errorResponse appends to buf a response to the DNS request in req with the
+// given RCode and no records other than the question. It returns false if req
+// can't be parsed or is not a request.
+func errorResponse(req []byte, rcode dnsmessage.RCode, buf []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               h.ID,
+			Response:         true,
+			OpCode:           h.OpCode,
+			RecursionDesired: h.RecursionDesired,
+			RCode:            rcode,
+		},
+	}
+	if q, err := p.Question(); err == nil {
+		resp.Questions = []dnsmessage.Question{q}
+	}
+	b, err := resp.AppendPack(buf)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// resolve resolves a request with resolvePacket. Unless DisablePanicRecovery
+// is set, a panic while resolving the request is recovered and the request is
+// answered with a SERVFAIL response, appended to buf.
+func (s *Server) resolve(ctx context.Context, req []byte, maxPacketLength int, buf []byte, udp bool) (resp []byte, err error) {
+	if s.config.Tracer != nil {
+		transport := "tcp"
+		if udp {
+			transport = "udp"
+		}
+		var span dnstrace.Span
+		ctx, span = dnstrace.Start(dnstrace.WithTracer(ctx, s.config.Tracer), "dnsserver.Query", dnstrace.String(dnstrace.KeyTransport, transport))
+		// Deferred first so that it sees the response to a recovered
+		// panic.
+		defer func() {
+			if err != nil {
+				span.SetAttributes(dnstrace.String(dnstrace.KeyError, err.Error()))
+			} else if len(resp) >= len(buf)+4 {
+				// The response code is in the low bits of the
+				// fourth byte of the header.
+				rcode := dnsmessage.RCode(resp[len(buf)+3] & 0xf)
+				span.SetAttributes(dnstrace.String(dnstrace.KeyRCode, rcode.String()))
+			}
+			span.End()
+		}()
+	}
+	if !s.config.DisablePanicRecovery {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			s.config.Stats.AddPanic()
+			s.errorf("DNS server: panic while resolving request: %v\n%s", r, debug.Stack())
+
+			var ok bool
+			if resp, ok = errorResponse(req, dnsmessage.RCodeServerFailure, buf); ok {
+				err = nil
+			} else {
+				resp, err = nil, errResolverPanic
+			}
+		}()
+	}
+	return s.resolvePacket(ctx, req, maxPacketLength, buf, udp)
+}
+
 func (s *Server) errorf(format string, v ...interface{}) {
 	if s.config.Errorf != nil {
-		s.config.Errorf(format, v)
+		s.config.Errorf(format, v...)
 	}
 }
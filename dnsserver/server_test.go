@@ -0,0 +1,430 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnscache"
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/dnstrace"
+)
+
+var panickingResolver = dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+	panic("resolver bug")
+})
+
+func TestPanicRecovery(t *testing.T) {
+	var stats Stats
+	var mu sync.Mutex
+	var logs []string
+	config := Config{
+		Stats: &stats,
+		Errorf: func(format string, v ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, v...))
+		},
+	}
+	srv, err := New(config, panickingResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+
+	pc, addr, err := testUDP()
+	if err != nil {
+		t.Fatal("creating UDP socket:", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		pc.Close()
+		t.Fatal("listening:", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		srv.ServeUDP(pc)
+		wg.Done()
+	}()
+	go func() {
+		srv.ServeTCP(l)
+		wg.Done()
+	}()
+	defer func() {
+		pc.Close()
+		l.Close()
+		wg.Wait()
+		srv.Wait()
+	}()
+
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 9, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	check := func(proto string, resp dnsmessage.Message) {
+		t.Helper()
+		if resp.Header.ID != req.Header.ID || resp.Header.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("%s response got ID = %d, RCode = %v, want = %d, %v", proto, resp.Header.ID, resp.Header.RCode, req.Header.ID, dnsmessage.RCodeServerFailure)
+		}
+	}
+
+	uc, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal("dialing UDP server:", err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(time.Second))
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	if _, err := uc.Write(b); err != nil {
+		t.Fatal("writing UDP request:", err)
+	}
+	buf := make([]byte, udpBufferSize)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal("reading UDP response:", err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatal("unpacking UDP response:", err)
+	}
+	check("UDP", resp)
+
+	tc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing TCP server:", err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(time.Second))
+	if err := writeTCPMessage(tc, req); err != nil {
+		t.Fatal("writing TCP request:", err)
+	}
+	resp, err = readTCPMessage(tc)
+	if err != nil {
+		t.Fatal("reading TCP response:", err)
+	}
+	check("TCP", resp)
+
+	if got, want := stats.Panics(), uint64(2); got != want {
+		t.Errorf("got Panics() = %d, want = %d", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, log := range logs {
+		if !strings.Contains(log, "resolver bug") || !strings.Contains(log, "goroutine") {
+			t.Errorf("got log = %q, want panic value and stack trace", log)
+		}
+	}
+	if len(logs) != 2 {
+		t.Errorf("got %d logs, want = 2", len(logs))
+	}
+}
+
+func TestDisablePanicRecovery(t *testing.T) {
+	srv, err := New(Config{DisablePanicRecovery: true}, panickingResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	defer func() {
+		if r := recover(); r != "resolver bug" {
+			t.Errorf("got recover() = %v, want = %q", r, "resolver bug")
+		}
+	}()
+	srv.resolve(context.Background(), nil, udpBufferSize, nil, true)
+	t.Error("resolve(...) returned, want panic")
+}
+
+// queryRecorder is a QueryLogger which records copies of the logged queries.
+type queryRecorder struct {
+	mu   sync.Mutex
+	logs []QueryLog
+}
+
+func (r *queryRecorder) LogQuery(l *QueryLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := *l
+	c.Query = append([]byte(nil), l.Query...)
+	c.Response = append([]byte(nil), l.Response...)
+	r.logs = append(r.logs, c)
+}
+
+func TestQueryLogger(t *testing.T) {
+	var rec queryRecorder
+	srv, err := New(Config{QueryLogger: &rec, Errorf: t.Logf}, echoPacketResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	pc, addr, err := testUDP()
+	if err != nil {
+		t.Fatal("creating UDP socket:", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeUDP(pc)
+		wg.Done()
+	}()
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal("dialing server:", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	before := time.Now()
+	if err := exchangeUDP(conn, 1, 1); err != nil {
+		t.Fatal("exchanging request:", err)
+	}
+	pc.Close()
+	wg.Wait()
+	srv.Wait()
+
+	if len(rec.logs) != 1 {
+		t.Fatalf("got %d logs, want = 1", len(rec.logs))
+	}
+	l := rec.logs[0]
+	if l.TCP {
+		t.Error("got TCP = true, want = false")
+	}
+	if l.Source.String() != conn.LocalAddr().String() || l.Local.String() != addr.String() {
+		t.Errorf("got Source, Local = %v, %v, want = %v, %v", l.Source, l.Local, conn.LocalAddr(), addr)
+	}
+	var p dnsmessage.Parser
+	if h, err := p.Start(l.Query); err != nil || h.Response {
+		t.Errorf("got Query header = %+v, %v, want query", h, err)
+	}
+	if h, err := p.Start(l.Response); err != nil || !h.Response {
+		t.Errorf("got Response header = %+v, %v, want response", h, err)
+	}
+	if l.QueryTime.Before(before) || l.ResponseTime.Before(l.QueryTime) {
+		t.Errorf("got QueryTime, ResponseTime = %v, %v, want ordered after %v", l.QueryTime, l.ResponseTime, before)
+	}
+}
+
+func TestResolvePacket(t *testing.T) {
+	var rec queryRecorder
+	var stats Stats
+	srv, err := New(Config{QueryLogger: &rec, Stats: &stats, Errorf: t.Logf}, echoPacketResolver)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	source := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	ctx := context.WithValue(context.Background(), dnsresolver.SourceContextKey, source)
+	req, err := proxyTestRequest.Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	prefix := []byte("prefix")
+	resp, err := srv.ResolvePacket(ctx, req, 512, prefix)
+	if err != nil {
+		t.Fatal("ResolvePacket(...) =", err)
+	}
+	if string(resp[:len(prefix)]) != string(prefix) {
+		t.Errorf("got response prefix %q, want = %q", resp[:len(prefix)], prefix)
+	}
+	if len(rec.logs) != 1 {
+		t.Fatalf("got %d logs, want = 1", len(rec.logs))
+	}
+	if l := rec.logs[0]; !l.TCP || l.Source != source || string(l.Response) != string(resp[len(prefix):]) {
+		t.Errorf("got log TCP, Source, Response = %t, %v, %x, want = true, %v, %x", l.TCP, l.Source, l.Response, source, resp[len(prefix):])
+	}
+
+	// Panics are recovered as for the other transports.
+	if err := srv.SetResolver(panickingResolver); err != nil {
+		t.Fatal("SetResolver(...) =", err)
+	}
+	resp, err = srv.ResolvePacket(ctx, req, 512, nil)
+	if err != nil {
+		t.Fatal("ResolvePacket(...) with panic =", err)
+	}
+	var p dnsmessage.Parser
+	if h, err := p.Start(resp); err != nil || h.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got response header = %+v, %v, want SERVFAIL", h, err)
+	}
+	if got := stats.Panics(); got != 1 {
+		t.Errorf("got %d panics, want = 1", got)
+	}
+}
+
+func TestMultiQueryLogger(t *testing.T) {
+	var a, b queryRecorder
+	l := MultiQueryLogger(&a, &b)
+	l.LogQuery(&QueryLog{TCP: true, Query: []byte("query")})
+	for i, r := range []*queryRecorder{&a, &b} {
+		if len(r.logs) != 1 || !r.logs[0].TCP || string(r.logs[0].Query) != "query" {
+			t.Errorf("logger %d got logs = %+v, want one TCP query", i, r.logs)
+		}
+	}
+}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...dnstrace.Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type spanContextKey struct{}
+
+// spanRecorder is a dnstrace.Tracer which records spans.
+type spanRecorder struct {
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) Start(ctx context.Context, name string) (context.Context, dnstrace.Span) {
+	parent, _ := ctx.Value(spanContextKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func TestTracer(t *testing.T) {
+	upstream := dnsresolver.NewTracingResolver("upstream", dnsresolver.ResolverFunc(func(_ context.Context, q dnsmessage.Question, _ bool) (dnsmessage.Message, bool) {
+		return dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused},
+			Questions: []dnsmessage.Question{q},
+		}, true
+	}))
+	cache, err := dnscache.NewResolver(dnscache.Config{}, upstream)
+	if err != nil {
+		t.Fatal("creating cache:", err)
+	}
+	pr, err := dnsresolver.NewPacketResolver(dnsresolver.PacketResolverConfig{}, cache)
+	if err != nil {
+		t.Fatal("creating packet resolver:", err)
+	}
+	var r spanRecorder
+	srv, err := New(Config{Tracer: &r}, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 3},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	if _, err := srv.resolve(context.Background(), b, udpBufferSize, []byte{0, 0}, false); err != nil {
+		t.Fatal("resolving request:", err)
+	}
+
+	wantNames := []string{"dnsserver.Query", "dnsresolver.PacketResolver", "dnscache.Resolve", "upstream"}
+	if len(r.spans) != len(wantNames) {
+		t.Fatalf("got %d spans, want = %d", len(r.spans), len(wantNames))
+	}
+	for i, s := range r.spans {
+		if s.name != wantNames[i] || !s.ended {
+			t.Errorf("got span %d = %q, ended = %t, want = %q, ended", i, s.name, s.ended, wantNames[i])
+		}
+		if i > 0 && s.parent != r.spans[i-1] {
+			t.Errorf("span %q isn't a child of %q", s.name, wantNames[i-1])
+		}
+		if got := s.attrs[dnstrace.KeyRCode]; got != "RCodeRefused" {
+			t.Errorf("span %q got rcode = %v, want = RCodeRefused", s.name, got)
+		}
+	}
+	if got := r.spans[0].attrs[dnstrace.KeyTransport]; got != "tcp" {
+		t.Errorf("got transport = %v, want = tcp", got)
+	}
+	if got := r.spans[2].attrs[dnstrace.KeyCacheResult]; got != "miss" {
+		t.Errorf("got cache result = %v, want = miss", got)
+	}
+}
+
+// rcodeResolver returns a PacketResolver which responds to requests with rcode.
+// If started isn't nil, the PacketResolver closes it and waits for release to
+// be closed before responding, so it can only handle one request.
+func rcodeResolver(rcode dnsmessage.RCode, started, release chan struct{}) dnsresolver.PacketResolver {
+	return dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+		if started != nil {
+			close(started)
+			<-release
+		}
+		resp, _ := errorResponse(packet, rcode, buf)
+		return resp, nil
+	})
+}
+
+func TestSetResolver(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv, err := New(Config{Errorf: t.Logf}, rcodeResolver(dnsmessage.RCodeRefused, started, release))
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+	req, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	resolve := func() (dnsmessage.RCode, error) {
+		resp, err := srv.resolve(context.Background(), req, udpBufferSize, nil, true)
+		if err != nil {
+			return 0, err
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(resp)
+		return h.RCode, err
+	}
+
+	type result struct {
+		rcode dnsmessage.RCode
+		err   error
+	}
+	inFlight := make(chan result)
+	go func() {
+		rcode, err := resolve()
+		inFlight <- result{rcode, err}
+	}()
+	<-started
+
+	if err := srv.SetResolver(nil); err != errNilResolver {
+		t.Errorf("got SetResolver(nil) = %v, want = %v", err, errNilResolver)
+	}
+	if err := srv.SetResolver(rcodeResolver(dnsmessage.RCodeNameError, nil, nil)); err != nil {
+		t.Fatal("SetResolver(...) =", err)
+	}
+	if rcode, err := resolve(); err != nil || rcode != dnsmessage.RCodeNameError {
+		t.Errorf("got new request rcode = %v, %v, want = %v, <nil>", rcode, err, dnsmessage.RCodeNameError)
+	}
+
+	// The request in progress completes with the old resolver.
+	close(release)
+	if r := <-inFlight; r.err != nil || r.rcode != dnsmessage.RCodeRefused {
+		t.Errorf("got in-flight request rcode = %v, %v, want = %v, <nil>", r.rcode, r.err, dnsmessage.RCodeRefused)
+	}
+}
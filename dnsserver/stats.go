@@ -0,0 +1,106 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"sync/atomic"
+)
+
+// Stats collects counts of various events that have occurred for a
+// particular DNS Server.
+//
+// All methods are safe for concurrent use.
+type Stats struct {
+	udpDropped  uint64
+	udpRejected uint64
+	rrlDropped  uint64
+	rrlSlipped  uint64
+	panics      uint64
+}
+
+// UDPDropped returns the number of UDP requests a server has dropped because
+// its queue was full.
+func (ss *Stats) UDPDropped() uint64 {
+	return atomic.LoadUint64(&ss.udpDropped)
+}
+
+// AddUDPDropped records that a server has dropped a UDP request because its
+// queue was full.
+//
+// If ss is nil, AddUDPDropped is a no-op.
+func (ss *Stats) AddUDPDropped() {
+	if ss == nil {
+		return
+	}
+	atomic.AddUint64(&ss.udpDropped, 1)
+}
+
+// UDPRejected returns the number of UDP requests a server has answered with
+// an error response because its queue was full.
+func (ss *Stats) UDPRejected() uint64 {
+	return atomic.LoadUint64(&ss.udpRejected)
+}
+
+// AddUDPRejected records that a server has answered a UDP request with an
+// error response because its queue was full.
+//
+// If ss is nil, AddUDPRejected is a no-op.
+func (ss *Stats) AddUDPRejected() {
+	if ss == nil {
+		return
+	}
+	atomic.AddUint64(&ss.udpRejected, 1)
+}
+
+// RRLDropped returns the number of UDP responses a server has dropped because
+// of Response Rate Limiting.
+func (ss *Stats) RRLDropped() uint64 {
+	return atomic.LoadUint64(&ss.rrlDropped)
+}
+
+// AddRRLDropped records that a server has dropped a UDP response because of
+// Response Rate Limiting.
+//
+// If ss is nil, AddRRLDropped is a no-op.
+func (ss *Stats) AddRRLDropped() {
+	if ss == nil {
+		return
+	}
+	atomic.AddUint64(&ss.rrlDropped, 1)
+}
+
+// RRLSlipped returns the number of UDP responses a server has replaced with
+// truncated responses because of Response Rate Limiting.
+func (ss *Stats) RRLSlipped() uint64 {
+	return atomic.LoadUint64(&ss.rrlSlipped)
+}
+
+// AddRRLSlipped records that a server has replaced a UDP response with a
+// truncated response because of Response Rate Limiting.
+//
+// If ss is nil, AddRRLSlipped is a no-op.
+func (ss *Stats) AddRRLSlipped() {
+	if ss == nil {
+		return
+	}
+	atomic.AddUint64(&ss.rrlSlipped, 1)
+}
+
+// Panics returns the number of panics a server has recovered from while
+// resolving requests.
+func (ss *Stats) Panics() uint64 {
+	return atomic.LoadUint64(&ss.panics)
+}
+
+// AddPanic records that a server has recovered from a panic while resolving
+// a request.
+//
+// If ss is nil, AddPanic is a no-op.
+func (ss *Stats) AddPanic() {
+	if ss == nil {
+		return
+	}
+	atomic.AddUint64(&ss.panics, 1)
+}
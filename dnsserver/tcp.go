@@ -12,6 +12,7 @@ import (
 	"io"
 	"math"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -37,6 +38,10 @@ const (
 	// According to RFC 7766, section 8, the two-byte length should be
 	// written in the same segment as the message.
 	tcpInitialWriteBufferSize = tcpInitialReadBufferSize + 2
+
+	// defaultTCPMaxInFlight is the default maximum number of requests
+	// processed concurrently on a single TCP connection.
+	defaultTCPMaxInFlight = 16
 )
 
 // TCPConfig contains optional configuration options for the TCP DNS server.
@@ -55,6 +60,50 @@ type TCPConfig struct {
 	//
 	// ResolverTimeout is only enforced if greater than zero.
 	ResolverTimeout time.Duration
+
+	// MaxInFlight is the maximum number of requests pipelined on a single
+	// connection which are processed concurrently. Once reached, no
+	// further requests are read from the connection until a response has
+	// been sent.
+	//
+	// If not positive, the default value will be used. A value of one
+	// processes requests sequentially.
+	MaxInFlight int
+
+	// IdleTimeout is an optional timeout for idle connections, which are
+	// connections with no requests in progress. ClientTimeout applies
+	// while a request is being read or responses are pending.
+	//
+	// RFC 7766, section 6.2.3 recommends that idle timeouts be of the
+	// order of seconds, which is much shorter than the default
+	// ClientTimeout.
+	//
+	// If zero, ClientTimeout will be used.
+	//
+	// If negative, idle connections will not time out.
+	IdleTimeout time.Duration
+
+	// MaxConnections is an optional limit on the number of concurrent
+	// connections. When the limit is reached, the connection which has
+	// been idle the longest is closed to make room for a new connection.
+	// If no connection is idle, the new connection is closed.
+	//
+	// MaxConnections is only enforced if greater than zero.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is an optional limit on the number of concurrent
+	// connections from a single client IP address. New connections over
+	// the limit are closed.
+	//
+	// MaxConnectionsPerIP is only enforced if greater than zero.
+	MaxConnectionsPerIP int
+
+	// MaxQueriesPerConnection is an optional limit on the number of
+	// requests read from a single connection. Once reached, the
+	// connection is closed after all pending responses have been sent.
+	//
+	// MaxQueriesPerConnection is only enforced if greater than zero.
+	MaxQueriesPerConnection int
 }
 
 // ServeTCP listens for and responds to TCP DNS requests.
@@ -65,18 +114,94 @@ func (s *Server) ServeTCP(l net.Listener) error {
 			return err
 		}
 
+		tc := newTCPConn(conn)
+		if !s.trackTCP(tc) {
+			conn.Close()
+			continue
+		}
+
 		s.wg.Add(1)
 
 		go func() {
-			if err := s.handleTCP(conn); err != nil {
+			if err := s.handleTCP(tc); err != nil {
 				s.errorf("TCP DNS server: %v", err)
 			}
+			s.untrackTCP(tc)
 			conn.Close()
 			s.wg.Done()
 		}()
 	}
 }
 
+// trackTCP records a newly accepted connection, enforcing the connection
+// limits. It returns false if the connection should be closed.
+func (s *Server) trackTCP(tc *tcpConn) bool {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+
+	if max := s.config.TCP.MaxConnectionsPerIP; max > 0 && s.tcpConnsPerIP[tc.ip] >= max {
+		return false
+	}
+
+	if max := s.config.TCP.MaxConnections; max > 0 && s.tcpOpen >= max {
+		// From RFC 7766, section 6.2.3:
+		// To mitigate the risk of unintentional server overload,
+		// DNS clients MUST take care to minimize the number of
+		// concurrent TCP connections made to any individual
+		// server. ... servers MAY close the oldest idle
+		// connections first.
+		if !s.evictIdleTCP() {
+			return false
+		}
+		s.tcpOpen--
+	}
+
+	if s.tcpConns == nil {
+		s.tcpConns = make(map[*tcpConn]struct{})
+		s.tcpConnsPerIP = make(map[string]int)
+	}
+	s.tcpConns[tc] = struct{}{}
+	s.tcpConnsPerIP[tc.ip]++
+	s.tcpOpen++
+	return true
+}
+
+// evictIdleTCP evicts the connection which has been idle the longest. It
+// returns false if no connection is idle.
+//
+// s.tcpMu must be held.
+func (s *Server) evictIdleTCP() bool {
+	for {
+		s.tcpIdleMu.Lock()
+		oldest := s.tcpIdle.front
+		s.tcpIdleMu.Unlock()
+		if oldest == nil {
+			return false
+		}
+		// The connection may have stopped being idle since it was
+		// found, in which case it has left the list.
+		if oldest.evict(s) {
+			return true
+		}
+	}
+}
+
+// untrackTCP removes a closed connection.
+func (s *Server) untrackTCP(tc *tcpConn) {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	tc.mu.Lock()
+	tc.clearIdle(s)
+	if !tc.evicted {
+		s.tcpOpen--
+	}
+	tc.mu.Unlock()
+	delete(s.tcpConns, tc)
+	if s.tcpConnsPerIP[tc.ip]--; s.tcpConnsPerIP[tc.ip] <= 0 {
+		delete(s.tcpConnsPerIP, tc.ip)
+	}
+}
+
 func (s *Server) tcpDeadline() time.Time {
 	d := time.Duration(atomic.LoadInt64((*int64)(&s.config.TCP.ClientTimeout)))
 	if d < 0 {
@@ -88,29 +213,302 @@ func (s *Server) tcpDeadline() time.Time {
 	return time.Now().Add(d)
 }
 
-// handleTCP responds to a TCP DNS request.
+// tcpIdleDeadline returns the read deadline for an idle connection.
+func (s *Server) tcpIdleDeadline() time.Time {
+	d := s.config.TCP.IdleTimeout
+	if d < 0 {
+		return time.Time{}
+	}
+	if d == 0 {
+		return s.tcpDeadline()
+	}
+	return time.Now().Add(d)
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used to unblock reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// A tcpConn is a TCP DNS connection with queries in flight.
+type tcpConn struct {
+	conn net.Conn
+
+	// ip is the client IP address, used to enforce per-IP limits.
+	ip string
+
+	// sem limits the number of queries in flight.
+	sem chan struct{}
+
+	// wg tracks queries in flight.
+	wg sync.WaitGroup
+
+	// wmu serializes writes.
+	wmu sync.Mutex
+
+	// mu protects the fields below and the read deadline of conn.
+	mu sync.Mutex
+
+	// err is the first error encountered on the connection.
+	err error
+
+	// cancel cancels the contexts of queries in flight.
+	cancel func()
+
+	// inFlight is the number of queries in flight.
+	inFlight int
+
+	// waiting indicates that the reader is waiting for the next request.
+	waiting bool
+
+	// idle is the time at which the connection became idle, or zero if it
+	// is not idle. A connection is idle if the reader is waiting for the
+	// next request and there are no queries in flight.
+	idle time.Time
+
+	// evicted indicates that the connection was closed to make room for
+	// another connection.
+	evicted bool
+
+	// idlePrev and idleNext link the connection into Server.tcpIdle while
+	// it is idle.
+	idlePrev, idleNext *tcpConn
+}
+
+// A tcpConnList is a doubly linked list of connections.
+type tcpConnList struct {
+	front, back *tcpConn
+}
+
+// pushBack inserts tc at the back of l.
+func (l *tcpConnList) pushBack(tc *tcpConn) {
+	tc.idlePrev, tc.idleNext = l.back, nil
+	if l.back != nil {
+		l.back.idleNext = tc
+	} else {
+		l.front = tc
+	}
+	l.back = tc
+}
+
+// remove removes tc from l.
+func (l *tcpConnList) remove(tc *tcpConn) {
+	if tc.idlePrev != nil {
+		tc.idlePrev.idleNext = tc.idleNext
+	} else {
+		l.front = tc.idleNext
+	}
+	if tc.idleNext != nil {
+		tc.idleNext.idlePrev = tc.idlePrev
+	} else {
+		l.back = tc.idlePrev
+	}
+	tc.idlePrev, tc.idleNext = nil, nil
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	tc := &tcpConn{conn: conn}
+	switch a := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		tc.ip = a.IP.String()
+	case nil:
+	default:
+		tc.ip = a.String()
+	}
+	return tc
+}
+
+// setIdle marks the connection as idle and adds it to the back of s.tcpIdle.
 //
-// handleTCP does not take ownership of conn.
-func (s *Server) handleTCP(conn net.Conn) error {
-	srb := make([]byte, tcpInitialReadBufferSize)
-	swb := make([]byte, tcpInitialWriteBufferSize)
-	ctx := context.Background()
-	if a := conn.RemoteAddr(); a != nil {
-		ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, a)
+// tc.mu must be held.
+func (tc *tcpConn) setIdle(s *Server) {
+	if !tc.idle.IsZero() {
+		return
 	}
+	tc.idle = time.Now()
+	s.tcpIdleMu.Lock()
+	s.tcpIdle.pushBack(tc)
+	s.tcpIdleMu.Unlock()
+}
 
-	for {
-		// Make a copy of the slice headers for use in this loop
-		// iteration.
-		readBuf := srb
-		writeBuf := swb
+// clearIdle marks the connection as not idle and removes it from s.tcpIdle.
+//
+// tc.mu must be held.
+func (tc *tcpConn) clearIdle(s *Server) {
+	if tc.idle.IsZero() {
+		return
+	}
+	tc.idle = time.Time{}
+	s.tcpIdleMu.Lock()
+	s.tcpIdle.remove(tc)
+	s.tcpIdleMu.Unlock()
+}
+
+// evict closes the connection if it is still idle. It reports whether the
+// connection was evicted.
+func (tc *tcpConn) evict(s *Server) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.idle.IsZero() || tc.err != nil {
+		return false
+	}
+	tc.clearIdle(s)
+	tc.evicted = true
 
-		if err := conn.SetReadDeadline(s.tcpDeadline()); err != nil {
-			return fmt.Errorf("setting read deadline: %v", err)
+	// Unblock the reader.
+	tc.conn.SetReadDeadline(aLongTimeAgo)
+	return true
+}
+
+// isStopped reports whether the reader should stop because the connection
+// has failed or been evicted.
+func (tc *tcpConn) isStopped() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.stopped()
+}
+
+// stopped reports whether the reader should stop because the connection has
+// failed or been evicted.
+//
+// tc.mu must be held.
+func (tc *tcpConn) stopped() bool {
+	return tc.err != nil || tc.evicted
+}
+
+// updateIdle updates the idle state and read deadline after the reader or a
+// query in flight changes state.
+//
+// tc.mu must be held.
+func (tc *tcpConn) updateIdle(s *Server) error {
+	if tc.stopped() {
+		return nil
+	}
+	if !tc.waiting || tc.inFlight > 0 {
+		tc.clearIdle(s)
+		return tc.conn.SetReadDeadline(s.tcpDeadline())
+	}
+	tc.setIdle(s)
+	return tc.conn.SetReadDeadline(s.tcpIdleDeadline())
+}
+
+// setWaiting records whether the reader is waiting for the next request. It
+// returns false if the reader should stop.
+func (tc *tcpConn) setWaiting(s *Server, waiting bool) (bool, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.waiting = waiting
+	if err := tc.updateIdle(s); err != nil {
+		return false, fmt.Errorf("setting read deadline: %v", err)
+	}
+	return !tc.stopped(), nil
+}
+
+// addInFlight adjusts the number of queries in flight by delta.
+func (tc *tcpConn) addInFlight(s *Server, delta int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.inFlight += delta
+	if err := tc.updateIdle(s); err != nil {
+		s.errorf("TCP DNS server: setting read deadline: %v", err)
+	}
+}
+
+// fail records err as the reason for the connection to be closed and stops
+// further processing.
+func (tc *tcpConn) fail(s *Server, err error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.err != nil {
+		return
+	}
+	tc.clearIdle(s)
+	tc.err = err
+	tc.cancel()
+
+	// Unblock the reader.
+	tc.conn.SetReadDeadline(aLongTimeAgo)
+}
+
+// failed reports whether the connection has failed.
+func (tc *tcpConn) failed() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.err != nil
+}
+
+// handleTCP responds to TCP DNS requests on conn.
+//
+// As described in RFC 7766, section 6.2.1.1, requests pipelined by the client
+// are processed concurrently and responses are sent as soon as they are
+// available, which may be out of order.
+//
+// handleTCP does not take ownership of tc.conn.
+func (s *Server) handleTCP(tc *tcpConn) error {
+	source, local := tc.conn.RemoteAddr(), tc.conn.LocalAddr()
+	if s.config.Proxy.trusted(source) {
+		if _, err := tc.setWaiting(s, false); err != nil {
+			return err
+		}
+		h, err := readProxyHeader(tc.conn)
+		if err != nil {
+			return fmt.Errorf("reading PROXY protocol header: %v", err)
+		}
+		if src, dst, ok := h.addrs(local); ok {
+			source, local = src, dst
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if source != nil {
+		ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, source)
+	}
+	if local != nil {
+		ctx = context.WithValue(ctx, dnsresolver.LocalContextKey, local)
+	}
+
+	maxInFlight := s.config.TCP.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultTCPMaxInFlight
+	}
+	tc.sem = make(chan struct{}, maxInFlight)
+	tc.cancel = cancel
+
+	if err := s.readTCP(ctx, tc); err != nil {
+		tc.fail(s, err)
+	}
+
+	// Finish the queries in flight before returning.
+	tc.wg.Wait()
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.err
+}
+
+// readTCP reads requests from tc and starts resolving them until the client
+// closes the connection or an error occurs.
+func (s *Server) readTCP(ctx context.Context, tc *tcpConn) error {
+	var lenBuf [2]byte
+	for queries := 0; ; queries++ {
+		if max := s.config.TCP.MaxQueriesPerConnection; max > 0 && queries >= max {
+			return nil
+		}
+
+		// Wait for a free slot before reading the next request, which
+		// applies backpressure to the client.
+		tc.sem <- struct{}{}
+
+		if ok, err := tc.setWaiting(s, true); !ok {
+			return err
 		}
 
 		// Read the message length.
-		if _, err := io.ReadFull(conn, readBuf[:2]); err != nil {
+		if _, err := io.ReadFull(tc.conn, lenBuf[:]); err != nil {
+			if tc.isStopped() {
+				// The connection failed while writing or was
+				// evicted.
+				return nil
+			}
 			if !errors.Is(err, io.EOF) {
 				return fmt.Errorf("reading request length: %v", err)
 			}
@@ -119,57 +517,90 @@ func (s *Server) handleTCP(conn net.Conn) error {
 			// after a transaction.
 			return nil
 		}
-		l := int(binary.BigEndian.Uint16(readBuf[:2]))
+		l := int(binary.BigEndian.Uint16(lenBuf[:]))
 
-		// The message length is a uint16, so it can't be big enough to
-		// cause a problem.
-		if l > cap(readBuf) {
-			readBuf = make([]byte, l)
+		if ok, err := tc.setWaiting(s, false); !ok {
+			return err
 		}
-		readBuf = readBuf[:l]
 
-		if _, err := io.ReadFull(conn, readBuf); err != nil {
+		// The message length is a uint16, so it can't be big enough to
+		// cause a problem.
+		readBuf := make([]byte, l)
+		if _, err := io.ReadFull(tc.conn, readBuf); err != nil {
+			if tc.isStopped() {
+				return nil
+			}
 			return fmt.Errorf("reading request data: %v", err)
 		}
 
-		ctx := ctx
-		var cancel func()
-		if t := s.config.TCP.ResolverTimeout; t > 0 {
-			ctx, cancel = context.WithTimeout(ctx, t)
-		}
+		tc.addInFlight(s, 1)
+		tc.wg.Add(1)
+		go func() {
+			if err := s.resolveTCP(ctx, tc, readBuf); err != nil {
+				tc.fail(s, err)
+			}
+			tc.addInFlight(s, -1)
+			<-tc.sem
+			tc.wg.Done()
+		}()
+	}
+}
 
-		// Resolve DNS request.
-		//
-		// As per RFC 1035, TCP DNS messages are preceded by a 16 bit
-		// size. Therefore the maximum size of a TCP DNS message is the
-		// maximum 16 bit number.
-		resp, err := s.pr.ResolvePacket(ctx, readBuf, math.MaxUint16, writeBuf[:2])
-		if cancel != nil {
-			cancel()
-		}
-		if err != nil {
-			return fmt.Errorf("resolving request: %v", err)
-		}
+// resolveTCP resolves a single request from tc and writes the response. It
+// only returns errors which leave the connection unusable.
+func (s *Server) resolveTCP(ctx context.Context, tc *tcpConn, req []byte) error {
+	var cancel func()
+	if t := s.config.TCP.ResolverTimeout; t > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t)
+	}
 
-		respLen := len(resp) - 2
-		if respLen > math.MaxUint16 {
-			// This should never happen as it is a direct violation
-			// of the interface contract.
-			panic(fmt.Sprintf("response from ResolvePacket is of length %d, max requested %d", respLen, math.MaxUint16))
-		}
+	// Resolve DNS request.
+	//
+	// As per RFC 1035, TCP DNS messages are preceded by a 16 bit
+	// size. Therefore the maximum size of a TCP DNS message is the
+	// maximum 16 bit number.
+	writeBuf := make([]byte, 2, tcpInitialWriteBufferSize)
+	start := s.queryStartTime()
+	resp, err := s.resolve(ctx, req, math.MaxUint16, writeBuf, false)
+	if cancel != nil {
+		cancel()
+	}
+	if err != nil {
+		// Drop the response as the other requests on the connection
+		// may still succeed (RFC 7766, section 6.2.1.1).
+		s.errorf("TCP DNS server: resolving request: %v", err)
+		return nil
+	}
+	s.logQuery(ctx, true, req, start, resp[2:])
 
-		// Set length bytes.
-		binary.BigEndian.PutUint16(resp[:2], uint16(respLen))
+	respLen := len(resp) - 2
+	if respLen > math.MaxUint16 {
+		// This should never happen as it is a direct violation
+		// of the interface contract.
+		panic(fmt.Sprintf("response from ResolvePacket is of length %d, max requested %d", respLen, math.MaxUint16))
+	}
 
-		// Write packet.
-		if err := conn.SetWriteDeadline(s.tcpDeadline()); err != nil {
-			return fmt.Errorf("setting write deadline: %v", err)
-		}
+	// Set length bytes.
+	//
+	// According to RFC 7766, section 8, the two-byte length should be
+	// written in the same segment as the message, so they are written
+	// together.
+	binary.BigEndian.PutUint16(resp[:2], uint16(respLen))
 
-		if _, err := conn.Write(resp); err != nil {
-			return fmt.Errorf("writing response: %v", err)
-		}
+	tc.wmu.Lock()
+	defer tc.wmu.Unlock()
+	if tc.failed() {
+		return nil
+	}
+
+	// Write packet.
+	if err := tc.conn.SetWriteDeadline(s.tcpDeadline()); err != nil {
+		return fmt.Errorf("setting write deadline: %v", err)
+	}
+	if _, err := tc.conn.Write(resp); err != nil {
+		return fmt.Errorf("writing response: %v", err)
 	}
+	return nil
 }
 
 // setTCPTimeout updates the TCP timeout.
@@ -5,11 +5,14 @@
 package dnsserver
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
 	"reflect"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -205,8 +208,9 @@ func TestTCPReadError(t *testing.T) {
 		{"no request", []byte{0, 5}, true},
 
 		// "zero length request" should cause a zero length request to
-		// be passed to the resolver causing a resolve error.
-		{"zero length request", []byte{0, 0}, false},
+		// be passed to the resolver causing a resolve error, which only
+		// drops the response, and then the next length read to timeout.
+		{"zero length request", []byte{0, 0}, true},
 	}
 
 	for _, test := range tests {
@@ -303,3 +307,394 @@ func TestTimeout(t *testing.T) {
 		})
 	}
 }
+
+// writeTCPMessage writes a length-prefixed DNS message to c.
+func writeTCPMessage(c net.Conn, msg dnsmessage.Message) error {
+	b, err := msg.AppendPack([]byte{0, 0})
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+	_, err = c.Write(b)
+	return err
+}
+
+// readTCPMessage reads a length-prefixed DNS message from c.
+func readTCPMessage(c net.Conn) (dnsmessage.Message, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var msg dnsmessage.Message
+	err := msg.Unpack(b)
+	return msg, err
+}
+
+// testPipelineServer starts a TCP DNS server with a resolver which calls
+// resolve with the ID of each request before echoing it back.
+func testPipelineServer(t *testing.T, config TCPConfig, resolve func(id uint16)) (srv *Server, addr net.Addr, shutdown func()) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(packet); err != nil {
+			return nil, err
+		}
+		resolve(msg.Header.ID)
+		msg.Header.Response = true
+		return msg.AppendPack(buf)
+	})
+	srv, err = New(Config{TCP: config, Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("New(...) =", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeTCP(lis)
+		wg.Done()
+	}()
+	return srv, lis.Addr(), func() {
+		lis.Close()
+		wg.Wait()
+		srv.Wait()
+	}
+}
+
+func TestTCPPipelining(t *testing.T) {
+	release := make(chan struct{})
+	_, addr, shutdown := testPipelineServer(t, TCPConfig{}, func(id uint16) {
+		if id == 1 {
+			<-release
+		}
+	})
+	defer shutdown()
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf(`net.Dial("tcp", %q) = _, %v`, addr, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for id := uint16(1); id <= 2; id++ {
+		if err := writeTCPMessage(c, dnsmessage.Message{Header: dnsmessage.Header{ID: id}}); err != nil {
+			t.Fatal("writing request:", err)
+		}
+	}
+
+	// The second request must not wait for the first.
+	for _, want := range []uint16{2, 1} {
+		got, err := readTCPMessage(c)
+		if err != nil {
+			t.Fatal("reading response:", err)
+		}
+		if got.Header.ID != want {
+			t.Errorf("got response ID %d, want %d", got.Header.ID, want)
+		}
+		if want == 2 {
+			close(release)
+		}
+	}
+}
+
+func TestTCPResolveError(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(packet); err != nil {
+			return nil, err
+		}
+		if msg.Header.ID == 1 {
+			return nil, errors.New("resolve failed")
+		}
+		msg.Header.Response = true
+		return msg.AppendPack(buf)
+	})
+	srv, err := New(Config{Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("New(...) =", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeTCP(lis)
+		wg.Done()
+	}()
+	defer func() {
+		lis.Close()
+		wg.Wait()
+		srv.Wait()
+	}()
+
+	c := dialTCP(t, lis.Addr())
+	defer c.Close()
+	for id := uint16(1); id <= 2; id++ {
+		if err := writeTCPMessage(c, dnsmessage.Message{Header: dnsmessage.Header{ID: id}}); err != nil {
+			t.Fatal("writing request:", err)
+		}
+	}
+
+	// Only the failed request goes unanswered.
+	got, err := readTCPMessage(c)
+	if err != nil {
+		t.Fatal("reading response:", err)
+	}
+	if got.Header.ID != 2 {
+		t.Errorf("got response ID %d, want 2", got.Header.ID)
+	}
+	exchangeTCP(t, c, 3)
+}
+
+func TestTCPMaxInFlight(t *testing.T) {
+	const (
+		maxInFlight = 3
+		requests    = 20
+	)
+	var (
+		mu      sync.Mutex
+		current int
+		peak    int
+	)
+	_, addr, shutdown := testPipelineServer(t, TCPConfig{MaxInFlight: maxInFlight}, func(uint16) {
+		mu.Lock()
+		current++
+		if current > peak {
+			peak = current
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+	})
+	defer shutdown()
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf(`net.Dial("tcp", %q) = _, %v`, addr, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for id := uint16(0); id < requests; id++ {
+		if err := writeTCPMessage(c, dnsmessage.Message{Header: dnsmessage.Header{ID: id}}); err != nil {
+			t.Fatal("writing request:", err)
+		}
+	}
+	seen := make(map[uint16]bool)
+	for i := 0; i < requests; i++ {
+		got, err := readTCPMessage(c)
+		if err != nil {
+			t.Fatal("reading response:", err)
+		}
+		seen[got.Header.ID] = true
+	}
+	if len(seen) != requests {
+		t.Errorf("got %d distinct responses, want %d", len(seen), requests)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > maxInFlight {
+		t.Errorf("got %d requests in flight, want at most %d", peak, maxInFlight)
+	}
+}
+
+// dialTCP dials the server at addr with a deadline for the test.
+func dialTCP(t *testing.T, addr net.Addr) net.Conn {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf(`net.Dial("tcp", %q) = _, %v`, addr, err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+// exchangeTCP sends a request with the given ID on c and checks the response.
+func exchangeTCP(t *testing.T, c net.Conn, id uint16) {
+	t.Helper()
+	if err := writeTCPMessage(c, dnsmessage.Message{Header: dnsmessage.Header{ID: id}}); err != nil {
+		t.Fatal("writing request:", err)
+	}
+	got, err := readTCPMessage(c)
+	if err != nil {
+		t.Fatal("reading response:", err)
+	}
+	if got.Header.ID != id {
+		t.Errorf("got response ID %d, want %d", got.Header.ID, id)
+	}
+}
+
+// expectTCPClosed checks that the server closes c. The connection may be
+// reset if the server closes it with unread requests.
+func expectTCPClosed(t *testing.T, c net.Conn) {
+	t.Helper()
+	_, err := readTCPMessage(c)
+	if err != io.EOF && !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("reading from closed connection: got = %v, want = %v", err, io.EOF)
+	}
+}
+
+// waitTCPIdle waits until the server has n idle connections.
+func waitTCPIdle(t *testing.T, srv *Server, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		srv.tcpIdleMu.Lock()
+		idle := 0
+		for tc := srv.tcpIdle.front; tc != nil; tc = tc.idleNext {
+			idle++
+		}
+		srv.tcpIdleMu.Unlock()
+		if idle == n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d idle connections", n)
+}
+
+func TestTCPMaxConnectionsPerIP(t *testing.T) {
+	srv, addr, shutdown := testPipelineServer(t, TCPConfig{MaxConnectionsPerIP: 1}, func(uint16) {})
+	defer shutdown()
+
+	a := dialTCP(t, addr)
+	defer a.Close()
+	exchangeTCP(t, a, 1)
+	waitTCPIdle(t, srv, 1)
+
+	b := dialTCP(t, addr)
+	defer b.Close()
+	expectTCPClosed(t, b)
+
+	// The first connection is unaffected.
+	exchangeTCP(t, a, 2)
+}
+
+func TestTCPMaxConnections(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	srv, addr, shutdown := testPipelineServer(t, TCPConfig{MaxConnections: 2}, func(id uint16) {
+		if id == 0 {
+			started <- struct{}{}
+			<-release
+		}
+	})
+	defer shutdown()
+
+	// The first connection is busy.
+	busy := dialTCP(t, addr)
+	defer busy.Close()
+	if err := writeTCPMessage(busy, dnsmessage.Message{}); err != nil {
+		t.Fatal("writing request:", err)
+	}
+	<-started
+
+	idle := dialTCP(t, addr)
+	defer idle.Close()
+	exchangeTCP(t, idle, 1)
+	waitTCPIdle(t, srv, 1)
+
+	// The idle connection is closed to make room.
+	c := dialTCP(t, addr)
+	defer c.Close()
+	expectTCPClosed(t, idle)
+	if err := writeTCPMessage(c, dnsmessage.Message{}); err != nil {
+		t.Fatal("writing request:", err)
+	}
+	<-started
+
+	// Once no connection is idle, new connections are closed.
+	rejected := dialTCP(t, addr)
+	defer rejected.Close()
+	expectTCPClosed(t, rejected)
+
+	close(release)
+	for _, c := range []net.Conn{busy, c} {
+		if got, err := readTCPMessage(c); err != nil || got.Header.ID != 0 {
+			t.Errorf("reading busy response: got = %#v, %v", &got.Header, err)
+		}
+	}
+}
+
+func TestTCPMaxConnectionsOldestIdle(t *testing.T) {
+	srv, addr, shutdown := testPipelineServer(t, TCPConfig{MaxConnections: 2}, func(uint16) {})
+	defer shutdown()
+
+	oldest := dialTCP(t, addr)
+	defer oldest.Close()
+	exchangeTCP(t, oldest, 1)
+	waitTCPIdle(t, srv, 1)
+
+	newest := dialTCP(t, addr)
+	defer newest.Close()
+	exchangeTCP(t, newest, 2)
+	waitTCPIdle(t, srv, 2)
+
+	// The connection which has been idle the longest makes room.
+	c := dialTCP(t, addr)
+	defer c.Close()
+	expectTCPClosed(t, oldest)
+	exchangeTCP(t, newest, 3)
+	exchangeTCP(t, c, 4)
+
+	// Once closed, the evicted connection no longer counts.
+	srv.tcpMu.Lock()
+	open := srv.tcpOpen
+	srv.tcpMu.Unlock()
+	if open != 2 {
+		t.Errorf("got %d open connections, want = 2", open)
+	}
+}
+
+func TestTCPMaxQueriesPerConnection(t *testing.T) {
+	_, addr, shutdown := testPipelineServer(t, TCPConfig{MaxQueriesPerConnection: 2}, func(uint16) {})
+	defer shutdown()
+
+	c := dialTCP(t, addr)
+	defer c.Close()
+	for id := uint16(1); id <= 3; id++ {
+		if err := writeTCPMessage(c, dnsmessage.Message{Header: dnsmessage.Header{ID: id}}); err != nil {
+			t.Fatal("writing request:", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := readTCPMessage(c); err != nil {
+			t.Fatal("reading response:", err)
+		}
+	}
+	expectTCPClosed(t, c)
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	_, addr, shutdown := testPipelineServer(t, TCPConfig{
+		ClientTimeout: 5 * time.Second,
+		IdleTimeout:   100 * time.Millisecond,
+	}, func(id uint16) {
+		if id == 1 {
+			// Take longer than the idle timeout.
+			time.Sleep(300 * time.Millisecond)
+		}
+	})
+	defer shutdown()
+
+	// A request in progress is not subject to the idle timeout.
+	c := dialTCP(t, addr)
+	defer c.Close()
+	exchangeTCP(t, c, 1)
+
+	// Once idle, the connection is closed promptly.
+	start := time.Now()
+	expectTCPClosed(t, c)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle connection closed after %v, want about 100ms", d)
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"runtime"
+	"sync"
 	"time"
 
+	"github.com/iangudger/dns/dnsmessage"
 	"github.com/iangudger/dns/dnsresolver"
 )
 
@@ -18,6 +21,45 @@ import (
 // RFC 1035 (section 2.3.4. Size limits) limits UDP DNS messages to 512 bytes.
 const udpBufferSize = 512
 
+// udpBufferPool holds buffers of at least udpBufferSize bytes.
+var udpBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, udpBufferSize)
+		return &b
+	},
+}
+
+// getUDPBuffer returns a buffer of size bytes from udpBufferPool.
+func getUDPBuffer(size int) *[]byte {
+	b := udpBufferPool.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+	return b
+}
+
+// A FullQueuePolicy specifies how a UDP server handles requests which arrive
+// while its queue is full.
+type FullQueuePolicy uint8
+
+const (
+	// DropWhenFull indicates that requests are dropped without a
+	// response.
+	DropWhenFull FullQueuePolicy = iota
+
+	// RefuseWhenFull indicates that requests are answered with a REFUSED
+	// response.
+	RefuseWhenFull
+
+	// ServerFailureWhenFull indicates that requests are answered with a
+	// SERVFAIL response.
+	ServerFailureWhenFull
+
+	// invalidFullQueuePolicy is one more than the maximum policy value.
+	invalidFullQueuePolicy
+)
+
 // UDPConfig contains optional configuration options for the UDP DNS server.
 type UDPConfig struct {
 	_ struct{} // Prevent positional initialization.
@@ -32,73 +74,385 @@ type UDPConfig struct {
 	//
 	// ResolverTimeout is only enforced if greater than zero.
 	ResolverTimeout time.Duration
+
+	// Workers is an optional number of goroutines which handle requests.
+	// Requests are queued until a worker is available.
+	//
+	// If not positive, each request is handled in a new goroutine.
+	//
+	// Workers is ignored if DisableConcurrency is set.
+	Workers int
+
+	// QueueDepth is the maximum number of requests waiting for a worker.
+	//
+	// If not positive, Workers is used.
+	QueueDepth int
+
+	// FullQueuePolicy specifies how requests which arrive while the queue
+	// is full are handled.
+	FullQueuePolicy FullQueuePolicy
+
+	// BatchSize is the maximum number of requests read and responses
+	// written with a single system call. If greater than one, ServeUDP
+	// uses recvmmsg and sendmmsg on Linux when serving a *net.UDPConn.
+	// Otherwise, requests are read and responses written one at a time,
+	// also with recvmmsg and sendmmsg when the source address of responses
+	// is chosen using IP_PKTINFO or IPV6_PKTINFO.
+	BatchSize int
+
+	// RRL contains optional configuration options for Response Rate
+	// Limiting.
+	RRL RRLConfig
+}
+
+// A udpRequest is a UDP request waiting to be handled.
+type udpRequest struct {
+	// buf is a buffer from udpBufferPool holding the request.
+	buf *[]byte
+
+	// n is the length of the request.
+	n int
+
+	addr net.Addr
+
+	// local is the local address the request was sent to.
+	local net.Addr
+
+	// source is the address of the client, if different from addr
+	// because the request was received from a proxy.
+	source net.Addr
+
+	// src is the address responses should be sent from, or nil if the
+	// system should choose. ifIndex is the interface the request arrived
+	// on, or zero if unknown.
+	src     net.IP
+	ifIndex int
+}
+
+// A udpReader reads UDP requests.
+type udpReader interface {
+	// read reads up to len(reqs) requests into reqs and returns the number
+	// of requests read. The buffers of the requests are owned by the
+	// caller.
+	read(reqs []udpRequest) (int, error)
+}
+
+// A udpResponder sends responses to UDP requests.
+type udpResponder interface {
+	// respond sends resp in reply to req. resp may be held by buf, a
+	// buffer from udpBufferPool, which the responder returns to the pool
+	// once resp has been sent. req.buf is not used.
+	respond(resp []byte, req udpRequest, buf *[]byte) error
+
+	// close is called once no more responses will be sent.
+	close()
+}
+
+// A packetConnUDP reads requests from and sends responses to a PacketConn
+// one at a time.
+type packetConnUDP struct {
+	c net.PacketConn
+
+	// size is the size of the buffers requests are read into.
+	size int
 }
 
+// read implements udpReader.read.
+func (p packetConnUDP) read(reqs []udpRequest) (int, error) {
+	buf := getUDPBuffer(p.size)
+	n, addr, err := p.c.ReadFrom(*buf)
+	if err != nil {
+		udpBufferPool.Put(buf)
+		return 0, err
+	}
+	reqs[0] = udpRequest{buf: buf, n: n, addr: addr, local: p.c.LocalAddr()}
+	return 1, nil
+}
+
+// respond implements udpResponder.respond.
+func (p packetConnUDP) respond(resp []byte, req udpRequest, buf *[]byte) error {
+	_, err := p.c.WriteTo(resp, req.addr)
+	udpBufferPool.Put(buf)
+	return err
+}
+
+// close implements udpResponder.close.
+func (packetConnUDP) close() {}
+
 // ServeUDP listens for and responds to UDP DNS requests.
+//
+// On Linux, if c is a *net.UDPConn bound to an unspecified address such as
+// 0.0.0.0 or ::, the address each request was sent to is read using
+// IP_PKTINFO or IPV6_PKTINFO and the response is sent from that address.
 func (s *Server) ServeUDP(c net.PacketConn) error {
-	var srb []byte
-	var swb []byte
-	if s.config.UDP.DisableConcurrency {
-		srb = make([]byte, udpBufferSize)
-		swb = make([]byte, udpBufferSize)
+	batchSize := s.config.UDP.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
 	}
-	for {
-		readBuf := srb
-		writeBuf := swb[:0]
-		if !s.config.UDP.DisableConcurrency {
-			readBuf = make([]byte, udpBufferSize)
-			writeBuf = nil
+	if bc, ok := newUDPBatchConn(c, batchSize, s.udpReadSize()); ok {
+		s.wg.Add(1)
+		go func() {
+			bc.writeBatches(s)
+			s.wg.Done()
+		}()
+		return s.serveUDP(bc, bc, batchSize)
+	}
+	p := packetConnUDP{c, s.udpReadSize()}
+	return s.serveUDP(p, p, 1)
+}
+
+// udpReadSize returns the size of the buffers UDP requests are read into.
+//
+// Requests from trusted proxies are preceded by a PROXY protocol header, so
+// room is left for one in front of a request of the maximum size.
+func (s *Server) udpReadSize() int {
+	if len(s.config.Proxy.Trusted) > 0 {
+		return proxyV2MaxUDPLength + udpBufferSize
+	}
+	return udpBufferSize
+}
+
+// ListenAndServeUDP listens on the UDP network address with the given number
+// of sockets and serves requests on each of them with ServeUDP. The sockets
+// share the address using SO_REUSEPORT, which allows the kernel to spread
+// requests across them. If sockets is not positive, one socket per CPU is
+// used.
+//
+// If the port in address is zero, all sockets share the same randomly
+// chosen port. On platforms without SO_REUSEPORT, such as Windows, a single
+// socket is used.
+//
+// ListenAndServeUDP closes the sockets and returns nil when ctx is done. If
+// serving on any socket fails, it closes the sockets and returns the error.
+// Either way, Wait can be used to wait for requests in progress.
+func (s *Server) ListenAndServeUDP(ctx context.Context, network, address string, sockets int) error {
+	if sockets <= 0 {
+		sockets = runtime.GOMAXPROCS(0)
+	}
+	if !reusePortSupported {
+		sockets = 1
+	}
+	var lc net.ListenConfig
+	if sockets > 1 {
+		lc.Control = reusePort
+	}
+
+	conns := make([]net.PacketConn, 0, sockets)
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
 		}
-		n, addr, err := c.ReadFrom(readBuf)
+	}
+	for i := 0; i < sockets; i++ {
+		c, err := lc.ListenPacket(ctx, network, address)
 		if err != nil {
-			return err
+			closeAll()
+			return fmt.Errorf("listening on UDP socket %d: %v", i, err)
 		}
-		readBuf = readBuf[:n]
+		conns = append(conns, c)
 
-		ctx := context.Background()
-		if addr != nil {
-			ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, addr)
+		// Use the port chosen for the first socket for the rest.
+		address = c.LocalAddr().String()
+	}
+
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		s.wg.Add(1)
+		go func(c net.PacketConn) {
+			errs <- s.ServeUDP(c)
+			s.wg.Done()
+		}(c)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	closeAll()
+	return err
+}
+
+// serveUDP reads requests from r and dispatches them according to the
+// concurrency configuration until r returns an error.
+func (s *Server) serveUDP(r udpReader, w udpResponder, batchSize int) error {
+	// handlers tracks requests being handled, so that w can be closed
+	// once they are all done.
+	var handlers sync.WaitGroup
+	s.wg.Add(1)
+	defer func() {
+		go func() {
+			handlers.Wait()
+			w.close()
+			s.wg.Done()
+		}()
+	}()
+
+	dispatch := func(req udpRequest) {
+		s.serveUDPRequest(w, req)
+	}
+	switch {
+	case s.config.UDP.DisableConcurrency:
+	case s.config.UDP.Workers > 0:
+		depth := s.config.UDP.QueueDepth
+		if depth <= 0 {
+			depth = s.config.UDP.Workers
 		}
-		var cancel func()
-		if t := s.config.UDP.ResolverTimeout; t > 0 {
-			ctx, cancel = context.WithTimeout(ctx, t)
+		queue := make(chan udpRequest, depth)
+		defer close(queue)
+
+		for i := 0; i < s.config.UDP.Workers; i++ {
+			s.wg.Add(1)
+			handlers.Add(1)
+			go func() {
+				for req := range queue {
+					s.serveUDPRequest(w, req)
+				}
+				handlers.Done()
+				s.wg.Done()
+			}()
 		}
 
-		servReq := func() {
-			if err := s.handleUDP(ctx, c, readBuf, addr, writeBuf); err != nil {
-				s.errorf("UDP DNS server: handling request: %v", err)
-			}
-			if cancel != nil {
-				cancel()
+		dispatch = func(req udpRequest) {
+			select {
+			case queue <- req:
+			default:
+				s.rejectUDP(w, req)
 			}
 		}
+	default:
+		dispatch = func(req udpRequest) {
+			s.wg.Add(1)
+			handlers.Add(1)
+			go func() {
+				s.serveUDPRequest(w, req)
+				handlers.Done()
+				s.wg.Done()
+			}()
+		}
+	}
 
-		if s.config.UDP.DisableConcurrency {
-			servReq()
-			continue
+	reqs := make([]udpRequest, batchSize)
+	for {
+		n, err := r.read(reqs)
+		if err != nil {
+			return err
+		}
+		for i := range reqs[:n] {
+			dispatch(reqs[i])
+			reqs[i] = udpRequest{}
 		}
+	}
+}
 
-		s.wg.Add(1)
-		go func() {
-			servReq()
-			s.wg.Done()
-		}()
+// rejectUDP handles a request which arrived while the queue was full.
+func (s *Server) rejectUDP(w udpResponder, req udpRequest) {
+	var rcode dnsmessage.RCode
+	switch s.config.UDP.FullQueuePolicy {
+	case RefuseWhenFull:
+		rcode = dnsmessage.RCodeRefused
+	case ServerFailureWhenFull:
+		rcode = dnsmessage.RCodeServerFailure
+	default:
+		udpBufferPool.Put(req.buf)
+		s.config.Stats.AddUDPDropped()
+		return
+	}
+
+	if err := s.unwrapUDPProxy(&req); err != nil {
+		udpBufferPool.Put(req.buf)
+		s.config.Stats.AddUDPDropped()
+		return
+	}
+
+	writeBuf := getUDPBuffer(udpBufferSize)
+	resp, ok := errorResponse((*req.buf)[:req.n], rcode, (*writeBuf)[:0])
+	udpBufferPool.Put(req.buf)
+	if !ok || len(resp) > udpBufferSize {
+		udpBufferPool.Put(writeBuf)
+		s.config.Stats.AddUDPDropped()
+		return
+	}
+	s.config.Stats.AddUDPRejected()
+	if err := w.respond(resp, req, writeBuf); err != nil {
+		s.errorf("UDP DNS server: writing response: %v", err)
+	}
+}
+
+// unwrapUDPProxy removes the PROXY protocol header from a request from a
+// trusted proxy and records the addresses it contains.
+func (s *Server) unwrapUDPProxy(req *udpRequest) error {
+	if !s.config.Proxy.trusted(req.addr) {
+		return nil
+	}
+	h, n, err := parseProxyV2((*req.buf)[:req.n])
+	if err != nil {
+		return fmt.Errorf("parsing PROXY protocol header: %v", err)
+	}
+	req.n = copy(*req.buf, (*req.buf)[n:req.n])
+	if src, dst, ok := h.addrs(req.addr); ok {
+		req.source, req.local = src, dst
 	}
+	return nil
+}
+
+// serveUDPRequest handles a request and returns its buffer to
+// udpBufferPool.
+func (s *Server) serveUDPRequest(w udpResponder, req udpRequest) {
+	if err := s.unwrapUDPProxy(&req); err != nil {
+		s.errorf("UDP DNS server: %v", err)
+		udpBufferPool.Put(req.buf)
+		return
+	}
+
+	ctx := context.Background()
+	if req.source != nil {
+		ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, req.source)
+	} else if req.addr != nil {
+		ctx = context.WithValue(ctx, dnsresolver.SourceContextKey, req.addr)
+	}
+	if req.local != nil {
+		ctx = context.WithValue(ctx, dnsresolver.LocalContextKey, req.local)
+	}
+	var cancel func()
+	if t := s.config.UDP.ResolverTimeout; t > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t)
+	}
+
+	if err := s.handleUDP(ctx, w, req); err != nil {
+		s.errorf("UDP DNS server: handling request: %v", err)
+	}
+	if cancel != nil {
+		cancel()
+	}
+	udpBufferPool.Put(req.buf)
 }
 
 // handleUDP responds to a UDP DNS request.
 //
-// handleUDP does not take ownership of conn.
-func (s *Server) handleUDP(ctx context.Context, c net.PacketConn, readBuf []byte, addr net.Addr, writeBuf []byte) error {
+// handleUDP does not take ownership of w.
+func (s *Server) handleUDP(ctx context.Context, w udpResponder, req udpRequest) error {
+	writeBuf := getUDPBuffer(udpBufferSize)
+	query := (*req.buf)[:req.n]
+	start := s.queryStartTime()
+
 	// Resolve DNS request.
-	resp, err := s.pr.ResolvePacket(ctx, readBuf, udpBufferSize, writeBuf)
+	resp, err := s.resolve(ctx, query, udpBufferSize, (*writeBuf)[:0], true)
 	if err != nil {
+		udpBufferPool.Put(writeBuf)
 		return fmt.Errorf("resolving packet: %v", err)
 	}
 
+	resp, ok := s.rateLimitUDP(sourceIP(ctx), resp, (*writeBuf)[:0])
+	s.logQuery(ctx, false, query, start, resp)
+	if !ok {
+		udpBufferPool.Put(writeBuf)
+		return nil
+	}
+
 	// Write packet.
-	if _, err := c.WriteTo(resp, addr); err != nil {
-		fmt.Errorf("writing response: %v", err)
+	if err := w.respond(resp, req, writeBuf); err != nil {
+		return fmt.Errorf("writing response: %v", err)
 	}
 	return nil
 }
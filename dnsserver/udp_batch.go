@@ -0,0 +1,241 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsserver
+
+import (
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A batchConn reads and writes multiple datagrams at once.
+//
+// It is implemented by both *ipv4.PacketConn and *ipv6.PacketConn as
+// ipv4.Message and ipv6.Message are the same type.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// A udpResponse is a response waiting to be written.
+type udpResponse struct {
+	resp []byte
+	addr net.Addr
+
+	// oob holds the control message specifying the source address, if
+	// any.
+	oob []byte
+
+	// buf is a buffer from udpBufferPool which may hold resp.
+	buf *[]byte
+}
+
+// A udpBatchConn reads requests and writes responses in batches using
+// recvmmsg and sendmmsg.
+type udpBatchConn struct {
+	conn batchConn
+
+	// local is the address of the socket.
+	local *net.UDPAddr
+
+	// pktinfo indicates that the socket is bound to an unspecified
+	// address, so the address each request was sent to is read from
+	// control messages and used as the source of the response.
+	pktinfo bool
+
+	// size is the size of the buffers requests are read into.
+	size int
+
+	// msgs and bufs are used to read requests. bufs[i] is the buffer held
+	// by msgs[i], or nil if it was handed off to a request.
+	msgs []ipv4.Message
+	bufs []*[]byte
+
+	// out holds responses waiting to be written.
+	out chan udpResponse
+}
+
+// newUDPBatchConn returns a udpBatchConn for c if batching is supported and
+// either batchSize is greater than one or c is bound to an unspecified address.
+// Requests are read into buffers of size bytes.
+func newUDPBatchConn(c net.PacketConn, batchSize, size int) (*udpBatchConn, bool) {
+	// Other platforms support ReadBatch and WriteBatch, but only read and
+	// write a single message at a time.
+	if runtime.GOOS != "linux" {
+		return nil, false
+	}
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return nil, false
+	}
+	la, ok := uc.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, false
+	}
+	pktinfo := la.IP == nil || la.IP.IsUnspecified()
+	if batchSize <= 1 && !pktinfo {
+		return nil, false
+	}
+
+	bc := &udpBatchConn{
+		local: la,
+		size:  size,
+		msgs:  make([]ipv4.Message, batchSize),
+		bufs:  make([]*[]byte, batchSize),
+		out:   make(chan udpResponse, batchSize),
+	}
+	var oobSize int
+	if la.IP.To4() != nil {
+		pc := ipv4.NewPacketConn(uc)
+		if pktinfo && pc.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true) == nil {
+			bc.pktinfo = true
+			oobSize = len(ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagInterface))
+		}
+		bc.conn = pc
+	} else {
+		pc := ipv6.NewPacketConn(uc)
+		if pktinfo && pc.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true) == nil {
+			bc.pktinfo = true
+			oobSize = len(ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface))
+		}
+		bc.conn = pc
+	}
+	if batchSize <= 1 && !bc.pktinfo {
+		return nil, false
+	}
+	for i := range bc.msgs {
+		bc.msgs[i].Buffers = make([][]byte, 1)
+		if bc.pktinfo {
+			bc.msgs[i].OOB = make([]byte, oobSize)
+		}
+	}
+	return bc, true
+}
+
+// packetInfo returns the destination address and interface index from the
+// control messages received with a request.
+func (bc *udpBatchConn) packetInfo(oob []byte) (net.IP, int, bool) {
+	if bc.local.IP.To4() != nil {
+		var cm ipv4.ControlMessage
+		if cm.Parse(oob) != nil || cm.Dst == nil {
+			return nil, 0, false
+		}
+		return cm.Dst, cm.IfIndex, true
+	}
+	var cm ipv6.ControlMessage
+	if cm.Parse(oob) != nil || cm.Dst == nil {
+		return nil, 0, false
+	}
+	return cm.Dst, cm.IfIndex, true
+}
+
+// sourceControlMessage returns a control message which sets the source
+// address of a response to src.
+func sourceControlMessage(src net.IP, ifIndex int) []byte {
+	// IPv4 requests received on an IPv6 socket have IPv4-mapped
+	// destination addresses. Linux accepts IP_PKTINFO on IPv6 sockets for
+	// such responses, while IPV6_PKTINFO would be ignored.
+	if ip4 := src.To4(); ip4 != nil {
+		return (&ipv4.ControlMessage{Src: ip4}).Marshal()
+	}
+	cm := ipv6.ControlMessage{Src: src}
+	// The interface is needed to route responses from link-local
+	// addresses.
+	if src.IsLinkLocalUnicast() {
+		cm.IfIndex = ifIndex
+	}
+	return cm.Marshal()
+}
+
+// read implements udpReader.read.
+func (bc *udpBatchConn) read(reqs []udpRequest) (int, error) {
+	for i, buf := range bc.bufs {
+		if buf == nil {
+			buf = getUDPBuffer(bc.size)
+			bc.bufs[i] = buf
+			bc.msgs[i].Buffers[0] = *buf
+		}
+	}
+
+	n, err := bc.conn.ReadBatch(bc.msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := range bc.msgs[:n] {
+		m := &bc.msgs[i]
+		req := udpRequest{buf: bc.bufs[i], n: m.N, addr: m.Addr, local: bc.local}
+		if bc.pktinfo {
+			if dst, ifIndex, ok := bc.packetInfo(m.OOB[:m.NN]); ok {
+				req.local = &net.UDPAddr{IP: dst, Port: bc.local.Port}
+				req.src = dst
+				req.ifIndex = ifIndex
+			}
+		}
+		reqs[i] = req
+		bc.bufs[i] = nil
+	}
+	return n, nil
+}
+
+// respond implements udpResponder.respond.
+func (bc *udpBatchConn) respond(resp []byte, req udpRequest, buf *[]byte) error {
+	r := udpResponse{resp: resp, addr: req.addr, buf: buf}
+	if req.src != nil {
+		r.oob = sourceControlMessage(req.src, req.ifIndex)
+	}
+	bc.out <- r
+	return nil
+}
+
+// close implements udpResponder.close.
+func (bc *udpBatchConn) close() {
+	close(bc.out)
+}
+
+// writeBatches writes responses until bc is closed. Responses which are
+// waiting when a write starts are written together.
+func (bc *udpBatchConn) writeBatches(s *Server) {
+	msgs := make([]ipv4.Message, 0, len(bc.msgs))
+	resps := make([]udpResponse, 0, len(bc.msgs))
+	for r := range bc.out {
+		resps = append(resps[:0], r)
+	collect:
+		for len(resps) < cap(resps) {
+			select {
+			case r, ok := <-bc.out:
+				if !ok {
+					break collect
+				}
+				resps = append(resps, r)
+			default:
+				break collect
+			}
+		}
+
+		msgs = msgs[:len(resps)]
+		for i, r := range resps {
+			msgs[i] = ipv4.Message{Buffers: [][]byte{r.resp}, OOB: r.oob, Addr: r.addr}
+		}
+		for pending := msgs; len(pending) > 0; {
+			n, err := bc.conn.WriteBatch(pending, 0)
+			pending = pending[n:]
+			if err != nil && len(pending) > 0 {
+				// The error belongs to the first message which
+				// wasn't written, such as a response to an
+				// unreachable address. Drop it and write the
+				// rest.
+				s.errorf("UDP DNS server: writing response to %v: %v", pending[0].Addr, err)
+				pending = pending[1:]
+			}
+		}
+
+		for i, r := range resps {
+			udpBufferPool.Put(r.buf)
+			resps[i] = udpResponse{}
+		}
+	}
+}
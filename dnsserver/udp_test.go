@@ -5,8 +5,12 @@
 package dnsserver
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -14,6 +18,7 @@ import (
 	"github.com/iangudger/dns/dnsmessage"
 	"github.com/iangudger/dns/dnsresolver"
 	"github.com/iangudger/dns/internal/resolvers"
+	"golang.org/x/net/ipv4"
 )
 
 func testUDP() (net.PacketConn, net.Addr, error) {
@@ -37,6 +42,10 @@ func TestUDP(t *testing.T) {
 	}{
 		{"concurrency", UDPConfig{DisableConcurrency: false}},
 		{"no concurrency", UDPConfig{DisableConcurrency: true}},
+		{"workers", UDPConfig{Workers: 2}},
+		{"batch", UDPConfig{BatchSize: 8}},
+		{"batch workers", UDPConfig{BatchSize: 8, Workers: 2}},
+		{"batch no concurrency", UDPConfig{BatchSize: 8, DisableConcurrency: true}},
 	}
 
 	for _, test := range tests {
@@ -150,3 +159,458 @@ func TestUDP(t *testing.T) {
 		})
 	}
 }
+
+func TestUDPFullQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    FullQueuePolicy
+		wantRCode dnsmessage.RCode
+		respond   bool
+	}{
+		{"drop", DropWhenFull, 0, false},
+		{"refuse", RefuseWhenFull, dnsmessage.RCodeRefused, true},
+		{"server failure", ServerFailureWhenFull, dnsmessage.RCodeServerFailure, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc, addr, err := testUDP()
+			if err != nil {
+				t.Fatal("creating UDP socket:", err)
+			}
+
+			started := make(chan struct{}, 3)
+			release := make(chan struct{})
+			pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+				started <- struct{}{}
+				<-release
+				resp, _ := errorResponse(packet, dnsmessage.RCodeSuccess, buf)
+				return resp, nil
+			})
+			var stats Stats
+			srv, err := New(Config{
+				UDP: UDPConfig{
+					Workers:         1,
+					QueueDepth:      1,
+					FullQueuePolicy: test.policy,
+				},
+				Errorf: t.Logf,
+				Stats:  &stats,
+			}, pr)
+			if err != nil {
+				pc.Close()
+				t.Fatal("creating UDP server:", err)
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				srv.ServeUDP(pc)
+				wg.Done()
+			}()
+			defer func() {
+				pc.Close()
+				srv.Wait()
+				wg.Wait()
+			}()
+
+			conn, err := net.Dial("udp", addr.String())
+			if err != nil {
+				t.Fatalf("dialing server (%v): %v", addr, err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			send := func(id uint16) {
+				t.Helper()
+				req := dnsmessage.Message{
+					Header: dnsmessage.Header{ID: id},
+					Questions: []dnsmessage.Question{{
+						Name:  dnsmessage.MustNewName("example.com."),
+						Type:  dnsmessage.TypeA,
+						Class: dnsmessage.ClassINET,
+					}},
+				}
+				b, err := req.Pack()
+				if err != nil {
+					t.Fatal("packing request:", err)
+				}
+				if _, err := conn.Write(b); err != nil {
+					t.Fatal("writing request:", err)
+				}
+			}
+
+			// The first request occupies the worker and the second
+			// fills the queue.
+			send(1)
+			<-started
+			send(2)
+			send(3)
+
+			if test.respond {
+				b := make([]byte, udpBufferSize)
+				n, err := conn.Read(b)
+				if err != nil {
+					t.Fatal("reading response:", err)
+				}
+				var resp dnsmessage.Message
+				if err := resp.Unpack(b[:n]); err != nil {
+					t.Fatal("unpacking response:", err)
+				}
+				if resp.Header.ID != 3 || resp.Header.RCode != test.wantRCode {
+					t.Errorf("got response ID %d with RCode %v, want ID 3 with RCode %v", resp.Header.ID, resp.Header.RCode, test.wantRCode)
+				}
+				if got := stats.UDPRejected(); got != 1 {
+					t.Errorf("got Stats.UDPRejected() = %d, want 1", got)
+				}
+			} else {
+				for start := time.Now(); stats.UDPDropped() == 0 && time.Since(start) < 5*time.Second; {
+					time.Sleep(time.Millisecond)
+				}
+				if got := stats.UDPDropped(); got != 1 {
+					t.Errorf("got Stats.UDPDropped() = %d, want 1", got)
+				}
+			}
+			close(release)
+
+			// The queued requests are still answered.
+			for i := 0; i < 2; i++ {
+				b := make([]byte, udpBufferSize)
+				if _, err := conn.Read(b); err != nil {
+					t.Fatal("reading response:", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInvalidFullQueuePolicy(t *testing.T) {
+	pr := dnsresolver.PacketResolverFunc(func(context.Context, []byte, int, []byte) ([]byte, error) {
+		return nil, nil
+	})
+	if _, err := New(Config{UDP: UDPConfig{FullQueuePolicy: invalidFullQueuePolicy}}, pr); err != errInvalidFullQueuePolicy {
+		t.Errorf("got New(...) = _, %v, want = %v", err, errInvalidFullQueuePolicy)
+	}
+}
+
+// echoPacketResolver responds to each request with an empty response with the
+// same ID.
+var echoPacketResolver = dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+	resp, _ := errorResponse(packet, dnsmessage.RCodeSuccess, buf)
+	return resp, nil
+})
+
+// startUDPServer starts a UDP DNS server with the given configuration on a
+// loopback socket.
+func startUDPServer(tb testing.TB, config UDPConfig) (addr net.Addr, shutdown func()) {
+	pc, addr, err := testUDP()
+	if err != nil {
+		tb.Fatal("creating UDP socket:", err)
+	}
+	srv, err := New(Config{UDP: config, Errorf: tb.Logf}, echoPacketResolver)
+	if err != nil {
+		pc.Close()
+		tb.Fatal("creating UDP server:", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		srv.ServeUDP(pc)
+		wg.Done()
+	}()
+	return addr, func() {
+		pc.Close()
+		wg.Wait()
+		srv.Wait()
+	}
+}
+
+// packTestRequest returns a packed request for example.com. A.
+func packTestRequest() ([]byte, error) {
+	req := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return req.Pack()
+}
+
+// exchangeUDP sends count requests on conn, keeping up to window requests
+// outstanding, and reads the responses.
+func exchangeUDP(conn net.Conn, count, window int) error {
+	b, err := packTestRequest()
+	if err != nil {
+		return err
+	}
+	resp := make([]byte, udpBufferSize)
+	sent, received := 0, 0
+	for received < count {
+		for sent < count && sent-received < window {
+			if _, err := conn.Write(b); err != nil {
+				return err
+			}
+			sent++
+		}
+		if _, err := conn.Read(resp); err != nil {
+			return err
+		}
+		received++
+	}
+	return nil
+}
+
+func TestUDPBatch(t *testing.T) {
+	addr, shutdown := startUDPServer(t, UDPConfig{BatchSize: 16})
+	defer shutdown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatalf("dialing server (%v): %v", addr, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := exchangeUDP(conn, 200, 8); err != nil {
+				t.Error("exchanging requests:", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// failingBatchConn is a batchConn which records written messages and fails
+// the write of the message at index fail once.
+type failingBatchConn struct {
+	batchConn
+	fail    int
+	written []string
+}
+
+func (c *failingBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i, m := range ms {
+		if len(c.written) == c.fail {
+			c.fail = -1
+			return i, errors.New("write failed")
+		}
+		c.written = append(c.written, string(m.Buffers[0]))
+	}
+	return len(ms), nil
+}
+
+func TestUDPBatchWriteError(t *testing.T) {
+	var logged []string
+	s := &Server{config: Config{Errorf: func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}}}
+	c := &failingBatchConn{fail: 1}
+	bc := &udpBatchConn{
+		conn: c,
+		msgs: make([]ipv4.Message, 4),
+		out:  make(chan udpResponse, 4),
+	}
+	for _, resp := range []string{"a", "b", "c", "d"} {
+		buf := udpBufferPool.Get().(*[]byte)
+		bc.out <- udpResponse{resp: []byte(resp), buf: buf}
+	}
+	bc.close()
+	bc.writeBatches(s)
+
+	if want := []string{"a", "c", "d"}; !reflect.DeepEqual(c.written, want) {
+		t.Errorf("got written = %q, want = %q", c.written, want)
+	}
+	if len(logged) != 1 {
+		t.Errorf("got logged = %q, want 1 error", logged)
+	}
+}
+
+func BenchmarkUDP(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		config UDPConfig
+	}{
+		{"single", UDPConfig{DisableConcurrency: true}},
+		{"batch", UDPConfig{DisableConcurrency: true, BatchSize: 32}},
+		{"workers", UDPConfig{Workers: 4, QueueDepth: 1024}},
+		{"batch workers", UDPConfig{Workers: 4, QueueDepth: 1024, BatchSize: 32}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			addr, shutdown := startUDPServer(b, bench.config)
+			defer shutdown()
+
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("udp", addr.String())
+				if err != nil {
+					b.Fatalf("dialing server (%v): %v", addr, err)
+				}
+				defer conn.Close()
+				for pb.Next() {
+					conn.SetDeadline(time.Now().Add(5 * time.Second))
+					if err := exchangeUDP(conn, 16, 16); err != nil {
+						b.Error("exchanging requests:", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestListenAndServeUDP(t *testing.T) {
+	// Each socket serves one request at a time, so the number of requests
+	// blocked in the resolver at once is the number of sockets serving.
+	var (
+		mu      sync.Mutex
+		blocked int
+		release = make(chan struct{})
+	)
+	pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+		mu.Lock()
+		blocked++
+		mu.Unlock()
+		<-release
+		return echoPacketResolver(ctx, packet, maxPacketLength, buf)
+	})
+	srv, err := New(Config{UDP: UDPConfig{DisableConcurrency: true}, Errorf: t.Logf}, pr)
+	if err != nil {
+		t.Fatal("creating server:", err)
+	}
+
+	// Find a free port.
+	pc, addr, err := testUDP()
+	if err != nil {
+		t.Fatal("creating UDP socket:", err)
+	}
+	pc.Close()
+
+	const sockets = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ListenAndServeUDP(ctx, "udp", addr.String(), sockets)
+	}()
+
+	conns := make([]net.Conn, 16)
+	for i := range conns {
+		conn, err := net.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatalf("dialing server (%v): %v", addr, err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	// Requests from many client ports are spread across the sockets. Send
+	// them until more than one socket is serving, retrying until the server
+	// is listening.
+	want := 2
+	if !reusePortSupported {
+		want = 1
+	}
+	req, err := packTestRequest()
+	if err != nil {
+		t.Fatal("packing request:", err)
+	}
+	var serving int
+	for try := 0; try < 100 && serving < want; try++ {
+		for _, conn := range conns {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write(req)
+		}
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		serving = blocked
+		mu.Unlock()
+	}
+	if serving < want || serving > sockets {
+		t.Errorf("got %d sockets serving, want between %d and %d", serving, want, sockets)
+	}
+	close(release)
+
+	for _, conn := range conns {
+		if err := exchangeUDP(conn, 1, 1); err != nil {
+			t.Fatal("exchanging requests:", err)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServeUDP(...) = %v, want = nil", err)
+	}
+	srv.Wait()
+}
+
+func TestUDPPacketInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("IP_PKTINFO is only used on Linux")
+	}
+
+	tests := []struct {
+		name    string
+		network string
+		address string
+		config  UDPConfig
+	}{
+		{"ipv4", "udp4", "0.0.0.0:0", UDPConfig{}},
+		{"ipv4 batch", "udp4", "0.0.0.0:0", UDPConfig{BatchSize: 8}},
+		{"dual stack", "udp", "[::]:0", UDPConfig{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc, err := net.ListenPacket(test.network, test.address)
+			if err != nil {
+				t.Skip("creating UDP socket:", err)
+			}
+			port := pc.LocalAddr().(*net.UDPAddr).Port
+
+			locals := make(chan net.Addr, 1)
+			pr := dnsresolver.PacketResolverFunc(func(ctx context.Context, packet []byte, maxPacketLength int, buf []byte) ([]byte, error) {
+				local, _ := ctx.Value(dnsresolver.LocalContextKey).(net.Addr)
+				locals <- local
+				return echoPacketResolver(ctx, packet, maxPacketLength, buf)
+			})
+			srv, err := New(Config{UDP: test.config, Errorf: t.Logf}, pr)
+			if err != nil {
+				pc.Close()
+				t.Fatal("creating UDP server:", err)
+			}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				srv.ServeUDP(pc)
+				wg.Done()
+			}()
+			defer func() {
+				pc.Close()
+				wg.Wait()
+				srv.Wait()
+			}()
+
+			// A connected socket only accepts responses from the
+			// address it sent the request to, and the whole of
+			// 127.0.0.0/8 is routed to the loopback interface.
+			dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port}
+			conn, err := net.DialUDP("udp4", nil, dst)
+			if err != nil {
+				t.Fatalf("dialing server (%v): %v", dst, err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if err := exchangeUDP(conn, 1, 1); err != nil {
+				t.Fatal("exchanging request:", err)
+			}
+
+			got, ok := (<-locals).(*net.UDPAddr)
+			if !ok || !got.IP.Equal(dst.IP) || got.Port != port {
+				t.Errorf("got LocalContextKey = %v, want = %v", got, dst)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsstatic provides a DNS resolver which answers from a fixed set of
+// records, such as local host names or names to block.
+//
+// Records are grouped by owner name and type, so that a question for a
+// configured name is answered with the records of the requested type, with
+// all of its records for ANY questions, or with an empty answer (NODATA) if it
+// has no records of the requested type. Names are compared ignoring case.
+//
+// A record whose owner name starts with the label "*" is a wildcard which
+// answers for the names below its parent that don't exist, as described in RFC
+// 4592. A name exists if it has records or names below it do, so a wildcard
+// doesn't match the names below an existing name. For example, with records
+// for *.example. and a.b.example., c.example. matches the wildcard, but
+// c.b.example. doesn't.
+//
+// Names at or below the parent of a wildcard, or the owner of the configured
+// SOA record, are answered locally even if they have no records: names which
+// exist only because names below them do, such as b.example. above, are
+// answered with NODATA, and names which don't exist and don't match a
+// wildcard, such as c.b.example., are answered with NXDOMAIN.
+//
+// Questions for other names without records, and questions of classes other
+// than IN, are passed to the nested resolver.
+package dnsstatic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/dnsresolver"
+	"github.com/iangudger/dns/internal/dnstree"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records that will be followed
+// when assembling an answer.
+const maxCNAMEChain = 8
+
+// Config contains the records of a static resolver.
+type Config struct {
+	_ struct{} // Prevent positional initialization.
+
+	// Records are the records to answer with. Each record must have its
+	// Name, Type and Class set, and the class must be IN. Records are
+	// returned with the TTL they are configured with, except that the
+	// records of an RRset with different TTLs are all returned with the
+	// lowest of them (RFC 2181, section 5.2).
+	Records []dnsmessage.Resource
+
+	// NXDomain lists names which don't exist. Questions for them, and
+	// for names below them, are answered with NXDOMAIN (RFC 8020). No
+	// record may be at or below one of these names.
+	NXDomain []dnsmessage.Name
+
+	// SOA is optionally the SOA record of the zone the records belong
+	// to. If set, it is included in the authority section of NXDOMAIN and
+	// NODATA responses, with the TTL described in RFC 2308, section 3, so
+	// that they can be cached.
+	SOA *dnsmessage.Resource
+
+	// Authoritative when true sets the Authoritative bit in responses.
+	Authoritative bool
+}
+
+// Errors returned by NewResolver for invalid configurations. They are wrapped
+// with the name of the offending record, so they should be checked with
+// errors.Is.
+var (
+	// ErrInvalidName indicates that a record or NXDomain name is invalid.
+	ErrInvalidName = errors.New("invalid name")
+
+	// ErrInvalidClass indicates that a record's class isn't IN.
+	ErrInvalidClass = errors.New("record class isn't IN")
+
+	// ErrInvalidType indicates that a record's type is a question-only
+	// type such as ANY, or doesn't match its body.
+	ErrInvalidType = errors.New("invalid record type")
+
+	// ErrNilBody indicates that a record has no body.
+	ErrNilBody = errors.New("record has no body")
+
+	// ErrCNAMEConflict indicates that a name has a CNAME record and
+	// other records, or several CNAME records.
+	ErrCNAMEConflict = errors.New("CNAME record with other records")
+
+	// ErrNXDomainConflict indicates that a record is at or below a name
+	// configured not to exist.
+	ErrNXDomainConflict = errors.New("record at or below an NXDOMAIN name")
+)
+
+type staticResolver struct {
+	authoritative bool
+
+	// records holds the configured records.
+	records dnstree.Tree
+
+	// nxdomain holds the keys of the names configured not to exist.
+	nxdomain map[string]bool
+
+	// zones holds the keys of the names at or below which every name is
+	// answered locally: the parents of wildcards and the owner of the SOA
+	// record.
+	zones map[string]bool
+
+	// soa holds the SOA record included in negative responses, if any.
+	soa []dnsmessage.Resource
+
+	nested dnsresolver.Resolver
+}
+
+// NewResolver creates a Resolver which answers questions from the records in
+// config, and passes other questions to the nested Resolver, which must not
+// be nil.
+func NewResolver(config Config, nested dnsresolver.Resolver) (dnsresolver.Resolver, error) {
+	r := &staticResolver{
+		authoritative: config.Authoritative,
+		nxdomain:      make(map[string]bool),
+		zones:         make(map[string]bool),
+		nested:        nested,
+	}
+	for i := range config.NXDomain {
+		key := dnstree.Key(&config.NXDomain[i])
+		if key == "" {
+			return nil, ErrInvalidName
+		}
+		r.nxdomain[key] = true
+	}
+	if soa := config.SOA; soa != nil {
+		switch {
+		case dnstree.Key(&soa.Header.Name) == "":
+			return nil, ErrInvalidName
+		case soa.Header.Class != dnsmessage.ClassINET:
+			return nil, fmt.Errorf("%v: %w", soa.Header.Name, ErrInvalidClass)
+		}
+		if _, ok := soa.Body.(*dnsmessage.SOAResource); !ok || soa.Header.Type != dnsmessage.TypeSOA {
+			return nil, fmt.Errorf("%v: %w", soa.Header.Name, ErrInvalidType)
+		}
+		r.soa = []dnsmessage.Resource{dnstree.NegativeSOA(*soa)}
+		r.zones[dnstree.Key(&soa.Header.Name)] = true
+	}
+	for _, rr := range config.Records {
+		switch {
+		case dnstree.Key(&rr.Header.Name) == "":
+			return nil, ErrInvalidName
+		case rr.Header.Class != dnsmessage.ClassINET:
+			return nil, fmt.Errorf("%v: %w", rr.Header.Name, ErrInvalidClass)
+		case rr.Header.Type == dnsmessage.TypeALL || rr.Header.Type == dnsmessage.TypeOPT:
+			return nil, fmt.Errorf("%v: %w", rr.Header.Name, ErrInvalidType)
+		case rr.Body == nil:
+			return nil, fmt.Errorf("%v: %w", rr.Header.Name, ErrNilBody)
+		}
+		if _, ok := rr.Body.(*dnsmessage.CNAMEResource); ok != (rr.Header.Type == dnsmessage.TypeCNAME) {
+			return nil, fmt.Errorf("%v: %w", rr.Header.Name, ErrInvalidType)
+		}
+		if r.denied(rr.Header.Name) {
+			return nil, fmt.Errorf("%v: %w", rr.Header.Name, ErrNXDomainConflict)
+		}
+		if r.records.Add(rr).CNAMEConflict() {
+			return nil, fmt.Errorf("%v: %w", rr.Header.Name, ErrCNAMEConflict)
+		}
+		if dnstree.IsWildcard(&rr.Header.Name) {
+			parent := rr.Header.Name.Parent()
+			r.zones[dnstree.Key(&parent)] = true
+		}
+	}
+	return dnsresolver.NewTracingResolver("dnsstatic.Resolve", r), nil
+}
+
+// denied reports whether name is at or below a name configured not to exist.
+func (r *staticResolver) denied(name dnsmessage.Name) bool {
+	return below(r.nxdomain, name)
+}
+
+// local reports whether name is answered locally even if it has no records.
+func (r *staticResolver) local(name dnsmessage.Name) bool {
+	return below(r.zones, name)
+}
+
+// below reports whether name is at or below a name whose key is in keys.
+func below(keys map[string]bool, name dnsmessage.Name) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	for {
+		if keys[dnstree.Key(&name)] {
+			return true
+		}
+		if name.Labels() == 0 {
+			return false
+		}
+		name = name.Parent()
+	}
+}
+
+// Resolve implements dnsresolver.Resolver.Resolve.
+func (r *staticResolver) Resolve(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	if question.Class != dnsmessage.ClassINET && question.Class != dnsmessage.ClassANY {
+		return r.nested.Resolve(ctx, question, recursionDesired)
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:         true,
+			Authoritative:    r.authoritative,
+			RecursionDesired: recursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	name := question.Name
+	for i := 0; ; i++ {
+		if r.denied(name) {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+			msg.Authorities = append(msg.Authorities, r.soa...)
+			break
+		}
+		n := r.records.Lookup(name)
+		if (n == nil || n.Empty()) && !r.local(name) {
+			if i == 0 {
+				return r.nested.Resolve(ctx, question, recursionDesired)
+			}
+			// The CNAME target isn't configured here; leave it to
+			// the client to follow.
+			break
+		}
+		if n == nil {
+			// The name doesn't exist and no wildcard matches it.
+			msg.Header.RCode = dnsmessage.RCodeNameError
+			msg.Authorities = append(msg.Authorities, r.soa...)
+			break
+		}
+		if question.Type == dnsmessage.TypeALL && !n.Empty() {
+			msg.Answers = n.AppendAll(msg.Answers, name)
+			break
+		}
+		if n.RRset(question.Type) != nil {
+			msg.Answers = n.Append(msg.Answers, question.Type, name)
+			break
+		}
+		cname := n.RRset(dnsmessage.TypeCNAME)
+		if cname == nil {
+			// NODATA.
+			msg.Authorities = append(msg.Authorities, r.soa...)
+			break
+		}
+		if i == maxCNAMEChain {
+			msg.Answers = nil
+			msg.Header.RCode = dnsmessage.RCodeServerFailure
+			break
+		}
+		msg.Answers = n.Append(msg.Answers, dnsmessage.TypeCNAME, name)
+		name = cname[0].Body.(*dnsmessage.CNAMEResource).CNAME
+	}
+	return msg, true
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsstatic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/iangudger/dns/dnsmessage"
+	"github.com/iangudger/dns/internal/resolvers"
+)
+
+func header(name string, typ dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func a(name string, ttl uint32, last byte) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeA, ttl), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, last}}}
+}
+
+func cname(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeCNAME, 60), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)}}
+}
+
+var testConfig = Config{
+	Records: []dnsmessage.Resource{
+		a("host.example.", 300, 1),
+		a("HOST.example.", 600, 2),
+		{Header: header("host.example.", dnsmessage.TypeTXT, 60), Body: &dnsmessage.TXTResource{TXT: []string{"hello"}}},
+		cname("alias.example.", "host.example."),
+		cname("chain.example.", "Alias.Example."),
+		cname("out.example.", "host.example.org."),
+		cname("gone.example.", "x.blocked.example."),
+		cname("loop1.example.", "loop2.example."),
+		cname("loop2.example.", "loop1.example."),
+		a("*.wild.example.", 30, 9),
+		a("*.sub.wild.example.", 30, 10),
+		a("exact.wild.example.", 30, 11),
+	},
+	NXDomain:      []dnsmessage.Name{dnsmessage.MustNewName("blocked.example.")},
+	Authoritative: true,
+}
+
+// summarize returns the rcode, the authoritative bit and the answers of msg in
+// a compact form.
+func summarize(msg dnsmessage.Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v aa=%t", msg.Header.RCode, msg.Header.Authoritative)
+	for _, r := range msg.Answers {
+		fmt.Fprintf(&b, " %s/%v/%d", r.Header.Name, r.Header.Type, r.Header.TTL)
+		if body, ok := r.Body.(*dnsmessage.AResource); ok {
+			fmt.Fprintf(&b, "/%d", body.A[3])
+		}
+	}
+	return b.String()
+}
+
+func TestResolve(t *testing.T) {
+	r, err := NewResolver(testConfig, resolvers.NewErroringResolver())
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	for _, test := range []struct {
+		name string
+		typ  dnsmessage.Type
+		want string
+	}{
+		{"host.example.", dnsmessage.TypeA, "RCodeSuccess aa=true host.example./TypeA/300/1 host.example./TypeA/300/2"},
+		{"hOsT.EXAMPLE.", dnsmessage.TypeTXT, "RCodeSuccess aa=true hOsT.EXAMPLE./TypeTXT/60"},
+		{"host.example.", dnsmessage.TypeALL, "RCodeSuccess aa=true host.example./TypeA/300/1 host.example./TypeA/300/2 host.example./TypeTXT/60"},
+		{"host.example.", dnsmessage.TypeAAAA, "RCodeSuccess aa=true"},
+		{"alias.example.", dnsmessage.TypeA, "RCodeSuccess aa=true alias.example./TypeCNAME/60 host.example./TypeA/300/1 host.example./TypeA/300/2"},
+		{"alias.example.", dnsmessage.TypeCNAME, "RCodeSuccess aa=true alias.example./TypeCNAME/60"},
+		{"chain.example.", dnsmessage.TypeAAAA, "RCodeSuccess aa=true chain.example./TypeCNAME/60 Alias.Example./TypeCNAME/60"},
+		{"out.example.", dnsmessage.TypeA, "RCodeSuccess aa=true out.example./TypeCNAME/60"},
+		{"gone.example.", dnsmessage.TypeA, "RCodeNameError aa=true gone.example./TypeCNAME/60"},
+		{"loop1.example.", dnsmessage.TypeA, "RCodeServerFailure aa=true"},
+		{"blocked.example.", dnsmessage.TypeA, "RCodeNameError aa=true"},
+		{"a.b.BLOCKED.example.", dnsmessage.TypeTXT, "RCodeNameError aa=true"},
+		{"x.wild.example.", dnsmessage.TypeA, "RCodeSuccess aa=true x.wild.example./TypeA/30/9"},
+		{"y.x.wild.example.", dnsmessage.TypeA, "RCodeSuccess aa=true y.x.wild.example./TypeA/30/9"},
+		{"x.sub.wild.example.", dnsmessage.TypeA, "RCodeSuccess aa=true x.sub.wild.example./TypeA/30/10"},
+		{"exact.wild.example.", dnsmessage.TypeA, "RCodeSuccess aa=true exact.wild.example./TypeA/30/11"},
+		{"x.wild.example.", dnsmessage.TypeMX, "RCodeSuccess aa=true"},
+		// exact.wild.example. exists, so the wildcard doesn't match
+		// names below it, which don't exist.
+		{"y.exact.wild.example.", dnsmessage.TypeA, "RCodeNameError aa=true"},
+		// wild.example. only exists because names below it do.
+		{"wild.example.", dnsmessage.TypeA, "RCodeSuccess aa=true"},
+		{"wild.example.", dnsmessage.TypeALL, "RCodeSuccess aa=true"},
+		// Other names without records are passed to the nested resolver.
+		{"example.", dnsmessage.TypeA, "RCodeNotImplemented aa=false"},
+		{"other.example.", dnsmessage.TypeA, "RCodeNotImplemented aa=false"},
+	} {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: test.typ, Class: dnsmessage.ClassINET}
+		msg, ok := r.Resolve(context.Background(), q, true)
+		if !ok {
+			t.Errorf("Resolve(%s %v) didn't respond", test.name, test.typ)
+			continue
+		}
+		if got := summarize(msg); got != test.want {
+			t.Errorf("Resolve(%s %v) = %s, want = %s", test.name, test.typ, got, test.want)
+		}
+		if !msg.Header.Response || !msg.Header.RecursionDesired {
+			t.Errorf("Resolve(%s %v) got Response, RecursionDesired = %t, %t, want = true, true", test.name, test.typ, msg.Header.Response, msg.Header.RecursionDesired)
+		}
+		if len(msg.Questions) != 1 || msg.Questions[0] != q {
+			t.Errorf("Resolve(%s %v) got questions %v, want = [%v]", test.name, test.typ, msg.Questions, q)
+		}
+	}
+
+	// Questions of other classes are passed to the nested resolver.
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("host.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassCHAOS}
+	if msg, _ := r.Resolve(context.Background(), q, false); msg.Header.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("Resolve(%v) got rcode = %v, want = %v", q, msg.Header.RCode, dnsmessage.RCodeNotImplemented)
+	}
+}
+
+func TestNewResolverErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config Config
+		want   error
+	}{
+		{"invalid name", Config{Records: []dnsmessage.Resource{{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, Body: &dnsmessage.AResource{}}}}, ErrInvalidName},
+		{"invalid NXDOMAIN name", Config{NXDomain: []dnsmessage.Name{{}}}, ErrInvalidName},
+		{"class", Config{Records: []dnsmessage.Resource{{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("a."), Type: dnsmessage.TypeA}, Body: &dnsmessage.AResource{}}}}, ErrInvalidClass},
+		{"ANY", Config{Records: []dnsmessage.Resource{{Header: header("a.", dnsmessage.TypeALL, 0), Body: &dnsmessage.AResource{}}}}, ErrInvalidType},
+		{"CNAME body", Config{Records: []dnsmessage.Resource{{Header: header("a.", dnsmessage.TypeCNAME, 0), Body: &dnsmessage.AResource{}}}}, ErrInvalidType},
+		{"nil body", Config{Records: []dnsmessage.Resource{{Header: header("a.", dnsmessage.TypeA, 0)}}}, ErrNilBody},
+		{"CNAME and A", Config{Records: []dnsmessage.Resource{a("a.", 0, 1), cname("A.", "b.")}}, ErrCNAMEConflict},
+		{"two CNAMEs", Config{Records: []dnsmessage.Resource{cname("a.", "b."), cname("a.", "c.")}}, ErrCNAMEConflict},
+		{"NXDOMAIN", Config{Records: []dnsmessage.Resource{a("x.a.", 0, 1)}, NXDomain: []dnsmessage.Name{dnsmessage.MustNewName("A.")}}, ErrNXDomainConflict},
+		{"SOA type", Config{SOA: &dnsmessage.Resource{Header: header("a.", dnsmessage.TypeA, 0), Body: &dnsmessage.AResource{}}}, ErrInvalidType},
+		{"SOA class", Config{SOA: &dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("a."), Type: dnsmessage.TypeSOA}, Body: &dnsmessage.SOAResource{}}}, ErrInvalidClass},
+	} {
+		if _, err := NewResolver(test.config, resolvers.NewErroringResolver()); !errors.Is(err, test.want) {
+			t.Errorf("%s: got NewResolver(...) = %v, want = %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestNegativeSOA(t *testing.T) {
+	soa := dnsmessage.Resource{
+		Header: header("example.", dnsmessage.TypeSOA, 3600),
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example."),
+			MBox:   dnsmessage.MustNewName("hostmaster.example."),
+			MinTTL: 120,
+		},
+	}
+	config := testConfig
+	config.SOA = &soa
+	r, err := NewResolver(config, resolvers.NewErroringResolver())
+	if err != nil {
+		t.Fatal("NewResolver(...) =", err)
+	}
+	for _, test := range []struct {
+		name string
+		typ  dnsmessage.Type
+		want int
+	}{
+		{"host.example.", dnsmessage.TypeA, 0},
+		{"host.example.", dnsmessage.TypeAAAA, 1},
+		{"blocked.example.", dnsmessage.TypeA, 1},
+		{"gone.example.", dnsmessage.TypeA, 1},
+		{"chain.example.", dnsmessage.TypeMX, 1},
+		{"out.example.", dnsmessage.TypeA, 0},
+	} {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: test.typ, Class: dnsmessage.ClassINET}
+		msg, _ := r.Resolve(context.Background(), q, false)
+		if len(msg.Authorities) != test.want {
+			t.Errorf("Resolve(%s %v) got %d authority records, want = %d", test.name, test.typ, len(msg.Authorities), test.want)
+			continue
+		}
+		if test.want == 0 {
+			continue
+		}
+		if got := msg.Authorities[0]; got.Header.Type != dnsmessage.TypeSOA || got.Header.TTL != 120 {
+			t.Errorf("Resolve(%s %v) got authority %v/%d, want = TypeSOA/120", test.name, test.typ, got.Header.Type, got.Header.TTL)
+		}
+	}
+}
+
+func TestEmptyNonTerminal(t *testing.T) {
+	soa := dnsmessage.Resource{
+		Header: header("example.", dnsmessage.TypeSOA, 3600),
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example."),
+			MBox:   dnsmessage.MustNewName("hostmaster.example."),
+			MinTTL: 120,
+		},
+	}
+	for _, test := range []struct {
+		name   string
+		config Config
+		q      string
+		want   string
+		soa    bool
+	}{
+		{"wildcard", Config{Records: []dnsmessage.Resource{a("*.example.", 30, 1), a("a.b.example.", 30, 2)}}, "c.example.", "RCodeSuccess aa=false c.example./TypeA/30/1", false},
+		{"wildcard ENT", Config{Records: []dnsmessage.Resource{a("*.example.", 30, 1), a("a.b.example.", 30, 2)}}, "b.example.", "RCodeSuccess aa=false", false},
+		{"wildcard below ENT", Config{Records: []dnsmessage.Resource{a("*.example.", 30, 1), a("a.b.example.", 30, 2)}}, "c.b.example.", "RCodeNameError aa=false", false},
+		{"wildcard outside", Config{Records: []dnsmessage.Resource{a("*.example.", 30, 1), a("a.b.example.", 30, 2)}}, "example.org.", "RCodeNotImplemented aa=false", false},
+		{"SOA ENT", Config{Records: []dnsmessage.Resource{a("a.b.example.", 30, 2)}, SOA: &soa}, "b.example.", "RCodeSuccess aa=false", true},
+		{"SOA below ENT", Config{Records: []dnsmessage.Resource{a("a.b.example.", 30, 2)}, SOA: &soa}, "c.b.example.", "RCodeNameError aa=false", true},
+		{"SOA outside", Config{Records: []dnsmessage.Resource{a("a.b.example.", 30, 2)}, SOA: &soa}, "example.org.", "RCodeNotImplemented aa=false", false},
+		// Without a wildcard or an SOA record, the ENT is not known to
+		// be in a zone the records belong to.
+		{"no zone", Config{Records: []dnsmessage.Resource{a("a.b.example.", 30, 2)}}, "b.example.", "RCodeNotImplemented aa=false", false},
+	} {
+		r, err := NewResolver(test.config, resolvers.NewErroringResolver())
+		if err != nil {
+			t.Fatalf("%s: NewResolver(...) = %v", test.name, err)
+		}
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.q), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+		msg, _ := r.Resolve(context.Background(), q, false)
+		if got := summarize(msg); got != test.want {
+			t.Errorf("%s: Resolve(%s) = %s, want = %s", test.name, test.q, got, test.want)
+		}
+		if gotSOA := len(msg.Authorities) == 1 && msg.Authorities[0].Header.Type == dnsmessage.TypeSOA; gotSOA != test.soa {
+			t.Errorf("%s: Resolve(%s) got authorities %v, want SOA = %t", test.name, test.q, msg.Authorities, test.soa)
+		}
+	}
+}
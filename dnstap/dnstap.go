@@ -0,0 +1,318 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnstap logs DNS queries and responses handled by a dnsserver.Server
+// in the dnstap format.
+//
+// dnstap is described at https://dnstap.info. Each query handled by a server
+// is logged as a pair of dnstap messages, one for the query and one for the
+// response, encoded as Protocol Buffers and written using the Frame Streams
+// protocol.
+package dnstap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iangudger/dns/dnsserver"
+)
+
+const (
+	// defaultQueueSize is the default number of frames waiting to be
+	// written.
+	defaultQueueSize = 1024
+
+	// defaultDialTimeout is the default time allowed to connect to a
+	// collector.
+	defaultDialTimeout = 5 * time.Second
+
+	// minReconnectDelay is the delay before the first attempt to
+	// reconnect to a collector.
+	minReconnectDelay = 100 * time.Millisecond
+
+	// defaultMaxReconnectDelay is the default maximum delay between
+	// attempts to reconnect to a collector.
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+// ErrClosed indicates that a Writer has been closed.
+var ErrClosed = errors.New("dnstap writer closed")
+
+// Config contains optional configuration options for a Writer.
+type Config struct {
+	_ struct{} // Prevent positional initialization.
+
+	// Identity optionally identifies the server, such as by its host
+	// name.
+	Identity string
+
+	// Version optionally identifies the server software.
+	Version string
+
+	// Authoritative indicates that the server is an authoritative server,
+	// so queries are logged as AUTH_QUERY and AUTH_RESPONSE messages.
+	// Otherwise, queries are logged as CLIENT_QUERY and CLIENT_RESPONSE
+	// messages, as for a recursive server.
+	Authoritative bool
+
+	// QueueSize is the maximum number of messages waiting to be written.
+	// Messages logged while the queue is full are dropped.
+	//
+	// If not positive, the default value will be used.
+	QueueSize int
+
+	// DialTimeout is the maximum time allowed to connect to a collector
+	// with DialUnix, including the Frame Streams handshake.
+	//
+	// If not positive, the default value of 5 seconds will be used.
+	DialTimeout time.Duration
+
+	// MaxReconnectDelay is the maximum delay between attempts to
+	// reconnect to a collector after the connection of a Writer created
+	// by DialUnix fails, such as when the collector restarts. The delay
+	// starts at 100 milliseconds and doubles after each failed attempt.
+	// Messages are queued while reconnecting, and dropped once the queue
+	// is full.
+	//
+	// If not positive, the default value of 30 seconds will be used.
+	MaxReconnectDelay time.Duration
+}
+
+// A Writer writes dnstap messages to an output. It implements
+// dnsserver.QueryLogger.
+//
+// Messages are written by a separate goroutine, so logging never blocks.
+// If the output is too slow to keep up, messages are dropped and counted.
+//
+// All methods are safe for concurrent use.
+type Writer struct {
+	config Config
+
+	// dropped counts dropped messages. It must be accessed atomically.
+	dropped uint64
+
+	// frames holds encoded data frames waiting to be written.
+	frames chan []byte
+
+	// mu protects closed and ensures that frames isn't written to after
+	// being closed.
+	mu     sync.RWMutex
+	closed bool
+
+	// stop is closed by Close, which stops attempts to reconnect.
+	stop chan struct{}
+
+	// done is closed when the writing goroutine exits, after which err
+	// holds the first error it encountered.
+	done chan struct{}
+	err  error
+}
+
+var _ dnsserver.QueryLogger = (*Writer)(nil)
+
+// NewWriter creates a Writer which writes a unidirectional Frame Stream to w,
+// such as a file.
+//
+// If w is an io.Closer, it is closed by Close.
+func NewWriter(w io.Writer, config Config) *Writer {
+	tw := newWriter(config)
+	go tw.write(w)
+	return tw
+}
+
+// DialUnix creates a Writer which writes a bidirectional Frame Stream to the
+// unix socket at path, which is the usual way of sending dnstap messages to
+// a collector.
+//
+// If the connection fails, the Writer reconnects to path, as described in
+// Config.MaxReconnectDelay.
+func DialUnix(path string, config Config) (*Writer, error) {
+	timeout := config.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	c, err := dialUnix(path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tw := newWriter(config)
+	go tw.writeUnix(c, path, timeout)
+	return tw, nil
+}
+
+// dialUnix connects to the collector at path and performs the bidirectional
+// handshake: the writer sends READY, and the reader responds with ACCEPT.
+func dialUnix(path string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(appendControlFrame(nil, controlReady)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := expectControlFrame(c, controlAccept); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func newWriter(config Config) *Writer {
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	return &Writer{
+		config: config,
+		frames: make(chan []byte, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// write writes the frames from tw.frames to w until tw is closed.
+func (tw *Writer) write(w io.Writer) {
+	defer close(tw.done)
+	if c, ok := w.(io.Closer); ok {
+		defer c.Close()
+	}
+	if err := tw.writeStream(w); err != nil {
+		// The output has failed. Discard the remaining frames.
+		tw.err = err
+		tw.drop()
+	}
+}
+
+// writeUnix writes the frames from tw.frames to the collector at path, which
+// c is connected to, until tw is closed, reconnecting if the connection
+// fails.
+func (tw *Writer) writeUnix(c net.Conn, path string, timeout time.Duration) {
+	defer close(tw.done)
+	maxDelay := tw.config.MaxReconnectDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+	for {
+		err := tw.writeStream(c)
+		if err == nil {
+			err = expectControlFrame(c, controlFinish)
+			c.Close()
+			tw.err = err
+			return
+		}
+		c.Close()
+
+		for delay := minReconnectDelay; ; {
+			t := time.NewTimer(delay)
+			select {
+			case <-tw.stop:
+				t.Stop()
+				tw.err = err
+				tw.drop()
+				return
+			case <-t.C:
+			}
+			var derr error
+			if c, derr = dialUnix(path, timeout); derr == nil {
+				break
+			}
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+	}
+}
+
+// writeStream writes a Frame Stream holding the frames from tw.frames to w
+// until tw is closed. If writing fails, the frame being written is dropped
+// and the error is returned.
+func (tw *Writer) writeStream(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(appendControlFrame(nil, controlStart)); err != nil {
+		return err
+	}
+	for f := range tw.frames {
+		if _, err := bw.Write(f); err != nil {
+			atomic.AddUint64(&tw.dropped, 1)
+			return err
+		}
+		if len(tw.frames) == 0 {
+			// Flush once the queue is empty, which batches writes
+			// while busy.
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := bw.Write(appendControlFrame(nil, controlStop)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// drop drops the frames from tw.frames until tw is closed.
+func (tw *Writer) drop() {
+	for range tw.frames {
+		atomic.AddUint64(&tw.dropped, 1)
+	}
+}
+
+// LogQuery implements dnsserver.QueryLogger.LogQuery.
+func (tw *Writer) LogQuery(l *dnsserver.QueryLog) {
+	tw.enqueue(tw.encode(l, false))
+	if l.Response != nil {
+		tw.enqueue(tw.encode(l, true))
+	}
+}
+
+// enqueue queues a data frame holding msg to be written, or drops it if the
+// queue is full.
+func (tw *Writer) enqueue(msg []byte) {
+	tw.mu.RLock()
+	defer tw.mu.RUnlock()
+	if tw.closed {
+		atomic.AddUint64(&tw.dropped, 1)
+		return
+	}
+	select {
+	case tw.frames <- appendDataFrame(make([]byte, 0, 4+len(msg)), msg):
+	default:
+		atomic.AddUint64(&tw.dropped, 1)
+	}
+}
+
+// Dropped returns the number of messages which have been dropped, because the
+// queue was full, the output failed or the Writer was closed.
+func (tw *Writer) Dropped() uint64 {
+	return atomic.LoadUint64(&tw.dropped)
+}
+
+// Close writes the messages waiting in the queue, ends the Frame Stream and
+// closes the output. It returns the error which stopped the Writer from
+// writing, if any. A Writer created by DialUnix which is reconnecting when
+// closed drops the messages in the queue and returns the error which broke
+// its connection.
+func (tw *Writer) Close() error {
+	tw.mu.Lock()
+	if tw.closed {
+		tw.mu.Unlock()
+		return ErrClosed
+	}
+	tw.closed = true
+	close(tw.stop)
+	close(tw.frames)
+	tw.mu.Unlock()
+
+	<-tw.done
+	return tw.err
+}
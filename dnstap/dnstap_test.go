@@ -0,0 +1,422 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsserver"
+)
+
+// fields holds decoded Protocol Buffers fields. Varint and fixed32 values
+// are stored as uint64 and length delimited values as []byte.
+type fields map[int][]interface{}
+
+func decodeFields(b []byte) (fields, error) {
+	f := make(fields)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint in field %d", field)
+			}
+			b = b[n:]
+			f[field] = append(f[field], v)
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, fmt.Errorf("invalid length in field %d", field)
+			}
+			f[field] = append(f[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("short fixed32 in field %d", field)
+			}
+			f[field] = append(f[field], uint64(binary.LittleEndian.Uint32(b)))
+			b = b[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return f, nil
+}
+
+// readFrames reads a unidirectional Frame Stream and returns its data frames.
+func readFrames(r io.Reader) ([][]byte, error) {
+	if err := expectControlFrame(r, controlStart); err != nil {
+		return nil, err
+	}
+	var frames [][]byte
+	for {
+		var l [4]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(l[:])
+		if n == 0 {
+			// The escape sequence of the STOP frame.
+			var h [8]byte
+			if _, err := io.ReadFull(r, h[:]); err != nil {
+				return nil, err
+			}
+			if typ := binary.BigEndian.Uint32(h[4:]); typ != controlStop {
+				return nil, fmt.Errorf("got control frame %d, want STOP", typ)
+			}
+			return frames, nil
+		}
+		f := make([]byte, n)
+		if _, err := io.ReadFull(r, f); err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func testLog() *dnsserver.QueryLog {
+	return &dnsserver.QueryLog{
+		Source:       &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353},
+		Local:        &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53},
+		Query:        []byte("query"),
+		QueryTime:    time.Unix(1000, 5),
+		Response:     []byte("response"),
+		ResponseTime: time.Unix(1001, 7),
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var out closeRecorder
+	w := NewWriter(&out, Config{Identity: "ns1", Version: "test", Authoritative: true})
+	w.LogQuery(testLog())
+	tcp := testLog()
+	tcp.TCP = true
+	tcp.Response = nil
+	w.LogQuery(tcp)
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+	if !out.closed {
+		t.Error("output wasn't closed")
+	}
+	if w.Dropped() != 0 {
+		t.Errorf("got Dropped() = %d, want = 0", w.Dropped())
+	}
+
+	frames, err := readFrames(&out.Buffer)
+	if err != nil {
+		t.Fatal("reading frames:", err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want = 3", len(frames))
+	}
+
+	wantMessages := []fields{
+		{
+			fieldMessageType:     {uint64(messageAuthQuery)},
+			fieldSocketFamily:    {uint64(familyINET)},
+			fieldSocketProtocol:  {uint64(protocolUDP)},
+			fieldQueryAddress:    {[]byte{192, 0, 2, 1}},
+			fieldQueryPort:       {uint64(5353)},
+			fieldResponseAddress: {[]byte{198, 51, 100, 1}},
+			fieldResponsePort:    {uint64(53)},
+			fieldQueryTimeSec:    {uint64(1000)},
+			fieldQueryTimeNsec:   {uint64(5)},
+			fieldQueryMessage:    {[]byte("query")},
+		},
+		{
+			fieldMessageType:      {uint64(messageAuthResponse)},
+			fieldSocketFamily:     {uint64(familyINET)},
+			fieldSocketProtocol:   {uint64(protocolUDP)},
+			fieldQueryAddress:     {[]byte{192, 0, 2, 1}},
+			fieldQueryPort:        {uint64(5353)},
+			fieldResponseAddress:  {[]byte{198, 51, 100, 1}},
+			fieldResponsePort:     {uint64(53)},
+			fieldQueryTimeSec:     {uint64(1000)},
+			fieldQueryTimeNsec:    {uint64(5)},
+			fieldResponseTimeSec:  {uint64(1001)},
+			fieldResponseTimeNsec: {uint64(7)},
+			fieldResponseMessage:  {[]byte("response")},
+		},
+		{
+			fieldMessageType:     {uint64(messageAuthQuery)},
+			fieldSocketFamily:    {uint64(familyINET)},
+			fieldSocketProtocol:  {uint64(protocolTCP)},
+			fieldQueryAddress:    {[]byte{192, 0, 2, 1}},
+			fieldQueryPort:       {uint64(5353)},
+			fieldResponseAddress: {[]byte{198, 51, 100, 1}},
+			fieldResponsePort:    {uint64(53)},
+			fieldQueryTimeSec:    {uint64(1000)},
+			fieldQueryTimeNsec:   {uint64(5)},
+			fieldQueryMessage:    {[]byte("query")},
+		},
+	}
+	for i, f := range frames {
+		d, err := decodeFields(f)
+		if err != nil {
+			t.Fatalf("decoding frame %d: %v", i, err)
+		}
+		wantDnstap := fields{
+			fieldIdentity: {[]byte("ns1")},
+			fieldVersion:  {[]byte("test")},
+			fieldType:     {uint64(typeMessage)},
+		}
+		if len(d[fieldMessage]) != 1 {
+			t.Fatalf("frame %d has %d messages, want = 1", i, len(d[fieldMessage]))
+		}
+		m, err := decodeFields(d[fieldMessage][0].([]byte))
+		if err != nil {
+			t.Fatalf("decoding message %d: %v", i, err)
+		}
+		delete(d, fieldMessage)
+		if !reflect.DeepEqual(d, wantDnstap) {
+			t.Errorf("frame %d got Dnstap = %v, want = %v", i, d, wantDnstap)
+		}
+		if !reflect.DeepEqual(m, wantMessages[i]) {
+			t.Errorf("frame %d got Message = %v, want = %v", i, m, wantMessages[i])
+		}
+	}
+}
+
+// blockingWriter blocks writes until unblocked.
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return len(b), nil
+}
+
+func TestWriterDropsWhenFull(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	w := NewWriter(bw, Config{QueueSize: 2})
+
+	// The query is too large to be buffered, so the writing goroutine
+	// blocks on the first frame. At most three of the ten messages are
+	// accepted: the one being written and two in the queue.
+	l := testLog()
+	l.Query = make([]byte, 8192)
+	l.Response = nil
+	for i := 0; i < 10; i++ {
+		w.LogQuery(l)
+	}
+	if got := w.Dropped(); got < 7 {
+		t.Errorf("got Dropped() = %d, want >= 7", got)
+	}
+
+	close(bw.unblock)
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+	w.LogQuery(l)
+	if got := w.Dropped(); got < 8 {
+		t.Errorf("after Close got Dropped() = %d, want >= 8", got)
+	}
+	if err := w.Close(); err != ErrClosed {
+		t.Errorf("second Close() = %v, want = %v", err, ErrClosed)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("listening on unix socket:", err)
+	}
+	defer l.Close()
+
+	type result struct {
+		frames [][]byte
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer c.Close()
+		if err := expectControlFrame(c, controlReady); err != nil {
+			results <- result{err: err}
+			return
+		}
+		if _, err := c.Write(appendControlFrame(nil, controlAccept)); err != nil {
+			results <- result{err: err}
+			return
+		}
+		frames, err := readFrames(c)
+		if err == nil {
+			_, err = c.Write(appendControlFrame(nil, controlFinish))
+		}
+		results <- result{frames, err}
+	}()
+
+	w, err := DialUnix(path, Config{})
+	if err != nil {
+		t.Fatal("DialUnix(...) =", err)
+	}
+	w.LogQuery(testLog())
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+	r := <-results
+	if r.err != nil {
+		t.Fatal("reading stream:", r.err)
+	}
+	if len(r.frames) != 2 {
+		t.Errorf("got %d frames, want = 2", len(r.frames))
+	}
+}
+
+// listenUnix listens on a unix socket in a temporary directory and returns the
+// listener and its path.
+func listenUnix(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("listening on unix socket:", err)
+	}
+	return l, path
+}
+
+// acceptFrameStream accepts a connection from l and performs the
+// bidirectional handshake.
+func acceptFrameStream(l net.Listener) (net.Conn, error) {
+	c, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := expectControlFrame(c, controlReady); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := c.Write(appendControlFrame(nil, controlAccept)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestDialUnixTimeout(t *testing.T) {
+	// The listener never accepts, so the handshake times out.
+	l, path := listenUnix(t)
+	defer l.Close()
+	start := time.Now()
+	if _, err := DialUnix(path, Config{DialTimeout: 50 * time.Millisecond}); err == nil {
+		t.Fatal("DialUnix(...) succeeded without a handshake")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("DialUnix(...) took %v, want about 50ms", d)
+	}
+}
+
+func TestDialUnixReconnect(t *testing.T) {
+	l, path := listenUnix(t)
+	first := make(chan error, 1)
+	go func() {
+		// The first collector exits after the stream starts.
+		c, err := acceptFrameStream(l)
+		if err == nil {
+			err = expectControlFrame(c, controlStart)
+			c.Close()
+		}
+		l.Close()
+		first <- err
+	}()
+
+	w, err := DialUnix(path, Config{MaxReconnectDelay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal("DialUnix(...) =", err)
+	}
+	// The START frame is flushed with the first message.
+	w.LogQuery(testLog())
+	if err := <-first; err != nil {
+		t.Fatal("first collector:", err)
+	}
+
+	// Messages logged while the collector is down fail the connection
+	// and are queued while reconnecting.
+	for i := 0; i < 10; i++ {
+		w.LogQuery(testLog())
+		time.Sleep(time.Millisecond)
+	}
+
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("listening again:", err)
+	}
+	defer l.Close()
+	type result struct {
+		frames [][]byte
+		err    error
+	}
+	results := make(chan result, 1)
+	connected := make(chan struct{})
+	go func() {
+		c, err := acceptFrameStream(l)
+		close(connected)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer c.Close()
+		frames, err := readFrames(c)
+		if err == nil {
+			_, err = c.Write(appendControlFrame(nil, controlFinish))
+		}
+		results <- result{frames, err}
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the Writer to reconnect")
+	}
+	w.LogQuery(testLog())
+	if err := w.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+	r := <-results
+	if r.err != nil {
+		t.Fatal("reading stream:", r.err)
+	}
+	if len(r.frames) < 2 {
+		t.Errorf("got %d frames after reconnecting, want >= 2", len(r.frames))
+	}
+}
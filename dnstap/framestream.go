@@ -0,0 +1,97 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame Streams is described at
+// https://farsightsec.github.io/fstrm/. Each data frame is preceded by its
+// length as a 32 bit big endian integer. Control frames are preceded by a
+// zero length, called the escape sequence, followed by their own length.
+
+// Control frame types.
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+)
+
+// controlFieldContentType is the control frame field type of a content type.
+const controlFieldContentType = 0x01
+
+// contentType is the content type of dnstap data frames.
+const contentType = "protobuf:dnstap.Dnstap"
+
+// maxControlFrameLength is the maximum length of a control frame accepted
+// from a reader, as recommended by the Frame Streams specification.
+const maxControlFrameLength = 512
+
+var errUnexpectedControlFrame = errors.New("unexpected Frame Streams control frame")
+
+// appendControlFrame appends a control frame of type typ, with a content type
+// field unless typ is controlStop or controlFinish, to b.
+func appendControlFrame(b []byte, typ uint32) []byte {
+	var fields []byte
+	if typ != controlStop && typ != controlFinish {
+		fields = appendUint32(fields, controlFieldContentType)
+		fields = appendUint32(fields, uint32(len(contentType)))
+		fields = append(fields, contentType...)
+	}
+	b = appendUint32(b, 0) // Escape.
+	b = appendUint32(b, uint32(4+len(fields)))
+	b = appendUint32(b, typ)
+	return append(b, fields...)
+}
+
+// readControlFrame reads a control frame from r and returns its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(h[:4]) != 0 {
+		return 0, errUnexpectedControlFrame
+	}
+	l := binary.BigEndian.Uint32(h[4:])
+	if l < 4 || l > maxControlFrameLength {
+		return 0, fmt.Errorf("invalid Frame Streams control frame length %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	// The content type fields are not checked, as the reader is required
+	// to only accept content types it supports.
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// expectControlFrame reads a control frame from r and checks its type.
+func expectControlFrame(r io.Reader, typ uint32) error {
+	got, err := readControlFrame(r)
+	if err != nil {
+		return fmt.Errorf("reading Frame Streams control frame: %v", err)
+	}
+	if got != typ {
+		return fmt.Errorf("%w: got type %d, want %d", errUnexpectedControlFrame, got, typ)
+	}
+	return nil
+}
+
+// appendDataFrame appends a data frame holding data to b.
+func appendDataFrame(b, data []byte) []byte {
+	b = appendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
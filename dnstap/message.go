@@ -0,0 +1,173 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnstap
+
+import (
+	"net"
+	"time"
+
+	"github.com/iangudger/dns/dnsserver"
+)
+
+// Field numbers and enum values from dnstap.proto, available at
+// https://github.com/dnstap/dnstap.pb.
+const (
+	// Dnstap message fields.
+	fieldIdentity = 1
+	fieldVersion  = 2
+	fieldMessage  = 14
+	fieldType     = 15
+
+	// Dnstap.Type values.
+	typeMessage = 1
+
+	// Message fields.
+	fieldMessageType      = 1
+	fieldSocketFamily     = 2
+	fieldSocketProtocol   = 3
+	fieldQueryAddress     = 4
+	fieldResponseAddress  = 5
+	fieldQueryPort        = 6
+	fieldResponsePort     = 7
+	fieldQueryTimeSec     = 8
+	fieldQueryTimeNsec    = 9
+	fieldQueryMessage     = 10
+	fieldResponseTimeSec  = 12
+	fieldResponseTimeNsec = 13
+	fieldResponseMessage  = 14
+
+	// Message.Type values.
+	messageAuthQuery      = 1
+	messageAuthResponse   = 2
+	messageClientQuery    = 5
+	messageClientResponse = 6
+
+	// SocketFamily values.
+	familyINET  = 1
+	familyINET6 = 2
+
+	// SocketProtocol values.
+	protocolUDP = 1
+	protocolTCP = 2
+)
+
+// Protocol Buffers wire types.
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// encode encodes a Dnstap message for the query or, if response is set, the
+// response described by l.
+func (tw *Writer) encode(l *dnsserver.QueryLog, response bool) []byte {
+	var m []byte
+	typ := messageClientQuery
+	if tw.config.Authoritative {
+		typ = messageAuthQuery
+	}
+	if response {
+		typ++
+	}
+	m = appendVarintField(m, fieldMessageType, uint64(typ))
+
+	protocol := protocolUDP
+	if l.TCP {
+		protocol = protocolTCP
+	}
+	// In dnstap, the query address is the address of the client, and the
+	// response address is the address of the server.
+	srcIP, srcPort := splitAddr(l.Source)
+	dstIP, dstPort := splitAddr(l.Local)
+	family := familyINET
+	if (srcIP != nil && srcIP.To4() == nil) || (dstIP != nil && dstIP.To4() == nil) {
+		family = familyINET6
+	}
+	if srcIP != nil || dstIP != nil {
+		m = appendVarintField(m, fieldSocketFamily, uint64(family))
+	}
+	m = appendVarintField(m, fieldSocketProtocol, uint64(protocol))
+	if srcIP != nil {
+		m = appendBytesField(m, fieldQueryAddress, familyIP(srcIP, family))
+		m = appendVarintField(m, fieldQueryPort, uint64(srcPort))
+	}
+	if dstIP != nil {
+		m = appendBytesField(m, fieldResponseAddress, familyIP(dstIP, family))
+		m = appendVarintField(m, fieldResponsePort, uint64(dstPort))
+	}
+
+	m = appendTime(m, fieldQueryTimeSec, fieldQueryTimeNsec, l.QueryTime)
+	if response {
+		m = appendTime(m, fieldResponseTimeSec, fieldResponseTimeNsec, l.ResponseTime)
+		m = appendBytesField(m, fieldResponseMessage, l.Response)
+	} else {
+		m = appendBytesField(m, fieldQueryMessage, l.Query)
+	}
+
+	var d []byte
+	if tw.config.Identity != "" {
+		d = appendBytesField(d, fieldIdentity, []byte(tw.config.Identity))
+	}
+	if tw.config.Version != "" {
+		d = appendBytesField(d, fieldVersion, []byte(tw.config.Version))
+	}
+	d = appendBytesField(d, fieldMessage, m)
+	return appendVarintField(d, fieldType, typeMessage)
+}
+
+// splitAddr returns the IP address and port of addr, if any.
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// familyIP returns ip in the form used by family.
+func familyIP(ip net.IP, family int) net.IP {
+	if family == familyINET {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+func appendTime(b []byte, secField, nsecField int, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = appendVarintField(b, secField, uint64(t.Unix()))
+	return appendFixed32Field(b, nsecField, uint32(t.Nanosecond()))
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendTag(b, field, wireFixed32)
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsotel adapts OpenTelemetry tracers to dnstrace.Tracer, so spans
+// recorded by DNS servers and resolvers are exported with OpenTelemetry.
+//
+// It is in its own module, github.com/iangudger/dns/dnstrace/dnsotel.
+package dnsotel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/iangudger/dns/dnstrace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer creates a dnstrace.Tracer which records spans with t.
+//
+// Spans are started as children of the OpenTelemetry span in the context, so
+// DNS spans join traces started by the caller.
+func NewTracer(t trace.Tracer) dnstrace.Tracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+// Start implements dnstrace.Tracer.Start.
+func (t tracer) Start(ctx context.Context, name string) (context.Context, dnstrace.Span) {
+	ctx, s := t.t.Start(ctx, name)
+	return ctx, span{s}
+}
+
+type span struct {
+	s trace.Span
+}
+
+// SetAttributes implements dnstrace.Span.SetAttributes.
+//
+// The dnstrace.KeyError attribute also sets the status of the span to Error.
+func (s span) SetAttributes(attrs ...dnstrace.Attribute) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = append(kvs, keyValue(a))
+		if a.Key == dnstrace.KeyError {
+			s.s.SetStatus(codes.Error, fmt.Sprint(a.Value))
+		}
+	}
+	s.s.SetAttributes(kvs...)
+}
+
+// End implements dnstrace.Span.End.
+func (s span) End() {
+	s.s.End()
+}
+
+// keyValue converts a to an OpenTelemetry attribute.
+func keyValue(a dnstrace.Attribute) attribute.KeyValue {
+	k := attribute.Key(a.Key)
+	switch v := a.Value.(type) {
+	case string:
+		return k.String(v)
+	case int64:
+		return k.Int64(v)
+	case bool:
+		return k.Bool(v)
+	}
+	return k.String(fmt.Sprint(a.Value))
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsotel
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/iangudger/dns/dnstrace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeSpan records the attributes, status and end of a span. Other methods
+// panic.
+type fakeSpan struct {
+	trace.Span
+
+	name   string
+	attrs  []attribute.KeyValue
+	status codes.Code
+	desc   string
+	ended  bool
+}
+
+func (s *fakeSpan) SetAttributes(kvs ...attribute.KeyValue) {
+	s.attrs = append(s.attrs, kvs...)
+}
+
+func (s *fakeSpan) SetStatus(code codes.Code, desc string) {
+	s.status, s.desc = code, desc
+}
+
+func (s *fakeSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	s := &fakeSpan{name: name}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func TestTracer(t *testing.T) {
+	var ft fakeTracer
+	ctx := dnstrace.WithTracer(context.Background(), NewTracer(&ft))
+	_, span := dnstrace.Start(ctx, "query",
+		dnstrace.String("s", "v"),
+		dnstrace.Int("i", 7),
+		dnstrace.Bool("b", true),
+	)
+	span.SetAttributes(dnstrace.String(dnstrace.KeyError, "failed"))
+	span.End()
+
+	if len(ft.spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(ft.spans))
+	}
+	s := ft.spans[0]
+	if s.name != "query" || !s.ended {
+		t.Errorf("got span %q, ended = %t, want %q, ended", s.name, s.ended, "query")
+	}
+	want := []attribute.KeyValue{
+		attribute.String("s", "v"),
+		attribute.Int64("i", 7),
+		attribute.Bool("b", true),
+		attribute.String(dnstrace.KeyError, "failed"),
+	}
+	if !reflect.DeepEqual(s.attrs, want) {
+		t.Errorf("got attributes = %v, want = %v", s.attrs, want)
+	}
+	if s.status != codes.Error || s.desc != "failed" {
+		t.Errorf("got status = %v, %q, want = %v, %q", s.status, s.desc, codes.Error, "failed")
+	}
+}
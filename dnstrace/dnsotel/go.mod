@@ -0,0 +1,11 @@
+module github.com/iangudger/dns/dnstrace/dnsotel
+
+go 1.17
+
+require (
+	github.com/iangudger/dns v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.10.0
+	go.opentelemetry.io/otel/trace v1.10.0
+)
+
+replace github.com/iangudger/dns => ../..
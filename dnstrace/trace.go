@@ -0,0 +1,165 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnstrace provides lightweight tracing hooks for DNS servers and
+// resolvers.
+//
+// A Tracer is carried through the resolver chain in a context.Context. Each
+// layer which handles a query, such as a server, a cache and the resolvers it
+// defers to, starts a span as a child of the span in its context, so a query
+// produces a span tree showing the time spent in each layer.
+//
+// If a context has no Tracer, spans are not recorded. The
+// go.opentelemetry.io/otel adapter is in package dnsotel, which is a separate
+// module so that only programs using it depend on OpenTelemetry.
+package dnstrace
+
+import (
+	"context"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+// A Tracer starts spans.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if
+	// any. It returns a context which holds the new span, for starting
+	// its children.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span records a unit of work, such as resolving a question.
+type Span interface {
+	// SetAttributes sets attributes describing the work. Attributes
+	// with the same key as an existing attribute replace it.
+	SetAttributes(attrs ...Attribute)
+
+	// End marks the end of the work. No methods may be called after
+	// End.
+	End()
+}
+
+// An Attribute is a key-value pair describing a span.
+type Attribute struct {
+	Key string
+
+	// Value is a string, int64 or bool.
+	Value interface{}
+}
+
+// String returns an Attribute with a string value.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an Attribute with an integer value.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Bool returns an Attribute with a boolean value.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Attribute keys used by the packages in this module.
+const (
+	// KeyQuestionName is the name of the question being resolved.
+	KeyQuestionName = "dns.question.name"
+
+	// KeyQuestionType is the type of the question being resolved.
+	KeyQuestionType = "dns.question.type"
+
+	// KeyRCode is the response code of the response.
+	KeyRCode = "dns.response.rcode"
+
+	// KeyTransport is the transport a query was received over, "udp"
+	// or "tcp".
+	KeyTransport = "dns.transport"
+
+	// KeyCacheResult is how a cache answered a question: "hit",
+	// "synthesized", "cached_failure" or "miss".
+	KeyCacheResult = "dns.cache.result"
+
+	// KeyError is set if the work failed, to a description of the
+	// failure.
+	KeyError = "error"
+)
+
+// tracerContextKey is the context key of the Tracer.
+type tracerContextKey struct{}
+
+// WithTracer returns a copy of ctx which carries t.
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerContextKey{}, t)
+}
+
+// TracerFromContext returns the Tracer carried by ctx, or a Tracer which
+// doesn't record spans if ctx carries none.
+func TracerFromContext(ctx context.Context) Tracer {
+	if t, ok := tracer(ctx); ok {
+		return t
+	}
+	return NopTracer{}
+}
+
+func tracer(ctx context.Context) (Tracer, bool) {
+	t, ok := ctx.Value(tracerContextKey{}).(Tracer)
+	return t, ok && t != nil
+}
+
+// Start starts a span named name, with attributes attrs, using the Tracer
+// carried by ctx. If ctx carries no Tracer, the returned span does nothing
+// and ctx is returned unchanged.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	t, ok := tracer(ctx)
+	if !ok {
+		return ctx, nopSpan{}
+	}
+	ctx, span := t.Start(ctx, name)
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	return ctx, span
+}
+
+// StartResolve starts a span named name for resolving question, using the
+// Tracer carried by ctx.
+func StartResolve(ctx context.Context, name string, question dnsmessage.Question) (context.Context, Span) {
+	if _, ok := tracer(ctx); !ok {
+		// Avoid formatting the attributes.
+		return ctx, nopSpan{}
+	}
+	return Start(ctx, name,
+		String(KeyQuestionName, question.Name.String()),
+		String(KeyQuestionType, question.Type.String()),
+	)
+}
+
+// EndResolve records the result of resolving a question, as returned by
+// dnsresolver.Resolver.Resolve, and ends span.
+func EndResolve(span Span, msg dnsmessage.Message, ok bool) {
+	if _, nop := span.(nopSpan); nop {
+		return
+	}
+	if ok {
+		span.SetAttributes(String(KeyRCode, msg.Header.RCode.String()))
+	} else {
+		span.SetAttributes(String(KeyError, "no response"))
+	}
+	span.End()
+}
+
+// NopTracer is a Tracer which doesn't record spans.
+type NopTracer struct{}
+
+// Start implements Tracer.Start.
+func (NopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...Attribute) {}
+func (nopSpan) End()                       {}
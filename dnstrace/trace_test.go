@@ -0,0 +1,100 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnstrace
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+// recordedSpan is a span recorded by a recorder.
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type spanContextKey struct{}
+
+// recorder is a Tracer which records spans.
+type recorder struct {
+	spans []*recordedSpan
+}
+
+func (r *recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanContextKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func TestStartWithoutTracer(t *testing.T) {
+	ctx := context.Background()
+	got, span := Start(ctx, "test", String("k", "v"))
+	if got != ctx {
+		t.Error("Start(...) changed the context without a Tracer")
+	}
+	span.SetAttributes(Int("n", 1))
+	span.End()
+	if _, ok := TracerFromContext(ctx).(NopTracer); !ok {
+		t.Errorf("got TracerFromContext(...) = %T, want = NopTracer", TracerFromContext(ctx))
+	}
+}
+
+func TestStart(t *testing.T) {
+	var r recorder
+	ctx := WithTracer(context.Background(), &r)
+	ctx, parent := Start(ctx, "parent", Bool("b", true))
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("example.com."),
+		Type:  dnsmessage.TypeMX,
+		Class: dnsmessage.ClassINET,
+	}
+	_, child := StartResolve(ctx, "child", q)
+	EndResolve(child, dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}, true)
+	parent.End()
+
+	if len(r.spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(r.spans))
+	}
+	p, c := r.spans[0], r.spans[1]
+	if p.name != "parent" || c.name != "child" || c.parent != p || !p.ended || !c.ended {
+		t.Errorf("got spans %+v, %+v, want ended parent and child", p, c)
+	}
+	if want := map[string]interface{}{"b": true}; !reflect.DeepEqual(p.attrs, want) {
+		t.Errorf("got parent attributes = %v, want = %v", p.attrs, want)
+	}
+	want := map[string]interface{}{
+		KeyQuestionName: "example.com.",
+		KeyQuestionType: "TypeMX",
+		KeyRCode:        "RCodeNameError",
+	}
+	if !reflect.DeepEqual(c.attrs, want) {
+		t.Errorf("got child attributes = %v, want = %v", c.attrs, want)
+	}
+}
+
+func TestEndResolveNoResponse(t *testing.T) {
+	var r recorder
+	_, span := StartResolve(WithTracer(context.Background(), &r), "resolve", dnsmessage.Question{})
+	EndResolve(span, dnsmessage.Message{}, false)
+	if got := r.spans[0].attrs[KeyError]; got != "no response" {
+		t.Errorf("got error attribute = %v, want = %q", got, "no response")
+	}
+}
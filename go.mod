@@ -1,3 +1,7 @@
 module github.com/iangudger/dns
 
 go 1.17
+
+require golang.org/x/net v0.11.0
+
+require golang.org/x/sys v0.9.0
@@ -0,0 +1,109 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsexchange sends DNS queries over UDP and stream connections, such
+// as TCP and TLS, and reads their responses.
+package dnsexchange
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+// ErrMismatch is returned when a response read from a stream doesn't match the
+// query.
+var ErrMismatch = errors.New("response doesn't match query")
+
+// Exchange writes the packed query to c and returns its response.
+//
+// If stream is true, messages are prefixed with their length, as described in
+// RFC 1035, section 4.2.2. Otherwise each message is a single packet.
+//
+// A response matches the query if it has the ID and the questions of the
+// query, ignoring the case of names. Over UDP, packets which don't match are
+// ignored, as they may be stray or spoofed (RFC 5452, section 9.1). Over a
+// stream, they can't be skipped, so ErrMismatch is returned.
+//
+// The query is copied to buf to be written and the response is read into buf,
+// so query must not alias buf. If buf has a capacity of less than 65535 bytes,
+// a new buffer is allocated.
+//
+// Exchange doesn't set deadlines on c.
+func Exchange(c net.Conn, query []byte, stream bool, buf []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	if cap(buf) < math.MaxUint16 {
+		buf = make([]byte, 0, math.MaxUint16)
+	}
+	b := buf[:0]
+	if stream {
+		if len(query) > math.MaxUint16 {
+			return nil, errors.New("query too large")
+		}
+		b = append(b, 0, 0)
+	}
+	b = append(b, query...)
+	if stream {
+		binary.BigEndian.PutUint16(b, uint16(len(query)))
+	}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	buf = buf[:cap(buf)]
+	for {
+		var resp []byte
+		if stream {
+			if _, err := io.ReadFull(c, buf[:2]); err != nil {
+				return nil, err
+			}
+			resp = buf[:binary.BigEndian.Uint16(buf)]
+			if _, err := io.ReadFull(c, resp); err != nil {
+				return nil, err
+			}
+		} else {
+			n, err := c.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			resp = buf[:n]
+		}
+		if matches(resp, h.ID, questions) {
+			return resp, nil
+		}
+		if stream {
+			return nil, ErrMismatch
+		}
+	}
+}
+
+// matches reports whether resp is a response with ID id to questions.
+func matches(resp []byte, id uint16, questions []dnsmessage.Question) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || !h.Response || h.ID != id {
+		return false
+	}
+	for _, want := range questions {
+		q, err := p.Question()
+		if err != nil || q.Type != want.Type || q.Class != want.Class || !q.Name.Equals(&want.Name) {
+			return false
+		}
+	}
+	_, err = p.Question()
+	return err == dnsmessage.ErrSectionDone
+}
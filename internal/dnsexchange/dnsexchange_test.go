@@ -0,0 +1,112 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsexchange
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+func pack(t *testing.T, h dnsmessage.Header, names ...string) []byte {
+	t.Helper()
+	m := dnsmessage.Message{Header: h}
+	for _, n := range names {
+		m.Questions = append(m.Questions, dnsmessage.Question{Name: dnsmessage.MustNewName(n), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal("Pack() =", err)
+	}
+	return b
+}
+
+func TestExchangeUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listening:", err)
+	}
+	defer pc.Close()
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal("dialing:", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Only the last packet is a response to the query.
+	want := pack(t, dnsmessage.Header{ID: 1, Response: true}, "EXAMPLE.com.")
+	packets := [][]byte{
+		{0},
+		pack(t, dnsmessage.Header{ID: 1}, "example.com."),
+		pack(t, dnsmessage.Header{ID: 2, Response: true}, "example.com."),
+		pack(t, dnsmessage.Header{ID: 1, Response: true}, "example.org."),
+		pack(t, dnsmessage.Header{ID: 1, Response: true}),
+		pack(t, dnsmessage.Header{ID: 1, Response: true}, "example.com.", "example.com."),
+		want,
+	}
+	go func() {
+		buf := make([]byte, 512)
+		_, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		for _, b := range packets {
+			pc.WriteTo(b, addr)
+		}
+	}()
+
+	got, err := Exchange(c, pack(t, dnsmessage.Header{ID: 1}, "example.com."), false, nil)
+	if err != nil {
+		t.Fatal("Exchange(...) =", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got Exchange(...) = %x, want = %x", got, want)
+	}
+}
+
+func TestExchangeStream(t *testing.T) {
+	query := pack(t, dnsmessage.Header{ID: 1}, "example.com.")
+	for _, test := range []struct {
+		name string
+		resp []byte
+		err  error
+	}{
+		{"match", pack(t, dnsmessage.Header{ID: 1, Response: true}, "example.com."), nil},
+		{"mismatch", pack(t, dnsmessage.Header{ID: 2, Response: true}, "example.com."), ErrMismatch},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			go func() {
+				defer s.Close()
+				var l [2]byte
+				if _, err := io.ReadFull(s, l[:]); err != nil {
+					return
+				}
+				got := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(s, got); err != nil || string(got) != string(query) {
+					return
+				}
+				b := make([]byte, 2, 2+len(test.resp))
+				binary.BigEndian.PutUint16(b, uint16(len(test.resp)))
+				s.Write(append(b, test.resp...))
+			}()
+
+			buf := make([]byte, 0, 1<<16)
+			got, err := Exchange(c, query, true, buf)
+			if err != test.err {
+				t.Fatalf("got Exchange(...) = _, %v, want = %v", err, test.err)
+			}
+			if err == nil && (string(got) != string(test.resp) || &got[0] != &buf[:1][0]) {
+				t.Errorf("got Exchange(...) = %x, want = %x read into buf", got, test.resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnsnames converts DNS types and response codes to and from the
+// mnemonics used in zone files and by tools such as dig.
+package dnsnames
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+var typeNames = map[dnsmessage.Type]string{
+	dnsmessage.TypeA:     "A",
+	dnsmessage.TypeNS:    "NS",
+	dnsmessage.TypeCNAME: "CNAME",
+	dnsmessage.TypeSOA:   "SOA",
+	dnsmessage.TypeWKS:   "WKS",
+	dnsmessage.TypePTR:   "PTR",
+	dnsmessage.TypeHINFO: "HINFO",
+	dnsmessage.TypeMINFO: "MINFO",
+	dnsmessage.TypeMX:    "MX",
+	dnsmessage.TypeTXT:   "TXT",
+	dnsmessage.TypeAAAA:  "AAAA",
+	dnsmessage.TypeSRV:   "SRV",
+	35:                   "NAPTR",
+	dnsmessage.TypeOPT:   "OPT",
+	43:                   "DS",
+	dnsmessage.TypeRRSIG: "RRSIG",
+	dnsmessage.TypeNSEC:  "NSEC",
+	48:                   "DNSKEY",
+	dnsmessage.TypeNSEC3: "NSEC3",
+	52:                   "TLSA",
+	64:                   "SVCB",
+	65:                   "HTTPS",
+	251:                  "IXFR",
+	dnsmessage.TypeAXFR:  "AXFR",
+	dnsmessage.TypeALL:   "ANY",
+	257:                  "CAA",
+}
+
+var typesByName = func() map[string]dnsmessage.Type {
+	m := make(map[string]dnsmessage.Type, len(typeNames))
+	for t, n := range typeNames {
+		m[n] = t
+	}
+	return m
+}()
+
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+	6:                              "YXDOMAIN",
+	7:                              "YXRRSET",
+	8:                              "NXRRSET",
+	9:                              "NOTAUTH",
+	10:                             "NOTZONE",
+	16:                             "BADVERS",
+	23:                             "BADCOOKIE",
+}
+
+// Type returns the mnemonic of t, such as "AAAA", or the generic form of
+// RFC 3597, such as "TYPE65534", for types without a mnemonic.
+func Type(t dnsmessage.Type) string {
+	if n, ok := typeNames[t]; ok {
+		return n
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType parses a type mnemonic or generic type, case-insensitively.
+func ParseType(s string) (dnsmessage.Type, error) {
+	s = strings.ToUpper(s)
+	if t, ok := typesByName[s]; ok {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if n, err := strconv.ParseUint(s[len("TYPE"):], 10, 16); err == nil {
+			return dnsmessage.Type(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown DNS type %q", s)
+}
+
+// RCode returns the mnemonic of rcode, such as "NXDOMAIN", or its number for
+// response codes without a mnemonic.
+func RCode(rcode dnsmessage.RCode) string {
+	if n, ok := rcodeNames[rcode]; ok {
+		return n
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnsnames
+
+import (
+	"testing"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+func TestType(t *testing.T) {
+	tests := []struct {
+		s    string
+		t    dnsmessage.Type
+		want string
+	}{
+		{"AAAA", dnsmessage.TypeAAAA, "AAAA"},
+		{"mx", dnsmessage.TypeMX, "MX"},
+		{"ANY", dnsmessage.TypeALL, "ANY"},
+		{"type65534", 65534, "TYPE65534"},
+		{"TYPE1", dnsmessage.TypeA, "A"},
+	}
+	for _, test := range tests {
+		got, err := ParseType(test.s)
+		if err != nil || got != test.t {
+			t.Errorf("ParseType(%q) = %v, %v, want = %v", test.s, got, err, test.t)
+		}
+		if got := Type(test.t); got != test.want {
+			t.Errorf("Type(%v) = %q, want = %q", test.t, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "TYPE", "TYPE65536", "BOGUS"} {
+		if _, err := ParseType(s); err == nil {
+			t.Errorf("ParseType(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestRCode(t *testing.T) {
+	for rcode, want := range map[dnsmessage.RCode]string{
+		dnsmessage.RCodeNameError: "NXDOMAIN",
+		23:                        "BADCOOKIE",
+		12:                        "RCODE12",
+	} {
+		if got := RCode(rcode); got != want {
+			t.Errorf("RCode(%d) = %q, want = %q", rcode, got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnstree holds DNS records by owner name and type, and finds the
+// records answering a question, including through wildcards as described in
+// RFC 4592.
+package dnstree
+
+import (
+	"strings"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+// nameLen is the maximum length of a name in wire format.
+const nameLen = 255
+
+// wildcardLabel is the wire format of the label which starts a wildcard name.
+const wildcardLabel = "\x01*"
+
+// Key returns the key of n in maps, which is its canonical wire format, or
+// the empty string if n is invalid.
+func Key(n *dnsmessage.Name) string {
+	return string(n.AppendCanonical(make([]byte, 0, nameLen)))
+}
+
+// IsWildcard reports whether n is a wildcard name, which starts with the label
+// "*".
+func IsWildcard(n *dnsmessage.Name) bool {
+	return strings.HasPrefix(Key(n), wildcardLabel)
+}
+
+// A Node holds the records of a name, by type. Empty non-terminals, which
+// are names that only exist because names below them do, have no records.
+type Node struct {
+	rrsets map[dnsmessage.Type][]dnsmessage.Resource
+
+	// types holds the types in rrsets in the order they were added, so
+	// that ANY responses are stable.
+	types []dnsmessage.Type
+}
+
+// Empty reports whether n has no records.
+func (n *Node) Empty() bool {
+	return len(n.types) == 0
+}
+
+// RRset returns the records of type t.
+func (n *Node) RRset(t dnsmessage.Type) []dnsmessage.Resource {
+	return n.rrsets[t]
+}
+
+// CNAMEConflict reports whether n has a CNAME record along with other
+// records, which RFC 1034, section 3.6.2 doesn't allow.
+func (n *Node) CNAMEConflict() bool {
+	cname := n.rrsets[dnsmessage.TypeCNAME]
+	return len(cname) > 1 || len(cname) == 1 && len(n.types) > 1
+}
+
+// Append appends the records of type t to rs, with owner name name.
+func (n *Node) Append(rs []dnsmessage.Resource, t dnsmessage.Type, name dnsmessage.Name) []dnsmessage.Resource {
+	for _, r := range n.rrsets[t] {
+		r.Header.Name = name
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// AppendAll appends all of the records of n to rs, with owner name name, as
+// in a response to an ANY question.
+func (n *Node) AppendAll(rs []dnsmessage.Resource, name dnsmessage.Name) []dnsmessage.Resource {
+	for _, t := range n.types {
+		rs = n.Append(rs, t, name)
+	}
+	return rs
+}
+
+// add adds r to n. The records of an RRset must have the same TTL (RFC 2181,
+// section 5.2), so if r has a different TTL than those already added, all of
+// them are given the lower one.
+func (n *Node) add(r dnsmessage.Resource) {
+	if n.rrsets == nil {
+		n.rrsets = make(map[dnsmessage.Type][]dnsmessage.Resource)
+	}
+	rrset, ok := n.rrsets[r.Header.Type]
+	if !ok {
+		n.types = append(n.types, r.Header.Type)
+	}
+	if len(rrset) > 0 {
+		if ttl := rrset[0].Header.TTL; ttl < r.Header.TTL {
+			r.Header.TTL = ttl
+		} else if ttl > r.Header.TTL {
+			for i := range rrset {
+				rrset[i].Header.TTL = r.Header.TTL
+			}
+		}
+	}
+	n.rrsets[r.Header.Type] = append(rrset, r)
+}
+
+// A Tree holds records by owner name, ignoring case.
+//
+// The zero value is an empty Tree ready to use.
+type Tree struct {
+	// nodes holds the names with records and their ancestors by key.
+	nodes map[string]*Node
+}
+
+// Add adds r to the tree and returns the Node of its owner name. It returns
+// nil if the owner name is invalid.
+func (t *Tree) Add(r dnsmessage.Resource) *Node {
+	k := Key(&r.Header.Name)
+	if k == "" {
+		return nil
+	}
+	if t.nodes == nil {
+		t.nodes = make(map[string]*Node)
+	}
+	n := t.nodes[k]
+	if n == nil {
+		n = &Node{}
+		t.nodes[k] = n
+	}
+	n.add(r)
+
+	// Add the empty non-terminals above the name.
+	for name := r.Header.Name; name.Labels() > 0; {
+		name = name.Parent()
+		k := Key(&name)
+		if _, ok := t.nodes[k]; ok {
+			break
+		}
+		t.nodes[k] = &Node{}
+	}
+	return n
+}
+
+// Get returns the Node of name, or nil if name doesn't exist.
+func (t *Tree) Get(name dnsmessage.Name) *Node {
+	return t.nodes[Key(&name)]
+}
+
+// Lookup returns the Node of name, synthesizing it from a wildcard if name
+// doesn't exist. A wildcard only matches a name if it is a child of the
+// closest encloser of the name, which is its closest existing ancestor (RFC
+// 4592, section 3.3.1). Lookup returns nil if name doesn't exist and no
+// wildcard matches it.
+func (t *Tree) Lookup(name dnsmessage.Name) *Node {
+	if n := t.Get(name); n != nil {
+		return n
+	}
+	for name.Labels() > 0 {
+		name = name.Parent()
+		if k := Key(&name); t.nodes[k] != nil {
+			return t.nodes[wildcardLabel+k]
+		}
+	}
+	return nil
+}
+
+// NegativeSOA returns the SOA record included in negative responses, with the
+// TTL described in RFC 2308, section 3.
+func NegativeSOA(soa dnsmessage.Resource) dnsmessage.Resource {
+	if min := soa.Body.(*dnsmessage.SOAResource).MinTTL; min < soa.Header.TTL {
+		soa.Header.TTL = min
+	}
+	return soa
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnstree
+
+import (
+	"testing"
+
+	"github.com/iangudger/dns/dnsmessage"
+)
+
+func a(name string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var tree Tree
+	for _, r := range []dnsmessage.Resource{a("*.example.", 60), a("a.b.example.", 60), a("*.c.example.", 60)} {
+		tree.Add(r)
+	}
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"EXAMPLE.", "empty"},
+		{"a.B.example.", "exact"},
+		{"b.example.", "empty"},
+		{"x.example.", "*.example."},
+		{"y.x.example.", "*.example."},
+		{"x.b.example.", "none"},
+		{"x.c.example.", "*.c.example."},
+		{"other.", "none"},
+	} {
+		n := tree.Lookup(dnsmessage.MustNewName(test.name))
+		var got string
+		switch {
+		case n == nil:
+			got = "none"
+		case n.Empty():
+			got = "empty"
+		case n == tree.Get(dnsmessage.MustNewName(test.name)):
+			got = "exact"
+		default:
+			for _, w := range []string{"*.example.", "*.c.example."} {
+				if n == tree.Get(dnsmessage.MustNewName(w)) {
+					got = w
+				}
+			}
+		}
+		if got != test.want {
+			t.Errorf("Lookup(%s) = %s, want = %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMixedTTL(t *testing.T) {
+	var tree Tree
+	tree.Add(a("a.example.", 300))
+	tree.Add(a("a.example.", 60))
+	n := tree.Add(a("A.example.", 600))
+	for i, r := range n.RRset(dnsmessage.TypeA) {
+		if r.Header.TTL != 60 {
+			t.Errorf("got record %d TTL = %d, want = 60", i, r.Header.TTL)
+		}
+	}
+	if got := len(n.RRset(dnsmessage.TypeA)); got != 3 {
+		t.Errorf("got %d records, want = 3", got)
+	}
+}
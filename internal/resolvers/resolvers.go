@@ -58,6 +58,9 @@ func normalizeName(n dnsmessage.Name) (dnsmessage.Name, error) {
 //
 // Questions which can't be answered with the static lookup table will be
 // delegated to the nested Resolver, which must not be nil.
+//
+// It is meant for tests which need exact responses. Package dnsstatic
+// provides a static resolver configured with records.
 func NewStaticResolver(mapping map[dnsmessage.Question]dnsmessage.Message, nested dnsresolver.Resolver) (dnsresolver.Resolver, error) {
 	m := map[dnsmessage.Question]dnsmessage.Message{}
 	for q, r := range mapping {
@@ -68,7 +71,7 @@ func NewStaticResolver(mapping map[dnsmessage.Question]dnsmessage.Message, neste
 		}
 		m[q] = r
 	}
-	return dnsresolver.ResolverFunc(func(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
+	return dnsresolver.NewTracingResolver("resolvers.StaticResolver", dnsresolver.ResolverFunc(func(ctx context.Context, question dnsmessage.Question, recursionDesired bool) (dnsmessage.Message, bool) {
 		nq := question
 
 		n, err := normalizeName(nq.Name)
@@ -95,5 +98,5 @@ func NewStaticResolver(mapping map[dnsmessage.Question]dnsmessage.Message, neste
 			Authorities: append([]dnsmessage.Resource(nil), r.Authorities...),
 			Additionals: append([]dnsmessage.Resource(nil), r.Additionals...),
 		}, true
-	}), nil
+	})), nil
 }